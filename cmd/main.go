@@ -2,7 +2,6 @@ package main
 
 import (
 	"fmt"
-	"io"
 	"log"
 	"os"
 	"os/signal"
@@ -17,7 +16,7 @@ const port = 42069
 
 func main() {
 	frfrHandler := func(
-		w io.Writer, req *request.Request,
+		w *response.Writer, req *request.Request,
 	) *response.HandlerError {
 		if req.RequestLine.RequestTarget == "/yourproblem" {
 			err := response.NewHandlerErr(response.StatusBadRequest)
@@ -48,4 +47,3 @@ func main() {
 	<-sigChan // block until sigChan has something to produce
 	log.Println("Server gracefully stopped")
 }
-
@@ -0,0 +1,189 @@
+package client
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yus-works/tcp-to-http/internal/headers"
+)
+
+var ErrUnsupportedScheme = errors.New("Unsupported URL scheme")
+
+// Request is an outgoing request
+type Request struct {
+	Method string
+	URL    *url.URL
+	// Headers are sent as is. Host, Content-Length and Connection are
+	// filled in by Do
+	Headers *headers.Headers
+	Body    []byte
+}
+
+// NewRequest returns a request for an http:// URL
+func NewRequest(method, rawURL string, body []byte) (*Request, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" {
+		return nil, fmt.Errorf("%w: %q", ErrUnsupportedScheme, u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("URL %q has no host", rawURL)
+	}
+
+	return &Request{
+		Method:  method,
+		URL:     u,
+		Headers: headers.NewHeaders(),
+		Body:    body,
+	}, nil
+}
+
+// address is the host:port to dial, defaulting to port 80
+func (r *Request) address() string {
+	port := r.URL.Port()
+	if port == "" {
+		port = "80"
+	}
+	return net.JoinHostPort(r.URL.Hostname(), port)
+}
+
+// Write serialises the request in origin-form with the framing headers set
+// from the body
+func (r *Request) Write(w io.Writer) error {
+	h := headers.NewHeaders()
+	for k, v := range r.Headers.All() {
+		switch strings.ToLower(k) {
+		case "content-length", "transfer-encoding":
+			continue
+		}
+		h.Add(k, v)
+	}
+
+	if !h.Has("Host") {
+		h.Set("Host", r.URL.Host)
+	}
+	if len(r.Body) > 0 || r.Method == "POST" || r.Method == "PUT" {
+		h.Set("Content-Length", strconv.Itoa(len(r.Body)))
+	}
+
+	if err := h.Validate(); err != nil {
+		return fmt.Errorf("Failed to write request: %w", err)
+	}
+
+	var msg strings.Builder
+	msg.WriteString(r.Method)
+	msg.WriteString(" ")
+	msg.WriteString(r.URL.RequestURI())
+	msg.WriteString(" HTTP/1.1\r\n")
+	for k, v := range h.All() {
+		msg.WriteString(k)
+		msg.WriteString(": ")
+		msg.WriteString(v)
+		msg.WriteString("\r\n")
+	}
+	msg.WriteString("\r\n")
+	msg.Write(r.Body)
+
+	if _, err := io.WriteString(w, msg.String()); err != nil {
+		return fmt.Errorf("Failed to write request: %w", err)
+	}
+	return nil
+}
+
+// Client sends requests over a fresh connection each, or over keep-alive
+// connections from Pool when it is set
+type Client struct {
+	// DialTimeout bounds getting a connection, including waiting for a
+	// pooled one
+	DialTimeout time.Duration
+	// Timeout bounds the whole exchange, from dialing until the body has
+	// been read. Zero means no limit
+	Timeout time.Duration
+
+	Pool *Pool
+}
+
+func NewClient() *Client {
+	return &Client{
+		DialTimeout: 10 * time.Second,
+		Timeout:     30 * time.Second,
+	}
+}
+
+// Do sends req and reads the whole response. Running out of time fails with
+// an error for which net.Error's Timeout reports true
+func (c *Client) Do(req *Request) (*Response, error) {
+	var deadline time.Time
+	if c.Timeout > 0 {
+		deadline = time.Now().Add(c.Timeout)
+	}
+
+	dialDeadline := deadline
+	if c.DialTimeout > 0 {
+		d := time.Now().Add(c.DialTimeout)
+		if dialDeadline.IsZero() || d.Before(dialDeadline) {
+			dialDeadline = d
+		}
+	}
+
+	if c.Pool == nil {
+		dialer := net.Dialer{Deadline: dialDeadline}
+		conn, err := dialer.Dial("tcp", req.address())
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+
+		// without pooling every connection serves one request
+		return exchange(conn, req, deadline, true)
+	}
+
+	conn, err := c.Pool.Get(req.address(), dialDeadline)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := exchange(conn, req, deadline, false)
+	if err != nil && conn.Reused && Stale(err) {
+		conn.Release(false)
+		if conn, err = c.Pool.Dial(req.address(), dialDeadline); err != nil {
+			return nil, err
+		}
+		resp, err = exchange(conn, req, deadline, false)
+	}
+	if err != nil {
+		conn.Release(false)
+		return nil, err
+	}
+
+	conn.Release(resp.Reusable() && !headers.HasToken(req.Headers, "Connection", "close"))
+	return resp, nil
+}
+
+// exchange writes req to conn and reads the response, asking the server to
+// close the connection afterwards if closeConn is set
+func exchange(conn net.Conn, req *Request, deadline time.Time, closeConn bool) (*Response, error) {
+	if err := conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+
+	out := *req
+	if closeConn {
+		out.Headers = req.Headers.Clone()
+		out.Headers.Set("Connection", "close")
+	}
+	if err := out.Write(conn); err != nil {
+		return nil, err
+	}
+
+	return readResponse(bufio.NewReader(conn), req.Method)
+}
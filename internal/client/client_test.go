@@ -0,0 +1,371 @@
+package client
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yus-works/tcp-to-http/internal/request"
+)
+
+type chunkReader struct {
+	data            string
+	numBytesPerRead int
+	pos             int
+}
+
+// Read reads up to len(p) or numBytesPerRead bytes from the string per call
+// its useful for simulating reading a variable number of bytes per chunk from a network connection
+func (cr *chunkReader) Read(p []byte) (n int, err error) {
+	if cr.pos >= len(cr.data) {
+		return 0, io.EOF
+	}
+	endIndex := min(cr.pos+cr.numBytesPerRead, len(cr.data))
+	n = copy(p, cr.data[cr.pos:endIndex])
+	cr.pos += n
+
+	return n, nil
+}
+
+func TestResponseParse(t *testing.T) {
+	tests := []struct {
+		name     string
+		raw      string
+		status   int
+		reason   string
+		body     string
+		trailers map[string]string
+		err      error
+	}{
+		{
+			name:   "content length",
+			raw:    "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello",
+			status: 200, reason: "OK", body: "hello",
+		},
+		{
+			name:   "chunked with trailers",
+			raw:    "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5;x=y\r\nhello\r\n6\r\n world\r\n0\r\nChecksum: abc\r\n\r\n",
+			status: 200, reason: "OK", body: "hello world",
+			trailers: map[string]string{"checksum": "abc"},
+		},
+		{
+			name:   "close delimited",
+			raw:    "HTTP/1.0 200 OK\r\n\r\nuntil the end",
+			status: 200, reason: "OK", body: "until the end",
+		},
+		{
+			name:   "reason with spaces",
+			raw:    "HTTP/1.1 404 Not Found\r\nContent-Length: 0\r\n\r\n",
+			status: 404, reason: "Not Found",
+		},
+		{
+			name:   "missing reason",
+			raw:    "HTTP/1.1 204\r\n\r\n",
+			status: 204,
+		},
+		{
+			name:   "interim response",
+			raw:    "HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok",
+			status: 200, reason: "OK", body: "ok",
+		},
+		{
+			name:   "no body on 304",
+			raw:    "HTTP/1.1 304 Not Modified\r\nContent-Length: 10\r\n\r\n",
+			status: 304, reason: "Not Modified",
+		},
+		{
+			name:   "long header line",
+			raw:    "HTTP/1.1 200 OK\r\nX-Long: " + strings.Repeat("a", 5000) + "\r\nContent-Length: 0\r\n\r\n",
+			status: 200, reason: "OK",
+		},
+		{
+			name: "both length and transfer encoding",
+			raw:  "HTTP/1.1 200 OK\r\nContent-Length: 5\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n",
+			err:  ErrContentLengthWithTransferEncoding,
+		},
+		{
+			name: "conflicting lengths",
+			raw:  "HTTP/1.1 200 OK\r\nContent-Length: 5\r\nContent-Length: 6\r\n\r\nhello",
+			err:  ErrConflictingContentLength,
+		},
+		{
+			name: "bad chunk size",
+			raw:  "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\n",
+			err:  ErrInvalidChunk,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := ResponseFromReader(&chunkReader{data: tt.raw, numBytesPerRead: 3})
+			if tt.err != nil {
+				require.ErrorIs(t, err, tt.err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.status, resp.StatusLine.StatusCode)
+			assert.Equal(t, tt.reason, resp.StatusLine.ReasonPhrase)
+			assert.Equal(t, tt.body, string(resp.Body))
+			for k, v := range tt.trailers {
+				assert.Equal(t, v, resp.Trailers.Get(k))
+			}
+		})
+	}
+
+	// Test: Truncated body
+	_, err := ResponseFromReader(&chunkReader{
+		data:            "HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\nshort",
+		numBytesPerRead: 3,
+	})
+	require.Error(t, err)
+
+	// Test: Invalid status lines
+	for _, raw := range []string{"HTTP/2 200 OK\r\n\r\n", "HTTP/1.1 20 OK\r\n\r\n", "ICY 200 OK\r\n\r\n"} {
+		_, err := ResponseFromReader(&chunkReader{data: raw, numBytesPerRead: 3})
+		require.Error(t, err, raw)
+	}
+}
+
+func TestReadResponse(t *testing.T) {
+	raw := "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n" +
+		"5\r\nhello\r\n6\r\n world\r\n0\r\nChecksum: abc\r\n\r\n"
+	br := bufio.NewReader(&chunkReader{data: raw, numBytesPerRead: 3})
+
+	// Test: Only the head is read up front
+	resp, err := ReadResponse(br, "GET")
+	require.NoError(t, err)
+	assert.Equal(t, int64(-1), resp.ContentLength)
+	assert.False(t, resp.Trailers.Has("checksum"))
+	assert.False(t, resp.Reusable())
+
+	// Test: The body streams in pieces and the trailers follow it
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(resp.BodyReader, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "hell", string(buf))
+	rest, err := io.ReadAll(resp.BodyReader)
+	require.NoError(t, err)
+	assert.Equal(t, "o world", string(rest))
+	assert.Equal(t, "abc", resp.Trailers.Get("checksum"))
+	assert.True(t, resp.Reusable())
+
+	// Test: A response to HEAD has no body whatever its headers say
+	raw = "HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\n"
+	resp, err = ReadResponse(bufio.NewReader(strings.NewReader(raw)), "HEAD")
+	require.NoError(t, err)
+	assert.Nil(t, resp.BodyReader)
+	assert.Equal(t, int64(-1), resp.ContentLength)
+	assert.True(t, resp.Reusable())
+
+	// Test: Nor can a connection be reused with more after the response
+	raw = "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nokHTTP/1.1"
+	resp, err = ReadResponse(bufio.NewReader(strings.NewReader(raw)), "GET")
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), resp.ContentLength)
+	_, err = io.ReadAll(resp.BodyReader)
+	require.NoError(t, err)
+	assert.False(t, resp.Reusable())
+
+	// Test: A head over the limit
+	raw = "HTTP/1.1 200 OK\r\nX-Long: " + strings.Repeat("a", maxHeadSize) + "\r\n\r\n"
+	_, err = ReadResponse(bufio.NewReader(strings.NewReader(raw)), "GET")
+	require.ErrorIs(t, err, ErrHeadTooLarge)
+}
+
+// serveOnce accepts one connection, hands the parsed request to received
+// and runs reply on the connection
+func serveOnce(t *testing.T, reply func(conn net.Conn)) (string, <-chan *request.Request) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+
+	received := make(chan *request.Request, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		req, err := request.RequestFromReader(conn)
+		if err != nil {
+			return
+		}
+		received <- req
+		reply(conn)
+	}()
+
+	return ln.Addr().String(), received
+}
+
+func TestDo(t *testing.T) {
+	addr, received := serveOnce(t, func(conn net.Conn) {
+		io.WriteString(conn, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n2\r\nok\r\n0\r\n\r\n")
+	})
+
+	req, err := NewRequest("POST", "http://"+addr+"/things?id=1", []byte("payload"))
+	require.NoError(t, err)
+	req.Headers.Set("X-Custom", "yes")
+
+	resp, err := NewClient().Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusLine.StatusCode)
+	assert.Equal(t, "ok", string(resp.Body))
+
+	// Test: The request is serialised with its framing filled in
+	got := <-received
+	assert.Equal(t, "POST", got.RequestLine.Method)
+	assert.Equal(t, "/things?id=1", got.RequestLine.RequestTarget)
+	assert.Equal(t, addr, got.Headers.Get("Host"))
+	assert.Equal(t, "7", got.Headers.Get("Content-Length"))
+	assert.Equal(t, "close", got.Headers.Get("Connection"))
+	assert.Equal(t, "yes", got.Headers.Get("X-Custom"))
+	assert.Equal(t, "payload", string(got.Body))
+
+	// Test: The caller's headers are left alone
+	assert.False(t, req.Headers.Has("Connection"))
+
+	// Test: Timeout while waiting for the response
+	addr, _ = serveOnce(t, func(conn net.Conn) {
+		time.Sleep(200 * time.Millisecond)
+	})
+	req, err = NewRequest("GET", "http://"+addr+"/", nil)
+	require.NoError(t, err)
+
+	c := NewClient()
+	c.Timeout = 50 * time.Millisecond
+	_, err = c.Do(req)
+	var netErr net.Error
+	require.True(t, errors.As(err, &netErr))
+	assert.True(t, netErr.Timeout())
+
+	// Test: Only http URLs
+	_, err = NewRequest("GET", "https://example.com/", nil)
+	require.ErrorIs(t, err, ErrUnsupportedScheme)
+}
+
+// serveKeepAlive answers every request on every connection with reply,
+// closing the connection afterwards when closeAfter is set. accepted counts
+// the connections
+func serveKeepAlive(t *testing.T, reply string, closeAfter bool) (string, *atomic.Int32) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+
+	accepted := &atomic.Int32{}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			go func() {
+				defer conn.Close()
+				for {
+					if _, err := request.RequestFromReader(conn); err != nil {
+						return
+					}
+					io.WriteString(conn, reply)
+					if closeAfter {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	return ln.Addr().String(), accepted
+}
+
+func pooledGet(t *testing.T, c *Client, addr string) *Response {
+	t.Helper()
+
+	req, err := NewRequest("GET", "http://"+addr+"/", nil)
+	require.NoError(t, err)
+	resp, err := c.Do(req)
+	require.NoError(t, err)
+	return resp
+}
+
+func TestPool(t *testing.T) {
+	ok := "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"
+
+	// Test: Keep-alive connections are reused
+	addr, accepted := serveKeepAlive(t, ok, false)
+	c := NewClient()
+	c.Pool = NewPool()
+	for range 3 {
+		assert.Equal(t, "ok", string(pooledGet(t, c, addr).Body))
+	}
+	assert.Equal(t, int32(1), accepted.Load())
+
+	// Test: Connection: close responses aren't
+	addr, accepted = serveKeepAlive(t,
+		"HTTP/1.1 200 OK\r\nContent-Length: 2\r\nConnection: close\r\n\r\nok", false)
+	for range 2 {
+		pooledGet(t, c, addr)
+	}
+	assert.Equal(t, int32(2), accepted.Load())
+
+	// Test: Nor are close delimited ones
+	addr, accepted = serveKeepAlive(t, "HTTP/1.1 200 OK\r\n\r\nok", true)
+	for range 2 {
+		assert.Equal(t, "ok", string(pooledGet(t, c, addr).Body))
+	}
+	assert.Equal(t, int32(2), accepted.Load())
+
+	// Test: A request on a connection the server closed while it was idle
+	// is sent again on a fresh one
+	addr, accepted = serveKeepAlive(t, ok, true)
+	pooledGet(t, c, addr)
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, "ok", string(pooledGet(t, c, addr).Body))
+	assert.Equal(t, int32(2), accepted.Load())
+
+	// Test: MaxPerHost makes Get wait for a connection to be released
+	addr, _ = serveKeepAlive(t, ok, false)
+	pool := NewPool()
+	pool.MaxPerHost = 1
+	conn, err := pool.Get(addr, time.Now().Add(time.Second))
+	require.NoError(t, err)
+
+	_, err = pool.Get(addr, time.Now().Add(50*time.Millisecond))
+	var netErr net.Error
+	require.True(t, errors.As(err, &netErr))
+	assert.True(t, netErr.Timeout())
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		conn.Release(true)
+	}()
+	conn, err = pool.Get(addr, time.Now().Add(time.Second))
+	require.NoError(t, err)
+	assert.True(t, conn.Reused)
+
+	// Test: Idle connections expire
+	pool.IdleTimeout = time.Millisecond
+	conn.Release(true)
+	time.Sleep(5 * time.Millisecond)
+	conn, err = pool.Get(addr, time.Now().Add(time.Second))
+	require.NoError(t, err)
+	assert.False(t, conn.Reused)
+	conn.Release(false)
+
+	// Test: Closing the pool
+	pool.Close()
+	_, err = pool.Get(addr, time.Now().Add(time.Second))
+	require.ErrorIs(t, err, ErrPoolClosed)
+}
@@ -0,0 +1,61 @@
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+
+	"github.com/yus-works/tcp-to-http/internal/framing"
+)
+
+var CRLF = []byte("\r\n")
+
+type StatusLine struct {
+	HttpVersion  string
+	StatusCode   int
+	ReasonPhrase string
+}
+
+func parseStatusLine(data []byte) (*StatusLine, int, error) {
+	var statusLine StatusLine
+
+	idx := bytes.Index(data, CRLF)
+	if idx == -1 {
+		return nil, 0, nil
+	}
+
+	line := data[:idx]
+	read := idx + len(CRLF)
+
+	// the reason phrase may contain spaces, or be missing entirely
+	parts := bytes.SplitN(line, []byte{' '}, 3)
+	if len(parts) < 2 {
+		return nil, 0, fmt.Errorf("Invalid number of status line parts")
+	}
+
+	versionParts := bytes.Split(parts[0], []byte{'/'})
+	if len(versionParts) != 2 || string(versionParts[0]) != "HTTP" {
+		return nil, 0, fmt.Errorf("Response type must be exactly 'HTTP'")
+	}
+
+	versionNum := string(versionParts[1])
+	if versionNum != "1.1" && versionNum != "1.0" {
+		return nil, 0, fmt.Errorf("Response version must be '1.1' or '1.0'")
+	}
+	statusLine.HttpVersion = versionNum
+
+	code := parts[1]
+	if len(code) != 3 || !framing.IsDigits(string(code)) {
+		return nil, 0, fmt.Errorf("Status code must be three digits")
+	}
+	statusLine.StatusCode, _ = strconv.Atoi(string(code))
+	if statusLine.StatusCode < 100 {
+		return nil, 0, fmt.Errorf("Status code must be at least 100")
+	}
+
+	if len(parts) == 3 {
+		statusLine.ReasonPhrase = string(parts[2])
+	}
+
+	return &statusLine, read, nil
+}
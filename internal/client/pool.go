@@ -0,0 +1,227 @@
+package client
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var ErrPoolClosed = errors.New("Connection pool is closed")
+
+// Pool keeps keep-alive connections per host:port so later requests can
+// skip the dial
+type Pool struct {
+	// MaxIdlePerHost is how many unused connections are kept per host
+	MaxIdlePerHost int
+	// MaxPerHost caps the open connections per host, in use or idle. Get
+	// waits for one to free up once it is reached. Zero means no limit
+	MaxPerHost int
+	// IdleTimeout is how long an unused connection is kept
+	IdleTimeout time.Duration
+
+	mu     sync.Mutex
+	hosts  map[string]*hostPool
+	closed bool
+}
+
+type hostPool struct {
+	// most recently used last
+	idle []idleConn
+	// connections handed out or idle
+	open int
+	// closed and replaced whenever a connection is returned or closed, to
+	// wake up Gets waiting on MaxPerHost
+	changed chan struct{}
+}
+
+type idleConn struct {
+	conn  net.Conn
+	since time.Time
+}
+
+func NewPool() *Pool {
+	return &Pool{
+		MaxIdlePerHost: 2,
+		IdleTimeout:    90 * time.Second,
+		hosts:          map[string]*hostPool{},
+	}
+}
+
+func (p *Pool) host(addr string) *hostPool {
+	h, ok := p.hosts[addr]
+	if !ok {
+		h = &hostPool{changed: make(chan struct{})}
+		p.hosts[addr] = h
+	}
+	return h
+}
+
+// notify wakes up anything waiting on h. Must be called with p.mu held
+func (h *hostPool) notify() {
+	close(h.changed)
+	h.changed = make(chan struct{})
+}
+
+// PooledConn is a connection checked out of a Pool. Release must be called
+// exactly once when the caller is done with it
+type PooledConn struct {
+	net.Conn
+	pool *Pool
+	addr string
+	// set when the connection came from the idle list rather than a dial
+	Reused bool
+}
+
+// Get returns an idle connection to addr or dials a new one. The deadline
+// bounds both waiting for MaxPerHost and dialing.
+//
+// An idle connection isn't checked before it is handed out, since the
+// server could close it right after anyway. Callers retry on a fresh
+// connection from Dial when an exchange over a reused one fails as Stale
+func (p *Pool) Get(addr string, deadline time.Time) (*PooledConn, error) {
+	return p.get(addr, deadline, true)
+}
+
+// Dial is Get without the idle connections, for retrying an exchange that
+// failed on a stale one
+func (p *Pool) Dial(addr string, deadline time.Time) (*PooledConn, error) {
+	return p.get(addr, deadline, false)
+}
+
+func (p *Pool) get(addr string, deadline time.Time, reuse bool) (*PooledConn, error) {
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return nil, ErrPoolClosed
+		}
+		h := p.host(addr)
+
+		if reuse {
+			if conn, ok := p.takeIdle(h); ok {
+				p.mu.Unlock()
+				return &PooledConn{Conn: conn, pool: p, addr: addr, Reused: true}, nil
+			}
+		}
+
+		if p.MaxPerHost <= 0 || h.open < p.MaxPerHost {
+			h.open++
+			p.mu.Unlock()
+
+			dialer := net.Dialer{Deadline: deadline}
+			conn, err := dialer.Dial("tcp", addr)
+			if err != nil {
+				p.forget(addr)
+				return nil, err
+			}
+			return &PooledConn{Conn: conn, pool: p, addr: addr}, nil
+		}
+
+		changed := h.changed
+		p.mu.Unlock()
+
+		if err := wait(changed, deadline); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// takeIdle pops the most recently used idle connection that hasn't timed
+// out, closing expired ones. Must be called with p.mu held
+func (p *Pool) takeIdle(h *hostPool) (net.Conn, bool) {
+	for len(h.idle) > 0 {
+		last := h.idle[len(h.idle)-1]
+		h.idle = h.idle[:len(h.idle)-1]
+
+		if p.IdleTimeout > 0 && time.Since(last.since) > p.IdleTimeout {
+			last.conn.Close()
+			h.open--
+			h.notify()
+			continue
+		}
+		return last.conn, true
+	}
+	return nil, false
+}
+
+// wait blocks until changed is closed or the deadline passes
+func wait(changed <-chan struct{}, deadline time.Time) error {
+	if deadline.IsZero() {
+		<-changed
+		return nil
+	}
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+
+	select {
+	case <-changed:
+		return nil
+	case <-timer.C:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+// forget drops a connection to addr that was closed
+func (p *Pool) forget(addr string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	h := p.host(addr)
+	h.open--
+	h.notify()
+}
+
+// Release returns the connection to the pool if reuse is set and there is
+// room for it, and closes it otherwise. Only pass reuse when the last
+// response was read completely and didn't ask for the connection to close
+func (c *PooledConn) Release(reuse bool) {
+	p := c.pool
+
+	// clear anything the last exchange left behind
+	c.Conn.SetDeadline(time.Time{})
+
+	p.mu.Lock()
+	h := p.host(c.addr)
+	if reuse && !p.closed && len(h.idle) < p.MaxIdlePerHost {
+		h.idle = append(h.idle, idleConn{conn: c.Conn, since: time.Now()})
+		h.notify()
+		p.mu.Unlock()
+		return
+	}
+	p.mu.Unlock()
+
+	c.Conn.Close()
+	p.forget(c.addr)
+}
+
+// Close closes every idle connection. Connections in use are closed when
+// they are released
+func (p *Pool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+	for _, h := range p.hosts {
+		for _, idle := range h.idle {
+			idle.conn.Close()
+			h.open--
+		}
+		h.idle = nil
+		h.notify()
+	}
+}
+
+// Stale reports whether err is how an exchange over a reused connection
+// fails when the server closed it while it sat idle: the write hits the
+// closed socket, or the connection ends before any of the response. The
+// server never acted on the request, so it can be sent again
+func Stale(err error) bool {
+	return errors.Is(err, io.EOF) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, syscall.ECONNRESET)
+}
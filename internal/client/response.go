@@ -0,0 +1,365 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/yus-works/tcp-to-http/internal/framing"
+	"github.com/yus-works/tcp-to-http/internal/headers"
+)
+
+type Response struct {
+	StatusLine StatusLine
+	Headers    *headers.Headers
+	// Body is the whole body for responses from Do and ResponseFromReader
+	Body []byte
+
+	// BodyReader streams the body of a response from ReadResponse, decoded
+	// from its transfer coding. It is nil when the response has no body
+	BodyReader io.Reader
+	// ContentLength is the length given by Content-Length, -1 when the body
+	// is delimited some other way
+	ContentLength int64
+
+	// Trailers holds the trailer fields sent after a chunked body. They are
+	// there once BodyReader has returned io.EOF
+	Trailers *headers.Headers
+
+	br *bufio.Reader
+	// set when the body ran until the connection closed
+	closeDelimited bool
+	// set once the body has been read to its end
+	bodyDone bool
+}
+
+// Errors returned for responses whose framing can't be trusted. They mirror
+// the checks done on requests, since a proxy relaying a misframed response
+// is open to the same desync attacks (RFC 9112 6.3)
+var (
+	ErrContentLengthWithTransferEncoding = errors.New(
+		"Response has both Content-Length and Transfer-Encoding",
+	)
+	ErrConflictingContentLength = framing.ErrConflictingContentLength
+	ErrInvalidContentLength     = framing.ErrInvalidContentLength
+	ErrInvalidChunk             = framing.ErrInvalidChunk
+	ErrHeadTooLarge             = errors.New("Response head too large")
+)
+
+// maxHeadSize bounds the status line and headers
+const maxHeadSize = 1 << 20
+
+// isChunked reports whether chunked is the final transfer coding
+func isChunked(v string) bool {
+	codings := strings.Split(v, ",")
+	last := strings.Trim(codings[len(codings)-1], " \t")
+	return strings.EqualFold(last, "chunked")
+}
+
+// ReadResponse reads the final response to a method request from br,
+// skipping interim 1xx responses. Only the head is read, the body is left
+// on br for BodyReader
+func ReadResponse(br *bufio.Reader, method string) (*Response, error) {
+	for {
+		r, err := readHead(br)
+		if err != nil {
+			return nil, err
+		}
+
+		// interim responses are followed by another response
+		code := r.StatusLine.StatusCode
+		if code < 200 && code != 101 {
+			continue
+		}
+
+		if err := r.startBody(method == "HEAD"); err != nil {
+			return nil, err
+		}
+		return r, nil
+	}
+}
+
+// readHead reads a status line and headers
+func readHead(br *bufio.Reader) (*Response, error) {
+	head, err := readSection(br)
+	if err == io.ErrUnexpectedEOF && len(head) == 0 {
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sl, n, err := parseStatusLine(head)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Response{
+		StatusLine:    *sl,
+		Headers:       headers.NewHeaders(),
+		Trailers:      headers.NewHeaders(),
+		ContentLength: -1,
+		br:            br,
+	}
+
+	_, done, err := r.Headers.Parse(head[n:])
+	if err != nil {
+		return nil, err
+	}
+	if !done {
+		return nil, fmt.Errorf("Malformed response head")
+	}
+	return r, nil
+}
+
+// startBody works out how the body is delimited once all headers have been
+// parsed (RFC 9112 6.3)
+func (r *Response) startBody(noBody bool) error {
+	code := r.StatusLine.StatusCode
+
+	// responses to HEAD have headers describing a body that is never sent
+	if noBody || code < 200 || code == 204 || code == 304 {
+		r.bodyDone = true
+		return nil
+	}
+
+	hasTE := r.Headers.Has("transfer-encoding")
+	hasCL := r.Headers.Has("content-length")
+
+	if hasTE && hasCL {
+		return ErrContentLengthWithTransferEncoding
+	}
+
+	if hasTE {
+		// any other final coding leaves closing the connection as the only
+		// way to end the body
+		if isChunked(r.Headers.Get("transfer-encoding")) {
+			r.BodyReader = &body{r: r, src: &chunkedReader{br: r.br, trailers: r.Trailers}}
+		} else {
+			r.BodyReader = &body{r: r, src: r.br}
+			r.closeDelimited = true
+		}
+		return nil
+	}
+
+	if hasCL {
+		ln, err := framing.ParseContentLength(r.Headers.Get("content-length"))
+		if err != nil {
+			return err
+		}
+		r.ContentLength = int64(ln)
+		r.BodyReader = &body{r: r, src: &lengthReader{r: r.br, remaining: int64(ln)}}
+		return nil
+	}
+
+	r.BodyReader = &body{r: r, src: r.br}
+	r.closeDelimited = true
+	return nil
+}
+
+// ResponseFromReader reads one response from reader. A body delimited by
+// the connection closing is read until io.EOF
+func ResponseFromReader(reader io.Reader) (*Response, error) {
+	return readResponse(bufio.NewReader(reader), "")
+}
+
+// readResponse reads the response to a method request along with its whole
+// body
+func readResponse(br *bufio.Reader, method string) (*Response, error) {
+	r, err := ReadResponse(br, method)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.BodyReader != nil {
+		if r.Body, err = io.ReadAll(r.BodyReader); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// Reusable reports whether the connection the response came in on can carry
+// another request: the body was read to its end, nothing followed it, and
+// the server didn't ask to close (RFC 9112 9.3)
+func (r *Response) Reusable() bool {
+	if !r.bodyDone || r.closeDelimited || r.br.Buffered() > 0 ||
+		r.StatusLine.StatusCode == 101 {
+		return false
+	}
+
+	if headers.HasToken(r.Headers, "Connection", "close") {
+		return false
+	}
+	if r.StatusLine.HttpVersion == "1.0" {
+		return headers.HasToken(r.Headers, "Connection", "keep-alive")
+	}
+	return true
+}
+
+// body notes when the body has been read to its end
+type body struct {
+	r   *Response
+	src io.Reader
+}
+
+func (b *body) Read(p []byte) (int, error) {
+	n, err := b.src.Read(p)
+	if err == io.EOF {
+		b.r.bodyDone = true
+	}
+	return n, err
+}
+
+// lengthReader reads a Content-Length delimited body, failing if the
+// connection closes before all of it arrived
+type lengthReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (l *lengthReader) Read(p []byte) (int, error) {
+	if l.remaining == 0 {
+		return 0, io.EOF
+	}
+
+	if int64(len(p)) > l.remaining {
+		p = p[:l.remaining]
+	}
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+
+	if err == io.EOF && l.remaining > 0 {
+		return n, fmt.Errorf("incomplete body, %d bytes missing: %w", l.remaining, io.ErrUnexpectedEOF)
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+// chunkedReader decodes a chunked body (RFC 9112 7.1) as it is read,
+// discarding chunk extensions and filling in trailers at the end
+type chunkedReader struct {
+	br       *bufio.Reader
+	trailers *headers.Headers
+	// bytes left in the current chunk
+	remaining int
+	done      bool
+}
+
+func (c *chunkedReader) Read(p []byte) (int, error) {
+	if c.done {
+		return 0, io.EOF
+	}
+
+	if c.remaining == 0 {
+		size, err := c.readSize()
+		if err != nil {
+			return 0, err
+		}
+		if size == 0 {
+			if err := c.readTrailers(); err != nil {
+				return 0, err
+			}
+			c.done = true
+			return 0, io.EOF
+		}
+		c.remaining = size
+	}
+
+	if len(p) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.br.Read(p)
+	c.remaining -= n
+
+	if c.remaining == 0 && err == nil {
+		err = c.readCRLF()
+	}
+	return n, unexpectedEOF(err)
+}
+
+func (c *chunkedReader) readSize() (int, error) {
+	line, err := c.br.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		return 0, ErrInvalidChunk
+	}
+	if err != nil {
+		return 0, unexpectedEOF(err)
+	}
+
+	size, n, err := framing.ParseChunkSize(line)
+	if err != nil {
+		return 0, err
+	}
+	if n == 0 {
+		// the line ended in a bare LF
+		return 0, ErrInvalidChunk
+	}
+	return size, nil
+}
+
+func (c *chunkedReader) readCRLF() error {
+	crlf := make([]byte, len(CRLF))
+	if _, err := io.ReadFull(c.br, crlf); err != nil {
+		return err
+	}
+	if !bytes.Equal(crlf, CRLF) {
+		return ErrInvalidChunk
+	}
+	return nil
+}
+
+func (c *chunkedReader) readTrailers() error {
+	section, err := readSection(c.br)
+	if err != nil {
+		return err
+	}
+
+	_, done, err := c.trailers.Parse(section)
+	if err != nil {
+		return err
+	}
+	if !done {
+		return ErrInvalidChunk
+	}
+	return nil
+}
+
+// readSection reads lines up to and including an empty one, as a head or
+// trailer section ends with
+func readSection(br *bufio.Reader) ([]byte, error) {
+	var section []byte
+	lineStart := 0
+	for {
+		line, err := br.ReadSlice('\n')
+		section = append(section, line...)
+		if len(section) > maxHeadSize {
+			return nil, ErrHeadTooLarge
+		}
+
+		// a line longer than br's buffer comes in pieces
+		if errors.Is(err, bufio.ErrBufferFull) {
+			continue
+		}
+		if err != nil {
+			return section, unexpectedEOF(err)
+		}
+
+		if bytes.Equal(section[lineStart:], CRLF) {
+			return section, nil
+		}
+		lineStart = len(section)
+	}
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,91 @@
+package fileserver
+
+import (
+	"io/fs"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yus-works/tcp-to-http/internal/headers"
+)
+
+// makeETag builds a strong validator from the modification time and size,
+// which change whenever the file's contents do
+func makeETag(info fs.FileInfo) string {
+	return `"` + strconv.FormatInt(info.ModTime().UnixNano(), 16) +
+		"-" + strconv.FormatInt(info.Size(), 16) + `"`
+}
+
+// notModified evaluates If-None-Match and, only when that is absent,
+// If-Modified-Since (RFC 9110 13.2.2)
+func notModified(h *headers.Headers, etag string, modTime time.Time) bool {
+	if h.Has("If-None-Match") {
+		return etagListMatches(h.Get("If-None-Match"), etag, false)
+	}
+
+	if h.Has("If-Modified-Since") {
+		since, err := headers.ParseTime(h.Get("If-Modified-Since"))
+		if err != nil {
+			return false
+		}
+		// HTTP dates only have second precision
+		return !modTime.Truncate(time.Second).After(since)
+	}
+
+	return false
+}
+
+// etagListMatches reports whether the "*" or entity-tag list in v matches
+// etag, using the strong or weak comparison function (RFC 9110 8.8.3.2)
+func etagListMatches(v, etag string, strong bool) bool {
+	if strings.TrimSpace(v) == "*" {
+		return true
+	}
+
+	for {
+		v = strings.TrimLeft(v, " \t,")
+		if v == "" {
+			return false
+		}
+
+		tag, rest, ok := nextETag(v)
+		if !ok {
+			return false
+		}
+		v = rest
+
+		if etagsMatch(tag, etag, strong) {
+			return true
+		}
+	}
+}
+
+// nextETag splits the entity-tag at the start of v from the rest. Commas are
+// allowed inside the quotes, so the list can't simply be split on them
+func nextETag(v string) (tag string, rest string, ok bool) {
+	start := 0
+	if strings.HasPrefix(v, "W/") {
+		start = 2
+	}
+	if len(v) <= start || v[start] != '"' {
+		return "", "", false
+	}
+
+	end := strings.IndexByte(v[start+1:], '"')
+	if end == -1 {
+		return "", "", false
+	}
+	end += start + 2
+	return v[:end], v[end:], true
+}
+
+func etagsMatch(a, b string, strong bool) bool {
+	if strong {
+		return !isWeak(a) && !isWeak(b) && a == b
+	}
+	return strings.TrimPrefix(a, "W/") == strings.TrimPrefix(b, "W/")
+}
+
+func isWeak(etag string) bool {
+	return strings.HasPrefix(etag, "W/")
+}
@@ -0,0 +1,279 @@
+package fileserver
+
+import (
+	"bytes"
+	"errors"
+	htmltemplate "html/template"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/yus-works/tcp-to-http/internal/headers"
+	"github.com/yus-works/tcp-to-http/internal/request"
+	"github.com/yus-works/tcp-to-http/internal/response"
+)
+
+// FileServer serves the files under a directory. Files are opened through an
+// os.Root, so neither `..` segments nor symlinks can reach outside of it
+type FileServer struct {
+	root *os.Root
+
+	// Index is the file served for a directory, "" to disable
+	Index string
+	// Listing lists the contents of directories without an index file
+	Listing bool
+}
+
+// New returns a FileServer for dir that serves index.html for directories
+// and doesn't list them
+func New(dir string) (*FileServer, error) {
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileServer{
+		root:  root,
+		Index: "index.html",
+	}, nil
+}
+
+func (s *FileServer) Close() error {
+	return s.root.Close()
+}
+
+// Serve is a response.Handler
+func (s *FileServer) Serve(w *response.Writer, req *request.Request) *response.HandlerError {
+	if req.RequestLine.Method != "GET" {
+		e := response.NewHandlerErr(response.StatusMethodNotAllowed)
+		e.Header = headers.NewHeaders()
+		e.Header.Set("Allow", "GET")
+		return &e
+	}
+
+	urlPath := req.RequestLine.Path()
+	name, ok := cleanPath(urlPath)
+	if !ok {
+		e := response.NewHandlerErrMsg(response.StatusBadRequest, "Invalid path")
+		return &e
+	}
+
+	f, info, herr := s.open(name)
+	if herr != nil {
+		return herr
+	}
+	defer f.Close()
+
+	if !info.IsDir() {
+		return serveFile(w, req, f, info)
+	}
+
+	// relative links in the index or listing only work from behind a slash
+	if !strings.HasSuffix(urlPath, "/") {
+		w.SetStatus(response.StatusMovedPermanently)
+		w.Header().Set("Location", dirRedirect(name, req.RequestLine.RequestTarget))
+		return nil
+	}
+
+	if s.Index != "" {
+		index, indexInfo, herr := s.open(path.Join(name, s.Index))
+		if herr == nil {
+			defer index.Close()
+			if !indexInfo.IsDir() {
+				return serveFile(w, req, index, indexInfo)
+			}
+		}
+	}
+
+	if s.Listing {
+		return serveListing(w, f, urlPath)
+	}
+
+	e := response.NewHandlerErr(response.StatusForbidden)
+	return &e
+}
+
+// cleanPath turns a request path into a name relative to the root. `..`
+// segments are resolved against "/" so they can never climb above it
+func cleanPath(p string) (string, bool) {
+	decoded, err := url.PathUnescape(p)
+	if err != nil {
+		return "", false
+	}
+	// backslashes are separators on Windows
+	if strings.ContainsAny(decoded, "\x00\\") {
+		return "", false
+	}
+
+	name := strings.TrimPrefix(path.Clean("/"+decoded), "/")
+	if name == "" {
+		name = "."
+	}
+	return name, true
+}
+
+// dirRedirect is the Location adding the slash to a directory. It is built
+// from the cleaned name rather than echoing the request path, which could
+// start with "//" and send the client to another host
+func dirRedirect(name, target string) string {
+	loc := "/"
+	if name != "." {
+		loc = "./" + path.Base(name) + "/"
+	}
+
+	if _, query, ok := strings.Cut(target, "?"); ok {
+		query, _, _ = strings.Cut(query, "#")
+		loc += "?" + query
+	}
+	return loc
+}
+
+func (s *FileServer) open(name string) (*os.File, fs.FileInfo, *response.HandlerError) {
+	f, err := s.root.Open(name)
+	if err != nil {
+		return nil, nil, openError(err)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, openError(err)
+	}
+	return f, info, nil
+}
+
+// openError maps a failure to open a file to a response. Anything but a
+// permission problem, including attempts to escape the root, is a 404
+func openError(err error) *response.HandlerError {
+	var e response.HandlerError
+	if errors.Is(err, fs.ErrPermission) {
+		e = response.NewHandlerErr(response.StatusForbidden)
+	} else {
+		e = response.NewHandlerErr(response.StatusNotFound)
+	}
+	return &e
+}
+
+// serveFile sends f, or the parts of it asked for by a Range header,
+// streaming it from disk
+func serveFile(
+	w *response.Writer, req *request.Request, f *os.File, info fs.FileInfo,
+) *response.HandlerError {
+	modTime := info.ModTime()
+	etag := makeETag(info)
+
+	w.Header().Set("Last-Modified", headers.FormatTime(modTime))
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Accept-Ranges", "bytes")
+
+	if notModified(req.Headers, etag, modTime) {
+		w.SetStatus(response.StatusNotModified)
+		return nil
+	}
+
+	contentType := detectContentType(f, info.Name())
+	size := info.Size()
+
+	ranges, herr := requestedRanges(req.Headers, etag, modTime, size)
+	if herr != nil {
+		return herr
+	}
+
+	switch len(ranges) {
+	case 0:
+		w.Header().Set("Content-Type", contentType)
+		return stream(w, io.NewSectionReader(f, 0, size), size)
+
+	case 1:
+		r := ranges[0]
+		w.SetStatus(response.StatusPartialContent)
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Range", r.contentRange(size))
+		return stream(w, io.NewSectionReader(f, r.start, r.length), r.length)
+
+	default:
+		mp := newMultipart(ranges, contentType, size)
+		w.SetStatus(response.StatusPartialContent)
+		w.Header().Set("Content-Type", mp.contentType())
+		return stream(w, mp.reader(f), mp.length())
+	}
+}
+
+// stream sends the head with a Content-Length of n and copies the body from
+// r without holding it in memory
+func stream(w *response.Writer, r io.Reader, n int64) *response.HandlerError {
+	w.SetContentLength(n)
+	if err := w.Flush(); err != nil {
+		e := response.NewHandlerErrMsg(response.StatusInternalServerError, err.Error())
+		return &e
+	}
+
+	if _, err := io.CopyN(w, r, n); err != nil {
+		e := response.NewHandlerErrMsg(response.StatusInternalServerError, err.Error())
+		return &e
+	}
+	return nil
+}
+
+var listingPage = htmltemplate.Must(htmltemplate.New("listing").Parse(
+	`<!DOCTYPE html>
+<html>
+<head><title>Index of {{.Path}}</title></head>
+<body>
+<h1>Index of {{.Path}}</h1>
+<ul>
+{{range .Entries}}<li><a href="{{.Href}}">{{.Name}}</a></li>
+{{end}}</ul>
+</body>
+</html>
+`))
+
+type listingEntry struct {
+	Name string
+	Href string
+}
+
+func serveListing(w *response.Writer, dir *os.File, urlPath string) *response.HandlerError {
+	entries, err := dir.ReadDir(-1)
+	if err != nil {
+		e := response.NewHandlerErrMsg(response.StatusInternalServerError, err.Error())
+		return &e
+	}
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+
+	var data struct {
+		Path    string
+		Entries []listingEntry
+	}
+	data.Path, _ = url.PathUnescape(urlPath)
+
+	if urlPath != "/" {
+		data.Entries = append(data.Entries, listingEntry{Name: "../", Href: "../"})
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		// the ./ keeps a name like "a:b" from being read as a scheme
+		href := "./" + url.PathEscape(name)
+		if entry.IsDir() {
+			name += "/"
+			href += "/"
+		}
+		data.Entries = append(data.Entries, listingEntry{Name: name, Href: href})
+	}
+
+	buf := bytes.Buffer{}
+	if err := listingPage.Execute(&buf, data); err != nil {
+		e := response.NewHandlerErrMsg(response.StatusInternalServerError, err.Error())
+		return &e
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(buf.Bytes())
+	return nil
+}
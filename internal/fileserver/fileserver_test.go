@@ -0,0 +1,264 @@
+package fileserver
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yus-works/tcp-to-http/internal/headers"
+	"github.com/yus-works/tcp-to-http/internal/request"
+	"github.com/yus-works/tcp-to-http/internal/response"
+)
+
+var modTime = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+func newTestServer(t *testing.T) *FileServer {
+	t.Helper()
+
+	dir := t.TempDir()
+	files := map[string]string{
+		"hello.txt":         "hello, world",
+		"digits":            "0123456789",
+		"page.html":         "<p>page</p>",
+		"docs/index.html":   "<h1>docs</h1>",
+		"files/a<b>.txt":    "a",
+		"files/sub/x.txt":   "x",
+		"blob":              "\x89PNG\r\n\x1a\n....",
+		"../outside-secret": "secret",
+	}
+	for name, contents := range files {
+		p := filepath.Join(dir, "root", name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0o755))
+		require.NoError(t, os.WriteFile(p, []byte(contents), 0o644))
+		require.NoError(t, os.Chtimes(p, modTime, modTime))
+	}
+	require.NoError(t, os.Symlink(filepath.Join(dir, "outside-secret"), filepath.Join(dir, "root", "link")))
+
+	s, err := New(filepath.Join(dir, "root"))
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func get(target string, fields ...string) *request.Request {
+	req := &request.Request{Headers: headers.NewHeaders()}
+	req.RequestLine.Method = "GET"
+	req.RequestLine.RequestTarget = target
+	for i := 0; i+1 < len(fields); i += 2 {
+		req.Headers.Set(fields[i], fields[i+1])
+	}
+	return req
+}
+
+// serve runs the handler and returns the raw response, or the handler error
+func serve(t *testing.T, s *FileServer, req *request.Request) (string, *response.HandlerError) {
+	t.Helper()
+
+	out := bytes.Buffer{}
+	w := response.NewWriter(&out)
+	if herr := s.Serve(w, req); herr != nil {
+		require.False(t, w.Committed())
+		return "", herr
+	}
+	require.NoError(t, w.Finish())
+	return out.String(), nil
+}
+
+func TestServeFile(t *testing.T) {
+	s := newTestServer(t)
+
+	// Test: Plain file with validators
+	raw, herr := serve(t, s, get("/hello.txt"))
+	require.Nil(t, herr)
+	assert.True(t, strings.HasPrefix(raw, "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, raw, "Content-Length: 12\r\n")
+	assert.Contains(t, raw, "Content-Type: text/plain; charset=utf-8\r\n")
+	assert.Contains(t, raw, "Last-Modified: Fri, 01 Mar 2024 12:00:00 GMT\r\n")
+	assert.Contains(t, raw, "Accept-Ranges: bytes\r\n")
+	assert.True(t, strings.HasSuffix(raw, "\r\n\r\nhello, world"))
+
+	// Test: Type sniffed from contents
+	raw, herr = serve(t, s, get("/blob"))
+	require.Nil(t, herr)
+	assert.Contains(t, raw, "Content-Type: image/png\r\n")
+
+	// Test: Traversal is resolved against the root
+	raw, herr = serve(t, s, get("/../hello.txt"))
+	require.Nil(t, herr)
+	assert.True(t, strings.HasSuffix(raw, "hello, world"))
+
+	_, herr = serve(t, s, get("/%2e%2e/outside-secret"))
+	require.NotNil(t, herr)
+	assert.Equal(t, response.StatusNotFound, herr.StatusCode)
+
+	// Test: Symlinks can't leave the root
+	_, herr = serve(t, s, get("/link"))
+	require.NotNil(t, herr)
+	assert.Equal(t, response.StatusNotFound, herr.StatusCode)
+
+	// Test: Missing file
+	_, herr = serve(t, s, get("/nope.txt"))
+	require.NotNil(t, herr)
+	assert.Equal(t, response.StatusNotFound, herr.StatusCode)
+
+	// Test: Only GET
+	req := get("/hello.txt")
+	req.RequestLine.Method = "POST"
+	_, herr = serve(t, s, req)
+	require.NotNil(t, herr)
+	assert.Equal(t, response.StatusMethodNotAllowed, herr.StatusCode)
+	assert.Equal(t, "GET", herr.Header.Get("Allow"))
+}
+
+func TestServeDirectory(t *testing.T) {
+	s := newTestServer(t)
+
+	// Test: Missing slash redirects
+	raw, herr := serve(t, s, get("/docs"))
+	require.Nil(t, herr)
+	assert.True(t, strings.HasPrefix(raw, "HTTP/1.1 301 Moved Permanently\r\n"))
+	assert.Contains(t, raw, "Location: ./docs/\r\n")
+
+	// Test: The redirect is relative to the last segment and keeps the query
+	raw, herr = serve(t, s, get("/files/sub?sort=name"))
+	require.Nil(t, herr)
+	assert.Contains(t, raw, "Location: ./sub/?sort=name\r\n")
+
+	// Test: A path cleaning down to the root can't redirect off-site
+	raw, herr = serve(t, s, get("//evil.com/.."))
+	require.Nil(t, herr)
+	assert.Contains(t, raw, "Location: /\r\n")
+	assert.NotContains(t, raw, "evil.com")
+
+	// Test: Index file
+	raw, herr = serve(t, s, get("/docs/"))
+	require.Nil(t, herr)
+	assert.Contains(t, raw, "Content-Type: text/html; charset=utf-8\r\n")
+	assert.True(t, strings.HasSuffix(raw, "<h1>docs</h1>"))
+
+	// Test: No index and listings disabled
+	_, herr = serve(t, s, get("/files/"))
+	require.NotNil(t, herr)
+	assert.Equal(t, response.StatusForbidden, herr.StatusCode)
+
+	// Test: Listing escapes names
+	s.Listing = true
+	raw, herr = serve(t, s, get("/files/"))
+	require.Nil(t, herr)
+	assert.Contains(t, raw, `<a href="../">../</a>`)
+	assert.Contains(t, raw, `<a href="./a%3Cb%3E.txt">a&lt;b&gt;.txt</a>`)
+	assert.Contains(t, raw, `<a href="./sub/">sub/</a>`)
+}
+
+func TestConditionalRequests(t *testing.T) {
+	s := newTestServer(t)
+
+	raw, herr := serve(t, s, get("/hello.txt"))
+	require.Nil(t, herr)
+	_, rest, _ := strings.Cut(raw, "ETag: ")
+	etag, _, _ := strings.Cut(rest, "\r\n")
+	require.True(t, strings.HasPrefix(etag, `"`))
+
+	tests := []struct {
+		name        string
+		fields      []string
+		notModified bool
+	}{
+		{"matching etag", []string{"If-None-Match", etag}, true},
+		{"weak comparison", []string{"If-None-Match", "W/" + etag}, true},
+		{"etag in list", []string{"If-None-Match", `"x,y", ` + etag}, true},
+		{"wildcard", []string{"If-None-Match", "*"}, true},
+		{"other etag", []string{"If-None-Match", `"other"`}, false},
+		{"same date", []string{"If-Modified-Since", "Fri, 01 Mar 2024 12:00:00 GMT"}, true},
+		{"later date", []string{"If-Modified-Since", "Sat, 02 Mar 2024 12:00:00 GMT"}, true},
+		{"obsolete date format", []string{"If-Modified-Since", "Friday, 01-Mar-24 12:00:00 GMT"}, true},
+		{"earlier date", []string{"If-Modified-Since", "Thu, 29 Feb 2024 12:00:00 GMT"}, false},
+		{"invalid date", []string{"If-Modified-Since", "yesterday"}, false},
+		{"etag takes precedence", []string{
+			"If-None-Match", `"other"`,
+			"If-Modified-Since", "Sat, 02 Mar 2024 12:00:00 GMT",
+		}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw, herr := serve(t, s, get("/hello.txt", tt.fields...))
+			require.Nil(t, herr)
+			if tt.notModified {
+				assert.True(t, strings.HasPrefix(raw, "HTTP/1.1 304 Not Modified\r\n"))
+				assert.NotContains(t, raw, "Content-Length")
+				assert.Contains(t, raw, "ETag: "+etag+"\r\n")
+				assert.True(t, strings.HasSuffix(raw, "\r\n\r\n"))
+			} else {
+				assert.True(t, strings.HasPrefix(raw, "HTTP/1.1 200 OK\r\n"))
+			}
+		})
+	}
+}
+
+func TestRangeRequests(t *testing.T) {
+	s := newTestServer(t)
+
+	// Test: Single range
+	raw, herr := serve(t, s, get("/digits", "Range", "bytes=2-4"))
+	require.Nil(t, herr)
+	assert.True(t, strings.HasPrefix(raw, "HTTP/1.1 206 Partial Content\r\n"))
+	assert.Contains(t, raw, "Content-Range: bytes 2-4/10\r\n")
+	assert.Contains(t, raw, "Content-Length: 3\r\n")
+	assert.True(t, strings.HasSuffix(raw, "\r\n\r\n234"))
+
+	// Test: Suffix and open ended ranges are clamped to the file
+	raw, herr = serve(t, s, get("/digits", "Range", "bytes=-3"))
+	require.Nil(t, herr)
+	assert.Contains(t, raw, "Content-Range: bytes 7-9/10\r\n")
+	raw, herr = serve(t, s, get("/digits", "Range", "bytes=8-100"))
+	require.Nil(t, herr)
+	assert.Contains(t, raw, "Content-Range: bytes 8-9/10\r\n")
+
+	// Test: Multiple ranges
+	raw, herr = serve(t, s, get("/digits", "Range", "bytes=0-1, 5-6"))
+	require.Nil(t, herr)
+	head, body, _ := strings.Cut(raw, "\r\n\r\n")
+	_, boundary, ok := strings.Cut(head, "Content-Type: multipart/byteranges; boundary=")
+	require.True(t, ok)
+	boundary, _, _ = strings.Cut(boundary, "\r\n")
+	assert.Equal(t, "--"+boundary+"\r\n"+
+		"Content-Type: text/plain; charset=utf-8\r\n"+
+		"Content-Range: bytes 0-1/10\r\n\r\n01\r\n"+
+		"--"+boundary+"\r\n"+
+		"Content-Type: text/plain; charset=utf-8\r\n"+
+		"Content-Range: bytes 5-6/10\r\n\r\n56\r\n"+
+		"--"+boundary+"--\r\n", body)
+	assert.Contains(t, head, "Content-Length: "+strconv.Itoa(len(body))+"\r\n")
+
+	// Test: Unsatisfiable
+	_, herr = serve(t, s, get("/digits", "Range", "bytes=10-"))
+	require.NotNil(t, herr)
+	assert.Equal(t, response.StatusRangeNotSatisfiable, herr.StatusCode)
+	assert.Equal(t, "bytes */10", herr.Header.Get("Content-Range"))
+
+	// Test: Malformed and overlapping ranges are ignored
+	for _, v := range []string{"bytes=4-2", "items=0-1", "bytes=x-", "bytes=0-9,0-9"} {
+		raw, herr = serve(t, s, get("/digits", "Range", v))
+		require.Nil(t, herr)
+		assert.True(t, strings.HasPrefix(raw, "HTTP/1.1 200 OK\r\n"), v)
+	}
+
+	// Test: If-Range
+	raw, herr = serve(t, s, get("/digits",
+		"Range", "bytes=0-0",
+		"If-Range", "Fri, 01 Mar 2024 12:00:00 GMT",
+	))
+	require.Nil(t, herr)
+	assert.True(t, strings.HasPrefix(raw, "HTTP/1.1 206 Partial Content\r\n"))
+
+	raw, herr = serve(t, s, get("/digits", "Range", "bytes=0-0", "If-Range", `"stale"`))
+	require.Nil(t, herr)
+	assert.True(t, strings.HasPrefix(raw, "HTTP/1.1 200 OK\r\n"))
+}
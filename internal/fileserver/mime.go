@@ -0,0 +1,94 @@
+package fileserver
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"path"
+	"unicode/utf8"
+)
+
+// sniffLen is how much of a file is looked at to guess its type
+const sniffLen = 512
+
+// detectContentType uses the file extension when it is known and otherwise
+// sniffs the start of the file
+func detectContentType(f io.ReaderAt, name string) string {
+	if ct := mime.TypeByExtension(path.Ext(name)); ct != "" {
+		return ct
+	}
+
+	buf := make([]byte, sniffLen)
+	n, _ := f.ReadAt(buf, 0)
+	return sniffContentType(buf[:n])
+}
+
+var signatures = []struct {
+	prefix      string
+	contentType string
+}{
+	{"%PDF-", "application/pdf"},
+	{"\x89PNG\r\n\x1a\n", "image/png"},
+	{"\xff\xd8\xff", "image/jpeg"},
+	{"GIF87a", "image/gif"},
+	{"GIF89a", "image/gif"},
+	{"PK\x03\x04", "application/zip"},
+	{"\x1f\x8b\x08", "application/gzip"},
+	{"\x00asm", "application/wasm"},
+	{"wOFF", "font/woff"},
+	{"wOF2", "font/woff2"},
+	{"\xef\xbb\xbf", "text/plain; charset=utf-8"},
+}
+
+var markupSignatures = []struct {
+	prefix      string
+	contentType string
+}{
+	{"<!doctype html", "text/html; charset=utf-8"},
+	{"<html", "text/html; charset=utf-8"},
+	{"<head", "text/html; charset=utf-8"},
+	{"<body", "text/html; charset=utf-8"},
+	{"<?xml", "text/xml; charset=utf-8"},
+}
+
+// sniffContentType recognises a few common binary formats by their magic
+// numbers and tells UTF-8 text from anything else
+func sniffContentType(data []byte) string {
+	for _, sig := range signatures {
+		if bytes.HasPrefix(data, []byte(sig.prefix)) {
+			return sig.contentType
+		}
+	}
+	if len(data) >= 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WEBP" {
+		return "image/webp"
+	}
+
+	markup := bytes.ToLower(bytes.TrimLeft(data, " \t\r\n\f"))
+	for _, sig := range markupSignatures {
+		if bytes.HasPrefix(markup, []byte(sig.prefix)) {
+			return sig.contentType
+		}
+	}
+
+	if isText(data) {
+		return "text/plain; charset=utf-8"
+	}
+	return "application/octet-stream"
+}
+
+// isText reports whether data is valid UTF-8 without control characters
+// other than whitespace and escape. A rune cut off by the sniff window
+// doesn't count against it
+func isText(data []byte) bool {
+	for i := 0; i < len(data); {
+		r, size := utf8.DecodeRune(data[i:])
+		if r == utf8.RuneError && size == 1 {
+			return !utf8.FullRune(data[i:]) && len(data) == sniffLen
+		}
+		if r < 0x20 && r != '\t' && r != '\n' && r != '\r' && r != '\f' && r != 0x1b || r == 0x7f {
+			return false
+		}
+		i += size
+	}
+	return true
+}
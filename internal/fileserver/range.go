@@ -0,0 +1,215 @@
+package fileserver
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yus-works/tcp-to-http/internal/headers"
+	"github.com/yus-works/tcp-to-http/internal/response"
+)
+
+var (
+	errMalformedRange     = errors.New("Malformed Range header")
+	errUnsatisfiableRange = errors.New("No satisfiable range")
+)
+
+// maxRanges caps how many parts a single request can ask for
+const maxRanges = 32
+
+type byteRange struct {
+	start  int64
+	length int64
+}
+
+func (r byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+// requestedRanges returns the ranges to send, or none for the whole file.
+// Malformed, outdated (If-Range) or abusive Range headers are ignored, as
+// RFC 9110 14.2 allows, while one with no satisfiable range gets a 416
+func requestedRanges(
+	h *headers.Headers, etag string, modTime time.Time, size int64,
+) ([]byteRange, *response.HandlerError) {
+	if !h.Has("Range") || !ifRangeMatches(h, etag, modTime) {
+		return nil, nil
+	}
+
+	ranges, err := parseRange(h.Get("Range"), size)
+	if errors.Is(err, errUnsatisfiableRange) {
+		e := response.NewHandlerErr(response.StatusRangeNotSatisfiable)
+		e.Header = headers.NewHeaders()
+		e.Header.Set("Content-Range", "bytes */"+strconv.FormatInt(size, 10))
+		return nil, &e
+	}
+	if err != nil {
+		return nil, nil
+	}
+
+	// overlapping ranges could make a small file produce a huge response
+	total := int64(0)
+	for _, r := range ranges {
+		total += r.length
+	}
+	if len(ranges) > maxRanges || total > size {
+		return nil, nil
+	}
+
+	return ranges, nil
+}
+
+// ifRangeMatches reports whether the representation is still the one the
+// client holds part of. Only a strong ETag or an exact date count
+func ifRangeMatches(h *headers.Headers, etag string, modTime time.Time) bool {
+	if !h.Has("If-Range") {
+		return true
+	}
+
+	v := strings.TrimSpace(h.Get("If-Range"))
+	if strings.HasPrefix(v, `"`) || strings.HasPrefix(v, "W/") {
+		return etagsMatch(v, etag, true)
+	}
+
+	t, err := headers.ParseTime(v)
+	if err != nil {
+		return false
+	}
+	return t.Equal(modTime.Truncate(time.Second))
+}
+
+// parseRange parses a bytes Range header (RFC 9110 14.1.2) against a
+// representation of size bytes. Ranges past the end are dropped, and if none
+// are left errUnsatisfiableRange is returned
+func parseRange(v string, size int64) ([]byteRange, error) {
+	unit, set, ok := strings.Cut(v, "=")
+	if !ok || !strings.EqualFold(strings.TrimSpace(unit), "bytes") {
+		return nil, errMalformedRange
+	}
+
+	var ranges []byteRange
+	for _, spec := range strings.Split(set, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+
+		first, last, ok := strings.Cut(spec, "-")
+		if !ok {
+			return nil, errMalformedRange
+		}
+
+		// suffix range: the last n bytes
+		if first == "" {
+			n, err := parseRangeInt(last)
+			if err != nil {
+				return nil, err
+			}
+			if n == 0 || size == 0 {
+				continue
+			}
+			n = min(n, size)
+			ranges = append(ranges, byteRange{start: size - n, length: n})
+			continue
+		}
+
+		start, err := parseRangeInt(first)
+		if err != nil {
+			return nil, err
+		}
+
+		end := size - 1
+		if last != "" {
+			end, err = parseRangeInt(last)
+			if err != nil {
+				return nil, err
+			}
+			if end < start {
+				return nil, errMalformedRange
+			}
+			end = min(end, size-1)
+		}
+
+		if start >= size {
+			continue
+		}
+		ranges = append(ranges, byteRange{start: start, length: end - start + 1})
+	}
+
+	if len(ranges) == 0 {
+		return nil, errUnsatisfiableRange
+	}
+	return ranges, nil
+}
+
+func parseRangeInt(s string) (int64, error) {
+	if s == "" || strings.Trim(s, "0123456789") != "" {
+		return 0, errMalformedRange
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, errMalformedRange
+	}
+	return n, nil
+}
+
+// multipart lays out a multipart/byteranges body (RFC 9110 14.6). The part
+// headers are built up front so the total length is known before streaming
+type multipart struct {
+	boundary string
+	ranges   []byteRange
+	heads    []string
+	tail     string
+}
+
+func newMultipart(ranges []byteRange, contentType string, size int64) *multipart {
+	b := make([]byte, 16)
+	rand.Read(b)
+	mp := &multipart{
+		boundary: hex.EncodeToString(b),
+		ranges:   ranges,
+	}
+
+	for i, r := range ranges {
+		head := "--" + mp.boundary + "\r\n"
+		if i > 0 {
+			head = "\r\n" + head
+		}
+		head += "Content-Type: " + contentType + "\r\n" +
+			"Content-Range: " + r.contentRange(size) + "\r\n\r\n"
+		mp.heads = append(mp.heads, head)
+	}
+	mp.tail = "\r\n--" + mp.boundary + "--\r\n"
+
+	return mp
+}
+
+func (mp *multipart) contentType() string {
+	return "multipart/byteranges; boundary=" + mp.boundary
+}
+
+func (mp *multipart) length() int64 {
+	n := int64(len(mp.tail))
+	for i, r := range mp.ranges {
+		n += int64(len(mp.heads[i])) + r.length
+	}
+	return n
+}
+
+// reader returns the whole body, reading each part from f as it goes
+func (mp *multipart) reader(f io.ReaderAt) io.Reader {
+	var parts []io.Reader
+	for i, r := range mp.ranges {
+		parts = append(parts,
+			strings.NewReader(mp.heads[i]),
+			io.NewSectionReader(f, r.start, r.length),
+		)
+	}
+	parts = append(parts, strings.NewReader(mp.tail))
+	return io.MultiReader(parts...)
+}
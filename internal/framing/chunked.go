@@ -0,0 +1,42 @@
+package framing
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// ChunkedWriter frames every write as one chunk (RFC 9112 7.1)
+type ChunkedWriter struct {
+	w io.Writer
+}
+
+func NewChunkedWriter(w io.Writer) *ChunkedWriter {
+	return &ChunkedWriter{w: w}
+}
+
+func (c *ChunkedWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	var chunk bytes.Buffer
+	chunk.WriteString(strconv.FormatInt(int64(len(p)), 16))
+	chunk.WriteString("\r\n")
+	chunk.Write(p)
+	chunk.WriteString("\r\n")
+
+	if _, err := c.w.Write(chunk.Bytes()); err != nil {
+		return 0, fmt.Errorf("Failed to write chunk: %w", err)
+	}
+	return len(p), nil
+}
+
+// Close writes the last chunk and the empty trailer section
+func (c *ChunkedWriter) Close() error {
+	if _, err := io.WriteString(c.w, "0\r\n\r\n"); err != nil {
+		return fmt.Errorf("Failed to write last chunk: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+// Package framing holds the message body framing rules (RFC 9112 6) that
+// the request and response parsers share, so both agree on where a message
+// ends
+package framing
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrConflictingContentLength = errors.New("Conflicting Content-Length values")
+	ErrInvalidContentLength     = errors.New("Invalid Content-Length value")
+	ErrInvalidChunk             = errors.New("Invalid chunked encoding")
+)
+
+var crlf = []byte("\r\n")
+
+// IsDigits reports whether s is a non-empty run of decimal digits
+func IsDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// IsHex reports whether s is a non-empty run of hex digits
+func IsHex(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F') {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseContentLength accepts a single length or a list of identical lengths
+// (which is what Get turns repeated Content-Length fields into), and rejects
+// anything that isn't plain decimal digits
+func ParseContentLength(v string) (int, error) {
+	ln := -1
+	for _, part := range strings.Split(v, ",") {
+		part = strings.Trim(part, " \t")
+		if !IsDigits(part) {
+			return 0, ErrInvalidContentLength
+		}
+
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return 0, ErrInvalidContentLength
+		}
+
+		if ln != -1 && n != ln {
+			return 0, ErrConflictingContentLength
+		}
+		ln = n
+	}
+	return ln, nil
+}
+
+// ParseChunkSize parses a chunk-size line at the start of data, ignoring
+// any chunk extensions. It returns the size and the length of the line, 0
+// if the line isn't complete yet
+func ParseChunkSize(data []byte) (int, int, error) {
+	idx := bytes.Index(data, crlf)
+	if idx == -1 {
+		return 0, 0, nil
+	}
+
+	line := string(data[:idx])
+	if i := strings.IndexByte(line, ';'); i != -1 {
+		line = strings.TrimRight(line[:i], " \t")
+	}
+
+	if !IsHex(line) {
+		return 0, 0, ErrInvalidChunk
+	}
+
+	size, err := strconv.ParseInt(line, 16, 32)
+	if err != nil {
+		return 0, 0, ErrInvalidChunk
+	}
+
+	return int(size), idx + len(crlf), nil
+}
@@ -0,0 +1,66 @@
+package framing
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseContentLength(t *testing.T) {
+	tests := []struct {
+		value string
+		n     int
+		err   error
+	}{
+		{value: "42", n: 42},
+		{value: "0", n: 0},
+		{value: "5, 5,5", n: 5},
+		{value: "5, 6", err: ErrConflictingContentLength},
+		{value: "", err: ErrInvalidContentLength},
+		{value: "+5", err: ErrInvalidContentLength},
+		{value: "0x10", err: ErrInvalidContentLength},
+		{value: "5,", err: ErrInvalidContentLength},
+		{value: "99999999999999999999", err: ErrInvalidContentLength},
+	}
+
+	for _, tt := range tests {
+		n, err := ParseContentLength(tt.value)
+		if tt.err != nil {
+			assert.ErrorIs(t, err, tt.err, tt.value)
+			continue
+		}
+		assert.NoError(t, err, tt.value)
+		assert.Equal(t, tt.n, n, tt.value)
+	}
+}
+
+func TestParseChunkSize(t *testing.T) {
+	tests := []struct {
+		data string
+		size int
+		n    int
+		err  error
+	}{
+		{data: "1a\r\nrest", size: 26, n: 4},
+		{data: "FF;name=value\r\n", size: 255, n: 15},
+		{data: "0 ;x\r\n", size: 0, n: 6},
+		// Test: an incomplete line asks for more
+		{data: "1a", n: 0},
+		{data: "\r\n", err: ErrInvalidChunk},
+		{data: "-1\r\n", err: ErrInvalidChunk},
+		{data: "0x10\r\n", err: ErrInvalidChunk},
+		{data: "1 a\r\n", err: ErrInvalidChunk},
+		{data: "ffffffffff\r\n", err: ErrInvalidChunk},
+	}
+
+	for _, tt := range tests {
+		size, n, err := ParseChunkSize([]byte(tt.data))
+		if tt.err != nil {
+			assert.ErrorIs(t, err, tt.err, tt.data)
+			continue
+		}
+		assert.NoError(t, err, tt.data)
+		assert.Equal(t, tt.size, size, tt.data)
+		assert.Equal(t, tt.n, n, tt.data)
+	}
+}
@@ -0,0 +1,33 @@
+package headers
+
+import (
+	"errors"
+	"time"
+)
+
+// TimeFormat is the IMF-fixdate format used for HTTP dates (RFC 9110 5.6.7)
+const TimeFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+// obsolete date formats recipients must still accept
+const (
+	rfc850Format  = "Monday, 02-Jan-06 15:04:05 GMT"
+	asctimeFormat = "Mon Jan _2 15:04:05 2006"
+)
+
+var ErrInvalidDate = errors.New("Invalid HTTP date")
+
+// FormatTime formats t as an IMF-fixdate in UTC
+func FormatTime(t time.Time) string {
+	return t.UTC().Format(TimeFormat)
+}
+
+// ParseTime parses an HTTP date in any of the three formats allowed by
+// RFC 9110 5.6.7
+func ParseTime(v string) (time.Time, error) {
+	for _, layout := range []string{TimeFormat, rfc850Format, asctimeFormat} {
+		if t, err := time.Parse(layout, v); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, ErrInvalidDate
+}
@@ -2,67 +2,214 @@ package headers
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"iter"
 	"regexp"
 	"slices"
 	"strings"
 )
 
-type Headers map[string]string
+// Headers is an ordered list of header fields. Names are matched case
+// insensitively but kept as they were added, and repeated names keep each
+// of their values
+type Headers struct {
+	fields []field
+}
+
+type field struct {
+	name  string
+	value string
+}
 
 var CRLF = []byte("\r\n")
 var SP = byte(' ')
-var isValidKey = regexp.MustCompile("^[a-zA-Z0-9!#$%&'*+-.^_`|~]+$")
+var HTAB = byte('\t')
+var isValidKey = regexp.MustCompile("^[a-zA-Z0-9!#$%&'*+.^_`|~-]+$")
+
+var (
+	// ErrObsFold is returned for a field line that starts with whitespace.
+	// Line folding is deprecated (RFC 9112 5.2) and proxies disagree on how
+	// to unfold it, so it is rejected rather than merged into the previous
+	// field.
+	ErrObsFold = errors.New("Obsolete line folding is not allowed")
+
+	// ErrSpaceBeforeColon is returned when whitespace separates a field
+	// name from its colon (RFC 9112 5.1).
+	ErrSpaceBeforeColon = errors.New(
+		"Invalid format: key and ':' should not have whitespace between",
+	)
+
+	// ErrInvalidFieldName and ErrInvalidFieldValue are returned for names
+	// that aren't tokens and values containing NUL, CR, LF or other control
+	// characters. Letting a CR or LF through in either direction allows
+	// injecting extra fields or splitting a message in two
+	ErrInvalidFieldName  = errors.New("Invalid header field name")
+	ErrInvalidFieldValue = errors.New("Invalid header field value")
+)
+
+func isOWS(b byte) bool {
+	return b == SP || b == HTAB
+}
 
 func parseHeader(fieldLine []byte) (string, string, error) {
-	colonIdx := bytes.Index(fieldLine, []byte(":"))
+	if len(fieldLine) > 0 && isOWS(fieldLine[0]) {
+		return "", "", ErrObsFold
+	}
+
+	colonIdx := bytes.IndexByte(fieldLine, ':')
 
 	if colonIdx > 0 {
-		if fieldLine[colonIdx-1] == SP {
-			return "", "", fmt.Errorf(
-				"Invalid format: key and ':' should not have a space between",
-			)
+		if isOWS(fieldLine[colonIdx-1]) {
+			return "", "", ErrSpaceBeforeColon
 		}
 	} else {
 		return "", "", fmt.Errorf("Missing ':' in header line")
 	}
 
-	kv := bytes.TrimSpace(fieldLine)
-
-	parts := bytes.SplitN(kv, []byte(":"), 2)
+	name := fieldLine[:colonIdx]
 
-	if !isValidKey.Match(parts[0]) {
+	if !isValidKey.Match(name) {
 		return "", "", fmt.Errorf("Invalid key format")
 	}
 
-	key := string(bytes.ToLower(parts[0]))
-	val := string(bytes.TrimSpace(parts[1]))
+	key := CanonicalKey(string(name))
+	val := string(bytes.Trim(fieldLine[colonIdx+1:], " \t"))
+
+	if !ValidValue(val) {
+		return "", "", ErrInvalidFieldValue
+	}
 
 	return key, val, nil
 }
 
-func (h Headers) Get(k string) string {
-	return h[strings.ToLower(k)]
+// ValidName reports whether k is a valid field name (a token)
+func ValidName(k string) bool {
+	return isValidKey.MatchString(k)
 }
 
-func (h Headers) Set(k, v string) {
-	key := strings.ToLower(k)
+// ValidValue reports whether v only contains visible characters, spaces,
+// tabs and obs-text (RFC 9110 5.5)
+func ValidValue(v string) bool {
+	for i := 0; i < len(v); i++ {
+		c := v[i]
+		if c < ' ' && c != HTAB || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
 
-	if oldVal, ok := h[key]; !ok { // not found
-		h[key] = v
+// Validate checks every field name and value, so a response built from
+// untrusted input can be rejected before any of it is written
+func (h *Headers) Validate() error {
+	for _, f := range h.fields {
+		if !ValidName(f.name) {
+			return fmt.Errorf("%w: %q", ErrInvalidFieldName, f.name)
+		}
+		if !ValidValue(f.value) {
+			return fmt.Errorf("%w for %s: %q", ErrInvalidFieldValue, f.name, f.value)
+		}
+	}
+	return nil
+}
+
+// CanonicalKey returns k with the first letter and every letter following a
+// hyphen upper cased and the rest lower cased, e.g. "content-length" becomes
+// "Content-Length"
+func CanonicalKey(k string) string {
+	b := []byte(k)
+	upper := true
+	for i, c := range b {
+		if upper && 'a' <= c && c <= 'z' {
+			b[i] = c - ('a' - 'A')
+		} else if !upper && 'A' <= c && c <= 'Z' {
+			b[i] = c + ('a' - 'A')
+		}
+		upper = c == '-'
+	}
+	return string(b)
+}
 
-	} else { // found
-		if v == oldVal {
+// Get returns every value of k joined into a single comma separated field
+// value, which is how RFC 9110 5.3 combines repeated list-based fields.
+// Fields that can't be combined, like Set-Cookie, should use Values instead
+func (h *Headers) Get(k string) string {
+	return strings.Join(h.Values(k), ", ")
+}
+
+// Values returns the values of k in the order they were added
+func (h *Headers) Values(k string) []string {
+	var vals []string
+	for _, f := range h.fields {
+		if strings.EqualFold(f.name, k) {
+			vals = append(vals, f.value)
+		}
+	}
+	return vals
+}
+
+// Has reports whether k is present, even with an empty value
+func (h *Headers) Has(k string) bool {
+	for _, f := range h.fields {
+		if strings.EqualFold(f.name, k) {
+			return true
+		}
+	}
+	return false
+}
+
+// Add appends a value for k, keeping any existing ones
+func (h *Headers) Add(k, v string) {
+	h.fields = append(h.fields, field{name: k, value: v})
+}
+
+// Set replaces all values of k with v. The field keeps the position of its
+// first occurrence, or is appended if k wasn't present
+func (h *Headers) Set(k, v string) {
+	for i, f := range h.fields {
+		if strings.EqualFold(f.name, k) {
+			h.fields[i] = field{name: k, value: v}
+			rest := slices.DeleteFunc(h.fields[i+1:], func(f field) bool {
+				return strings.EqualFold(f.name, k)
+			})
+			h.fields = h.fields[:i+1+len(rest)]
 			return
+		}
+	}
+	h.Add(k, v)
+}
+
+// Del removes all values of k
+func (h *Headers) Del(k string) {
+	h.fields = slices.DeleteFunc(h.fields, func(f field) bool {
+		return strings.EqualFold(f.name, k)
+	})
+}
+
+// Clone returns a copy of h that can be changed independently
+func (h *Headers) Clone() *Headers {
+	return &Headers{fields: slices.Clone(h.fields)}
+}
+
+// Len returns the number of fields, counting repeated names separately
+func (h *Headers) Len() int {
+	return len(h.fields)
+}
 
-		} else {
-			newVal := strings.Join([]string{oldVal, v}, ", ")
-			h[key] = newVal
+// All iterates over every field in order, yielding repeated names once per
+// value
+func (h *Headers) All() iter.Seq2[string, string] {
+	return func(yield func(string, string) bool) {
+		for _, f := range h.fields {
+			if !yield(f.name, f.value) {
+				return
+			}
 		}
 	}
 }
 
-func (h Headers) Parse(data []byte) (int, bool, error) {
+func (h *Headers) Parse(data []byte) (int, bool, error) {
 	read := 0
 	done := false
 
@@ -92,7 +239,7 @@ func (h Headers) Parse(data []byte) (int, bool, error) {
 
 		read += idx + len(CRLF)
 
-		h.Set(k, v)
+		h.Add(k, v)
 	}
 
 	return read, done, nil
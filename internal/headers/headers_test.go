@@ -125,4 +125,141 @@ func TestHeadersParse(t *testing.T) {
 	assert.Equal(t, "lane-loves-go", headers.Get("set-person"))
 	assert.Equal(t, len(data) - 2, n)
 	assert.True(t, done)
+
+	// Test: Obsolete line folding
+	headers = NewHeaders()
+	data = []byte("X-Folded: first\r\n second\r\n\r\n")
+	n, done, err = headers.Parse(data)
+	require.ErrorIs(t, err, ErrObsFold)
+	assert.Equal(t, 0, n)
+	assert.False(t, done)
+
+	// Test: Tab before colon
+	headers = NewHeaders()
+	data = []byte("Host\t: localhost:42069\r\n\r\n")
+	n, done, err = headers.Parse(data)
+	require.ErrorIs(t, err, ErrSpaceBeforeColon)
+	assert.Equal(t, 0, n)
+	assert.False(t, done)
+
+	// Test: Comma is not a valid key character
+	headers = NewHeaders()
+	data = []byte("Content-Length,: 5\r\n\r\n")
+	n, done, err = headers.Parse(data)
+	require.Error(t, err)
+	assert.Equal(t, 0, n)
+	assert.False(t, done)
+}
+
+func TestHeadersMultiValue(t *testing.T) {
+	// Test: Add keeps every value in order
+	headers := NewHeaders()
+	headers.Add("Set-Cookie", "session=abc")
+	headers.Add("Content-Type", "text/plain")
+	headers.Add("set-cookie", "user=123")
+	assert.Equal(t, []string{"session=abc", "user=123"}, headers.Values("SET-COOKIE"))
+	assert.Equal(t, "session=abc, user=123", headers.Get("set-cookie"))
+	assert.Equal(t, 3, headers.Len())
+
+	// Test: Set replaces all values in place of the first one
+	headers.Set("SET-COOKIE", "theme=dark")
+	assert.Equal(t, []string{"theme=dark"}, headers.Values("set-cookie"))
+	var names []string
+	for k := range headers.All() {
+		names = append(names, k)
+	}
+	assert.Equal(t, []string{"SET-COOKIE", "Content-Type"}, names)
+
+	// Test: Set appends a missing field
+	headers.Set("X-New", "1")
+	assert.Equal(t, "1", headers.Get("x-new"))
+	assert.Equal(t, 3, headers.Len())
+
+	// Test: Del removes every value
+	headers.Add("x-new", "2")
+	headers.Del("X-NEW")
+	assert.False(t, headers.Has("x-new"))
+	assert.Nil(t, headers.Values("x-new"))
+	assert.Equal(t, "", headers.Get("x-new"))
+	assert.Equal(t, 2, headers.Len())
+
+	// Test: Has reports empty values
+	headers.Add("X-Empty", "")
+	assert.True(t, headers.Has("x-empty"))
+	assert.Equal(t, "", headers.Get("x-empty"))
+
+	// Test: Parse keeps duplicates and order
+	headers = NewHeaders()
+	data := []byte("Set-Cookie: a=1\r\nHost: localhost\r\nSet-Cookie: a=1\r\nSet-Cookie: b=2\r\n\r\n")
+	_, done, err := headers.Parse(data)
+	require.NoError(t, err)
+	assert.True(t, done)
+	assert.Equal(t, []string{"a=1", "a=1", "b=2"}, headers.Values("set-cookie"))
+
+	var fields []string
+	for k, v := range headers.All() {
+		fields = append(fields, k+": "+v)
+	}
+	assert.Equal(t, []string{
+		"Set-Cookie: a=1",
+		"Host: localhost",
+		"Set-Cookie: a=1",
+		"Set-Cookie: b=2",
+	}, fields)
+}
+
+func TestCanonicalKey(t *testing.T) {
+	tests := map[string]string{
+		"content-length":   "Content-Length",
+		"CONTENT-TYPE":     "Content-Type",
+		"x-forwarded-for":  "X-Forwarded-For",
+		"www-authenticate": "Www-Authenticate",
+		"Host":             "Host",
+		"te":               "Te",
+		"x--double":        "X--Double",
+		"-leading":         "-Leading",
+		"with_underscore":  "With_underscore",
+	}
+	for in, want := range tests {
+		assert.Equal(t, want, CanonicalKey(in), in)
+	}
+}
+
+func TestHeadersFieldValueValidation(t *testing.T) {
+	// Test: Control characters in field values
+	for _, val := range []string{"a\x00b", "a\rb", "a\nInjected: 1", "a\x1bb", "a\x7fb", "\x0b"} {
+		headers := NewHeaders()
+		data := []byte("X-Value: " + val + "\r\n\r\n")
+		n, done, err := headers.Parse(data)
+		require.ErrorIs(t, err, ErrInvalidFieldValue, val)
+		assert.Equal(t, 0, n)
+		assert.False(t, done)
+	}
+
+	// Test: Tabs and obs-text are allowed
+	headers := NewHeaders()
+	data := []byte("X-Value: a\tb caf\xc3\xa9\r\n\r\n")
+	_, done, err := headers.Parse(data)
+	require.NoError(t, err)
+	assert.True(t, done)
+	assert.Equal(t, "a\tb caf\xc3\xa9", headers.Get("x-value"))
+
+	// Test: Validate rejects values set directly
+	headers = NewHeaders()
+	headers.Set("Location", "/home\r\nSet-Cookie: admin=1")
+	require.ErrorIs(t, headers.Validate(), ErrInvalidFieldValue)
+
+	// Test: Validate rejects invalid names
+	headers = NewHeaders()
+	headers.Set("X-Bad Name", "value")
+	require.ErrorIs(t, headers.Validate(), ErrInvalidFieldName)
+
+	headers = NewHeaders()
+	headers.Set("X-Bad:\r\nName", "value")
+	require.ErrorIs(t, headers.Validate(), ErrInvalidFieldName)
+
+	// Test: Validate accepts normal headers
+	headers = NewHeaders()
+	headers.Set("Content-Type", "text/html; charset=utf-8")
+	require.NoError(t, headers.Validate())
 }
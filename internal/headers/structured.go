@@ -0,0 +1,582 @@
+package headers
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ErrMalformedField is returned when a structured field value doesn't follow
+// its grammar
+var ErrMalformedField = errors.New("Malformed header field value")
+
+func malformed(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", ErrMalformedField, fmt.Sprintf(format, args...))
+}
+
+func isTChar(c byte) bool {
+	return 'a' <= c && c <= 'z' ||
+		'A' <= c && c <= 'Z' ||
+		'0' <= c && c <= '9' ||
+		strings.IndexByte("!#$%&'*+-.^_`|~", c) != -1
+}
+
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !isTChar(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Quote returns s as a quoted-string, escaping quotes and backslashes
+func Quote(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		if s[i] == '"' || s[i] == '\\' {
+			b.WriteByte('\\')
+		}
+		b.WriteByte(s[i])
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// quoteIfNeeded returns s unchanged if it is a token and quoted otherwise
+func quoteIfNeeded(s string) string {
+	if isToken(s) {
+		return s
+	}
+	return Quote(s)
+}
+
+// fieldScanner walks a field value one byte at a time
+type fieldScanner struct {
+	s string
+	i int
+}
+
+func (sc *fieldScanner) done() bool {
+	return sc.i >= len(sc.s)
+}
+
+func (sc *fieldScanner) peek() byte {
+	if sc.done() {
+		return 0
+	}
+	return sc.s[sc.i]
+}
+
+func (sc *fieldScanner) consume(c byte) bool {
+	if !sc.done() && sc.s[sc.i] == c {
+		sc.i++
+		return true
+	}
+	return false
+}
+
+func (sc *fieldScanner) skipOWS() {
+	for !sc.done() && isOWS(sc.s[sc.i]) {
+		sc.i++
+	}
+}
+
+func (sc *fieldScanner) token() string {
+	start := sc.i
+	for !sc.done() && isTChar(sc.s[sc.i]) {
+		sc.i++
+	}
+	return sc.s[start:sc.i]
+}
+
+func (sc *fieldScanner) quotedString() (string, error) {
+	if !sc.consume('"') {
+		return "", malformed("expected '\"' at %d", sc.i)
+	}
+
+	var b strings.Builder
+	for !sc.done() {
+		c := sc.s[sc.i]
+		sc.i++
+
+		switch c {
+		case '"':
+			return b.String(), nil
+		case '\\':
+			if sc.done() {
+				return "", malformed("unterminated quoted string")
+			}
+			b.WriteByte(sc.s[sc.i])
+			sc.i++
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", malformed("unterminated quoted string")
+}
+
+// tokenOrQuoted reads a value that may be either a token or a quoted-string
+func (sc *fieldScanner) tokenOrQuoted() (string, error) {
+	if sc.peek() == '"' {
+		return sc.quotedString()
+	}
+
+	tok := sc.token()
+	if tok == "" {
+		return "", malformed("expected a token at %d", sc.i)
+	}
+	return tok, nil
+}
+
+// Param is a name=value pair. Names are lower cased when parsed
+type Param struct {
+	Name  string
+	Value string
+}
+
+// Params keeps parameters in the order they appeared
+type Params []Param
+
+// Get returns the value of the first parameter called name
+func (ps Params) Get(name string) (string, bool) {
+	for _, p := range ps {
+		if strings.EqualFold(p.Name, name) {
+			return p.Value, true
+		}
+	}
+	return "", false
+}
+
+// String formats the parameters as "; name=value" pairs
+func (ps Params) String() string {
+	var b strings.Builder
+	for _, p := range ps {
+		b.WriteString("; ")
+		b.WriteString(p.Name)
+		b.WriteByte('=')
+		b.WriteString(quoteIfNeeded(p.Value))
+	}
+	return b.String()
+}
+
+// parseParams reads *( OWS ";" OWS [ name "=" value ] )
+func (sc *fieldScanner) parseParams() (Params, error) {
+	var params Params
+
+	for {
+		sc.skipOWS()
+		if !sc.consume(';') {
+			return params, nil
+		}
+		sc.skipOWS()
+
+		// empty parameters are allowed, e.g. "text/plain;;charset=utf-8"
+		if sc.done() || sc.peek() == ';' || sc.peek() == ',' {
+			continue
+		}
+
+		name := sc.token()
+		if name == "" {
+			return nil, malformed("expected a parameter name at %d", sc.i)
+		}
+		if !sc.consume('=') {
+			return nil, malformed("parameter %q has no value", name)
+		}
+
+		val, err := sc.tokenOrQuoted()
+		if err != nil {
+			return nil, err
+		}
+
+		params = append(params, Param{Name: strings.ToLower(name), Value: val})
+	}
+}
+
+// ParseList splits a comma separated list, ignoring commas inside quoted
+// strings and dropping empty elements (RFC 9110 5.6.1). Elements are
+// returned as they appear, quotes included
+func ParseList(v string) ([]string, error) {
+	var elems []string
+
+	sc := fieldScanner{s: v}
+	for !sc.done() {
+		start := sc.i
+		for !sc.done() && sc.peek() != ',' {
+			if sc.peek() == '"' {
+				if _, err := sc.quotedString(); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			sc.i++
+		}
+
+		elem := strings.Trim(v[start:sc.i], " \t")
+		if elem != "" {
+			elems = append(elems, elem)
+		}
+		sc.consume(',')
+	}
+
+	return elems, nil
+}
+
+// HasToken reports whether the comma separated list in field k contains
+// token, ignoring case
+func HasToken(h *Headers, k, token string) bool {
+	list, err := ParseList(h.Get(k))
+	if err != nil {
+		return false
+	}
+	for _, v := range list {
+		if strings.EqualFold(v, token) {
+			return true
+		}
+	}
+	return false
+}
+
+// FormatList joins elements into a comma separated list
+func FormatList(elems []string) string {
+	return strings.Join(elems, ", ")
+}
+
+// MediaType is a parsed Content-Type or Accept media range
+type MediaType struct {
+	Type    string
+	Subtype string
+	Params  Params
+}
+
+// ParseMediaType parses "type/subtype *( ; name=value )". Type, subtype and
+// parameter names are lower cased
+func ParseMediaType(v string) (MediaType, error) {
+	sc := fieldScanner{s: v}
+	sc.skipOWS()
+
+	mt, err := sc.parseMediaType()
+	if err != nil {
+		return MediaType{}, err
+	}
+
+	sc.skipOWS()
+	if !sc.done() {
+		return MediaType{}, malformed("unexpected %q after media type", v[sc.i:])
+	}
+	return mt, nil
+}
+
+func (sc *fieldScanner) parseMediaType() (MediaType, error) {
+	typ := sc.token()
+	if typ == "" || !sc.consume('/') {
+		return MediaType{}, malformed("expected type/subtype")
+	}
+
+	subtype := sc.token()
+	if subtype == "" {
+		return MediaType{}, malformed("expected a subtype after %q", typ+"/")
+	}
+
+	params, err := sc.parseParams()
+	if err != nil {
+		return MediaType{}, err
+	}
+
+	return MediaType{
+		Type:    strings.ToLower(typ),
+		Subtype: strings.ToLower(subtype),
+		Params:  params,
+	}, nil
+}
+
+// Essence returns "type/subtype" without parameters
+func (m MediaType) Essence() string {
+	return m.Type + "/" + m.Subtype
+}
+
+func (m MediaType) String() string {
+	return m.Essence() + m.Params.String()
+}
+
+// QualityValue is one element of a list weighted with q-values, like Accept,
+// Accept-Encoding or Accept-Language
+type QualityValue struct {
+	Value string
+	// Q is the weight, from 0 to 1. It is 1 when not given
+	Q float64
+	// Params holds any parameters except q, e.g. the media type parameters
+	// of an Accept element
+	Params Params
+}
+
+// parseQ accepts a qvalue: 0 or 1 with up to three decimals (RFC 9110 12.4.2)
+func parseQ(v string) (float64, error) {
+	intPart, frac, _ := strings.Cut(v, ".")
+	if intPart != "0" && intPart != "1" || len(frac) > 3 {
+		return 0, malformed("invalid qvalue %q", v)
+	}
+	for i := 0; i < len(frac); i++ {
+		if frac[i] < '0' || frac[i] > '9' || intPart == "1" && frac[i] != '0' {
+			return 0, malformed("invalid qvalue %q", v)
+		}
+	}
+
+	q, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, malformed("invalid qvalue %q", v)
+	}
+	return q, nil
+}
+
+// ParseQualityList parses a comma separated list of values with optional
+// parameters and q-values, keeping the order of the elements
+func ParseQualityList(v string) ([]QualityValue, error) {
+	elems, err := ParseList(v)
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]QualityValue, 0, len(elems))
+	for _, elem := range elems {
+		sc := fieldScanner{s: elem}
+
+		start := sc.i
+		for !sc.done() && (isTChar(sc.peek()) || sc.peek() == '/') {
+			sc.i++
+		}
+		val := elem[start:sc.i]
+		if val == "" {
+			return nil, malformed("expected a value in %q", elem)
+		}
+
+		params, err := sc.parseParams()
+		if err != nil {
+			return nil, err
+		}
+		if !sc.done() {
+			return nil, malformed("unexpected %q in %q", elem[sc.i:], elem)
+		}
+
+		qv := QualityValue{Value: val, Q: 1}
+		for i, p := range params {
+			if p.Name == "q" {
+				qv.Q, err = parseQ(p.Value)
+				if err != nil {
+					return nil, err
+				}
+				// anything after q is an accept extension, which is dropped
+				params = params[:i]
+				break
+			}
+		}
+		if len(params) > 0 {
+			qv.Params = params
+		}
+
+		list = append(list, qv)
+	}
+
+	return list, nil
+}
+
+func (qv QualityValue) String() string {
+	s := qv.Value + qv.Params.String()
+	if qv.Q != 1 {
+		s += "; q=" + strconv.FormatFloat(qv.Q, 'f', -1, 64)
+	}
+	return s
+}
+
+// FormatQualityList is the inverse of ParseQualityList
+func FormatQualityList(list []QualityValue) string {
+	elems := make([]string, len(list))
+	for i, qv := range list {
+		elems[i] = qv.String()
+	}
+	return FormatList(elems)
+}
+
+// CacheControl holds Cache-Control directives in the order they were given.
+// Directives without an argument have an empty value
+type CacheControl Params
+
+// ParseCacheControl parses a list of "directive [= argument]" pairs.
+// Directive names are lower cased
+func ParseCacheControl(v string) (CacheControl, error) {
+	elems, err := ParseList(v)
+	if err != nil {
+		return nil, err
+	}
+
+	cc := make(CacheControl, 0, len(elems))
+	for _, elem := range elems {
+		sc := fieldScanner{s: elem}
+
+		name := sc.token()
+		if name == "" {
+			return nil, malformed("expected a directive in %q", elem)
+		}
+
+		val := ""
+		if sc.consume('=') {
+			val, err = sc.tokenOrQuoted()
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if !sc.done() {
+			return nil, malformed("unexpected %q in %q", elem[sc.i:], elem)
+		}
+
+		cc = append(cc, Param{Name: strings.ToLower(name), Value: val})
+	}
+
+	return cc, nil
+}
+
+// Has reports whether the directive is present
+func (cc CacheControl) Has(name string) bool {
+	_, ok := Params(cc).Get(name)
+	return ok
+}
+
+// Get returns the argument of a directive
+func (cc CacheControl) Get(name string) (string, bool) {
+	return Params(cc).Get(name)
+}
+
+// Seconds returns the delta-seconds argument of a directive like max-age.
+// Values too large for an int32 are capped, as RFC 9111 1.2.2 requires
+func (cc CacheControl) Seconds(name string) (int, bool) {
+	v, ok := cc.Get(name)
+	if !ok || v == "" {
+		return 0, false
+	}
+
+	for i := 0; i < len(v); i++ {
+		if v[i] < '0' || v[i] > '9' {
+			return 0, false
+		}
+	}
+
+	n, err := strconv.ParseInt(v, 10, 32)
+	if err != nil {
+		return 1<<31 - 1, true
+	}
+	return int(n), true
+}
+
+func (cc CacheControl) String() string {
+	elems := make([]string, len(cc))
+	for i, d := range cc {
+		elems[i] = d.Name
+		if d.Value != "" {
+			elems[i] += "=" + quoteIfNeeded(d.Value)
+		}
+	}
+	return FormatList(elems)
+}
+
+// Credentials is a parsed Authorization or Proxy-Authorization value. Either
+// Token68 or Params is set, depending on the scheme
+type Credentials struct {
+	Scheme  string
+	Token68 string
+	Params  Params
+}
+
+func isToken68(s string) bool {
+	end := len(strings.TrimRight(s, "="))
+	if end == 0 {
+		return false
+	}
+	for i := 0; i < end; i++ {
+		c := s[i]
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+			strings.IndexByte("-._~+/", c) != -1) {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseCredentials parses "scheme [ token68 / #auth-param ]" (RFC 9110 11.4)
+func ParseCredentials(v string) (Credentials, error) {
+	sc := fieldScanner{s: v}
+
+	scheme := sc.token()
+	if scheme == "" {
+		return Credentials{}, malformed("expected an auth scheme")
+	}
+
+	creds := Credentials{Scheme: scheme}
+	if sc.done() {
+		return creds, nil
+	}
+
+	if sc.peek() != ' ' {
+		return Credentials{}, malformed("expected a space after %q", scheme)
+	}
+	for sc.consume(' ') {
+	}
+
+	rest := v[sc.i:]
+	if isToken68(rest) {
+		creds.Token68 = rest
+		return creds, nil
+	}
+
+	elems, err := ParseList(rest)
+	if err != nil {
+		return Credentials{}, err
+	}
+
+	for _, elem := range elems {
+		esc := fieldScanner{s: elem}
+
+		name := esc.token()
+		if name == "" {
+			return Credentials{}, malformed("expected an auth-param in %q", elem)
+		}
+
+		esc.skipOWS()
+		if !esc.consume('=') {
+			return Credentials{}, malformed("auth-param %q has no value", name)
+		}
+		esc.skipOWS()
+
+		val, err := esc.tokenOrQuoted()
+		if err != nil {
+			return Credentials{}, err
+		}
+		if !esc.done() {
+			return Credentials{}, malformed("unexpected %q in %q", elem[esc.i:], elem)
+		}
+
+		creds.Params = append(creds.Params, Param{Name: strings.ToLower(name), Value: val})
+	}
+
+	return creds, nil
+}
+
+func (c Credentials) String() string {
+	if c.Token68 != "" {
+		return c.Scheme + " " + c.Token68
+	}
+	if len(c.Params) == 0 {
+		return c.Scheme
+	}
+
+	elems := make([]string, len(c.Params))
+	for i, p := range c.Params {
+		elems[i] = p.Name + "=" + quoteIfNeeded(p.Value)
+	}
+	return c.Scheme + " " + FormatList(elems)
+}
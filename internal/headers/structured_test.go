@@ -0,0 +1,326 @@
+package headers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseList(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []string
+		err   bool
+	}{
+		{"single", "gzip", []string{"gzip"}, false},
+		{"multiple", "gzip, deflate,br", []string{"gzip", "deflate", "br"}, false},
+		{"empty elements", ", a,, b ,", []string{"a", "b"}, false},
+		{"empty", "", nil, false},
+		{"quoted comma", `"a, b", c`, []string{`"a, b"`, "c"}, false},
+		{"escaped quote", `W/"x\"y", "z"`, []string{`W/"x\"y"`, `"z"`}, false},
+		{"unterminated quote", `"a, b`, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseList(tt.input)
+			if tt.err {
+				require.ErrorIs(t, err, ErrMalformedField)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	assert.Equal(t, "a, b", FormatList([]string{"a", "b"}))
+}
+
+func TestHasToken(t *testing.T) {
+	h := NewHeaders()
+	h.Add("Connection", "keep-alive, Upgrade")
+	h.Add("Connection", "HTTP2-Settings")
+	h.Add("Upgrade", `"websocket, h2c`)
+
+	// Test: Any of the fields, ignoring case
+	assert.True(t, HasToken(h, "connection", "upgrade"))
+	assert.True(t, HasToken(h, "Connection", "http2-settings"))
+	assert.False(t, HasToken(h, "Connection", "close"))
+	assert.False(t, HasToken(h, "Keep-Alive", "timeout"))
+
+	// Test: A malformed list has no tokens
+	assert.False(t, HasToken(h, "Upgrade", "h2c"))
+}
+
+func TestParseMediaType(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  string
+		want   MediaType
+		format string
+		err    bool
+	}{
+		{
+			name:   "plain",
+			input:  "text/html",
+			want:   MediaType{Type: "text", Subtype: "html"},
+			format: "text/html",
+		},
+		{
+			name:  "charset",
+			input: "Text/HTML; Charset=UTF-8",
+			want: MediaType{Type: "text", Subtype: "html", Params: Params{
+				{Name: "charset", Value: "UTF-8"},
+			}},
+			format: "text/html; charset=UTF-8",
+		},
+		{
+			name:  "quoted boundary",
+			input: `multipart/form-data;boundary="simple boundary";x=1`,
+			want: MediaType{Type: "multipart", Subtype: "form-data", Params: Params{
+				{Name: "boundary", Value: "simple boundary"},
+				{Name: "x", Value: "1"},
+			}},
+			format: `multipart/form-data; boundary="simple boundary"; x=1`,
+		},
+		{
+			name:  "empty parameter",
+			input: "text/plain;;charset=utf-8",
+			want: MediaType{Type: "text", Subtype: "plain", Params: Params{
+				{Name: "charset", Value: "utf-8"},
+			}},
+			format: "text/plain; charset=utf-8",
+		},
+		{
+			name:   "wildcard",
+			input:  "*/*",
+			want:   MediaType{Type: "*", Subtype: "*"},
+			format: "*/*",
+		},
+		{name: "missing subtype", input: "text/", err: true},
+		{name: "missing slash", input: "text", err: true},
+		{name: "parameter without value", input: "text/plain; charset", err: true},
+		{name: "space in type", input: "text /plain", err: true},
+		{name: "trailing junk", input: "text/plain, text/html", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseMediaType(tt.input)
+			if tt.err {
+				require.ErrorIs(t, err, ErrMalformedField)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+			assert.Equal(t, tt.format, got.String())
+
+			charset, ok := got.Params.Get("CHARSET")
+			wantCharset, wantOk := tt.want.Params.Get("charset")
+			assert.Equal(t, wantOk, ok)
+			assert.Equal(t, wantCharset, charset)
+		})
+	}
+}
+
+func TestParseQualityList(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  string
+		want   []QualityValue
+		format string
+		err    bool
+	}{
+		{
+			name:  "accept",
+			input: "text/html, application/xml;q=0.9, */*;q=0.8",
+			want: []QualityValue{
+				{Value: "text/html", Q: 1},
+				{Value: "application/xml", Q: 0.9},
+				{Value: "*/*", Q: 0.8},
+			},
+			format: "text/html, application/xml; q=0.9, */*; q=0.8",
+		},
+		{
+			name:  "media parameters and extensions",
+			input: "text/plain; format=flowed; q=0.5; ext=1",
+			want: []QualityValue{
+				{Value: "text/plain", Q: 0.5, Params: Params{{Name: "format", Value: "flowed"}}},
+			},
+			format: "text/plain; format=flowed; q=0.5",
+		},
+		{
+			name:  "accept-encoding exclusion",
+			input: "gzip;q=1.0, identity; q=0.5, *;q=0",
+			want: []QualityValue{
+				{Value: "gzip", Q: 1},
+				{Value: "identity", Q: 0.5},
+				{Value: "*", Q: 0},
+			},
+			format: "gzip, identity; q=0.5, *; q=0",
+		},
+		{
+			name:  "accept-language",
+			input: "da, en-gb;q=0.8, en;q=0.7",
+			want: []QualityValue{
+				{Value: "da", Q: 1},
+				{Value: "en-gb", Q: 0.8},
+				{Value: "en", Q: 0.7},
+			},
+			format: "da, en-gb; q=0.8, en; q=0.7",
+		},
+		{
+			name:   "uppercase Q and trailing dot",
+			input:  "br;Q=0.",
+			want:   []QualityValue{{Value: "br", Q: 0}},
+			format: "br; q=0",
+		},
+		{name: "q above one", input: "gzip;q=1.5", err: true},
+		{name: "q with four decimals", input: "gzip;q=0.1234", err: true},
+		{name: "negative q", input: "gzip;q=-1", err: true},
+		{name: "q not a number", input: "gzip;q=high", err: true},
+		{name: "missing value", input: ";q=0.5", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseQualityList(tt.input)
+			if tt.err {
+				require.ErrorIs(t, err, ErrMalformedField)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+			assert.Equal(t, tt.format, FormatQualityList(got))
+		})
+	}
+}
+
+func TestParseCacheControl(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  string
+		want   CacheControl
+		format string
+		err    bool
+	}{
+		{
+			name:  "directives",
+			input: "No-Cache, max-age=60, s-maxage=\"120\"",
+			want: CacheControl{
+				{Name: "no-cache"},
+				{Name: "max-age", Value: "60"},
+				{Name: "s-maxage", Value: "120"},
+			},
+			format: "no-cache, max-age=60, s-maxage=120",
+		},
+		{
+			name:  "quoted field list",
+			input: `private="set-cookie, authorization", no-store`,
+			want: CacheControl{
+				{Name: "private", Value: "set-cookie, authorization"},
+				{Name: "no-store"},
+			},
+			format: `private="set-cookie, authorization", no-store`,
+		},
+		{name: "space before equals", input: "max-age =60", err: true},
+		{name: "missing argument", input: "max-age=", err: true},
+		{name: "empty directive", input: "=60", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseCacheControl(tt.input)
+			if tt.err {
+				require.ErrorIs(t, err, ErrMalformedField)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+			assert.Equal(t, tt.format, got.String())
+		})
+	}
+
+	cc, err := ParseCacheControl("no-cache, max-age=60, s-maxage=99999999999, stale=soon")
+	require.NoError(t, err)
+	assert.True(t, cc.Has("NO-CACHE"))
+	assert.False(t, cc.Has("no-store"))
+
+	secs, ok := cc.Seconds("max-age")
+	assert.True(t, ok)
+	assert.Equal(t, 60, secs)
+
+	secs, ok = cc.Seconds("s-maxage")
+	assert.True(t, ok)
+	assert.Equal(t, 1<<31-1, secs)
+
+	_, ok = cc.Seconds("stale")
+	assert.False(t, ok)
+
+	_, ok = cc.Seconds("no-cache")
+	assert.False(t, ok)
+}
+
+func TestParseCredentials(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  string
+		want   Credentials
+		format string
+		err    bool
+	}{
+		{
+			name:   "basic",
+			input:  "Basic QWxhZGRpbjpvcGVuIHNlc2FtZQ==",
+			want:   Credentials{Scheme: "Basic", Token68: "QWxhZGRpbjpvcGVuIHNlc2FtZQ=="},
+			format: "Basic QWxhZGRpbjpvcGVuIHNlc2FtZQ==",
+		},
+		{
+			name:   "bearer",
+			input:  "Bearer mF_9.B5f-4.1JqM",
+			want:   Credentials{Scheme: "Bearer", Token68: "mF_9.B5f-4.1JqM"},
+			format: "Bearer mF_9.B5f-4.1JqM",
+		},
+		{
+			name:  "auth params",
+			input: `Digest username="Mufasa", realm="http-auth@example.org", nc=00000001, Opaque = "x"`,
+			want: Credentials{Scheme: "Digest", Params: Params{
+				{Name: "username", Value: "Mufasa"},
+				{Name: "realm", Value: "http-auth@example.org"},
+				{Name: "nc", Value: "00000001"},
+				{Name: "opaque", Value: "x"},
+			}},
+			format: `Digest username=Mufasa, realm="http-auth@example.org", nc=00000001, opaque=x`,
+		},
+		{
+			name:   "scheme only",
+			input:  "Negotiate",
+			want:   Credentials{Scheme: "Negotiate"},
+			format: "Negotiate",
+		},
+		{name: "empty", input: "", err: true},
+		{name: "missing space", input: "Basic\tabc", err: true},
+		{name: "param without value", input: "Digest username, realm=x", err: true},
+		{name: "token68 with inner equals", input: "Basic ab=cd=", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseCredentials(tt.input)
+			if tt.err {
+				require.ErrorIs(t, err, ErrMalformedField)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+			assert.Equal(t, tt.format, got.String())
+		})
+	}
+}
+
+func TestQuote(t *testing.T) {
+	assert.Equal(t, `"a \"b\" \\c"`, Quote(`a "b" \c`))
+	assert.Equal(t, `""`, Quote(""))
+}
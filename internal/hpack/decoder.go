@@ -0,0 +1,112 @@
+package hpack
+
+// Decoder decodes header blocks from one peer. Its dynamic table carries
+// over between blocks, so every block on a connection must go through the
+// same Decoder, in order
+type Decoder struct {
+	table dynamicTable
+	// maxTableSize is the most the peer may set the table size to: our
+	// SETTINGS_HEADER_TABLE_SIZE
+	maxTableSize uint32
+	// MaxStringLength bounds each decoded name and value; zero means
+	// unbounded
+	MaxStringLength int
+}
+
+// NewDecoder returns a Decoder whose table may grow to maxTableSize bytes
+func NewDecoder(maxTableSize uint32) *Decoder {
+	return &Decoder{
+		table:        dynamicTable{maxSize: maxTableSize},
+		maxTableSize: maxTableSize,
+	}
+}
+
+// SetMaxTableSize changes the limit the peer's size updates are held to,
+// after we've advertised a new SETTINGS_HEADER_TABLE_SIZE
+func (d *Decoder) SetMaxTableSize(n uint32) {
+	d.maxTableSize = n
+	if d.table.maxSize > n {
+		d.table.setMaxSize(n)
+	}
+}
+
+// Decode decodes a complete header block (RFC 7541 6)
+func (d *Decoder) Decode(block []byte) ([]HeaderField, error) {
+	var fields []HeaderField
+
+	// size updates are only allowed before the first field (RFC 7541 4.2)
+	first := true
+	p := block
+	for len(p) > 0 {
+		b := p[0]
+
+		var f HeaderField
+		var err error
+		switch {
+		case b&0x80 != 0:
+			// indexed header field
+			var i uint64
+			i, p, err = readInt(p, 7)
+			if err == nil {
+				f, err = lookup(&d.table, i)
+			}
+		case b&0xc0 == 0x40:
+			// literal with incremental indexing
+			f, p, err = d.readLiteral(p, 6)
+			if err == nil {
+				d.table.add(f)
+			}
+		case b&0xe0 == 0x20:
+			if !first {
+				return nil, ErrInvalidSizeUpdate
+			}
+			var n uint64
+			n, p, err = readInt(p, 5)
+			if err != nil {
+				return nil, err
+			}
+			if n > uint64(d.maxTableSize) {
+				return nil, ErrInvalidSizeUpdate
+			}
+			d.table.setMaxSize(uint32(n))
+			continue
+		default:
+			// literal without indexing (0000) or never indexed (0001)
+			f, p, err = d.readLiteral(p, 4)
+			f.Sensitive = b&0x10 != 0
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		first = false
+		fields = append(fields, f)
+	}
+
+	return fields, nil
+}
+
+// readLiteral reads a literal field whose name index has an n-bit prefix,
+// the name being a literal string when the index is zero
+func (d *Decoder) readLiteral(p []byte, n uint) (HeaderField, []byte, error) {
+	var f HeaderField
+
+	i, p, err := readInt(p, n)
+	if err != nil {
+		return f, p, err
+	}
+
+	if i == 0 {
+		f.Name, p, err = readString(p, d.MaxStringLength)
+	} else {
+		var named HeaderField
+		named, err = lookup(&d.table, i)
+		f.Name = named.Name
+	}
+	if err != nil {
+		return f, p, err
+	}
+
+	f.Value, p, err = readString(p, d.MaxStringLength)
+	return f, p, err
+}
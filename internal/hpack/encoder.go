@@ -0,0 +1,128 @@
+package hpack
+
+// Encoder encodes header blocks for one peer. Like the peer's Decoder it
+// keeps a dynamic table across blocks, so blocks must be sent in the order
+// they were encoded
+type Encoder struct {
+	table dynamicTable
+	// maxTableSize is the most the peer lets the table grow to, its
+	// SETTINGS_HEADER_TABLE_SIZE
+	maxTableSize uint32
+
+	// sizeUpdate is set when the table size changed since the last block,
+	// which has to be signalled at the start of the next one. minSize is
+	// the smallest it was in between (RFC 7541 4.2)
+	sizeUpdate bool
+	minSize    uint32
+
+	// Huffman codes strings whenever that makes them shorter
+	Huffman bool
+}
+
+// NewEncoder returns an Encoder with a dynamic table of tableSize bytes,
+// which must be no more than the peer allows
+func NewEncoder(tableSize uint32) *Encoder {
+	return &Encoder{
+		table:        dynamicTable{maxSize: tableSize},
+		maxTableSize: tableSize,
+		Huffman:      true,
+	}
+}
+
+// SetMaxTableSize changes the dynamic table's size, after the peer has
+// announced a new SETTINGS_HEADER_TABLE_SIZE or to use less of it
+func (e *Encoder) SetMaxTableSize(n uint32) {
+	if !e.sizeUpdate || n < e.minSize {
+		e.minSize = n
+	}
+	e.sizeUpdate = true
+	e.maxTableSize = n
+	e.table.setMaxSize(n)
+}
+
+// Encode returns the header block for fields
+func (e *Encoder) Encode(fields []HeaderField) []byte {
+	var block []byte
+
+	if e.sizeUpdate {
+		if e.minSize < e.maxTableSize {
+			block = appendInt(block, 0x20, 5, uint64(e.minSize))
+		}
+		block = appendInt(block, 0x20, 5, uint64(e.maxTableSize))
+		e.sizeUpdate = false
+	}
+
+	for _, f := range fields {
+		block = e.appendField(block, f)
+	}
+	return block
+}
+
+// appendField appends f as an index when one of the tables has the exact
+// field, and otherwise as a literal, referring to an existing name where it
+// can. Literals are added to the dynamic table unless they are sensitive or
+// too big to fit (RFC 7541 6.1, 6.2)
+func (e *Encoder) appendField(dst []byte, f HeaderField) []byte {
+	exact, name := e.search(f)
+	if exact > 0 && !f.Sensitive {
+		return appendInt(dst, 0x80, 7, uint64(exact))
+	}
+
+	switch {
+	case f.Sensitive:
+		dst = appendInt(dst, 0x10, 4, uint64(name))
+	case f.Size() > e.table.maxSize:
+		dst = appendInt(dst, 0, 4, uint64(name))
+	default:
+		dst = appendInt(dst, 0x40, 6, uint64(name))
+		e.table.add(HeaderField{Name: f.Name, Value: f.Value})
+	}
+
+	if name == 0 {
+		dst = e.appendString(dst, f.Name)
+	}
+	return e.appendString(dst, f.Value)
+}
+
+// search returns the index of f, and of a field with its name, or zero
+// where there is none. The static table is preferred, then the most recent
+// dynamic entries
+func (e *Encoder) search(f HeaderField) (exact int, name int) {
+	for i, s := range staticTable {
+		if s.Name != f.Name {
+			continue
+		}
+		if name == 0 {
+			name = i + 1
+		}
+		if s.Value == f.Value {
+			return i + 1, name
+		}
+	}
+
+	for i := 1; i <= e.table.len(); i++ {
+		d := e.table.at(i)
+		if d.Name != f.Name {
+			continue
+		}
+		if name == 0 {
+			name = len(staticTable) + i
+		}
+		if d.Value == f.Value {
+			return len(staticTable) + i, name
+		}
+	}
+	return 0, name
+}
+
+// appendString appends s as a string literal, Huffman coded if that is
+// enabled and no longer. Ties go to Huffman coding, as in the RFC's examples
+func (e *Encoder) appendString(dst []byte, s string) []byte {
+	if e.Huffman && s != "" {
+		if n := huffmanEncodedLen(s); n <= len(s) {
+			dst = appendInt(dst, 0x80, 7, uint64(n))
+			return appendHuffman(dst, s)
+		}
+	}
+	return appendString(dst, s)
+}
@@ -0,0 +1,38 @@
+package hpack
+
+import (
+	"strings"
+
+	"github.com/yus-works/tcp-to-http/internal/headers"
+)
+
+// sensitiveFields carry credentials, which are easy to guess at through the
+// compression ratio if they are indexed (RFC 7541 7.1.3)
+var sensitiveFields = map[string]struct{}{
+	"authorization":       {},
+	"proxy-authorization": {},
+}
+
+// FromHeaders converts h to header fields in the same order, lowercasing
+// names as HTTP/2 requires. Credentials are marked Sensitive
+func FromHeaders(h *headers.Headers) []HeaderField {
+	fields := make([]HeaderField, 0, h.Len())
+	for k, v := range h.All() {
+		name := strings.ToLower(k)
+		_, sensitive := sensitiveFields[name]
+		fields = append(fields, HeaderField{Name: name, Value: v, Sensitive: sensitive})
+	}
+	return fields
+}
+
+// ToHeaders converts fields to headers.Headers, leaving out pseudo-header
+// fields, which aren't headers
+func ToHeaders(fields []HeaderField) *headers.Headers {
+	h := headers.NewHeaders()
+	for _, f := range fields {
+		if !strings.HasPrefix(f.Name, ":") {
+			h.Add(f.Name, f.Value)
+		}
+	}
+	return h
+}
@@ -0,0 +1,245 @@
+// Package hpack implements HPACK, the header compression format of HTTP/2
+// (RFC 7541)
+package hpack
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrIntegerOverflow   = errors.New("HPACK integer overflows")
+	ErrTruncated         = errors.New("HPACK data truncated")
+	ErrInvalidIndex      = errors.New("HPACK index out of range")
+	ErrInvalidHuffman    = errors.New("Invalid HPACK Huffman data")
+	ErrInvalidSizeUpdate = errors.New("Invalid HPACK dynamic table size update")
+	ErrStringTooLong     = errors.New("HPACK string too long")
+)
+
+// HeaderField is a name-value pair. Sensitive fields are never added to a
+// dynamic table, by this end or by any intermediary (RFC 7541 7.1.3)
+type HeaderField struct {
+	Name      string
+	Value     string
+	Sensitive bool
+}
+
+// Size is the field's size for dynamic table accounting (RFC 7541 4.1)
+func (f HeaderField) Size() uint32 {
+	return uint32(len(f.Name) + len(f.Value) + 32)
+}
+
+func (f HeaderField) String() string {
+	return fmt.Sprintf("%s: %s", f.Name, f.Value)
+}
+
+// staticTable is RFC 7541 Appendix A. Index 1 is staticTable[0]
+var staticTable = [...]HeaderField{
+	{Name: ":authority"},
+	{Name: ":method", Value: "GET"},
+	{Name: ":method", Value: "POST"},
+	{Name: ":path", Value: "/"},
+	{Name: ":path", Value: "/index.html"},
+	{Name: ":scheme", Value: "http"},
+	{Name: ":scheme", Value: "https"},
+	{Name: ":status", Value: "200"},
+	{Name: ":status", Value: "204"},
+	{Name: ":status", Value: "206"},
+	{Name: ":status", Value: "304"},
+	{Name: ":status", Value: "400"},
+	{Name: ":status", Value: "404"},
+	{Name: ":status", Value: "500"},
+	{Name: "accept-charset"},
+	{Name: "accept-encoding", Value: "gzip, deflate"},
+	{Name: "accept-language"},
+	{Name: "accept-ranges"},
+	{Name: "accept"},
+	{Name: "access-control-allow-origin"},
+	{Name: "age"},
+	{Name: "allow"},
+	{Name: "authorization"},
+	{Name: "cache-control"},
+	{Name: "content-disposition"},
+	{Name: "content-encoding"},
+	{Name: "content-language"},
+	{Name: "content-length"},
+	{Name: "content-location"},
+	{Name: "content-range"},
+	{Name: "content-type"},
+	{Name: "cookie"},
+	{Name: "date"},
+	{Name: "etag"},
+	{Name: "expect"},
+	{Name: "expires"},
+	{Name: "from"},
+	{Name: "host"},
+	{Name: "if-match"},
+	{Name: "if-modified-since"},
+	{Name: "if-none-match"},
+	{Name: "if-range"},
+	{Name: "if-unmodified-since"},
+	{Name: "last-modified"},
+	{Name: "link"},
+	{Name: "location"},
+	{Name: "max-forwards"},
+	{Name: "proxy-authenticate"},
+	{Name: "proxy-authorization"},
+	{Name: "range"},
+	{Name: "referer"},
+	{Name: "refresh"},
+	{Name: "retry-after"},
+	{Name: "server"},
+	{Name: "set-cookie"},
+	{Name: "strict-transport-security"},
+	{Name: "transfer-encoding"},
+	{Name: "user-agent"},
+	{Name: "vary"},
+	{Name: "via"},
+	{Name: "www-authenticate"},
+}
+
+// dynamicTable holds recently sent fields, newest first (RFC 7541 2.3.2)
+type dynamicTable struct {
+	// oldest first, so insertions append
+	entries []HeaderField
+	size    uint32
+	maxSize uint32
+}
+
+func (t *dynamicTable) add(f HeaderField) {
+	t.entries = append(t.entries, f)
+	t.size += f.Size()
+	t.evict()
+}
+
+func (t *dynamicTable) setMaxSize(n uint32) {
+	t.maxSize = n
+	t.evict()
+}
+
+// evict drops the oldest entries until the table fits. A field bigger than
+// the whole table empties it (RFC 7541 4.4)
+func (t *dynamicTable) evict() {
+	n := 0
+	for t.size > t.maxSize && n < len(t.entries) {
+		t.size -= t.entries[n].Size()
+		n++
+	}
+	if n > 0 {
+		t.entries = append(t.entries[:0], t.entries[n:]...)
+	}
+}
+
+func (t *dynamicTable) len() int {
+	return len(t.entries)
+}
+
+// at returns the entry at a 1-based dynamic index, 1 being the newest
+func (t *dynamicTable) at(i int) HeaderField {
+	return t.entries[len(t.entries)-i]
+}
+
+// lookup returns the field at an index into the combined static and
+// dynamic address space (RFC 7541 2.3.3)
+func lookup(t *dynamicTable, i uint64) (HeaderField, error) {
+	if i == 0 {
+		return HeaderField{}, ErrInvalidIndex
+	}
+	if i <= uint64(len(staticTable)) {
+		return staticTable[i-1], nil
+	}
+
+	i -= uint64(len(staticTable))
+	if i > uint64(t.len()) {
+		return HeaderField{}, ErrInvalidIndex
+	}
+	return t.at(int(i)), nil
+}
+
+// appendInt encodes i with an n-bit prefix, ORing first into the first
+// byte for the representation's pattern bits (RFC 7541 5.1)
+func appendInt(dst []byte, first byte, n uint, i uint64) []byte {
+	max := uint64(1)<<n - 1
+	if i < max {
+		return append(dst, first|byte(i))
+	}
+
+	dst = append(dst, first|byte(max))
+	i -= max
+	for i >= 128 {
+		dst = append(dst, byte(i&0x7f)|0x80)
+		i >>= 7
+	}
+	return append(dst, byte(i))
+}
+
+// readInt decodes an integer with an n-bit prefix, returning it and the
+// rest of p
+func readInt(p []byte, n uint) (uint64, []byte, error) {
+	if len(p) == 0 {
+		return 0, p, ErrTruncated
+	}
+
+	max := uint64(1)<<n - 1
+	i := uint64(p[0]) & max
+	p = p[1:]
+	if i < max {
+		return i, p, nil
+	}
+
+	var shift uint
+	for {
+		if len(p) == 0 {
+			return 0, p, ErrTruncated
+		}
+		b := p[0]
+		p = p[1:]
+
+		// anything past 63 bits is more than any field could need
+		if shift > 56 {
+			return 0, p, ErrIntegerOverflow
+		}
+		i += uint64(b&0x7f) << shift
+		shift += 7
+
+		if b&0x80 == 0 {
+			return i, p, nil
+		}
+	}
+}
+
+// readString decodes a string literal, Huffman coded or not (RFC 7541
+// 5.2), refusing ones longer than max
+func readString(p []byte, max int) (string, []byte, error) {
+	if len(p) == 0 {
+		return "", p, ErrTruncated
+	}
+	huffman := p[0]&0x80 != 0
+
+	n, p, err := readInt(p, 7)
+	if err != nil {
+		return "", p, err
+	}
+	if n > uint64(len(p)) {
+		return "", p, ErrTruncated
+	}
+
+	data := p[:n]
+	p = p[n:]
+
+	if !huffman {
+		if max > 0 && len(data) > max {
+			return "", p, ErrStringTooLong
+		}
+		return string(data), p, nil
+	}
+
+	s, err := huffmanDecode(data, max)
+	return s, p, err
+}
+
+// appendString encodes s as a string literal without Huffman coding
+func appendString(dst []byte, s string) []byte {
+	dst = appendInt(dst, 0, 7, uint64(len(s)))
+	return append(dst, s...)
+}
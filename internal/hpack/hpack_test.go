@@ -0,0 +1,331 @@
+package hpack
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yus-works/tcp-to-http/internal/headers"
+)
+
+// unhex decodes the hex dumps used in RFC 7541 Appendix C, spaces allowed
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	require.NoError(t, err)
+	return b
+}
+
+func TestInteger(t *testing.T) {
+	// RFC 7541 C.1
+	cases := []struct {
+		n       uint
+		value   uint64
+		encoded []byte
+	}{
+		{5, 10, []byte{0x0a}},
+		{5, 1337, []byte{0x1f, 0x9a, 0x0a}},
+		{8, 42, []byte{0x2a}},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.encoded, appendInt(nil, 0, c.n, c.value))
+
+		v, rest, err := readInt(c.encoded, c.n)
+		require.NoError(t, err)
+		assert.Equal(t, c.value, v)
+		assert.Empty(t, rest)
+	}
+
+	// Test: Truncated and overflowing integers
+	_, _, err := readInt([]byte{0x1f, 0x9a}, 5)
+	assert.ErrorIs(t, err, ErrTruncated)
+	_, _, err = readInt(unhex(t, "ff ffffffffffffffffffff 01"), 8)
+	assert.ErrorIs(t, err, ErrIntegerOverflow)
+}
+
+// exchange is a sequence of header blocks on one connection, from RFC 7541
+// Appendix C, with the fields each one carries and the dynamic table size
+// after it
+type exchange struct {
+	name      string
+	tableSize uint32
+	huffman   bool
+	blocks    []string
+	fields    [][]HeaderField
+	sizes     []uint32
+}
+
+var (
+	requests = [][]HeaderField{
+		{
+			{Name: ":method", Value: "GET"},
+			{Name: ":scheme", Value: "http"},
+			{Name: ":path", Value: "/"},
+			{Name: ":authority", Value: "www.example.com"},
+		},
+		{
+			{Name: ":method", Value: "GET"},
+			{Name: ":scheme", Value: "http"},
+			{Name: ":path", Value: "/"},
+			{Name: ":authority", Value: "www.example.com"},
+			{Name: "cache-control", Value: "no-cache"},
+		},
+		{
+			{Name: ":method", Value: "GET"},
+			{Name: ":scheme", Value: "https"},
+			{Name: ":path", Value: "/index.html"},
+			{Name: ":authority", Value: "www.example.com"},
+			{Name: "custom-key", Value: "custom-value"},
+		},
+	}
+
+	responses = [][]HeaderField{
+		{
+			{Name: ":status", Value: "302"},
+			{Name: "cache-control", Value: "private"},
+			{Name: "date", Value: "Mon, 21 Oct 2013 20:13:21 GMT"},
+			{Name: "location", Value: "https://www.example.com"},
+		},
+		{
+			{Name: ":status", Value: "307"},
+			{Name: "cache-control", Value: "private"},
+			{Name: "date", Value: "Mon, 21 Oct 2013 20:13:21 GMT"},
+			{Name: "location", Value: "https://www.example.com"},
+		},
+		{
+			{Name: ":status", Value: "200"},
+			{Name: "cache-control", Value: "private"},
+			{Name: "date", Value: "Mon, 21 Oct 2013 20:13:22 GMT"},
+			{Name: "location", Value: "https://www.example.com"},
+			{Name: "content-encoding", Value: "gzip"},
+			{Name: "set-cookie", Value: "foo=ASDJKHQKBZXOQWEOPIUAXQWEOIU; max-age=3600; version=1"},
+		},
+	}
+
+	exchanges = []exchange{
+		{
+			name:      "C.3 requests",
+			tableSize: 4096,
+			blocks: []string{
+				"8286 8441 0f77 7777 2e65 7861 6d70 6c65 2e63 6f6d",
+				"8286 84be 5808 6e6f 2d63 6163 6865",
+				"8287 85bf 400a 6375 7374 6f6d 2d6b 6579 0c63 7573 746f 6d2d 7661 6c75 65",
+			},
+			fields: requests,
+			sizes:  []uint32{57, 110, 164},
+		},
+		{
+			name:      "C.4 requests with Huffman coding",
+			tableSize: 4096,
+			huffman:   true,
+			blocks: []string{
+				"8286 8441 8cf1 e3c2 e5f2 3a6b a0ab 90f4 ff",
+				"8286 84be 5886 a8eb 1064 9cbf",
+				"8287 85bf 4088 25a8 49e9 5ba9 7d7f 8925 a849 e95b b8e8 b4bf",
+			},
+			fields: requests,
+			sizes:  []uint32{57, 110, 164},
+		},
+		{
+			name:      "C.5 responses",
+			tableSize: 256,
+			blocks: []string{
+				"4803 3330 3258 0770 7269 7661 7465 611d 4d6f 6e2c 2032 3120 4f63 7420 3230 3133 " +
+					"2032 303a 3133 3a32 3120 474d 546e 1768 7474 7073 3a2f 2f77 7777 2e65 7861 6d70 " +
+					"6c65 2e63 6f6d",
+				"4803 3330 37c1 c0bf",
+				"88c1 611d 4d6f 6e2c 2032 3120 4f63 7420 3230 3133 2032 303a 3133 3a32 3220 474d " +
+					"54c0 5a04 677a 6970 7738 666f 6f3d 4153 444a 4b48 514b 425a 584f 5157 454f 5049 " +
+					"5541 5851 5745 4f49 553b 206d 6178 2d61 6765 3d33 3630 303b 2076 6572 7369 6f6e " +
+					"3d31",
+			},
+			fields: responses,
+			sizes:  []uint32{222, 222, 215},
+		},
+		{
+			name:      "C.6 responses with Huffman coding",
+			tableSize: 256,
+			huffman:   true,
+			blocks: []string{
+				"4882 6402 5885 aec3 771a 4b61 96d0 7abe 9410 54d4 44a8 2005 9504 0b81 66e0 82a6 " +
+					"2d1b ff6e 919d 29ad 1718 63c7 8f0b 97c8 e9ae 82ae 43d3",
+				"4883 640e ffc1 c0bf",
+				"88c1 6196 d07a be94 1054 d444 a820 0595 040b 8166 e084 a62d 1bff c05a 839b d9ab " +
+					"77ad 94e7 821d d7f2 e6c7 b335 dfdf cd5b 3960 d5af 2708 7f36 72c1 ab27 0fb5 291f " +
+					"9587 3160 65c0 03ed 4ee5 b106 3d50 07",
+			},
+			fields: responses,
+			sizes:  []uint32{222, 222, 215},
+		},
+	}
+)
+
+func TestAppendixC(t *testing.T) {
+	for _, ex := range exchanges {
+		t.Run(ex.name, func(t *testing.T) {
+			d := NewDecoder(ex.tableSize)
+			e := NewEncoder(ex.tableSize)
+			e.Huffman = ex.huffman
+
+			for i, block := range ex.blocks {
+				want := unhex(t, block)
+
+				fields, err := d.Decode(want)
+				require.NoError(t, err)
+				assert.Equal(t, ex.fields[i], fields)
+				assert.Equal(t, ex.sizes[i], d.table.size)
+
+				assert.Equal(t, want, e.Encode(ex.fields[i]))
+				assert.Equal(t, ex.sizes[i], e.table.size)
+			}
+		})
+	}
+}
+
+func TestLiteralRepresentations(t *testing.T) {
+	// RFC 7541 C.2, one fresh decoder each
+	cases := []struct {
+		block string
+		field HeaderField
+		size  uint32
+	}{
+		{
+			"400a 6375 7374 6f6d 2d6b 6579 0d63 7573 746f 6d2d 6865 6164 6572",
+			HeaderField{Name: "custom-key", Value: "custom-header"},
+			55,
+		},
+		{
+			"040c 2f73 616d 706c 652f 7061 7468",
+			HeaderField{Name: ":path", Value: "/sample/path"},
+			0,
+		},
+		{
+			"1008 7061 7373 776f 7264 0673 6563 7265 74",
+			HeaderField{Name: "password", Value: "secret", Sensitive: true},
+			0,
+		},
+		{
+			"82",
+			HeaderField{Name: ":method", Value: "GET"},
+			0,
+		},
+	}
+
+	for _, c := range cases {
+		d := NewDecoder(4096)
+		fields, err := d.Decode(unhex(t, c.block))
+		require.NoError(t, err)
+		assert.Equal(t, []HeaderField{c.field}, fields)
+		assert.Equal(t, c.size, d.table.size)
+	}
+
+	// Test: The encoder produces C.2.1, C.2.3 and C.2.4 too
+	e := NewEncoder(4096)
+	e.Huffman = false
+	for _, i := range []int{0, 2, 3} {
+		assert.Equal(t, unhex(t, cases[i].block), e.Encode([]HeaderField{cases[i].field}))
+	}
+}
+
+func TestHuffman(t *testing.T) {
+	for _, s := range []string{"", "a", "www.example.com", "\x00\xff binary \r\n", strings.Repeat("z", 300)} {
+		encoded := appendHuffman(nil, s)
+		assert.Len(t, encoded, huffmanEncodedLen(s))
+
+		decoded, err := huffmanDecode(encoded, 0)
+		require.NoError(t, err)
+		assert.Equal(t, s, decoded)
+	}
+
+	// Test: Decoded length is limited
+	_, err := huffmanDecode(appendHuffman(nil, "toolong"), 3)
+	assert.ErrorIs(t, err, ErrStringTooLong)
+}
+
+func TestTableSizeUpdates(t *testing.T) {
+	e := NewEncoder(4096)
+	d := NewDecoder(4096)
+	field := []HeaderField{{Name: "custom-key", Value: "custom-value"}}
+
+	_, err := d.Decode(e.Encode(field))
+	require.NoError(t, err)
+	require.Equal(t, 1, d.table.len())
+
+	// Test: Shrinking then growing again signals both sizes, evicting
+	// everything on the way
+	e.SetMaxTableSize(0)
+	e.SetMaxTableSize(1024)
+	block := e.Encode(nil)
+	assert.Equal(t, append([]byte{0x20}, appendInt(nil, 0x20, 5, 1024)...), block)
+
+	_, err = d.Decode(block)
+	require.NoError(t, err)
+	assert.Zero(t, d.table.len())
+	assert.Equal(t, uint32(1024), d.table.maxSize)
+
+	// Test: Fields bigger than the table aren't indexed
+	e.SetMaxTableSize(40)
+	big := []HeaderField{{Name: "custom-key", Value: "a value that will not fit"}}
+	fields, err := d.Decode(e.Encode(big))
+	require.NoError(t, err)
+	assert.Equal(t, big, fields)
+	assert.Zero(t, d.table.len())
+	assert.Zero(t, e.table.len())
+}
+
+func TestHeadersConversion(t *testing.T) {
+	h := headers.NewHeaders()
+	h.Add("Content-Type", "text/plain")
+	h.Add("Authorization", "Bearer token")
+	h.Add("X-Multi", "1")
+	h.Add("X-Multi", "2")
+
+	fields := FromHeaders(h)
+	assert.Equal(t, []HeaderField{
+		{Name: "content-type", Value: "text/plain"},
+		{Name: "authorization", Value: "Bearer token", Sensitive: true},
+		{Name: "x-multi", Value: "1"},
+		{Name: "x-multi", Value: "2"},
+	}, fields)
+
+	// Test: Sensitive fields stay out of the table on the way through
+	e := NewEncoder(4096)
+	d := NewDecoder(4096)
+	decoded, err := d.Decode(e.Encode(append([]HeaderField{{Name: ":status", Value: "200"}}, fields...)))
+	require.NoError(t, err)
+	assert.Equal(t, 3, d.table.len())
+
+	back := ToHeaders(decoded)
+	assert.Equal(t, 4, back.Len())
+	assert.Equal(t, "text/plain", back.Get("Content-Type"))
+	assert.Equal(t, []string{"1", "2"}, back.Values("x-multi"))
+	assert.False(t, back.Has(":status"))
+}
+
+func TestDecodeErrors(t *testing.T) {
+	d := NewDecoder(4096)
+
+	// Test: Index past the end of both tables
+	_, err := d.Decode([]byte{0xbe})
+	assert.ErrorIs(t, err, ErrInvalidIndex)
+
+	// Test: Size update above the limit, and one after a field
+	_, err = d.Decode(appendInt(nil, 0x20, 5, 8192))
+	assert.ErrorIs(t, err, ErrInvalidSizeUpdate)
+	_, err = d.Decode([]byte{0x82, 0x20})
+	assert.ErrorIs(t, err, ErrInvalidSizeUpdate)
+
+	// Test: Huffman padding that isn't all ones, and EOS in the data
+	_, err = d.Decode(unhex(t, "0081 00 00"))
+	assert.ErrorIs(t, err, ErrInvalidHuffman)
+	_, err = d.Decode(unhex(t, "0084 ffffffff 00"))
+	assert.ErrorIs(t, err, ErrInvalidHuffman)
+
+	// Test: String cut short
+	_, err = d.Decode(unhex(t, "000a 6162"))
+	assert.ErrorIs(t, err, ErrTruncated)
+}
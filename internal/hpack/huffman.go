@@ -0,0 +1,114 @@
+package hpack
+
+import "sync"
+
+// huffmanNode is a node of the decoding tree. Leaves have no children
+type huffmanNode struct {
+	children *[2]*huffmanNode
+	sym      uint16
+}
+
+var (
+	huffmanRoot     *huffmanNode
+	huffmanRootOnce sync.Once
+)
+
+// buildHuffmanTree turns the code table into a binary tree walked one bit at
+// a time while decoding
+func buildHuffmanTree() {
+	huffmanRoot = &huffmanNode{children: new([2]*huffmanNode)}
+
+	for sym, c := range huffmanCodes {
+		n := huffmanRoot
+		for i := int(c.bits) - 1; i >= 0; i-- {
+			bit := (c.code >> i) & 1
+			if n.children[bit] == nil {
+				child := &huffmanNode{}
+				if i > 0 {
+					child.children = new([2]*huffmanNode)
+				} else {
+					child.sym = uint16(sym)
+				}
+				n.children[bit] = child
+			}
+			n = n.children[bit]
+		}
+	}
+}
+
+// huffmanDecode decodes a Huffman coded string (RFC 7541 5.2). Padding must
+// be fewer than 8 bits, all ones, and EOS may not appear in the data
+func huffmanDecode(data []byte, max int) (string, error) {
+	huffmanRootOnce.Do(buildHuffmanTree)
+
+	out := make([]byte, 0, len(data)*8/5)
+	n := huffmanRoot
+	// bits walked since the last symbol, and whether all were ones
+	depth := 0
+	allOnes := true
+
+	for _, b := range data {
+		for i := 7; i >= 0; i-- {
+			bit := (b >> i) & 1
+			n = n.children[bit]
+			if n == nil {
+				return "", ErrInvalidHuffman
+			}
+			depth++
+			allOnes = allOnes && bit == 1
+
+			if n.children != nil {
+				continue
+			}
+			if n.sym == 256 {
+				return "", ErrInvalidHuffman
+			}
+
+			out = append(out, byte(n.sym))
+			if max > 0 && len(out) > max {
+				return "", ErrStringTooLong
+			}
+			n = huffmanRoot
+			depth = 0
+			allOnes = true
+		}
+	}
+
+	if depth > 7 || !allOnes {
+		return "", ErrInvalidHuffman
+	}
+	return string(out), nil
+}
+
+// huffmanEncodedLen returns how long s is once Huffman coded
+func huffmanEncodedLen(s string) int {
+	bits := 0
+	for i := 0; i < len(s); i++ {
+		bits += int(huffmanCodes[s[i]].bits)
+	}
+	return (bits + 7) / 8
+}
+
+// appendHuffman appends s Huffman coded, padded out to a byte with the most
+// significant bits of EOS, which are all ones (RFC 7541 5.2)
+func appendHuffman(dst []byte, s string) []byte {
+	var acc uint64
+	var bits uint
+
+	for i := 0; i < len(s); i++ {
+		c := huffmanCodes[s[i]]
+		acc = acc<<c.bits | uint64(c.code)
+		bits += uint(c.bits)
+
+		for bits >= 8 {
+			bits -= 8
+			dst = append(dst, byte(acc>>bits))
+		}
+	}
+
+	if bits > 0 {
+		pad := 8 - bits
+		dst = append(dst, byte(acc<<pad)|byte(1<<pad-1))
+	}
+	return dst
+}
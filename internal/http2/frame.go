@@ -0,0 +1,248 @@
+package http2
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// FrameType identifies what a frame carries (RFC 9113 6)
+type FrameType uint8
+
+const (
+	FrameData         FrameType = 0x0
+	FrameHeaders      FrameType = 0x1
+	FramePriority     FrameType = 0x2
+	FrameRSTStream    FrameType = 0x3
+	FrameSettings     FrameType = 0x4
+	FramePushPromise  FrameType = 0x5
+	FramePing         FrameType = 0x6
+	FrameGoAway       FrameType = 0x7
+	FrameWindowUpdate FrameType = 0x8
+	FrameContinuation FrameType = 0x9
+)
+
+// Flags are a frame's type-specific flags
+type Flags uint8
+
+const (
+	FlagEndStream  Flags = 0x1
+	FlagAck        Flags = 0x1
+	FlagEndHeaders Flags = 0x4
+	FlagPadded     Flags = 0x8
+	FlagPriority   Flags = 0x20
+)
+
+func (f Flags) Has(flag Flags) bool {
+	return f&flag != 0
+}
+
+// ErrCode is the reason carried by RST_STREAM and GOAWAY (RFC 9113 7)
+type ErrCode uint32
+
+const (
+	ErrCodeNo                 ErrCode = 0x0
+	ErrCodeProtocol           ErrCode = 0x1
+	ErrCodeInternal           ErrCode = 0x2
+	ErrCodeFlowControl        ErrCode = 0x3
+	ErrCodeSettingsTimeout    ErrCode = 0x4
+	ErrCodeStreamClosed       ErrCode = 0x5
+	ErrCodeFrameSize          ErrCode = 0x6
+	ErrCodeRefusedStream      ErrCode = 0x7
+	ErrCodeCancel             ErrCode = 0x8
+	ErrCodeCompression        ErrCode = 0x9
+	ErrCodeConnect            ErrCode = 0xa
+	ErrCodeEnhanceYourCalm    ErrCode = 0xb
+	ErrCodeInadequateSecurity ErrCode = 0xc
+	ErrCodeHTTP11Required     ErrCode = 0xd
+)
+
+var errCodeNames = map[ErrCode]string{
+	ErrCodeNo:                 "NO_ERROR",
+	ErrCodeProtocol:           "PROTOCOL_ERROR",
+	ErrCodeInternal:           "INTERNAL_ERROR",
+	ErrCodeFlowControl:        "FLOW_CONTROL_ERROR",
+	ErrCodeSettingsTimeout:    "SETTINGS_TIMEOUT",
+	ErrCodeStreamClosed:       "STREAM_CLOSED",
+	ErrCodeFrameSize:          "FRAME_SIZE_ERROR",
+	ErrCodeRefusedStream:      "REFUSED_STREAM",
+	ErrCodeCancel:             "CANCEL",
+	ErrCodeCompression:        "COMPRESSION_ERROR",
+	ErrCodeConnect:            "CONNECT_ERROR",
+	ErrCodeEnhanceYourCalm:    "ENHANCE_YOUR_CALM",
+	ErrCodeInadequateSecurity: "INADEQUATE_SECURITY",
+	ErrCodeHTTP11Required:     "HTTP_1_1_REQUIRED",
+}
+
+func (c ErrCode) String() string {
+	if name, ok := errCodeNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown error code 0x%x", uint32(c))
+}
+
+// SettingID identifies a SETTINGS parameter (RFC 9113 6.5.2)
+type SettingID uint16
+
+const (
+	SettingHeaderTableSize      SettingID = 0x1
+	SettingEnablePush           SettingID = 0x2
+	SettingMaxConcurrentStreams SettingID = 0x3
+	SettingInitialWindowSize    SettingID = 0x4
+	SettingMaxFrameSize         SettingID = 0x5
+	SettingMaxHeaderListSize    SettingID = 0x6
+)
+
+// Setting is one SETTINGS parameter
+type Setting struct {
+	ID  SettingID
+	Val uint32
+}
+
+const (
+	frameHeaderLen = 9
+
+	// defaultMaxFrameSize and maxMaxFrameSize bound SETTINGS_MAX_FRAME_SIZE
+	defaultMaxFrameSize = 1 << 14
+	maxMaxFrameSize     = 1<<24 - 1
+
+	defaultWindowSize = 65535
+	maxWindowSize     = 1<<31 - 1
+
+	defaultHeaderTableSize = 4096
+)
+
+// ClientPreface starts every HTTP/2 connection (RFC 9113 3.4)
+const ClientPreface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+var ErrFrameTooLarge = errors.New("HTTP/2 frame exceeds the maximum frame size")
+
+// Frame is one frame, its payload still undecoded
+type Frame struct {
+	Type     FrameType
+	Flags    Flags
+	StreamID uint32
+	Payload  []byte
+}
+
+// ReadFrame reads one frame, refusing payloads over maxSize
+func ReadFrame(r io.Reader, maxSize uint32) (Frame, error) {
+	var head [frameHeaderLen]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return Frame{}, err
+	}
+
+	length := uint32(head[0])<<16 | uint32(head[1])<<8 | uint32(head[2])
+	if length > maxSize {
+		return Frame{}, ErrFrameTooLarge
+	}
+
+	f := Frame{
+		Type:  FrameType(head[3]),
+		Flags: Flags(head[4]),
+		// the high bit is reserved and ignored on receipt
+		StreamID: binary.BigEndian.Uint32(head[5:]) & (1<<31 - 1),
+		Payload:  make([]byte, length),
+	}
+
+	if _, err := io.ReadFull(r, f.Payload); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return Frame{}, err
+	}
+	return f, nil
+}
+
+// AppendFrame appends a frame with the given header and payload to dst
+func AppendFrame(dst []byte, typ FrameType, flags Flags, streamID uint32, payload []byte) []byte {
+	n := len(payload)
+	dst = append(dst, byte(n>>16), byte(n>>8), byte(n), byte(typ), byte(flags))
+	dst = binary.BigEndian.AppendUint32(dst, streamID&(1<<31-1))
+	return append(dst, payload...)
+}
+
+// appendSettings encodes settings as a SETTINGS payload
+func appendSettings(dst []byte, settings []Setting) []byte {
+	for _, s := range settings {
+		dst = binary.BigEndian.AppendUint16(dst, uint16(s.ID))
+		dst = binary.BigEndian.AppendUint32(dst, s.Val)
+	}
+	return dst
+}
+
+// parseSettings decodes a SETTINGS payload
+func parseSettings(p []byte) ([]Setting, error) {
+	if len(p)%6 != 0 {
+		return nil, connError{ErrCodeFrameSize, "SETTINGS payload not a multiple of 6"}
+	}
+
+	settings := make([]Setting, 0, len(p)/6)
+	for ; len(p) > 0; p = p[6:] {
+		settings = append(settings, Setting{
+			ID:  SettingID(binary.BigEndian.Uint16(p)),
+			Val: binary.BigEndian.Uint32(p[2:]),
+		})
+	}
+	return settings, nil
+}
+
+// validSetting checks a setting's value, unknown settings being ignored
+// (RFC 9113 6.5.2)
+func validSetting(s Setting) error {
+	switch s.ID {
+	case SettingEnablePush:
+		if s.Val > 1 {
+			return connError{ErrCodeProtocol, "invalid SETTINGS_ENABLE_PUSH"}
+		}
+	case SettingInitialWindowSize:
+		if s.Val > maxWindowSize {
+			return connError{ErrCodeFlowControl, "invalid SETTINGS_INITIAL_WINDOW_SIZE"}
+		}
+	case SettingMaxFrameSize:
+		if s.Val < defaultMaxFrameSize || s.Val > maxMaxFrameSize {
+			return connError{ErrCodeProtocol, "invalid SETTINGS_MAX_FRAME_SIZE"}
+		}
+	}
+	return nil
+}
+
+// stripPadding removes the padding of a PADDED frame
+func stripPadding(f Frame) ([]byte, error) {
+	p := f.Payload
+	if !f.Flags.Has(FlagPadded) {
+		return p, nil
+	}
+
+	if len(p) == 0 {
+		return nil, connError{ErrCodeFrameSize, "padded frame without a pad length"}
+	}
+	pad := int(p[0])
+	p = p[1:]
+	if pad > len(p) {
+		return nil, connError{ErrCodeProtocol, "padding longer than the payload"}
+	}
+	return p[:len(p)-pad], nil
+}
+
+// connError fails the whole connection with a GOAWAY (RFC 9113 5.4.1)
+type connError struct {
+	Code   ErrCode
+	Reason string
+}
+
+func (e connError) Error() string {
+	return fmt.Sprintf("HTTP/2 connection error %s: %s", e.Code, e.Reason)
+}
+
+// streamError resets one stream with RST_STREAM (RFC 9113 5.4.2)
+type streamError struct {
+	StreamID uint32
+	Code     ErrCode
+	Reason   string
+}
+
+func (e streamError) Error() string {
+	return fmt.Sprintf("HTTP/2 stream %d error %s: %s", e.StreamID, e.Code, e.Reason)
+}
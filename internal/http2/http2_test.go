@@ -0,0 +1,382 @@
+package http2
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yus-works/tcp-to-http/internal/hpack"
+	"github.com/yus-works/tcp-to-http/internal/request"
+	"github.com/yus-works/tcp-to-http/internal/response"
+)
+
+// testClient speaks just enough HTTP/2 to drive the server
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	enc  *hpack.Encoder
+	dec  *hpack.Decoder
+}
+
+type testResponse struct {
+	fields []hpack.HeaderField
+	body   string
+}
+
+func (r testResponse) get(name string) string {
+	for _, f := range r.fields {
+		if f.Name == name {
+			return f.Value
+		}
+	}
+	return ""
+}
+
+// dial starts srv on a loopback connection and performs the preface
+// exchange, sending settings as the client's SETTINGS
+func dial(t *testing.T, srv *Server, settings ...Setting) *testClient {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			srv.ServeConn(conn, nil, nil)
+		}
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	c := &testClient{t: t, conn: conn, enc: hpack.NewEncoder(4096), dec: hpack.NewDecoder(4096)}
+	c.write(append([]byte(ClientPreface), AppendFrame(nil, FrameSettings, 0, 0, appendSettings(nil, settings))...))
+
+	f := c.read()
+	require.Equal(t, FrameSettings, f.Type)
+	require.False(t, f.Flags.Has(FlagAck))
+	c.writeFrame(FrameSettings, FlagAck, 0, nil)
+
+	f = c.read()
+	require.Equal(t, FrameSettings, f.Type)
+	require.True(t, f.Flags.Has(FlagAck))
+	return c
+}
+
+func (c *testClient) write(p []byte) {
+	_, err := c.conn.Write(p)
+	require.NoError(c.t, err)
+}
+
+func (c *testClient) writeFrame(typ FrameType, flags Flags, streamID uint32, payload []byte) {
+	c.write(AppendFrame(nil, typ, flags, streamID, payload))
+}
+
+// read returns the next frame, skipping WINDOW_UPDATEs
+func (c *testClient) read() Frame {
+	for {
+		f, err := ReadFrame(c.conn, maxMaxFrameSize)
+		require.NoError(c.t, err)
+		if f.Type != FrameWindowUpdate {
+			return f
+		}
+	}
+}
+
+// request opens a stream with a GET-like request, adding fields after the
+// pseudo-headers
+func (c *testClient) request(streamID uint32, method, path string, endStream bool, fields ...hpack.HeaderField) {
+	all := []hpack.HeaderField{
+		{Name: ":method", Value: method},
+		{Name: ":scheme", Value: "http"},
+		{Name: ":path", Value: path},
+		{Name: ":authority", Value: "localhost"},
+	}
+	flags := FlagEndHeaders
+	if endStream {
+		flags |= FlagEndStream
+	}
+	c.writeFrame(FrameHeaders, flags, streamID, c.enc.Encode(append(all, fields...)))
+}
+
+// response reads frames until streamID ends, failing on frames for other
+// streams
+func (c *testClient) response(streamID uint32) testResponse {
+	var resp testResponse
+	var body strings.Builder
+	for {
+		f := c.read()
+		require.Equal(c.t, streamID, f.StreamID, "frame %v", f.Type)
+
+		switch f.Type {
+		case FrameHeaders:
+			fields, err := c.dec.Decode(f.Payload)
+			require.NoError(c.t, err)
+			resp.fields = fields
+		case FrameData:
+			body.Write(f.Payload)
+		default:
+			c.t.Fatalf("unexpected frame %v", f.Type)
+		}
+
+		if f.Flags.Has(FlagEndStream) {
+			resp.body = body.String()
+			return resp
+		}
+	}
+}
+
+// errCode reads the next frame, which must be of type typ, and returns its
+// error code
+func (c *testClient) errCode(typ FrameType) ErrCode {
+	f := c.read()
+	require.Equal(c.t, typ, f.Type)
+	if typ == FrameGoAway {
+		return ErrCode(binary.BigEndian.Uint32(f.Payload[4:]))
+	}
+	return ErrCode(binary.BigEndian.Uint32(f.Payload))
+}
+
+func TestServeConn(t *testing.T) {
+	srv := NewServer(func(w *response.Writer, req *request.Request) *response.HandlerError {
+		switch req.RequestLine.Path() {
+		case "/missing":
+			e := response.NewHandlerErr(response.StatusNotFound)
+			return &e
+		case "/echo":
+			w.Header().Set("X-Trailer", req.Trailers.Get("x-checksum"))
+			w.Write(req.Body)
+			return nil
+		}
+
+		assert.Equal(t, "2", req.RequestLine.HttpVersion)
+		assert.Equal(t, "localhost", req.Host.Name)
+		assert.Equal(t, "a=1; b=2", req.Headers.Get("Cookie"))
+		assert.NotEmpty(t, req.RemoteAddr)
+		assert.Equal(t, req.RemoteAddr, req.Conn.RemoteAddr.String())
+		assert.False(t, req.StartTime.IsZero())
+
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("hello " + req.RequestLine.Method))
+		return nil
+	})
+	srv.ErrorRenderer = response.PlainTextErrors
+	c := dial(t, srv)
+
+	// Test: Simple GET, split cookies put back together
+	c.request(1, "GET", "/", true,
+		hpack.HeaderField{Name: "cookie", Value: "a=1"},
+		hpack.HeaderField{Name: "cookie", Value: "b=2"})
+	resp := c.response(1)
+	assert.Equal(t, "200", resp.get(":status"))
+	assert.Equal(t, ":status", resp.fields[0].Name)
+	assert.Equal(t, "text/plain", resp.get("content-type"))
+	assert.Equal(t, "9", resp.get("content-length"))
+	assert.Empty(t, resp.get("connection"))
+	assert.Equal(t, "hello GET", resp.body)
+
+	// Test: Body over several DATA frames, padded, with trailers
+	c.request(3, "POST", "/echo", false)
+	c.writeFrame(FrameData, 0, 3, []byte("abc"))
+	c.writeFrame(FrameData, FlagPadded, 3, []byte("\x02def\x00\x00"))
+	c.writeFrame(FrameHeaders, FlagEndHeaders|FlagEndStream, 3,
+		c.enc.Encode([]hpack.HeaderField{{Name: "x-checksum", Value: "42"}}))
+	resp = c.response(3)
+	assert.Equal(t, "abcdef", resp.body)
+	assert.Equal(t, "42", resp.get("x-trailer"))
+
+	// Test: Handler errors are rendered
+	c.request(5, "GET", "/missing", true)
+	resp = c.response(5)
+	assert.Equal(t, "404", resp.get(":status"))
+	assert.Equal(t, "Not Found", resp.body)
+
+	// Test: Invalid requests get an error response
+	c.request(7, "BREW", "/", true)
+	resp = c.response(7)
+	assert.Equal(t, "400", resp.get(":status"))
+
+	// Test: Body longer than Content-Length
+	c.request(9, "POST", "/echo", false, hpack.HeaderField{Name: "content-length", Value: "2"})
+	c.writeFrame(FrameData, FlagEndStream, 9, []byte("abc"))
+	assert.Equal(t, ErrCodeProtocol, c.errCode(FrameRSTStream))
+
+	// Test: Malformed requests are reset
+	c.request(11, "GET", "/", true, hpack.HeaderField{Name: "connection", Value: "close"})
+	assert.Equal(t, ErrCodeProtocol, c.errCode(FrameRSTStream))
+
+	c.writeFrame(FrameHeaders, FlagEndHeaders|FlagEndStream, 13,
+		c.enc.Encode([]hpack.HeaderField{{Name: ":method", Value: "GET"}}))
+	assert.Equal(t, ErrCodeProtocol, c.errCode(FrameRSTStream))
+
+	// Test: PING is answered
+	c.writeFrame(FramePing, 0, 0, []byte("12345678"))
+	f := c.read()
+	assert.Equal(t, FramePing, f.Type)
+	assert.True(t, f.Flags.Has(FlagAck))
+	assert.Equal(t, []byte("12345678"), f.Payload)
+
+	// Test: Header block split over CONTINUATION
+	block := c.enc.Encode([]hpack.HeaderField{
+		{Name: ":method", Value: "GET"},
+		{Name: ":scheme", Value: "http"},
+		{Name: ":path", Value: "/"},
+		{Name: ":authority", Value: "localhost"},
+		{Name: "cookie", Value: "a=1; b=2"},
+	})
+	c.writeFrame(FrameHeaders, FlagEndStream, 15, block[:5])
+	c.writeFrame(FrameContinuation, FlagEndHeaders, 15, block[5:])
+	assert.Equal(t, "hello GET", c.response(15).body)
+}
+
+func TestMultiplexing(t *testing.T) {
+	release := make(chan struct{})
+	srv := NewServer(func(w *response.Writer, req *request.Request) *response.HandlerError {
+		if req.RequestLine.Path() == "/slow" {
+			<-release
+		} else {
+			close(release)
+		}
+		fmt.Fprintf(w, "%s %d", req.RequestLine.Path(), req.Seq)
+		return nil
+	})
+	c := dial(t, srv)
+
+	// Test: A later stream is answered while an earlier one is waiting on
+	// it, and the requests are numbered in the order they arrived
+	c.request(1, "GET", "/slow", true)
+	c.request(3, "GET", "/fast", true)
+	assert.Equal(t, "/fast 2", c.response(3).body)
+	assert.Equal(t, "/slow 1", c.response(1).body)
+}
+
+func TestFlowControl(t *testing.T) {
+	written := make(chan error, 1)
+	srv := NewServer(func(w *response.Writer, req *request.Request) *response.HandlerError {
+		w.Flush()
+		_, err := w.Write([]byte(strings.Repeat("x", 25)))
+		written <- err
+		return nil
+	})
+	c := dial(t, srv, Setting{SettingInitialWindowSize, 10})
+
+	// Test: Sending stops when the stream window runs out
+	c.request(1, "GET", "/", true)
+	f := c.read()
+	require.Equal(t, FrameHeaders, f.Type)
+	f = c.read()
+	require.Equal(t, FrameData, f.Type)
+	assert.Len(t, f.Payload, 10)
+
+	select {
+	case <-written:
+		t.Fatal("write finished without window")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Test: And resumes once the client opens it
+	c.writeFrame(FrameWindowUpdate, 0, 1, binary.BigEndian.AppendUint32(nil, 100))
+	f = c.read()
+	assert.Len(t, f.Payload, 15)
+	require.NoError(t, <-written)
+	f = c.read()
+	assert.True(t, f.Flags.Has(FlagEndStream))
+
+	// Test: A reset fails writes waiting on the window
+	c.request(3, "GET", "/", true)
+	c.read()
+	c.read()
+	c.writeFrame(FrameRSTStream, 0, 3, binary.BigEndian.AppendUint32(nil, uint32(ErrCodeCancel)))
+	assert.ErrorIs(t, <-written, ErrStreamClosed)
+
+	// Test: Window overflow resets the stream
+	c.request(5, "GET", "/", true)
+	c.read()
+	c.read()
+	update := binary.BigEndian.AppendUint32(nil, maxWindowSize)
+	c.write(append(AppendFrame(nil, FrameWindowUpdate, 0, 5, update),
+		AppendFrame(nil, FrameWindowUpdate, 0, 5, update)...))
+	assert.Equal(t, ErrCodeFlowControl, c.errCode(FrameRSTStream))
+	assert.ErrorIs(t, <-written, ErrStreamClosed)
+}
+
+func TestConnectionErrors(t *testing.T) {
+	srv := NewServer(func(w *response.Writer, req *request.Request) *response.HandlerError {
+		return nil
+	})
+
+	cases := []struct {
+		name string
+		send func(c *testClient)
+		code ErrCode
+	}{
+		{"PING on a stream", func(c *testClient) {
+			c.writeFrame(FramePing, 0, 1, []byte("12345678"))
+		}, ErrCodeProtocol},
+		{"zero WINDOW_UPDATE", func(c *testClient) {
+			c.writeFrame(FrameWindowUpdate, 0, 0, make([]byte, 4))
+		}, ErrCodeProtocol},
+		{"even stream", func(c *testClient) {
+			c.request(2, "GET", "/", true)
+		}, ErrCodeProtocol},
+		{"interrupted header block", func(c *testClient) {
+			c.writeFrame(FrameHeaders, 0, 1, nil)
+			c.writeFrame(FramePing, 0, 0, []byte("12345678"))
+		}, ErrCodeProtocol},
+		{"bad HPACK", func(c *testClient) {
+			c.writeFrame(FrameHeaders, FlagEndHeaders, 1, []byte{0xff})
+		}, ErrCodeCompression},
+		{"oversized frame", func(c *testClient) {
+			c.writeFrame(FrameData, 0, 1, make([]byte, defaultMaxFrameSize+1))
+		}, ErrCodeFrameSize},
+		{"invalid setting", func(c *testClient) {
+			c.writeFrame(FrameSettings, 0, 0, appendSettings(nil, []Setting{{SettingEnablePush, 2}}))
+		}, ErrCodeProtocol},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := dial(t, srv)
+			tc.send(c)
+			assert.Equal(t, tc.code, c.errCode(FrameGoAway))
+
+			_, err := ReadFrame(c.conn, maxMaxFrameSize)
+			assert.Error(t, err)
+		})
+	}
+
+	// Test: Streams past the limit are refused
+	srv.MaxConcurrentStreams = 1
+	wait := make(chan struct{})
+	defer close(wait)
+	srv.Handler = func(w *response.Writer, req *request.Request) *response.HandlerError {
+		<-wait
+		return nil
+	}
+	c := dial(t, srv)
+	c.request(1, "GET", "/", true)
+	c.request(3, "GET", "/", true)
+	assert.Equal(t, ErrCodeRefusedStream, c.errCode(FrameRSTStream))
+}
+
+func TestSniffPreface(t *testing.T) {
+	head, ok, err := SniffPreface(strings.NewReader(ClientPreface + "rest"))
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, ClientPreface, string(head))
+
+	// Test: Stops at the first byte that differs
+	head, ok, err = SniffPreface(strings.NewReader("GET / HTTP/1.1\r\n"))
+	require.NoError(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, "GET / HTTP/1.1\r\n", string(head))
+}
@@ -0,0 +1,494 @@
+// Package http2 serves HTTP/2 over cleartext TCP (h2c), either to clients
+// that know in advance the server speaks it or after an HTTP/1.1 Upgrade.
+// Each stream is handed to an ordinary response.Handler (RFC 9113)
+package http2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/yus-works/tcp-to-http/internal/hpack"
+	"github.com/yus-works/tcp-to-http/internal/request"
+	"github.com/yus-works/tcp-to-http/internal/response"
+)
+
+// Server holds the settings shared by every HTTP/2 connection it serves
+type Server struct {
+	Handler       response.Handler
+	ErrorRenderer response.ErrorRenderer
+
+	// MaxConcurrentStreams is how many streams a client may have open at
+	// once. Streams past it are refused
+	MaxConcurrentStreams uint32
+	// MaxBodySize rejects request bodies over this many bytes with 413.
+	// Zero means no limit
+	MaxBodySize int
+}
+
+// NewServer returns a Server handing requests to handler
+func NewServer(handler response.Handler) *Server {
+	return &Server{
+		Handler:              handler,
+		ErrorRenderer:        response.NewErrorPages(),
+		MaxConcurrentStreams: 100,
+	}
+}
+
+// ServeConn serves an HTTP/2 connection until it is closed. buffered holds
+// bytes already read from conn, starting with the client preface, and info
+// is handed to every request on it
+func (s *Server) ServeConn(conn net.Conn, buffered []byte, info *request.ConnInfo) error {
+	sc := s.newConn(conn, buffered, info)
+	return sc.serve(nil)
+}
+
+// SniffPreface reads from r only as far as it takes to tell whether the
+// client preface is coming, returning the bytes read. A client that knows
+// the server speaks HTTP/2 starts with the preface straight away (RFC 9113
+// 3.3)
+func SniffPreface(r io.Reader) ([]byte, bool, error) {
+	buf := make([]byte, len(ClientPreface))
+	n := 0
+	for n < len(buf) {
+		m, err := r.Read(buf[n:])
+		n += m
+		if !strings.HasPrefix(ClientPreface, string(buf[:n])) {
+			return buf[:n], false, nil
+		}
+		if err != nil {
+			return buf[:n], false, err
+		}
+	}
+	return buf, true, nil
+}
+
+// serverConn is the state of one connection. The read loop owns the
+// decoder and the header block being assembled; everything handlers touch
+// as well is guarded by mu
+type serverConn struct {
+	srv  *Server
+	conn net.Conn
+	r    io.Reader
+	info *request.ConnInfo
+
+	// seq counts the requests the client has sent
+	seq uint64
+
+	dec *hpack.Decoder
+	// recvWindow is how much more the client may send on the connection
+	recvWindow int64
+
+	// headerStream is the stream whose header block is still arriving in
+	// CONTINUATION frames, 0 when there is none
+	headerStream    uint32
+	headerBlock     []byte
+	headerEndStream bool
+
+	// wmu serialises writes. Header blocks are encoded under it so they
+	// reach the client in the order the encoder produced them
+	wmu sync.Mutex
+	enc *hpack.Encoder
+	// encTableSize is the size of the encoder's dynamic table
+	encTableSize uint32
+
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	streams map[uint32]*stream
+	// lastStreamID is the highest stream the client has opened
+	lastStreamID uint32
+
+	// sendWindow is how much more we may send on the connection
+	sendWindow int64
+	// peerInitialWindow, peerMaxFrameSize and peerHeaderTableSize are the
+	// client's settings
+	peerInitialWindow   int64
+	peerMaxFrameSize    uint32
+	peerHeaderTableSize uint32
+
+	closed bool
+}
+
+func (s *Server) newConn(conn net.Conn, buffered []byte, info *request.ConnInfo) *serverConn {
+	if info == nil {
+		info = request.NewConnInfo(0, conn)
+	}
+
+	sc := &serverConn{
+		srv:               s,
+		conn:              conn,
+		r:                 io.MultiReader(bytes.NewReader(buffered), conn),
+		info:              info,
+		dec:               hpack.NewDecoder(defaultHeaderTableSize),
+		recvWindow:        defaultWindowSize,
+		enc:               hpack.NewEncoder(defaultHeaderTableSize),
+		encTableSize:      defaultHeaderTableSize,
+		streams:           map[uint32]*stream{},
+		sendWindow:        defaultWindowSize,
+		peerInitialWindow: defaultWindowSize,
+		peerMaxFrameSize:  defaultMaxFrameSize,
+
+		peerHeaderTableSize: defaultHeaderTableSize,
+	}
+	sc.cond = sync.NewCond(&sc.mu)
+	return sc
+}
+
+// settings are the ones we announce. Everything else is left at its
+// default
+func (sc *serverConn) settings() []Setting {
+	return []Setting{
+		{SettingMaxConcurrentStreams, sc.srv.MaxConcurrentStreams},
+		{SettingEnablePush, 0},
+	}
+}
+
+// serve runs the read loop. upgraded is the request that came in with an
+// HTTP/1.1 Upgrade, which becomes stream 1
+func (sc *serverConn) serve(upgraded *request.Request) error {
+	defer sc.close()
+
+	// our SETTINGS is the server preface and has to come first (RFC 9113
+	// 3.4)
+	err := sc.writeFrame(FrameSettings, 0, 0, appendSettings(nil, sc.settings()))
+	if err != nil {
+		return err
+	}
+
+	if upgraded != nil {
+		sc.startUpgraded(upgraded)
+	}
+
+	err = sc.readPreface()
+	for err == nil {
+		var f Frame
+		f, err = ReadFrame(sc.r, defaultMaxFrameSize)
+		if errors.Is(err, ErrFrameTooLarge) {
+			err = connError{ErrCodeFrameSize, err.Error()}
+			break
+		}
+		if err != nil {
+			break
+		}
+
+		err = sc.processFrame(f)
+
+		var se streamError
+		if errors.As(err, &se) {
+			sc.resetStream(se.StreamID, se.Code)
+			err = nil
+		}
+	}
+
+	var ce connError
+	if errors.As(err, &ce) {
+		log.Println("Closing HTTP/2 connection: ", ce)
+		sc.goAway(ce.Code, ce.Reason)
+		return ce
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+// readPreface checks the client preface, which is the magic string followed
+// by a SETTINGS frame
+func (sc *serverConn) readPreface() error {
+	buf := make([]byte, len(ClientPreface))
+	if _, err := io.ReadFull(sc.r, buf); err != nil {
+		return err
+	}
+	if string(buf) != ClientPreface {
+		return connError{ErrCodeProtocol, "invalid client preface"}
+	}
+
+	f, err := ReadFrame(sc.r, defaultMaxFrameSize)
+	if err != nil {
+		return err
+	}
+	if f.Type != FrameSettings || f.Flags.Has(FlagAck) {
+		return connError{ErrCodeProtocol, "client preface must end with SETTINGS"}
+	}
+	return sc.processSettings(f)
+}
+
+func (sc *serverConn) close() {
+	sc.mu.Lock()
+	sc.closed = true
+	for _, st := range sc.streams {
+		st.reset = true
+	}
+	clear(sc.streams)
+	sc.cond.Broadcast()
+	sc.mu.Unlock()
+
+	sc.conn.Close()
+}
+
+// processFrame handles one frame from the client
+func (sc *serverConn) processFrame(f Frame) error {
+	// a header block has to be finished before anything else is sent on the
+	// connection (RFC 9113 6.10)
+	if sc.headerStream != 0 &&
+		(f.Type != FrameContinuation || f.StreamID != sc.headerStream) {
+		return connError{ErrCodeProtocol, "expected CONTINUATION"}
+	}
+
+	switch f.Type {
+	case FrameData:
+		return sc.processData(f)
+	case FrameHeaders:
+		return sc.processHeaders(f)
+	case FrameContinuation:
+		return sc.processContinuation(f)
+	case FramePriority:
+		if f.StreamID == 0 {
+			return connError{ErrCodeProtocol, "PRIORITY on stream 0"}
+		}
+		if len(f.Payload) != 5 {
+			return streamError{f.StreamID, ErrCodeFrameSize, "PRIORITY payload must be 5 bytes"}
+		}
+		// prioritisation is only a hint and is ignored
+		return nil
+	case FrameRSTStream:
+		return sc.processRSTStream(f)
+	case FrameSettings:
+		return sc.processSettings(f)
+	case FramePushPromise:
+		return connError{ErrCodeProtocol, "clients can't push"}
+	case FramePing:
+		return sc.processPing(f)
+	case FrameGoAway:
+		if f.StreamID != 0 {
+			return connError{ErrCodeProtocol, "GOAWAY on a stream"}
+		}
+		// the client closes the connection once it's done with the streams
+		// it still has open
+		return nil
+	case FrameWindowUpdate:
+		return sc.processWindowUpdate(f)
+	}
+
+	// unknown frame types are ignored (RFC 9113 4.1)
+	return nil
+}
+
+func (sc *serverConn) processSettings(f Frame) error {
+	if f.StreamID != 0 {
+		return connError{ErrCodeProtocol, "SETTINGS on a stream"}
+	}
+	if f.Flags.Has(FlagAck) {
+		if len(f.Payload) != 0 {
+			return connError{ErrCodeFrameSize, "SETTINGS ACK with a payload"}
+		}
+		return nil
+	}
+
+	settings, err := parseSettings(f.Payload)
+	if err != nil {
+		return err
+	}
+	if err := sc.applySettings(settings); err != nil {
+		return err
+	}
+	return sc.writeFrame(FrameSettings, FlagAck, 0, nil)
+}
+
+func (sc *serverConn) applySettings(settings []Setting) error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	defer sc.cond.Broadcast()
+
+	for _, s := range settings {
+		if err := validSetting(s); err != nil {
+			return err
+		}
+
+		switch s.ID {
+		case SettingInitialWindowSize:
+			// the change applies to the windows of open streams too (RFC
+			// 9113 6.9.2)
+			delta := int64(s.Val) - sc.peerInitialWindow
+			for _, st := range sc.streams {
+				st.sendWindow += delta
+				if st.sendWindow > maxWindowSize {
+					return connError{ErrCodeFlowControl, "stream window overflow"}
+				}
+			}
+			sc.peerInitialWindow = int64(s.Val)
+		case SettingMaxFrameSize:
+			sc.peerMaxFrameSize = s.Val
+		case SettingHeaderTableSize:
+			sc.peerHeaderTableSize = s.Val
+		}
+	}
+	return nil
+}
+
+func (sc *serverConn) processPing(f Frame) error {
+	if f.StreamID != 0 {
+		return connError{ErrCodeProtocol, "PING on a stream"}
+	}
+	if len(f.Payload) != 8 {
+		return connError{ErrCodeFrameSize, "PING payload must be 8 bytes"}
+	}
+	if f.Flags.Has(FlagAck) {
+		return nil
+	}
+	return sc.writeFrame(FramePing, FlagAck, 0, f.Payload)
+}
+
+func (sc *serverConn) processWindowUpdate(f Frame) error {
+	if len(f.Payload) != 4 {
+		return connError{ErrCodeFrameSize, "WINDOW_UPDATE payload must be 4 bytes"}
+	}
+	inc := int64(binary.BigEndian.Uint32(f.Payload) & (1<<31 - 1))
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	defer sc.cond.Broadcast()
+
+	if f.StreamID == 0 {
+		if inc == 0 {
+			return connError{ErrCodeProtocol, "zero WINDOW_UPDATE increment"}
+		}
+		sc.sendWindow += inc
+		if sc.sendWindow > maxWindowSize {
+			return connError{ErrCodeFlowControl, "connection window overflow"}
+		}
+		return nil
+	}
+
+	st, ok := sc.streams[f.StreamID]
+	if !ok {
+		if f.StreamID > sc.lastStreamID {
+			return connError{ErrCodeProtocol, "WINDOW_UPDATE on an idle stream"}
+		}
+		// the stream may have ended while the update was in flight
+		return nil
+	}
+	if inc == 0 {
+		return streamError{f.StreamID, ErrCodeProtocol, "zero WINDOW_UPDATE increment"}
+	}
+	st.sendWindow += inc
+	if st.sendWindow > maxWindowSize {
+		return streamError{f.StreamID, ErrCodeFlowControl, "stream window overflow"}
+	}
+	return nil
+}
+
+func (sc *serverConn) processRSTStream(f Frame) error {
+	if f.StreamID == 0 {
+		return connError{ErrCodeProtocol, "RST_STREAM on stream 0"}
+	}
+	if len(f.Payload) != 4 {
+		return connError{ErrCodeFrameSize, "RST_STREAM payload must be 4 bytes"}
+	}
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	if f.StreamID > sc.lastStreamID {
+		return connError{ErrCodeProtocol, "RST_STREAM on an idle stream"}
+	}
+	sc.removeStream(f.StreamID)
+	return nil
+}
+
+// removeStream forgets a stream and fails anything still writing to it. mu
+// must be held
+func (sc *serverConn) removeStream(id uint32) {
+	if st, ok := sc.streams[id]; ok {
+		st.reset = true
+		delete(sc.streams, id)
+		sc.cond.Broadcast()
+	}
+}
+
+// resetStream sends RST_STREAM and forgets the stream
+func (sc *serverConn) resetStream(id uint32, code ErrCode) {
+	sc.mu.Lock()
+	sc.removeStream(id)
+	sc.mu.Unlock()
+
+	payload := binary.BigEndian.AppendUint32(nil, uint32(code))
+	sc.writeFrame(FrameRSTStream, 0, id, payload)
+}
+
+// goAway tells the client the connection is ending and which of its streams
+// were processed (RFC 9113 6.8)
+func (sc *serverConn) goAway(code ErrCode, reason string) {
+	sc.mu.Lock()
+	last := sc.lastStreamID
+	sc.mu.Unlock()
+
+	payload := binary.BigEndian.AppendUint32(nil, last)
+	payload = binary.BigEndian.AppendUint32(payload, uint32(code))
+	payload = append(payload, reason...)
+	sc.writeFrame(FrameGoAway, 0, 0, payload)
+}
+
+// writeFrame sends a single frame. A failed write leaves the connection
+// unusable, so it is closed, which also ends the read loop
+func (sc *serverConn) writeFrame(typ FrameType, flags Flags, streamID uint32, payload []byte) error {
+	sc.wmu.Lock()
+	defer sc.wmu.Unlock()
+
+	return sc.write(AppendFrame(nil, typ, flags, streamID, payload))
+}
+
+// write sends raw frames. wmu must be held
+func (sc *serverConn) write(p []byte) error {
+	if _, err := sc.conn.Write(p); err != nil {
+		sc.conn.Close()
+		return err
+	}
+	return nil
+}
+
+// writeHeaders encodes fields and sends them as a HEADERS frame followed by
+// as many CONTINUATION frames as the client's frame size calls for
+func (sc *serverConn) writeHeaders(streamID uint32, fields []hpack.HeaderField, endStream bool) error {
+	sc.mu.Lock()
+	maxSize := int(sc.peerMaxFrameSize)
+	// a bigger table than the default isn't worth the memory
+	tableSize := min(sc.peerHeaderTableSize, defaultHeaderTableSize)
+	sc.mu.Unlock()
+
+	sc.wmu.Lock()
+	defer sc.wmu.Unlock()
+
+	if tableSize != sc.encTableSize {
+		sc.enc.SetMaxTableSize(tableSize)
+		sc.encTableSize = tableSize
+	}
+	block := sc.enc.Encode(fields)
+
+	var buf []byte
+	typ := FrameHeaders
+	var flags Flags
+	if endStream {
+		flags = FlagEndStream
+	}
+	for {
+		chunk := block[:min(len(block), maxSize)]
+		block = block[len(chunk):]
+		if len(block) == 0 {
+			flags |= FlagEndHeaders
+		}
+
+		buf = AppendFrame(buf, typ, flags, streamID, chunk)
+		if len(block) == 0 {
+			break
+		}
+		typ, flags = FrameContinuation, 0
+	}
+	return sc.write(buf)
+}
@@ -0,0 +1,524 @@
+package http2
+
+import (
+	"encoding/binary"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yus-works/tcp-to-http/internal/headers"
+	"github.com/yus-works/tcp-to-http/internal/hpack"
+	"github.com/yus-works/tcp-to-http/internal/request"
+	"github.com/yus-works/tcp-to-http/internal/response"
+)
+
+// ErrStreamClosed is returned for writes to a stream the client has reset,
+// or whose connection has gone
+var ErrStreamClosed = errors.New("HTTP/2 stream closed")
+
+// stream is one request and its response. Fields are guarded by the
+// connection's mu
+type stream struct {
+	sc  *serverConn
+	id  uint32
+	req *request.Request
+
+	// sendWindow is how much more we may send on the stream, recvWindow how
+	// much more the client may
+	sendWindow int64
+	recvWindow int64
+
+	// recvDone is set once the client has ended the stream, sendDone once
+	// we have
+	recvDone bool
+	sendDone bool
+	// reset is set once the stream is gone, after which writes fail
+	reset bool
+	// discard is set when the response was started before the request
+	// finished arriving, so the rest of the body isn't wanted
+	discard bool
+}
+
+// connectionHeaders are HTTP/1.1 fields that are meaningless in HTTP/2 and
+// make a request malformed (RFC 9113 8.2.2)
+var connectionHeaders = map[string]struct{}{
+	"connection":        {},
+	"keep-alive":        {},
+	"proxy-connection":  {},
+	"transfer-encoding": {},
+	"upgrade":           {},
+}
+
+func (sc *serverConn) processHeaders(f Frame) error {
+	if f.StreamID == 0 {
+		return connError{ErrCodeProtocol, "HEADERS on stream 0"}
+	}
+
+	block, err := stripPadding(f)
+	if err != nil {
+		return err
+	}
+	if f.Flags.Has(FlagPriority) {
+		if len(block) < 5 {
+			return connError{ErrCodeFrameSize, "HEADERS too short for its priority"}
+		}
+		block = block[5:]
+	}
+
+	endStream := f.Flags.Has(FlagEndStream)
+	if !f.Flags.Has(FlagEndHeaders) {
+		sc.headerStream = f.StreamID
+		sc.headerBlock = append([]byte(nil), block...)
+		sc.headerEndStream = endStream
+		return nil
+	}
+	return sc.endHeaders(f.StreamID, block, endStream)
+}
+
+func (sc *serverConn) processContinuation(f Frame) error {
+	if sc.headerStream == 0 {
+		return connError{ErrCodeProtocol, "CONTINUATION without HEADERS"}
+	}
+
+	sc.headerBlock = append(sc.headerBlock, f.Payload...)
+	if len(sc.headerBlock) > maxHeaderBlockSize {
+		return connError{ErrCodeEnhanceYourCalm, "header block too large"}
+	}
+	if !f.Flags.Has(FlagEndHeaders) {
+		return nil
+	}
+
+	id, block := sc.headerStream, sc.headerBlock
+	sc.headerStream, sc.headerBlock = 0, nil
+	return sc.endHeaders(id, block, sc.headerEndStream)
+}
+
+// maxHeaderBlockSize bounds a header block spread over CONTINUATION frames
+const maxHeaderBlockSize = 1 << 20
+
+// endHeaders handles a complete header block, which either opens a stream
+// or carries the trailers of one
+func (sc *serverConn) endHeaders(id uint32, block []byte, endStream bool) error {
+	// the block is decoded even for a stream that is refused so the
+	// decoder's table stays in step with the client's encoder
+	fields, err := sc.dec.Decode(block)
+	if err != nil {
+		return connError{ErrCodeCompression, err.Error()}
+	}
+
+	sc.mu.Lock()
+	st, open := sc.streams[id]
+	lastID := sc.lastStreamID
+	active := len(sc.streams)
+	sc.mu.Unlock()
+
+	if open {
+		return sc.processTrailers(st, fields, endStream)
+	}
+	if id%2 == 0 {
+		return connError{ErrCodeProtocol, "HEADERS on a server-initiated stream"}
+	}
+	if id <= lastID {
+		return connError{ErrCodeStreamClosed, "HEADERS on a closed stream"}
+	}
+
+	sc.mu.Lock()
+	sc.lastStreamID = id
+	sc.mu.Unlock()
+
+	if uint32(active) >= sc.srv.MaxConcurrentStreams {
+		return streamError{id, ErrCodeRefusedStream, "too many concurrent streams"}
+	}
+
+	line, h, err := requestHead(fields)
+	if err != nil {
+		return streamError{id, ErrCodeProtocol, err.Error()}
+	}
+
+	st = sc.newStream(id)
+	st.recvDone = endStream
+
+	req, err := request.NewRequest(line, h, sc.srv.MaxBodySize)
+	if err != nil {
+		log.Println("Failed to parse HTTP/2 request: ", err)
+		st.respondEarly(nil, response.RequestError(err))
+		return nil
+	}
+	sc.seq++
+	req.SetConn(sc.info, sc.seq, time.Now())
+	st.req = req
+
+	if endStream {
+		go st.run()
+	} else if req.ExpectContinue {
+		// the body is buffered before the handler runs, so there is nothing
+		// to wait for
+		sc.writeHeaders(id, []hpack.HeaderField{{Name: ":status", Value: "100"}}, false)
+	}
+	return nil
+}
+
+func (sc *serverConn) newStream(id uint32) *stream {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	st := &stream{
+		sc:         sc,
+		id:         id,
+		sendWindow: sc.peerInitialWindow,
+		recvWindow: defaultWindowSize,
+	}
+	sc.streams[id] = st
+	return st
+}
+
+// requestHead validates a request's header fields and splits them into the
+// request line and the regular headers (RFC 9113 8.3.1)
+func requestHead(fields []hpack.HeaderField) (request.RequestLine, *headers.Headers, error) {
+	var line request.RequestLine
+	line.HttpVersion = "2"
+
+	h := headers.NewHeaders()
+	pseudo := map[string]string{}
+	var cookies []string
+
+	for _, f := range fields {
+		if strings.ToLower(f.Name) != f.Name {
+			return line, nil, errors.New("uppercase header field name")
+		}
+
+		if name, ok := strings.CutPrefix(f.Name, ":"); ok {
+			if h.Len() > 0 || len(cookies) > 0 {
+				return line, nil, errors.New("pseudo-header after regular header")
+			}
+			switch name {
+			case "method", "scheme", "path", "authority":
+			default:
+				return line, nil, errors.New("unknown pseudo-header " + f.Name)
+			}
+			if _, dup := pseudo[name]; dup {
+				return line, nil, errors.New("repeated pseudo-header " + f.Name)
+			}
+			pseudo[name] = f.Value
+			continue
+		}
+
+		if !headers.ValidName(f.Name) || !headers.ValidValue(f.Value) {
+			return line, nil, errors.New("invalid header field")
+		}
+		if _, ok := connectionHeaders[f.Name]; ok {
+			return line, nil, errors.New("connection-specific header " + f.Name)
+		}
+		if f.Name == "te" && f.Value != "trailers" {
+			return line, nil, errors.New("TE other than trailers")
+		}
+
+		// cookies may be split into separate fields for better compression
+		// and are put back together for HTTP/1.1 semantics (RFC 9113 8.2.3)
+		if f.Name == "cookie" {
+			cookies = append(cookies, f.Value)
+			continue
+		}
+		h.Add(f.Name, f.Value)
+	}
+	if len(cookies) > 0 {
+		h.Add("cookie", strings.Join(cookies, "; "))
+	}
+
+	line.Method = pseudo["method"]
+	authority := pseudo["authority"]
+	if line.Method == "CONNECT" {
+		if pseudo["scheme"] != "" || pseudo["path"] != "" || authority == "" {
+			return line, nil, errors.New("CONNECT takes only :authority")
+		}
+		line.RequestTarget = authority
+	} else {
+		if line.Method == "" || pseudo["scheme"] == "" || pseudo["path"] == "" {
+			return line, nil, errors.New("missing pseudo-header")
+		}
+		line.RequestTarget = pseudo["path"]
+	}
+
+	// :authority stands in for Host, and the two mustn't disagree
+	if authority != "" {
+		if !h.Has("host") {
+			h.Set("host", authority)
+		} else if !strings.EqualFold(h.Get("host"), authority) {
+			return line, nil, errors.New("Host and :authority differ")
+		}
+	}
+
+	return line, h, nil
+}
+
+// processTrailers handles a header block that arrives after the body
+func (sc *serverConn) processTrailers(st *stream, fields []hpack.HeaderField, endStream bool) error {
+	sc.mu.Lock()
+	recvDone := st.recvDone
+	sc.mu.Unlock()
+
+	if recvDone {
+		return streamError{st.id, ErrCodeStreamClosed, "HEADERS after END_STREAM"}
+	}
+	if !endStream {
+		return streamError{st.id, ErrCodeProtocol, "trailers without END_STREAM"}
+	}
+
+	for _, f := range fields {
+		if strings.HasPrefix(f.Name, ":") || strings.ToLower(f.Name) != f.Name ||
+			!headers.ValidName(f.Name) || !headers.ValidValue(f.Value) {
+			return streamError{st.id, ErrCodeProtocol, "invalid trailer field"}
+		}
+		if st.req != nil {
+			st.req.Trailers.Add(f.Name, f.Value)
+		}
+	}
+	return sc.endBody(st)
+}
+
+func (sc *serverConn) processData(f Frame) error {
+	if f.StreamID == 0 {
+		return connError{ErrCodeProtocol, "DATA on stream 0"}
+	}
+
+	// flow control counts the whole payload, padding included (RFC 9113
+	// 6.9.1). The connection window is given back straight away since the
+	// data is consumed as it arrives
+	n := int64(len(f.Payload))
+	sc.recvWindow -= n
+	if sc.recvWindow < 0 {
+		return connError{ErrCodeFlowControl, "connection window exceeded"}
+	}
+	if n > 0 {
+		sc.recvWindow += n
+		sc.writeWindowUpdate(0, n)
+	}
+
+	sc.mu.Lock()
+	st, ok := sc.streams[f.StreamID]
+	lastID := sc.lastStreamID
+	var recvDone, discard bool
+	if ok {
+		st.recvWindow -= n
+		recvDone, discard = st.recvDone, st.discard
+	}
+	sc.mu.Unlock()
+
+	switch {
+	case !ok && f.StreamID > lastID:
+		return connError{ErrCodeProtocol, "DATA on an idle stream"}
+	case !ok || recvDone:
+		return streamError{f.StreamID, ErrCodeStreamClosed, "DATA on a closed stream"}
+	case st.recvWindow < 0:
+		return streamError{f.StreamID, ErrCodeFlowControl, "stream window exceeded"}
+	}
+
+	data, err := stripPadding(f)
+	if err != nil {
+		return err
+	}
+
+	endStream := f.Flags.Has(FlagEndStream)
+	if !discard {
+		req := st.req
+		req.Body = append(req.Body, data...)
+
+		if cl := req.ContentLength(); cl != -1 && len(req.Body) > cl {
+			return streamError{st.id, ErrCodeProtocol, "body longer than Content-Length"}
+		}
+		if max := sc.srv.MaxBodySize; max > 0 && len(req.Body) > max {
+			st.respondEarly(req, response.RequestError(request.ErrBodyTooLarge))
+			return nil
+		}
+
+		if n > 0 && !endStream {
+			sc.mu.Lock()
+			st.recvWindow += n
+			sc.mu.Unlock()
+			sc.writeWindowUpdate(st.id, n)
+		}
+	}
+
+	if endStream {
+		return sc.endBody(st)
+	}
+	return nil
+}
+
+// endBody handles the client ending its side of the stream, at which point
+// the request is complete and the handler can run
+func (sc *serverConn) endBody(st *stream) error {
+	sc.mu.Lock()
+	st.recvDone = true
+	discard := st.discard
+	sendDone := st.sendDone
+	if sendDone {
+		sc.removeStream(st.id)
+	}
+	sc.mu.Unlock()
+
+	if discard {
+		return nil
+	}
+
+	req := st.req
+	if cl := req.ContentLength(); cl != -1 && len(req.Body) != cl {
+		return streamError{st.id, ErrCodeProtocol, "body shorter than Content-Length"}
+	}
+	go st.run()
+	return nil
+}
+
+func (sc *serverConn) writeWindowUpdate(streamID uint32, n int64) {
+	sc.writeFrame(FrameWindowUpdate, 0, streamID, binary.BigEndian.AppendUint32(nil, uint32(n)))
+}
+
+// respondEarly answers with e before the request has finished arriving, or
+// couldn't be parsed when req is nil. Whatever the client still sends is
+// dropped
+func (st *stream) respondEarly(req *request.Request, e *response.HandlerError) {
+	st.sc.mu.Lock()
+	st.discard = true
+	st.sc.mu.Unlock()
+
+	go func() {
+		w := response.NewFramedWriter(st)
+		if err := e.RenderTo(w, req, st.sc.srv.ErrorRenderer); err != nil {
+			log.Println("Failed to write error response: ", err)
+		}
+		st.finish()
+	}()
+}
+
+// run hands the request to the handler and sends its response
+func (st *stream) run() {
+	srv := st.sc.srv
+	req := st.req
+	defer st.finish()
+
+	w := response.NewFramedWriter(st)
+
+	handlerErr := srv.Handler(w, req)
+	if handlerErr != nil {
+		if w.Committed() {
+			// finish resets the stream, telling the client the response is
+			// incomplete
+			log.Println("Handler failed after flushing: ", handlerErr.Message)
+			return
+		}
+
+		if err := handlerErr.RenderTo(w, req, srv.ErrorRenderer); err != nil {
+			log.Println("Failed to write error response: ", err)
+		}
+		return
+	}
+
+	err := w.Finish()
+	if err != nil {
+		log.Println("Failed to write response: ", err)
+
+		if !w.Committed() && (errors.Is(err, headers.ErrInvalidFieldName) ||
+			errors.Is(err, headers.ErrInvalidFieldValue)) {
+			internalErr := response.NewHandlerErr(response.StatusInternalServerError)
+			internalErr.RenderTo(w, req, srv.ErrorRenderer)
+		}
+	}
+}
+
+// finish resets a stream whose response never ended, and one the client is
+// still sending on once the response is done (RFC 9113 8.1)
+func (st *stream) finish() {
+	sc := st.sc
+
+	sc.mu.Lock()
+	reset := st.reset
+	sendDone := st.sendDone
+	recvDone := st.recvDone
+	sc.mu.Unlock()
+
+	switch {
+	case reset:
+	case !sendDone:
+		sc.resetStream(st.id, ErrCodeInternal)
+	case !recvDone:
+		sc.resetStream(st.id, ErrCodeNo)
+	}
+}
+
+// WriteHead sends the response's HEADERS, making st a response.Framer
+func (st *stream) WriteHead(statusCode response.StatusCode, h headers.Headers) error {
+	if err := st.check(); err != nil {
+		return err
+	}
+
+	fields := []hpack.HeaderField{{Name: ":status", Value: strconv.Itoa(int(statusCode))}}
+	for _, f := range hpack.FromHeaders(&h) {
+		if _, ok := connectionHeaders[f.Name]; !ok {
+			fields = append(fields, f)
+		}
+	}
+	return st.sc.writeHeaders(st.id, fields, false)
+}
+
+// Write sends p in DATA frames as the flow control windows allow, waiting
+// for the client to open them when they are used up
+func (st *stream) Write(p []byte) (int, error) {
+	sc := st.sc
+	written := 0
+
+	for len(p) > 0 {
+		sc.mu.Lock()
+		for !st.reset && !sc.closed && (st.sendWindow <= 0 || sc.sendWindow <= 0) {
+			sc.cond.Wait()
+		}
+		if st.reset || sc.closed {
+			sc.mu.Unlock()
+			return written, ErrStreamClosed
+		}
+
+		n := min(int64(len(p)), st.sendWindow, sc.sendWindow, int64(sc.peerMaxFrameSize))
+		st.sendWindow -= n
+		sc.sendWindow -= n
+		sc.mu.Unlock()
+
+		if err := sc.writeFrame(FrameData, 0, st.id, p[:n]); err != nil {
+			return written, err
+		}
+		written += int(n)
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Close ends the response with an empty END_STREAM DATA frame
+func (st *stream) Close() error {
+	if err := st.check(); err != nil {
+		return err
+	}
+	if err := st.sc.writeFrame(FrameData, FlagEndStream, st.id, nil); err != nil {
+		return err
+	}
+
+	sc := st.sc
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	st.sendDone = true
+	if st.recvDone {
+		sc.removeStream(st.id)
+	}
+	return nil
+}
+
+// check fails once the stream can no longer be written to
+func (st *stream) check() error {
+	st.sc.mu.Lock()
+	defer st.sc.mu.Unlock()
+
+	if st.reset || st.sc.closed {
+		return ErrStreamClosed
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package http2
+
+import (
+	"encoding/base64"
+	"net"
+	"strings"
+
+	"github.com/yus-works/tcp-to-http/internal/headers"
+	"github.com/yus-works/tcp-to-http/internal/request"
+	"github.com/yus-works/tcp-to-http/internal/response"
+)
+
+// IsUpgrade reports whether req asks to switch to h2c with a usable
+// HTTP2-Settings header. Requests that ask without one are served as
+// HTTP/1.1 (RFC 7540 3.2.1)
+func IsUpgrade(req *request.Request) bool {
+	if !headers.HasToken(req.Headers, "Upgrade", "h2c") ||
+		!headers.HasToken(req.Headers, "Connection", "upgrade") ||
+		!headers.HasToken(req.Headers, "Connection", "http2-settings") {
+		return false
+	}
+
+	_, err := upgradeSettings(req)
+	return err == nil
+}
+
+// upgradeSettings decodes the HTTP2-Settings header, the payload of a
+// SETTINGS frame in base64url
+func upgradeSettings(req *request.Request) ([]Setting, error) {
+	vals := req.Headers.Values("HTTP2-Settings")
+	if len(vals) != 1 {
+		return nil, connError{ErrCodeProtocol, "need exactly one HTTP2-Settings"}
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(strings.TrimSpace(vals[0]), "="))
+	if err != nil {
+		return nil, connError{ErrCodeProtocol, "invalid HTTP2-Settings"}
+	}
+
+	settings, err := parseSettings(payload)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range settings {
+		if err := validSetting(s); err != nil {
+			return nil, err
+		}
+	}
+	return settings, nil
+}
+
+// ServeUpgrade switches conn to HTTP/2 after req asked for it, answering req
+// itself on stream 1. req must have been read in full, and buffered holds
+// whatever was read past it
+func (s *Server) ServeUpgrade(conn net.Conn, buffered []byte, req *request.Request) error {
+	settings, err := upgradeSettings(req)
+	if err != nil {
+		return err
+	}
+
+	err = response.WriteStatusLine(conn, response.StatusSwitchingProtocols)
+	if err == nil {
+		h := headers.NewHeaders()
+		h.Set("Connection", "Upgrade")
+		h.Set("Upgrade", "h2c")
+		err = response.WriteHeaders(conn, *h)
+	}
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	sc := s.newConn(conn, buffered, req.Conn)
+	if err := sc.applySettings(settings); err != nil {
+		conn.Close()
+		return err
+	}
+	return sc.serve(req)
+}
+
+// startUpgraded opens stream 1 for the request that came with the Upgrade,
+// which is already complete (RFC 7540 3.2)
+func (sc *serverConn) startUpgraded(req *request.Request) {
+	// the upgrade headers only meant something to HTTP/1.1
+	req.Headers.Del("Upgrade")
+	req.Headers.Del("Connection")
+	req.Headers.Del("HTTP2-Settings")
+
+	sc.mu.Lock()
+	sc.lastStreamID = 1
+	sc.mu.Unlock()
+	sc.seq = req.Seq
+
+	st := sc.newStream(1)
+	st.req = req
+	st.recvDone = true
+	go st.run()
+}
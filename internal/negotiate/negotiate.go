@@ -0,0 +1,195 @@
+// Package negotiate picks the best of the server's available representations
+// for a request's Accept, Accept-Encoding and Accept-Language headers
+// (RFC 9110 12.5)
+package negotiate
+
+import (
+	"strings"
+
+	"github.com/yus-works/tcp-to-http/internal/headers"
+)
+
+// match is the q-value an offer gets from the most specific range that
+// matched it. specificity orders ranges, higher meaning more specific
+type match struct {
+	q           float64
+	specificity int
+}
+
+// best returns the offer with the highest q, preferring earlier offers on a
+// tie. Offers that matched nothing or only matched with q=0 are skipped
+func best(offers []string, matchOffer func(offer string) (match, bool)) (string, bool) {
+	bestOffer, bestQ := "", 0.0
+
+	for _, offer := range offers {
+		m, ok := matchOffer(offer)
+		if !ok || m.q <= bestQ {
+			continue
+		}
+		bestOffer, bestQ = offer, m.q
+	}
+
+	return bestOffer, bestQ > 0
+}
+
+// acceptList parses a header into its q-value list. ok is false when the
+// header is missing or malformed, which both mean anything is acceptable
+func acceptList(h *headers.Headers, name string) ([]headers.QualityValue, bool) {
+	if !h.Has(name) {
+		return nil, false
+	}
+
+	list, err := headers.ParseQualityList(h.Get(name))
+	if err != nil {
+		return nil, false
+	}
+	return list, true
+}
+
+// ContentType returns the media type from offers that the Accept header
+// prefers. Offers may carry parameters, which then have to match any
+// parameters on a media range
+func ContentType(h *headers.Headers, offers []string) (string, bool) {
+	accepts, ok := acceptList(h, "Accept")
+	if !ok {
+		return firstOffer(offers)
+	}
+
+	for _, accept := range accepts {
+		if _, err := headers.ParseMediaType(accept.Value); err != nil {
+			return firstOffer(offers)
+		}
+	}
+
+	return best(offers, func(offer string) (match, bool) {
+		mt, err := headers.ParseMediaType(offer)
+		if err != nil {
+			return match{}, false
+		}
+
+		var found match
+		var matched bool
+		for _, accept := range accepts {
+			specificity, ok := mediaRangeMatches(accept, mt)
+			if ok && (!matched || specificity > found.specificity) {
+				found = match{q: accept.Q, specificity: specificity}
+				matched = true
+			}
+		}
+		return found, matched
+	})
+}
+
+// mediaRangeMatches reports whether an Accept element covers mt, ranking
+// "*/*" below "type/*" below "type/subtype" below ranges with parameters
+func mediaRangeMatches(accept headers.QualityValue, mt headers.MediaType) (int, bool) {
+	typ, subtype, _ := strings.Cut(strings.ToLower(accept.Value), "/")
+
+	switch {
+	case typ == "*" && subtype == "*":
+		return 0, true
+
+	case typ == mt.Type && subtype == "*":
+		return 1, true
+
+	case typ == mt.Type && subtype == mt.Subtype:
+		for _, p := range accept.Params {
+			v, ok := mt.Params.Get(p.Name)
+			if !ok || !strings.EqualFold(v, p.Value) {
+				return 0, false
+			}
+		}
+		return 2 + len(accept.Params), true
+	}
+
+	return 0, false
+}
+
+// Encoding returns the content coding from offers that the Accept-Encoding
+// header prefers. "identity" is acceptable unless the header excludes it
+// explicitly or through "*;q=0", and a present but empty header means only
+// "identity" is
+func Encoding(h *headers.Headers, offers []string) (string, bool) {
+	accepts, ok := acceptList(h, "Accept-Encoding")
+	if !ok {
+		return firstOffer(offers)
+	}
+
+	return best(offers, func(offer string) (match, bool) {
+		coding := normalizeCoding(offer)
+
+		wildcardQ, hasWildcard := 0.0, false
+		for _, accept := range accepts {
+			value := normalizeCoding(accept.Value)
+			if value == coding {
+				return match{q: accept.Q}, true
+			}
+			if value == "*" {
+				wildcardQ, hasWildcard = accept.Q, true
+			}
+		}
+
+		if hasWildcard {
+			return match{q: wildcardQ}, true
+		}
+		if coding == "identity" {
+			// identity only needs to be listed to be excluded, and is
+			// least preferred otherwise
+			return match{q: 0.001}, true
+		}
+		return match{}, false
+	})
+}
+
+// normalizeCoding lower cases a coding and maps the legacy x- aliases
+func normalizeCoding(coding string) string {
+	coding = strings.ToLower(coding)
+	switch coding {
+	case "x-gzip":
+		return "gzip"
+	case "x-compress":
+		return "compress"
+	}
+	return coding
+}
+
+// Language returns the language tag from offers that the Accept-Language
+// header prefers, using basic filtering (RFC 4647 3.3.1): a range matches
+// a tag equal to it or starting with it followed by "-"
+func Language(h *headers.Headers, offers []string) (string, bool) {
+	accepts, ok := acceptList(h, "Accept-Language")
+	if !ok {
+		return firstOffer(offers)
+	}
+
+	return best(offers, func(offer string) (match, bool) {
+		tag := strings.ToLower(offer)
+
+		var found match
+		var matched bool
+		for _, accept := range accepts {
+			lang := strings.ToLower(accept.Value)
+
+			specificity := -1
+			switch {
+			case lang == "*":
+				specificity = 0
+			case lang == tag || strings.HasPrefix(tag, lang+"-"):
+				specificity = len(lang)
+			}
+
+			if specificity >= 0 && (!matched || specificity > found.specificity) {
+				found = match{q: accept.Q, specificity: specificity}
+				matched = true
+			}
+		}
+		return found, matched
+	})
+}
+
+func firstOffer(offers []string) (string, bool) {
+	if len(offers) == 0 {
+		return "", false
+	}
+	return offers[0], true
+}
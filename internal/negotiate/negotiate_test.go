@@ -0,0 +1,110 @@
+package negotiate
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yus-works/tcp-to-http/internal/headers"
+)
+
+func withHeader(name, value string) *headers.Headers {
+	h := headers.NewHeaders()
+	h.Set(name, value)
+	return h
+}
+
+func TestContentType(t *testing.T) {
+	offers := []string{"application/json", "text/html", "text/plain; charset=utf-8"}
+
+	tests := []struct {
+		name   string
+		h      *headers.Headers
+		offers []string
+		want   string
+		ok     bool
+	}{
+		{"missing header", headers.NewHeaders(), offers, "application/json", true},
+		{"malformed header", withHeader("Accept", "text/"), offers, "application/json", true},
+		{"exact", withHeader("Accept", "text/html"), offers, "text/html", true},
+		{"wildcard", withHeader("Accept", "*/*"), offers, "application/json", true},
+		{"type wildcard", withHeader("Accept", "text/*"), offers, "text/html", true},
+		{"highest q", withHeader("Accept", "application/json;q=0.5, text/plain"), offers, "text/plain; charset=utf-8", true},
+		{"tie keeps server order", withHeader("Accept", "text/plain, text/html"), offers, "text/html", true},
+		{"browser", withHeader("Accept", "text/html,application/xhtml+xml,*/*;q=0.8"), offers, "text/html", true},
+		{"specific range overrides wildcard", withHeader("Accept", "*/*, application/json;q=0"), offers, "text/html", true},
+		{"q=0 type wildcard", withHeader("Accept", "text/*;q=0, */*;q=0.1"), offers, "application/json", true},
+		{"matching parameter", withHeader("Accept", "text/plain;charset=UTF-8"), offers, "text/plain; charset=utf-8", true},
+		{"mismatched parameter", withHeader("Accept", "text/plain;charset=latin1"), offers, "", false},
+		{"nothing acceptable", withHeader("Accept", "image/png"), offers, "", false},
+		{"all excluded", withHeader("Accept", "*/*;q=0"), offers, "", false},
+		{"no offers", withHeader("Accept", "*/*"), nil, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := ContentType(tt.h, tt.offers)
+			assert.Equal(t, tt.ok, ok)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestEncoding(t *testing.T) {
+	offers := []string{"br", "gzip", "identity"}
+
+	tests := []struct {
+		name string
+		h    *headers.Headers
+		want string
+		ok   bool
+	}{
+		{"missing header", headers.NewHeaders(), "br", true},
+		{"empty header means identity", withHeader("Accept-Encoding", ""), "identity", true},
+		{"gzip", withHeader("Accept-Encoding", "gzip"), "gzip", true},
+		{"legacy alias", withHeader("Accept-Encoding", "x-gzip"), "gzip", true},
+		{"case insensitive", withHeader("Accept-Encoding", "GZIP"), "gzip", true},
+		{"highest q", withHeader("Accept-Encoding", "br;q=0.5, gzip;q=0.8"), "gzip", true},
+		{"wildcard", withHeader("Accept-Encoding", "*"), "br", true},
+		{"wildcard with exclusion", withHeader("Accept-Encoding", "br;q=0, *"), "gzip", true},
+		{"unknown coding falls back to identity", withHeader("Accept-Encoding", "zstd"), "identity", true},
+		{"identity excluded", withHeader("Accept-Encoding", "zstd, identity;q=0"), "", false},
+		{"everything excluded", withHeader("Accept-Encoding", "*;q=0"), "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := Encoding(tt.h, offers)
+			assert.Equal(t, tt.ok, ok)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestLanguage(t *testing.T) {
+	offers := []string{"en-US", "en-GB", "de", "fr-CA"}
+
+	tests := []struct {
+		name string
+		h    *headers.Headers
+		want string
+		ok   bool
+	}{
+		{"missing header", headers.NewHeaders(), "en-US", true},
+		{"exact", withHeader("Accept-Language", "de"), "de", true},
+		{"prefix", withHeader("Accept-Language", "fr"), "fr-CA", true},
+		{"case insensitive", withHeader("Accept-Language", "EN-gb"), "en-GB", true},
+		{"q ordering", withHeader("Accept-Language", "da, en-gb;q=0.8, en;q=0.7"), "en-GB", true},
+		{"more specific range wins", withHeader("Accept-Language", "en, en-us;q=0"), "en-GB", true},
+		{"wildcard", withHeader("Accept-Language", "ja, *;q=0.1"), "en-US", true},
+		{"prefix must end at a subtag", withHeader("Accept-Language", "en-G"), "", false},
+		{"nothing acceptable", withHeader("Accept-Language", "ja"), "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := Language(tt.h, offers)
+			assert.Equal(t, tt.ok, ok)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -0,0 +1,201 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/yus-works/tcp-to-http/internal/headers"
+	"github.com/yus-works/tcp-to-http/internal/request"
+	"github.com/yus-works/tcp-to-http/internal/response"
+)
+
+// Tunnel is a forward proxy for CONNECT requests: it dials the requested
+// host:port and relays bytes both ways, typically carrying TLS the proxy
+// can't see into (RFC 9110 9.3.6)
+type Tunnel struct {
+	// Allowed lists the destinations that may be tunnelled to, as host:port
+	// patterns. The host is a name or address, "*.example.com" for any
+	// subdomain or "*" for any host; the port is a number or "*". Nothing
+	// is allowed when it is empty
+	Allowed []string
+	// DialTimeout bounds connecting to the destination
+	DialTimeout time.Duration
+	// IdleTimeout closes a tunnel once neither side has sent anything for
+	// this long
+	IdleTimeout time.Duration
+}
+
+// NewTunnel returns a Tunnel allowing the given destination patterns
+func NewTunnel(allowed ...string) *Tunnel {
+	return &Tunnel{
+		Allowed:     allowed,
+		DialTimeout: 10 * time.Second,
+		IdleTimeout: 5 * time.Minute,
+	}
+}
+
+// Serve is a response.Handler, for server.WithTunnel
+func (t *Tunnel) Serve(w *response.Writer, req *request.Request) *response.HandlerError {
+	if req.RequestLine.Method != "CONNECT" {
+		e := response.NewHandlerErr(response.StatusMethodNotAllowed)
+		e.Header = headers.NewHeaders()
+		e.Header.Set("Allow", "CONNECT")
+		return &e
+	}
+
+	target, err := req.RequestLine.Authority()
+	if err != nil {
+		e := response.NewHandlerErr(response.StatusBadRequest)
+		return &e
+	}
+
+	if !t.allowed(target) {
+		log.Printf("Tunnel to %s refused", target)
+		e := response.NewHandlerErrMsg(response.StatusForbidden, "Destination not allowed")
+		return &e
+	}
+
+	upstream, err := net.DialTimeout("tcp", target.String(), t.DialTimeout)
+	if err != nil {
+		log.Printf("Tunnel failed to reach %s: %v", target, err)
+		return gatewayError(err)
+	}
+
+	conn, buffered, err := w.Hijack()
+	if err != nil {
+		upstream.Close()
+		e := response.NewHandlerErrMsg(response.StatusInternalServerError, err.Error())
+		return &e
+	}
+
+	// a 2xx to CONNECT has no body and no framing headers; everything after
+	// it belongs to the tunnel
+	err = response.WriteStatusLine(conn, response.StatusOK)
+	if err == nil {
+		err = response.WriteHeaders(conn, *headers.NewHeaders())
+	}
+	// bytes the client sent ahead of our answer are the start of the tunnel
+	if err == nil && len(buffered) > 0 {
+		_, err = upstream.Write(buffered)
+	}
+	if err != nil {
+		log.Printf("Tunnel to %s failed to start: %v", target, err)
+		conn.Close()
+		upstream.Close()
+		return nil
+	}
+
+	t.splice(conn, upstream)
+	return nil
+}
+
+// allowed reports whether target matches one of the Allowed patterns
+func (t *Tunnel) allowed(target request.Host) bool {
+	for _, pattern := range t.Allowed {
+		host, port, err := net.SplitHostPort(pattern)
+		if err != nil {
+			continue
+		}
+
+		if port != "*" && port != target.Port {
+			continue
+		}
+
+		switch {
+		case host == "*":
+			return true
+		case strings.HasPrefix(host, "*."):
+			if len(target.Name) > len(host)-1 &&
+				strings.HasSuffix(strings.ToLower(target.Name), strings.ToLower(host[1:])) {
+				return true
+			}
+		case strings.EqualFold(host, target.Name):
+			return true
+		}
+	}
+	return false
+}
+
+// splice copies between the two connections until both directions have
+// finished or the tunnel goes idle, then closes both. When one side stops
+// sending, the other is told with a half-close so it can still answer
+func (t *Tunnel) splice(a, b net.Conn) {
+	var lastActive atomic.Int64
+	lastActive.Store(time.Now().UnixNano())
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	relay := func(dst, src net.Conn) {
+		defer wg.Done()
+
+		err := t.copy(dst, src, &lastActive)
+		if err == nil {
+			closeWrite(dst)
+			return
+		}
+
+		// anything but a clean end takes the whole tunnel down, which also
+		// stops the other direction
+		if !errors.Is(err, net.ErrClosed) {
+			log.Println("Tunnel closed: ", err)
+		}
+		a.Close()
+		b.Close()
+	}
+
+	go relay(b, a)
+	go relay(a, b)
+	wg.Wait()
+
+	a.Close()
+	b.Close()
+}
+
+// copy relays src to dst until src ends, returning nil on a clean end. Read
+// deadlines are pushed back as long as either direction is active, so a
+// download isn't cut off because the client has nothing to say
+func (t *Tunnel) copy(dst, src net.Conn, lastActive *atomic.Int64) error {
+	buf := make([]byte, 32<<10)
+	for {
+		if t.IdleTimeout > 0 {
+			src.SetReadDeadline(time.Now().Add(t.IdleTimeout))
+		}
+
+		n, err := src.Read(buf)
+		if n > 0 {
+			lastActive.Store(time.Now().UnixNano())
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				return werr
+			}
+		}
+
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			var netErr net.Error
+			idle := time.Since(time.Unix(0, lastActive.Load()))
+			if errors.As(err, &netErr) && netErr.Timeout() && idle < t.IdleTimeout {
+				continue
+			}
+			return err
+		}
+	}
+}
+
+// closeWrite shuts down the sending side of conn, or all of it if it can't
+// be half-closed
+func closeWrite(conn net.Conn) {
+	// wrappers have the method whether or not what they wrap does
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok && cw.CloseWrite() == nil {
+		return
+	}
+	conn.Close()
+}
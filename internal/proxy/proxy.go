@@ -0,0 +1,348 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yus-works/tcp-to-http/internal/client"
+	"github.com/yus-works/tcp-to-http/internal/framing"
+	"github.com/yus-works/tcp-to-http/internal/headers"
+	"github.com/yus-works/tcp-to-http/internal/request"
+	"github.com/yus-works/tcp-to-http/internal/response"
+)
+
+var (
+	ErrNoHealthyUpstream = errors.New("No healthy upstream")
+	// ErrUnexpectedSwitch is returned for an upstream switching protocols,
+	// which a request passed on as is never asks for
+	ErrUnexpectedSwitch = errors.New("Upstream switched protocols")
+)
+
+// hopByHopHeaders only apply to a single connection and are never forwarded
+// (RFC 9110 7.6.1)
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Connection",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"TE",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// Proxy forwards requests to a set of upstream servers, taking turns and
+// skipping those that keep failing
+type Proxy struct {
+	balancer *balancer
+
+	// Pool holds keep-alive connections to the upstreams
+	Pool *client.Pool
+
+	// Name identifies the proxy in Via headers
+	Name string
+	// DialTimeout bounds connecting to an upstream
+	DialTimeout time.Duration
+	// ResponseTimeout bounds the wait for the upstream's response head.
+	// Running out of it is answered with 504
+	ResponseTimeout time.Duration
+	// an upstream that fails MaxFails times in a row is left out for
+	// FailTimeout
+	MaxFails    int
+	FailTimeout time.Duration
+}
+
+// New returns a Proxy balancing over the upstream host:port addresses
+func New(addrs ...string) *Proxy {
+	return &Proxy{
+		balancer:        newBalancer(addrs),
+		Pool:            client.NewPool(),
+		Name:            "tcp-to-http",
+		DialTimeout:     5 * time.Second,
+		ResponseTimeout: 30 * time.Second,
+		MaxFails:        3,
+		FailTimeout:     10 * time.Second,
+	}
+}
+
+// Serve is a response.Handler
+func (p *Proxy) Serve(w *response.Writer, req *request.Request) *response.HandlerError {
+	conn, u, err := p.dial()
+	if err != nil {
+		log.Println("Proxy failed to reach upstream: ", err)
+		return gatewayError(err)
+	}
+
+	// a body the server left on the connection is passed on as it arrives,
+	// once there is somewhere to send it
+	body, err := req.BodyReader()
+	if err != nil {
+		log.Println("Proxy failed to read request body: ", err)
+		conn.Release(false)
+		return response.RequestError(err)
+	}
+
+	src := &clientBody{r: body}
+	resp, err := p.exchange(conn, req, src)
+
+	// an idle connection the upstream closed just as it was checked out is
+	// no sign of trouble, and the upstream never saw the request. It is sent
+	// once more on a fresh connection if the body can be
+	if err != nil && src.err == nil && conn.Reused && client.Stale(err) && src.rewind(req) {
+		conn.Release(false)
+		conn, err = p.Pool.Dial(u.addr, time.Now().Add(p.DialTimeout))
+		if err != nil {
+			log.Println("Proxy failed to reach upstream: ", err)
+			u.failed(p.MaxFails, p.FailTimeout)
+			return gatewayError(err)
+		}
+		resp, err = p.exchange(conn, req, src)
+	}
+
+	if err != nil {
+		conn.Release(false)
+		if src.err != nil {
+			log.Println("Proxy failed to read request body: ", src.err)
+			return response.RequestError(src.err)
+		}
+		log.Printf("Proxy got no response from %s: %v", u.addr, err)
+		if !conn.Reused || !client.Stale(err) {
+			u.failed(p.MaxFails, p.FailTimeout)
+		}
+		return gatewayError(err)
+	}
+	u.succeeded()
+
+	herr := p.writeResponse(w, resp)
+
+	conn.Release(herr == nil && resp.Reusable())
+	return herr
+}
+
+// exchange sends req upstream over conn and reads the response head
+func (p *Proxy) exchange(
+	conn *client.PooledConn, req *request.Request, body io.Reader,
+) (*client.Response, error) {
+	if err := p.writeRequest(conn, req, body); err != nil {
+		return nil, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(p.ResponseTimeout))
+	resp, err := client.ReadResponse(bufio.NewReader(conn), req.RequestLine.Method)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusLine.StatusCode == 101 {
+		return nil, ErrUnexpectedSwitch
+	}
+	conn.SetReadDeadline(time.Time{})
+	return resp, nil
+}
+
+// dial gets a connection to the next healthy upstream. Connection failures
+// are safe to retry since nothing has been sent yet, so each upstream gets
+// one try
+func (p *Proxy) dial() (*client.PooledConn, *upstream, error) {
+	tried := map[*upstream]bool{}
+	err := ErrNoHealthyUpstream
+
+	for {
+		u := p.balancer.pick(tried)
+		if u == nil {
+			return nil, nil, err
+		}
+		tried[u] = true
+
+		var conn *client.PooledConn
+		conn, err = p.Pool.Get(u.addr, time.Now().Add(p.DialTimeout))
+		if err == nil {
+			return conn, u, nil
+		}
+		u.failed(p.MaxFails, p.FailTimeout)
+	}
+}
+
+func (p *Proxy) via() string {
+	return "1.1 " + p.Name
+}
+
+// writeRequest sends req upstream with the hop-by-hop headers swapped for
+// the forwarding ones, copying the body from body. A chunked body is sent
+// chunked, and one with a Content-Length with the same length
+func (p *Proxy) writeRequest(conn io.Writer, req *request.Request, body io.Reader) error {
+	h := forwardHeaders(req.Headers)
+
+	if ip, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		appendField(h, "X-Forwarded-For", ip)
+	}
+	// the origin tells what the client used when we are behind a proxy
+	// ourselves
+	proto, host := req.Origin.Scheme, req.Origin.Host.String()
+	if proto == "" {
+		proto, host = "http", req.Headers.Get("Host")
+	}
+	h.Set("X-Forwarded-Proto", proto)
+	h.Set("X-Forwarded-Host", host)
+	appendField(h, "Via", p.via())
+
+	// the Content-Length has been checked against the body, and chunked is
+	// the only coding requests are accepted with
+	chunked := req.Headers.Has("Transfer-Encoding")
+	if chunked {
+		h.Set("Transfer-Encoding", "chunked")
+	} else if !h.Has("Content-Length") && len(req.Body) > 0 {
+		h.Set("Content-Length", strconv.Itoa(len(req.Body)))
+	}
+
+	requestLine := fmt.Sprintf("%s %s HTTP/1.1\r\n",
+		req.RequestLine.Method, originForm(req.RequestLine.RequestTarget))
+	if _, err := io.WriteString(conn, requestLine); err != nil {
+		return err
+	}
+	if err := response.WriteHeaders(conn, *h); err != nil {
+		return err
+	}
+
+	if !chunked {
+		_, err := io.Copy(conn, body)
+		return err
+	}
+	cw := framing.NewChunkedWriter(conn)
+	if _, err := io.Copy(cw, body); err != nil {
+		return err
+	}
+	return cw.Close()
+}
+
+// clientBody keeps the error reading the client's body, so it isn't put
+// down to the upstream
+type clientBody struct {
+	r   io.Reader
+	err error
+	// bytes read so far
+	n int64
+}
+
+func (b *clientBody) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	b.n += int64(n)
+	if err != nil && err != io.EOF {
+		b.err = err
+	}
+	return n, err
+}
+
+// rewind gets the body ready to be sent again. That takes none of it having
+// been read yet, or all of it being held in the request rather than
+// streamed from the client
+func (b *clientBody) rewind(req *request.Request) bool {
+	if b.n == 0 {
+		return true
+	}
+
+	r, err := req.BodyReader()
+	if err != nil {
+		return false
+	}
+	b.r, b.n = r, 0
+	return true
+}
+
+// writeResponse relays the upstream response head and streams its body,
+// keeping the upstream's framing where it is known up front
+func (p *Proxy) writeResponse(w *response.Writer, resp *client.Response) *response.HandlerError {
+	w.SetStatus(response.StatusCode(resp.StatusLine.StatusCode))
+	for k, v := range forwardHeaders(resp.Headers).All() {
+		w.Header().Add(k, v)
+	}
+	appendField(w.Header(), "Via", p.via())
+
+	if resp.BodyReader == nil {
+		return nil
+	}
+
+	if resp.ContentLength != -1 {
+		w.SetContentLength(resp.ContentLength)
+	}
+	if err := w.Flush(); err != nil {
+		e := response.NewHandlerErrMsg(response.StatusInternalServerError, err.Error())
+		return &e
+	}
+
+	// the body reader reports an upstream that closes early
+	if _, err := io.Copy(w, resp.BodyReader); err != nil {
+		// the head is out, so all that's left is cutting the response short
+		e := response.NewHandlerErrMsg(response.StatusBadGateway, err.Error())
+		return &e
+	}
+	return nil
+}
+
+// forwardHeaders copies h without the hop-by-hop fields, including any
+// named in Connection
+func forwardHeaders(h *headers.Headers) *headers.Headers {
+	drop := map[string]bool{}
+	for _, name := range hopByHopHeaders {
+		drop[strings.ToLower(name)] = true
+	}
+	if names, err := headers.ParseList(h.Get("Connection")); err == nil {
+		for _, name := range names {
+			drop[strings.ToLower(name)] = true
+		}
+	}
+
+	out := headers.NewHeaders()
+	for k, v := range h.All() {
+		if !drop[strings.ToLower(k)] {
+			out.Add(k, v)
+		}
+	}
+	return out
+}
+
+// appendField adds v to the end of the comma separated list in field k
+func appendField(h *headers.Headers, k, v string) {
+	if prev := h.Get(k); prev != "" {
+		v = prev + ", " + v
+	}
+	h.Set(k, v)
+}
+
+// originForm strips the scheme and authority from an absolute-form target
+func originForm(target string) string {
+	_, rest, ok := strings.Cut(target, "://")
+	if !ok || strings.HasPrefix(target, "/") {
+		return target
+	}
+
+	i := strings.IndexAny(rest, "/?")
+	if i == -1 {
+		return "/"
+	}
+	if rest[i] == '?' {
+		return "/" + rest[i:]
+	}
+	return rest[i:]
+}
+
+// gatewayError maps an upstream failure to 504 for timeouts and 502 for
+// everything else
+func gatewayError(err error) *response.HandlerError {
+	var e response.HandlerError
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		e = response.NewHandlerErr(response.StatusGatewayTimeout)
+	} else {
+		e = response.NewHandlerErr(response.StatusBadGateway)
+	}
+	return &e
+}
@@ -0,0 +1,616 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yus-works/tcp-to-http/internal/client"
+	"github.com/yus-works/tcp-to-http/internal/headers"
+	"github.com/yus-works/tcp-to-http/internal/request"
+	"github.com/yus-works/tcp-to-http/internal/response"
+)
+
+// startUpstream answers every request on every connection by passing it on
+// received and writing reply verbatim, closing the connection if the reply
+// says so. accepted counts the connections
+func startUpstream(t *testing.T, reply string) (string, <-chan *request.Request, *atomic.Int32) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+
+	received := make(chan *request.Request, 10)
+	accepted := &atomic.Int32{}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			go func() {
+				defer conn.Close()
+				for {
+					req, err := request.RequestFromReader(conn)
+					if err != nil {
+						return
+					}
+					received <- req
+					io.WriteString(conn, reply)
+					if strings.Contains(reply, "Connection: close") {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	return ln.Addr().String(), received, accepted
+}
+
+// closedAddr returns an address nothing is listening on
+func closedAddr(t *testing.T) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+func newRequest(method, target, body string, fields ...string) *request.Request {
+	req := &request.Request{
+		Headers:    headers.NewHeaders(),
+		Body:       []byte(body),
+		RemoteAddr: "192.0.2.7:51234",
+	}
+	req.RequestLine.Method = method
+	req.RequestLine.RequestTarget = target
+	req.Headers.Set("Host", "example.com")
+	for i := 0; i+1 < len(fields); i += 2 {
+		req.Headers.Add(fields[i], fields[i+1])
+	}
+	return req
+}
+
+func proxyRoundTrip(t *testing.T, p *Proxy, req *request.Request) (string, *response.HandlerError) {
+	t.Helper()
+
+	out := bytes.Buffer{}
+	w := response.NewWriter(&out)
+	if herr := p.Serve(w, req); herr != nil {
+		return out.String(), herr
+	}
+	require.NoError(t, w.Finish())
+	return out.String(), nil
+}
+
+func TestForwardRequest(t *testing.T) {
+	addr, received, _ := startUpstream(t,
+		"HTTP/1.1 201 Created\r\n"+
+			"Content-Length: 5\r\n"+
+			"Connection: close, X-Upstream-Hop\r\n"+
+			"X-Upstream-Hop: secret\r\n"+
+			"Keep-Alive: timeout=5\r\n"+
+			"X-Id: 7\r\n"+
+			"\r\n"+
+			"hello",
+	)
+	p := New(addr)
+
+	req := newRequest("POST", "http://example.com/things?x=1", "data",
+		"Content-Length", "4",
+		"Connection", "X-Client-Hop",
+		"X-Client-Hop", "secret",
+		"Proxy-Authorization", "Basic Zm9vOmJhcg==",
+		"X-Forwarded-For", "203.0.113.1",
+		"Via", "1.0 edge",
+		"Accept", "*/*",
+	)
+	raw, herr := proxyRoundTrip(t, p, req)
+	require.Nil(t, herr)
+
+	// Test: Upstream sees the forwarding headers and none of the hop-by-hop
+	up := <-received
+	assert.Equal(t, "/things?x=1", up.RequestLine.RequestTarget)
+	assert.Equal(t, "data", string(up.Body))
+	assert.Equal(t, "example.com", up.Headers.Get("Host"))
+	assert.Equal(t, "203.0.113.1, 192.0.2.7", up.Headers.Get("X-Forwarded-For"))
+	assert.Equal(t, "http", up.Headers.Get("X-Forwarded-Proto"))
+	assert.Equal(t, "example.com", up.Headers.Get("X-Forwarded-Host"))
+	assert.Equal(t, "1.0 edge, 1.1 tcp-to-http", up.Headers.Get("Via"))
+	assert.False(t, up.Headers.Has("Connection"))
+	assert.Equal(t, "*/*", up.Headers.Get("Accept"))
+	assert.False(t, up.Headers.Has("X-Client-Hop"))
+	assert.False(t, up.Headers.Has("Proxy-Authorization"))
+
+	// Test: Client gets the upstream response minus its hop-by-hop headers
+	assert.True(t, strings.HasPrefix(raw, "HTTP/1.1 201 Created\r\n"))
+	assert.Contains(t, raw, "Content-Length: 5\r\n")
+	assert.Contains(t, raw, "X-Id: 7\r\n")
+	assert.Contains(t, raw, "Via: 1.1 tcp-to-http\r\n")
+	assert.NotContains(t, raw, "X-Upstream-Hop")
+	assert.NotContains(t, raw, "Keep-Alive")
+	assert.True(t, strings.HasSuffix(raw, "\r\n\r\nhello"))
+}
+
+func TestForwardOrigin(t *testing.T) {
+	addr, received, _ := startUpstream(t, "HTTP/1.1 204 No Content\r\n\r\n")
+
+	// Test: Behind a proxy ourselves, the origin's scheme and host are
+	// passed on
+	req := newRequest("GET", "/", "")
+	req.Origin = request.Origin{Scheme: "https", Host: request.Host{Name: "shop.example"}}
+	_, herr := proxyRoundTrip(t, New(addr), req)
+	require.Nil(t, herr)
+
+	up := <-received
+	assert.Equal(t, "https", up.Headers.Get("X-Forwarded-Proto"))
+	assert.Equal(t, "shop.example", up.Headers.Get("X-Forwarded-Host"))
+}
+
+func TestStreamResponseBodies(t *testing.T) {
+	tests := []struct {
+		name   string
+		reply  string
+		framed string
+	}{
+		{
+			"chunked",
+			"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n" +
+				"5;ext=1\r\nhello\r\n6\r\n world\r\n0\r\nX-Trailer: 1\r\n\r\n",
+			"Transfer-Encoding: chunked",
+		},
+		{
+			"close delimited",
+			"HTTP/1.1 200 OK\r\nConnection: close\r\n\r\nhello world",
+			"Transfer-Encoding: chunked",
+		},
+		{
+			"interim response skipped",
+			"HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 200 OK\r\nContent-Length: 11\r\n\r\nhello world",
+			"Content-Length: 11",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, _, _ := startUpstream(t, tt.reply)
+			raw, herr := proxyRoundTrip(t, New(addr), newRequest("GET", "/", ""))
+			require.Nil(t, herr)
+
+			head, body, _ := strings.Cut(raw, "\r\n\r\n")
+			assert.Contains(t, head, tt.framed)
+
+			// chunk boundaries depend on how the reads fall, so compare the
+			// decoded body
+			decoded := body
+			if tt.framed == "Transfer-Encoding: chunked" {
+				resp, err := client.ReadResponse(bufio.NewReader(strings.NewReader(raw)), "GET")
+				require.NoError(t, err)
+				dec, err := io.ReadAll(resp.BodyReader)
+				require.NoError(t, err)
+				decoded = string(dec)
+			}
+			assert.Equal(t, "hello world", decoded)
+		})
+	}
+}
+
+// streamedRequest reads the head of a request from r and leaves its body to
+// be streamed, as the server does with WithStreamingBodies
+func streamedRequest(t *testing.T, r io.Reader) *request.Request {
+	t.Helper()
+
+	rr := request.NewReader(r)
+	req, err := rr.ReadHead()
+	require.NoError(t, err)
+	req.RemoteAddr = "192.0.2.7:51234"
+	req.DeferBody(rr.ReadBody, func() (io.Reader, error) {
+		return rr.BodyReader(), nil
+	})
+	return req
+}
+
+func TestStreamRequestBodies(t *testing.T) {
+	tests := []struct {
+		name   string
+		head   string
+		first  string
+		rest   string
+		framed string
+	}{
+		{
+			"chunked",
+			"Transfer-Encoding: chunked",
+			"5\r\nhello\r\n",
+			"6\r\n world\r\n0\r\n\r\n",
+			"Transfer-Encoding",
+		},
+		{
+			"content length",
+			"Content-Length: 11",
+			"hello",
+			" world",
+			"Content-Length",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			require.NoError(t, err)
+			defer ln.Close()
+
+			// the upstream reports the start of the body as soon as it has
+			// it, and the whole body once it ends
+			started := make(chan *request.Request, 1)
+			body := make(chan string, 1)
+			go func() {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+
+				rr := request.NewReader(conn)
+				req, err := rr.ReadHead()
+				if err != nil {
+					return
+				}
+				first := make([]byte, 5)
+				io.ReadFull(rr.BodyReader(), first)
+				started <- req
+				rest, _ := io.ReadAll(rr.BodyReader())
+				body <- string(first) + string(rest)
+				io.WriteString(conn, "HTTP/1.1 204 No Content\r\n\r\n")
+			}()
+
+			pr, pw := io.Pipe()
+			go io.WriteString(pw, "POST /upload HTTP/1.1\r\nHost: example.com\r\n"+
+				tt.head+"\r\n\r\n"+tt.first)
+			req := streamedRequest(t, pr)
+
+			done := make(chan *response.HandlerError, 1)
+			go func() {
+				_, herr := proxyRoundTrip(t, New(ln.Addr().String()), req)
+				done <- herr
+			}()
+
+			// Test: The upstream gets the body before the client has sent
+			// all of it, in the framing it came in
+			select {
+			case up := <-started:
+				assert.True(t, up.Headers.Has(tt.framed))
+			case <-time.After(time.Second):
+				t.Fatal("upstream got none of the body")
+			}
+			io.WriteString(pw, tt.rest)
+
+			assert.Equal(t, "hello world", <-body)
+			assert.Nil(t, <-done)
+		})
+	}
+
+	// Test: A bad body is the client's fault, not the upstream's
+	addr, _, _ := startUpstream(t, "HTTP/1.1 204 No Content\r\n\r\n")
+	p := New(addr)
+	p.MaxFails = 1
+	req := streamedRequest(t, io.MultiReader(
+		strings.NewReader("POST /upload HTTP/1.1\r\n"+
+			"Host: example.com\r\nTransfer-Encoding: chunked\r\n\r\n"),
+		strings.NewReader("zz\r\n"),
+	))
+	_, herr := proxyRoundTrip(t, p, req)
+	require.NotNil(t, herr)
+	assert.Equal(t, response.StatusBadRequest, herr.StatusCode)
+
+	_, herr = proxyRoundTrip(t, p, newRequest("GET", "/", ""))
+	assert.Nil(t, herr)
+}
+
+func TestUpstreamFailures(t *testing.T) {
+	// Test: Nothing listening
+	_, herr := proxyRoundTrip(t, New(closedAddr(t)), newRequest("GET", "/", ""))
+	require.NotNil(t, herr)
+	assert.Equal(t, response.StatusBadGateway, herr.StatusCode)
+
+	// Test: Garbage instead of a response
+	addr, _, _ := startUpstream(t, "SMTP ready\r\n\r\n")
+	_, herr = proxyRoundTrip(t, New(addr), newRequest("GET", "/", ""))
+	require.NotNil(t, herr)
+	assert.Equal(t, response.StatusBadGateway, herr.StatusCode)
+
+	// Test: No response in time
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			defer conn.Close()
+			io.Copy(io.Discard, conn)
+		}
+	}()
+
+	p := New(ln.Addr().String())
+	p.ResponseTimeout = 50 * time.Millisecond
+	_, herr = proxyRoundTrip(t, p, newRequest("GET", "/", ""))
+	require.NotNil(t, herr)
+	assert.Equal(t, response.StatusGatewayTimeout, herr.StatusCode)
+}
+
+func TestRoundRobin(t *testing.T) {
+	addrA, receivedA, _ := startUpstream(t, "HTTP/1.1 200 OK\r\nContent-Length: 1\r\n\r\na")
+	addrB, receivedB, _ := startUpstream(t, "HTTP/1.1 200 OK\r\nContent-Length: 1\r\n\r\nb")
+	dead := closedAddr(t)
+
+	p := New(addrA, dead, addrB)
+	p.MaxFails = 1
+	p.FailTimeout = time.Minute
+
+	// Test: Upstreams take turns and a dead one is skipped over
+	var bodies []string
+	for range 4 {
+		raw, herr := proxyRoundTrip(t, p, newRequest("GET", "/", ""))
+		require.Nil(t, herr)
+		bodies = append(bodies, raw[len(raw)-1:])
+	}
+	assert.Equal(t, []string{"a", "b", "a", "b"}, bodies)
+	assert.Len(t, receivedA, 2)
+	assert.Len(t, receivedB, 2)
+
+	// Test: With every upstream down there is nothing to try
+	p = New(dead)
+	p.MaxFails = 1
+	p.FailTimeout = time.Minute
+	_, herr := proxyRoundTrip(t, p, newRequest("GET", "/", ""))
+	require.NotNil(t, herr)
+	_, herr = proxyRoundTrip(t, p, newRequest("GET", "/", ""))
+	require.NotNil(t, herr)
+	assert.Equal(t, response.StatusBadGateway, herr.StatusCode)
+	assert.Nil(t, p.balancer.pick(map[*upstream]bool{}))
+}
+
+func TestUpstreamKeepAlive(t *testing.T) {
+	// Test: Connections are reused between requests
+	addr, _, accepted := startUpstream(t, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+	p := New(addr)
+	for range 3 {
+		_, herr := proxyRoundTrip(t, p, newRequest("GET", "/", ""))
+		require.Nil(t, herr)
+	}
+	assert.Equal(t, int32(1), accepted.Load())
+
+	// Test: Not after the upstream asks to close
+	addr, _, accepted = startUpstream(t,
+		"HTTP/1.1 200 OK\r\nContent-Length: 2\r\nConnection: close\r\n\r\nok")
+	p = New(addr)
+	for range 2 {
+		_, herr := proxyRoundTrip(t, p, newRequest("GET", "/", ""))
+		require.Nil(t, herr)
+	}
+	assert.Equal(t, int32(2), accepted.Load())
+
+	// an upstream that keeps the connection alive, then closes it once it
+	// has answered
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	received := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			req, err := request.RequestFromReader(conn)
+			if err == nil {
+				received <- string(req.Body)
+				io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+			}
+			conn.Close()
+		}
+	}()
+
+	// Test: A request on a connection the upstream closed while it was idle
+	// is sent again on a fresh one, body and all, without counting against
+	// the upstream
+	p = New(ln.Addr().String())
+	p.MaxFails = 1
+	for _, body := range []string{"", "first", "second"} {
+		_, herr := proxyRoundTrip(t, p, newRequest("POST", "/", body))
+		require.Nil(t, herr)
+		assert.Equal(t, body, <-received)
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// startTunnel serves tun on a local listener the way the server would,
+// giving it the connection and any bytes read past the request
+func startTunnel(t *testing.T, tun *Tunnel) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				req, buffered, err := request.ReadRequest(conn)
+				if err != nil {
+					conn.Close()
+					return
+				}
+
+				w := response.NewWriter(conn)
+				w.SetHijacker(func() (net.Conn, []byte, error) {
+					return conn, buffered, nil
+				})
+				if herr := tun.Serve(w, req); herr != nil {
+					herr.Write(conn)
+				}
+				if !w.Hijacked() {
+					conn.Close()
+				}
+			}()
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+// startEcho answers each connection with everything it sent, once the
+// client has half-closed it
+func startEcho(t *testing.T) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				data, _ := io.ReadAll(conn)
+				conn.Write(append([]byte("echo: "), data...))
+			}()
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+func TestTunnel(t *testing.T) {
+	target := startEcho(t)
+	_, port, _ := net.SplitHostPort(target)
+
+	tun := NewTunnel("127.0.0.1:" + port)
+	addr := startTunnel(t, tun)
+
+	connect := func(target string, extra string) (*net.TCPConn, *bufio.Reader, string) {
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+
+		io.WriteString(conn, "CONNECT "+target+" HTTP/1.1\r\nHost: "+target+"\r\n\r\n"+extra)
+		br := bufio.NewReader(conn)
+		status, err := br.ReadString('\n')
+		require.NoError(t, err)
+		return conn.(*net.TCPConn), br, status
+	}
+
+	// Test: Bytes are relayed both ways, including ones sent before the
+	// 200, and a half-close lets the destination still answer
+	conn, br, status := connect(target, "early ")
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n", status)
+
+	io.WriteString(conn, "and late")
+	require.NoError(t, conn.CloseWrite())
+
+	out, err := io.ReadAll(br)
+	require.NoError(t, err)
+	assert.Equal(t, "\r\necho: early and late", string(out))
+
+	// Test: Destinations off the allow-list
+	_, _, status = connect("127.0.0.1:1", "")
+	assert.Equal(t, "HTTP/1.1 403 Forbidden\r\n", status)
+
+	// Test: Unreachable destinations
+	tun.Allowed = append(tun.Allowed, "127.0.0.1:*")
+	_, port, _ = net.SplitHostPort(closedAddr(t))
+	_, _, status = connect("127.0.0.1:"+port, "")
+	assert.Equal(t, "HTTP/1.1 502 Bad Gateway\r\n", status)
+
+	// Test: Only CONNECT
+	herr := tun.Serve(response.NewWriter(nil), newRequest("GET", "/", ""))
+	require.NotNil(t, herr)
+	assert.Equal(t, response.StatusMethodNotAllowed, herr.StatusCode)
+	assert.Equal(t, "CONNECT", herr.Header.Get("Allow"))
+}
+
+func TestTunnelIdleTimeout(t *testing.T) {
+	// a destination that never says anything
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	tun := NewTunnel("*:*")
+	tun.IdleTimeout = 50 * time.Millisecond
+	addr := startTunnel(t, tun)
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	target := ln.Addr().String()
+	io.WriteString(conn, "CONNECT "+target+" HTTP/1.1\r\nHost: "+target+"\r\n\r\n")
+
+	// Test: Activity pushes the timeout back
+	time.Sleep(30 * time.Millisecond)
+	io.WriteString(conn, "still here")
+	time.Sleep(30 * time.Millisecond)
+
+	// Test: The tunnel closes once both sides are quiet
+	start := time.Now()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	out, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n\r\n", string(out))
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+}
+
+func TestTunnelAllowed(t *testing.T) {
+	tun := NewTunnel("example.com:443", "*.internal.test:*", "[::1]:8443")
+
+	tests := []struct {
+		host    string
+		port    string
+		allowed bool
+	}{
+		{"example.com", "443", true},
+		{"EXAMPLE.com", "443", true},
+		{"example.com", "80", false},
+		{"api.internal.test", "9000", true},
+		{"internal.test", "9000", false},
+		{"evilinternal.test", "9000", false},
+		{"::1", "8443", true},
+		{"127.0.0.1", "443", false},
+	}
+	for _, tt := range tests {
+		got := tun.allowed(request.Host{Name: tt.host, Port: tt.port})
+		assert.Equal(t, tt.allowed, got, tt.host+":"+tt.port)
+	}
+
+	// Test: Nothing is allowed by default
+	assert.False(t, NewTunnel().allowed(request.Host{Name: "example.com", Port: "443"}))
+}
@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// upstream is one backend address and its passive health state
+type upstream struct {
+	addr string
+
+	mu sync.Mutex
+	// consecutive failed attempts
+	fails int
+	// the upstream is skipped until this time after too many failures
+	downUntil time.Time
+}
+
+func (u *upstream) healthy(now time.Time) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return !now.Before(u.downUntil)
+}
+
+// failed records a failed attempt, taking the upstream out of rotation for
+// failTimeout once maxFails happen in a row
+func (u *upstream) failed(maxFails int, failTimeout time.Duration) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.fails++
+	if u.fails >= maxFails {
+		u.downUntil = time.Now().Add(failTimeout)
+		u.fails = 0
+	}
+}
+
+func (u *upstream) succeeded() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.fails = 0
+}
+
+// balancer hands out upstreams round-robin, skipping unhealthy ones
+type balancer struct {
+	upstreams []*upstream
+	next      atomic.Uint64
+}
+
+func newBalancer(addrs []string) *balancer {
+	b := &balancer{}
+	for _, addr := range addrs {
+		b.upstreams = append(b.upstreams, &upstream{addr: addr})
+	}
+	return b
+}
+
+// pick returns the next healthy upstream not in tried, or nil if there is
+// none
+func (b *balancer) pick(tried map[*upstream]bool) *upstream {
+	now := time.Now()
+	n := uint64(len(b.upstreams))
+
+	for range n {
+		u := b.upstreams[(b.next.Add(1)-1)%n]
+		if !tried[u] && u.healthy(now) {
+			return u
+		}
+	}
+	return nil
+}
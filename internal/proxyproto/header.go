@@ -0,0 +1,330 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+var (
+	// ErrInvalidHeader is returned for a PROXY header that can't be parsed
+	ErrInvalidHeader = errors.New("Invalid PROXY protocol header")
+	// ErrChecksum is returned for a v2 header whose CRC32C TLV is wrong
+	ErrChecksum = errors.New("PROXY protocol header checksum mismatch")
+)
+
+// Command says whether a header describes a proxied connection
+type Command byte
+
+const (
+	// CommandLocal is sent for connections the proxy makes itself, like
+	// health checks. The connection's own addresses are the real ones
+	CommandLocal Command = 0x0
+	// CommandProxy is sent for connections relayed for a client
+	CommandProxy Command = 0x1
+)
+
+// TLV types from the v2 specification
+const (
+	TypeALPN      byte = 0x01
+	TypeAuthority byte = 0x02
+	TypeCRC32C    byte = 0x03
+	TypeNoop      byte = 0x04
+	TypeUniqueID  byte = 0x05
+	TypeSSL       byte = 0x20
+	TypeNetNS     byte = 0x30
+)
+
+// TLV is a type-length-value extension of a v2 header
+type TLV struct {
+	Type  byte
+	Value []byte
+}
+
+// Header is a parsed PROXY protocol header
+type Header struct {
+	// Version is 1 for the text format and 2 for the binary one
+	Version int
+	Command Command
+	// Source and Destination are the client's address and the address it
+	// connected to. They are nil when the proxy didn't say, as for LOCAL
+	// connections or v1 UNKNOWN
+	Source      net.Addr
+	Destination net.Addr
+	// TLVs are the v2 extensions, in the order they were sent
+	TLVs []TLV
+}
+
+// TLV returns the value of the first extension of type typ
+func (h *Header) TLV(typ byte) ([]byte, bool) {
+	for _, tlv := range h.TLVs {
+		if tlv.Type == typ {
+			return tlv.Value, true
+		}
+	}
+	return nil, false
+}
+
+var (
+	v1Prefix    = []byte("PROXY ")
+	v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+const (
+	// v1MaxLen is the longest a v1 header can be, CRLF included
+	v1MaxLen = 107
+	// v2HeaderLen is the fixed part of a v2 header
+	v2HeaderLen = 16
+)
+
+// hasHeader reports whether br starts with a PROXY header of either
+// version, reading only as much as it takes to tell
+func hasHeader(br *bufio.Reader) (bool, error) {
+	first, err := br.Peek(1)
+	if err != nil {
+		return false, err
+	}
+
+	var sig []byte
+	switch first[0] {
+	case v1Prefix[0]:
+		sig = v1Prefix
+	case v2Signature[0]:
+		sig = v2Signature
+	default:
+		return false, nil
+	}
+
+	p, err := br.Peek(len(sig))
+	if err != nil && len(p) < len(sig) {
+		// a shorter message than the signature can't be a header
+		return false, nil
+	}
+	return bytes.Equal(p, sig), nil
+}
+
+// readHeader reads a PROXY header of either version from br
+func readHeader(br *bufio.Reader) (*Header, error) {
+	first, err := br.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if first[0] == v1Prefix[0] {
+		return readV1(br)
+	}
+	return readV2(br)
+}
+
+// readV1 parses a text header, such as
+// "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"
+func readV1(br *bufio.Reader) (*Header, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) == v1MaxLen {
+			return nil, fmt.Errorf("%w: v1 header too long", ErrInvalidHeader)
+		}
+		b, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+	}
+
+	parts := strings.Split(string(line[:len(line)-2]), " ")
+	if parts[0] != "PROXY" || len(parts) < 2 {
+		return nil, fmt.Errorf("%w: not a v1 header", ErrInvalidHeader)
+	}
+
+	h := &Header{Version: 1, Command: CommandProxy}
+	if parts[1] == "UNKNOWN" {
+		// anything after UNKNOWN is to be ignored
+		return h, nil
+	}
+
+	if len(parts) != 6 {
+		return nil, fmt.Errorf("%w: v1 header needs 6 fields", ErrInvalidHeader)
+	}
+
+	var want4 bool
+	switch parts[1] {
+	case "TCP4":
+		want4 = true
+	case "TCP6":
+	default:
+		return nil, fmt.Errorf("%w: unknown v1 protocol %q", ErrInvalidHeader, parts[1])
+	}
+
+	src, err := v1Addr(parts[2], parts[4], want4)
+	if err != nil {
+		return nil, err
+	}
+	dst, err := v1Addr(parts[3], parts[5], want4)
+	if err != nil {
+		return nil, err
+	}
+
+	h.Source, h.Destination = src, dst
+	return h, nil
+}
+
+// v1Addr parses an address and port from a v1 header
+func v1Addr(ip, port string, want4 bool) (net.Addr, error) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil || addr.Is4() != want4 || addr.Zone() != "" {
+		return nil, fmt.Errorf("%w: bad address %q", ErrInvalidHeader, ip)
+	}
+
+	// ports are plain decimal without leading zeros
+	n, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || (len(port) > 1 && port[0] == '0') {
+		return nil, fmt.Errorf("%w: bad port %q", ErrInvalidHeader, port)
+	}
+
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, uint16(n))), nil
+}
+
+// readV2 parses a binary header
+func readV2(br *bufio.Reader) (*Header, error) {
+	fixed := make([]byte, v2HeaderLen)
+	if _, err := io.ReadFull(br, fixed); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(fixed[:12], v2Signature) {
+		return nil, fmt.Errorf("%w: not a v2 header", ErrInvalidHeader)
+	}
+
+	verCmd, famProto := fixed[12], fixed[13]
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidHeader, verCmd>>4)
+	}
+	cmd := Command(verCmd & 0x0f)
+	if cmd != CommandLocal && cmd != CommandProxy {
+		return nil, fmt.Errorf("%w: unknown command %d", ErrInvalidHeader, cmd)
+	}
+
+	rest := make([]byte, binary.BigEndian.Uint16(fixed[14:]))
+	if _, err := io.ReadFull(br, rest); err != nil {
+		return nil, err
+	}
+
+	h := &Header{Version: 2, Command: cmd}
+
+	// the address block's size depends on the family; a LOCAL header's
+	// addresses are still skipped over but not used
+	var addrLen int
+	family, proto := famProto>>4, famProto&0x0f
+	switch family {
+	case 0x0:
+	case 0x1:
+		addrLen = 12
+	case 0x2:
+		addrLen = 36
+	case 0x3:
+		addrLen = 216
+	default:
+		return nil, fmt.Errorf("%w: unknown address family %d", ErrInvalidHeader, family)
+	}
+	if proto > 0x2 {
+		return nil, fmt.Errorf("%w: unknown transport %d", ErrInvalidHeader, proto)
+	}
+	if len(rest) < addrLen {
+		return nil, fmt.Errorf("%w: address block too short", ErrInvalidHeader)
+	}
+
+	if cmd == CommandProxy && addrLen > 0 {
+		h.Source, h.Destination = v2Addrs(family, proto, rest[:addrLen])
+	}
+
+	tlvs, err := parseTLVs(rest[addrLen:])
+	if err != nil {
+		return nil, err
+	}
+	h.TLVs = tlvs
+
+	if sum, ok := h.TLV(TypeCRC32C); ok {
+		if err := checkCRC(fixed, rest, sum); err != nil {
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+// v2Addrs decodes the source and destination of a v2 address block
+func v2Addrs(family, proto byte, block []byte) (net.Addr, net.Addr) {
+	if family == 0x3 {
+		name := func(b []byte) string {
+			if i := bytes.IndexByte(b, 0); i != -1 {
+				b = b[:i]
+			}
+			return string(b)
+		}
+		network := "unix"
+		if proto == 0x2 {
+			network = "unixgram"
+		}
+		return &net.UnixAddr{Name: name(block[:108]), Net: network},
+			&net.UnixAddr{Name: name(block[108:]), Net: network}
+	}
+
+	size := 4
+	if family == 0x2 {
+		size = 16
+	}
+	src, _ := netip.AddrFromSlice(block[:size])
+	dst, _ := netip.AddrFromSlice(block[size : 2*size])
+	srcPort := binary.BigEndian.Uint16(block[2*size:])
+	dstPort := binary.BigEndian.Uint16(block[2*size+2:])
+
+	if proto == 0x2 {
+		return net.UDPAddrFromAddrPort(netip.AddrPortFrom(src, srcPort)),
+			net.UDPAddrFromAddrPort(netip.AddrPortFrom(dst, dstPort))
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(src, srcPort)),
+		net.TCPAddrFromAddrPort(netip.AddrPortFrom(dst, dstPort))
+}
+
+// parseTLVs splits what follows the addresses into extensions
+func parseTLVs(p []byte) ([]TLV, error) {
+	var tlvs []TLV
+	for len(p) > 0 {
+		if len(p) < 3 {
+			return nil, fmt.Errorf("%w: truncated TLV", ErrInvalidHeader)
+		}
+		n := int(binary.BigEndian.Uint16(p[1:]))
+		if len(p) < 3+n {
+			return nil, fmt.Errorf("%w: truncated TLV", ErrInvalidHeader)
+		}
+
+		tlvs = append(tlvs, TLV{Type: p[0], Value: p[3 : 3+n]})
+		p = p[3+n:]
+	}
+	return tlvs, nil
+}
+
+// checkCRC verifies the CRC32C of the whole header, which is computed with
+// the checksum's own value zeroed
+func checkCRC(fixed, rest, sum []byte) error {
+	if len(sum) != 4 {
+		return fmt.Errorf("%w: CRC32C TLV must be 4 bytes", ErrInvalidHeader)
+	}
+	want := binary.BigEndian.Uint32(sum)
+
+	// sum points into rest, so zeroing it there zeroes it in the header
+	clear(sum)
+	table := crc32.MakeTable(crc32.Castagnoli)
+	got := crc32.Update(crc32.Checksum(fixed, table), table, rest)
+	binary.BigEndian.PutUint32(sum, want)
+
+	if got != want {
+		return ErrChecksum
+	}
+	return nil
+}
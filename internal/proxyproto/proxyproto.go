@@ -0,0 +1,197 @@
+// Package proxyproto reads the HAProxy PROXY protocol header a load balancer
+// sends at the start of each connection, so the server sees the client's
+// address rather than the balancer's
+package proxyproto
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrUntrusted is returned for a connection that sends a PROXY header
+// without coming from a trusted proxy. Anyone else could use one to claim
+// whatever address they liked
+var ErrUntrusted = errors.New("PROXY protocol header from an untrusted source")
+
+// ErrNoCloseWrite is returned by CloseWrite when the underlying connection
+// can't be half-closed
+var ErrNoCloseWrite = errors.New("Connection doesn't support CloseWrite")
+
+// ParseTrusted parses a list of CIDR ranges, single addresses standing for
+// themselves
+func ParseTrusted(cidrs ...string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			addr, err := netip.ParseAddr(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid trusted address %q: %w", cidr, err)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid trusted range %q: %w", cidr, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// Listener wraps a listener whose connections may start with a PROXY
+// header. Trusted peers must send one; anyone else sending one is rejected
+type Listener struct {
+	net.Listener
+
+	// Trusted are the proxies allowed to send a header
+	Trusted []netip.Prefix
+	// HeaderTimeout bounds how long a trusted peer has to send its header
+	HeaderTimeout time.Duration
+}
+
+// NewListener wraps ln, trusting headers from the given ranges
+func NewListener(ln net.Listener, trusted []netip.Prefix) *Listener {
+	return &Listener{
+		Listener:      ln,
+		Trusted:       trusted,
+		HeaderTimeout: 5 * time.Second,
+	}
+}
+
+// Accept returns the next connection. The header is read on first use, so
+// a slow peer doesn't hold up the others
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Conn{
+		Conn:    conn,
+		br:      bufio.NewReader(conn),
+		trusted: l.trusts(conn.RemoteAddr()),
+		timeout: l.HeaderTimeout,
+	}, nil
+}
+
+// trusts reports whether addr is in one of the trusted ranges
+func (l *Listener) trusts(addr net.Addr) bool {
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return false
+	}
+	ip := ap.Addr().Unmap()
+
+	for _, prefix := range l.Trusted {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Conn is a connection accepted by a Listener. Its addresses are the ones
+// from the PROXY header, once it has been read
+type Conn struct {
+	net.Conn
+	br *bufio.Reader
+
+	trusted bool
+	timeout time.Duration
+
+	once   sync.Once
+	header *Header
+	err    error
+}
+
+// Handshake reads the PROXY header from a trusted peer, or makes sure an
+// untrusted one hasn't sent one. It is done by the first Read or address
+// lookup otherwise, and failing closes the connection
+func (c *Conn) Handshake() error {
+	c.once.Do(func() {
+		c.err = c.handshake()
+		if c.err != nil {
+			c.Conn.Close()
+		}
+	})
+	return c.err
+}
+
+func (c *Conn) handshake() error {
+	if !c.trusted {
+		found, err := hasHeader(c.br)
+		if err != nil {
+			return err
+		}
+		if found {
+			return ErrUntrusted
+		}
+		return nil
+	}
+
+	if c.timeout > 0 {
+		c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		defer c.Conn.SetReadDeadline(time.Time{})
+	}
+
+	header, err := readHeader(c.br)
+	if err != nil {
+		return fmt.Errorf("Failed to read PROXY header: %w", err)
+	}
+	c.header = header
+	return nil
+}
+
+// Header returns the PROXY header, nil for a peer that didn't send one
+func (c *Conn) Header() *Header {
+	c.Handshake()
+	return c.header
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	if err := c.Handshake(); err != nil {
+		return 0, err
+	}
+	return c.br.Read(p)
+}
+
+// RemoteAddr returns the client's address from the header, falling back to
+// the connection's
+func (c *Conn) RemoteAddr() net.Addr {
+	if h := c.Header(); h != nil && h.Source != nil {
+		return h.Source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the address the client connected to from the header,
+// falling back to the connection's
+func (c *Conn) LocalAddr() net.Addr {
+	if h := c.Header(); h != nil && h.Destination != nil {
+		return h.Destination
+	}
+	return c.Conn.LocalAddr()
+}
+
+// CloseWrite shuts down the sending side of the underlying connection, so a
+// tunnel can still half-close it through the wrapper
+func (c *Conn) CloseWrite() error {
+	cw, ok := c.Conn.(interface{ CloseWrite() error })
+	if !ok {
+		return ErrNoCloseWrite
+	}
+	return cw.CloseWrite()
+}
+
+// ProxyAddr returns the address of the proxy itself
+func (c *Conn) ProxyAddr() net.Addr {
+	return c.Conn.RemoteAddr()
+}
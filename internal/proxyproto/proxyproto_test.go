@@ -0,0 +1,246 @@
+package proxyproto
+
+import (
+	"bufio"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func parse(t *testing.T, raw string) (*Header, string, error) {
+	t.Helper()
+
+	br := bufio.NewReader(strings.NewReader(raw))
+	h, err := readHeader(br)
+	rest, _ := io.ReadAll(br)
+	return h, string(rest), err
+}
+
+func TestReadV1(t *testing.T) {
+	// Test: TCP4 and TCP6, leaving what follows alone
+	h, rest, err := parse(t, "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\nGET /")
+	require.NoError(t, err)
+	assert.Equal(t, 1, h.Version)
+	assert.Equal(t, "192.0.2.1:56324", h.Source.String())
+	assert.Equal(t, "198.51.100.1:443", h.Destination.String())
+	assert.Equal(t, "GET /", rest)
+
+	h, _, err = parse(t, "PROXY TCP6 2001:db8::1 2001:db8::2 1 2\r\n")
+	require.NoError(t, err)
+	assert.Equal(t, "[2001:db8::1]:1", h.Source.String())
+
+	// Test: UNKNOWN has no addresses
+	h, _, err = parse(t, "PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n")
+	require.NoError(t, err)
+	assert.Nil(t, h.Source)
+
+	invalid := []string{
+		"PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n",
+		"PROXY TCP4 2001:db8::1 198.51.100.1 1 2\r\n",
+		"PROXY TCP6 192.0.2.1 198.51.100.1 1 2\r\n",
+		"PROXY UDP4 192.0.2.1 198.51.100.1 1 2\r\n",
+		"PROXY TCP4 192.0.2.1 198.51.100.1 65536 2\r\n",
+		"PROXY TCP4 192.0.2.1 198.51.100.1 01 2\r\n",
+		"PROXY TCP4  192.0.2.1 198.51.100.1 1 2\r\n",
+		"PROXY " + strings.Repeat("x", 120) + "\r\n",
+	}
+	for _, raw := range invalid {
+		_, _, err := parse(t, raw)
+		assert.ErrorIs(t, err, ErrInvalidHeader, raw)
+	}
+}
+
+// v2 builds a binary header from its parts, adding a CRC32C TLV when crc is
+// set
+func v2(cmd, famProto byte, addrs []byte, tlvs []TLV, crc bool) []byte {
+	var rest []byte
+	rest = append(rest, addrs...)
+	for _, tlv := range tlvs {
+		rest = append(rest, tlv.Type)
+		rest = binary.BigEndian.AppendUint16(rest, uint16(len(tlv.Value)))
+		rest = append(rest, tlv.Value...)
+	}
+	if crc {
+		rest = append(rest, TypeCRC32C, 0, 4, 0, 0, 0, 0)
+	}
+
+	h := append([]byte{}, v2Signature...)
+	h = append(h, 0x20|cmd, famProto)
+	h = binary.BigEndian.AppendUint16(h, uint16(len(rest)))
+	h = append(h, rest...)
+
+	if crc {
+		sum := crc32.Checksum(h, crc32.MakeTable(crc32.Castagnoli))
+		binary.BigEndian.PutUint32(h[len(h)-4:], sum)
+	}
+	return h
+}
+
+func TestReadV2(t *testing.T) {
+	ipv4 := []byte{192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0x01, 0xbb}
+
+	// Test: TCP over IPv4 with extensions and a checksum
+	raw := v2(0x1, 0x11, ipv4, []TLV{
+		{TypeAuthority, []byte("example.com")},
+		{TypeUniqueID, []byte{1, 2, 3}},
+	}, true)
+	h, rest, err := parse(t, string(raw)+"GET /")
+	require.NoError(t, err)
+	assert.Equal(t, 2, h.Version)
+	assert.Equal(t, CommandProxy, h.Command)
+	assert.Equal(t, &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1).To4(), Port: 56324}, h.Source)
+	assert.Equal(t, "198.51.100.1:443", h.Destination.String())
+	authority, ok := h.TLV(TypeAuthority)
+	assert.True(t, ok)
+	assert.Equal(t, "example.com", string(authority))
+	assert.Len(t, h.TLVs, 3)
+	assert.Equal(t, "GET /", rest)
+
+	// Test: A wrong checksum
+	raw[len(raw)-1] ^= 0xff
+	_, _, err = parse(t, string(raw))
+	assert.ErrorIs(t, err, ErrChecksum)
+
+	// Test: UDP over IPv6
+	ipv6 := make([]byte, 36)
+	copy(ipv6, netip.MustParseAddr("2001:db8::1").AsSlice())
+	copy(ipv6[16:], netip.MustParseAddr("2001:db8::2").AsSlice())
+	binary.BigEndian.PutUint16(ipv6[32:], 1000)
+	h, _, err = parse(t, string(v2(0x1, 0x22, ipv6, nil, false)))
+	require.NoError(t, err)
+	assert.Equal(t, "[2001:db8::1]:1000", h.Source.String())
+	assert.Equal(t, "udp", h.Source.Network())
+
+	// Test: Unix sockets
+	unix := make([]byte, 216)
+	copy(unix, "/run/client.sock")
+	copy(unix[108:], "/run/server.sock")
+	h, _, err = parse(t, string(v2(0x1, 0x31, unix, nil, false)))
+	require.NoError(t, err)
+	assert.Equal(t, "/run/client.sock", h.Source.String())
+
+	// Test: LOCAL skips the addresses
+	h, _, err = parse(t, string(v2(0x0, 0x11, ipv4, nil, false)))
+	require.NoError(t, err)
+	assert.Equal(t, CommandLocal, h.Command)
+	assert.Nil(t, h.Source)
+
+	invalid := [][]byte{
+		v2(0x2, 0x11, ipv4, nil, false),
+		v2(0x1, 0x41, ipv4, nil, false),
+		v2(0x1, 0x13, ipv4, nil, false),
+		v2(0x1, 0x21, ipv4, nil, false),
+		v2(0x1, 0x11, append(ipv4, TypeNoop, 0, 9), nil, false),
+	}
+	for _, raw := range invalid {
+		_, _, err := parse(t, string(raw))
+		assert.ErrorIs(t, err, ErrInvalidHeader)
+	}
+}
+
+// listen returns a Listener on loopback and a func dialling it
+func listen(t *testing.T, trusted ...string) (*Listener, func() net.Conn) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+
+	prefixes, err := ParseTrusted(trusted...)
+	require.NoError(t, err)
+
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+	return NewListener(ln, prefixes), dial
+}
+
+func TestListener(t *testing.T) {
+	l, dial := listen(t, "10.0.0.0/8", "127.0.0.1")
+
+	// Test: A trusted proxy's header replaces the addresses
+	client := dial()
+	io.WriteString(client, "PROXY TCP4 203.0.113.7 192.0.2.10 4000 80\r\nhello")
+	conn, err := l.Accept()
+	require.NoError(t, err)
+
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+	assert.Equal(t, "203.0.113.7:4000", conn.RemoteAddr().String())
+	assert.Equal(t, "192.0.2.10:80", conn.LocalAddr().String())
+	assert.Equal(t, client.LocalAddr().String(), conn.(*Conn).ProxyAddr().String())
+
+	// Test: Trusted peers have to send the header in time
+	l.HeaderTimeout = 20 * time.Millisecond
+	dial()
+	conn, err = l.Accept()
+	require.NoError(t, err)
+	err = conn.(*Conn).Handshake()
+	var netErr net.Error
+	require.ErrorAs(t, err, &netErr)
+	assert.True(t, netErr.Timeout())
+
+	// Test: And it has to be valid
+	client = dial()
+	io.WriteString(client, "GET / HTTP/1.1\r\n")
+	conn, err = l.Accept()
+	require.NoError(t, err)
+	assert.ErrorIs(t, conn.(*Conn).Handshake(), ErrInvalidHeader)
+	_, err = client.Read(buf)
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestListenerUntrusted(t *testing.T) {
+	l, dial := listen(t, "10.0.0.0/8")
+
+	// Test: Untrusted peers sending a header are dropped
+	io.WriteString(dial(), "PROXY TCP4 203.0.113.7 192.0.2.10 4000 80\r\n")
+	conn, err := l.Accept()
+	require.NoError(t, err)
+	_, err = conn.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, ErrUntrusted)
+
+	io.WriteString(dial(), string(v2Signature))
+	conn, err = l.Accept()
+	require.NoError(t, err)
+	assert.ErrorIs(t, conn.(*Conn).Handshake(), ErrUntrusted)
+
+	// Test: Otherwise they are served as they are
+	client := dial()
+	io.WriteString(client, "POST / HTTP/1.1\r\n")
+	conn, err = l.Accept()
+	require.NoError(t, err)
+	buf := make([]byte, 6)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "POST /", string(buf))
+	assert.Equal(t, client.LocalAddr().String(), conn.RemoteAddr().String())
+}
+
+func TestParseTrusted(t *testing.T) {
+	prefixes, err := ParseTrusted("10.1.2.3/8", "192.0.2.1", "2001:db8::/32")
+	require.NoError(t, err)
+	assert.Equal(t, []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("192.0.2.1/32"),
+		netip.MustParsePrefix("2001:db8::/32"),
+	}, prefixes)
+
+	_, err = ParseTrusted("10.0.0.0/33")
+	assert.Error(t, err)
+	_, err = ParseTrusted("example.com")
+	assert.Error(t, err)
+}
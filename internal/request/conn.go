@@ -0,0 +1,47 @@
+package request
+
+import (
+	"crypto/tls"
+	"net"
+	"time"
+)
+
+// ConnInfo describes the connection a request arrived on. Requests from
+// the same connection share it
+type ConnInfo struct {
+	// ID identifies the connection among the ones the server has accepted
+	ID uint64
+	// RemoteAddr is the client's address and LocalAddr the one it
+	// connected to
+	RemoteAddr net.Addr
+	LocalAddr  net.Addr
+	// TLS is the handshake state of a TLS connection, nil otherwise
+	TLS *tls.ConnectionState
+}
+
+// NewConnInfo describes conn. A TLS connection has to have finished its
+// handshake for its state to be recorded
+func NewConnInfo(id uint64, conn net.Conn) *ConnInfo {
+	info := &ConnInfo{
+		ID:         id,
+		RemoteAddr: conn.RemoteAddr(),
+		LocalAddr:  conn.LocalAddr(),
+	}
+
+	if tc, ok := conn.(interface{ ConnectionState() tls.ConnectionState }); ok {
+		state := tc.ConnectionState()
+		if state.HandshakeComplete {
+			info.TLS = &state
+		}
+	}
+	return info
+}
+
+// SetConn records that r is the seq'th request on the connection info
+// describes, which started at start
+func (r *Request) SetConn(info *ConnInfo, seq uint64, start time.Time) {
+	r.Conn = info
+	r.Seq = seq
+	r.StartTime = start
+	r.RemoteAddr = info.RemoteAddr.String()
+}
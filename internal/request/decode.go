@@ -0,0 +1,116 @@
+package request
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/yus-works/tcp-to-http/internal/headers"
+)
+
+var (
+	ErrUnsupportedContentEncoding = errors.New("Unsupported Content-Encoding")
+	ErrDecodedBodyTooLarge        = errors.New("Decoded body exceeds the size limit")
+)
+
+// DecodeBody replaces a gzip or deflate encoded Body with the decoded bytes
+// and drops the Content-Encoding header, reading the body first if the
+// server put that off. Decoding stops with
+// ErrDecodedBodyTooLarge once more than maxSize bytes come out, so a small
+// upload can't expand into gigabytes
+func (r *Request) DecodeBody(maxSize int64) error {
+	if !r.Headers.Has("content-encoding") {
+		return nil
+	}
+
+	codings, err := headers.ParseList(r.Headers.Get("content-encoding"))
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrUnsupportedContentEncoding, err)
+	}
+
+	body, err := r.ReadBody()
+	if err != nil {
+		return err
+	}
+
+	// codings are listed in the order they were applied, so undo them
+	// back to front
+	for i := len(codings) - 1; i >= 0; i-- {
+		coding := strings.ToLower(codings[i])
+		if coding == "identity" {
+			continue
+		}
+
+		body, err = decode(coding, body, maxSize)
+		if err != nil {
+			return err
+		}
+	}
+
+	r.Body = body
+	r.Headers.Del("content-encoding")
+	if r.Headers.Has("content-length") {
+		r.Headers.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	return nil
+}
+
+func decode(coding string, body []byte, maxSize int64) ([]byte, error) {
+	var dec io.Reader
+
+	switch coding {
+	case "gzip", "x-gzip":
+		gz, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid gzip body: %w", err)
+		}
+		defer gz.Close()
+		dec = gz
+
+	case "deflate":
+		// deflate is meant to be zlib wrapped, but some clients send raw
+		// deflate data, so sniff the zlib header first
+		br := bufio.NewReader(bytes.NewReader(body))
+		if isZlibHeader(br) {
+			zr, err := zlib.NewReader(br)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid deflate body: %w", err)
+			}
+			defer zr.Close()
+			dec = zr
+		} else {
+			fr := flate.NewReader(br)
+			defer fr.Close()
+			dec = fr
+		}
+
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedContentEncoding, coding)
+	}
+
+	decoded, err := io.ReadAll(io.LimitReader(dec, maxSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decode %s body: %w", coding, err)
+	}
+	if int64(len(decoded)) > maxSize {
+		return nil, ErrDecodedBodyTooLarge
+	}
+	return decoded, nil
+}
+
+// isZlibHeader checks for a zlib header (RFC 1950 2.2): deflate compression
+// method and a check value that makes the first two bytes a multiple of 31
+func isZlibHeader(br *bufio.Reader) bool {
+	hdr, err := br.Peek(2)
+	if err != nil {
+		return false
+	}
+	return hdr[0]&0x0f == 8 && (uint16(hdr[0])<<8|uint16(hdr[1]))%31 == 0
+}
@@ -0,0 +1,295 @@
+package request
+
+import (
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+// Origin is where a request really came from once trusted proxies are
+// looked past: the client's address, and the scheme and host it asked for
+type Origin struct {
+	// IP is the client's address. It is invalid when a trusted proxy didn't
+	// know it or kept it hidden
+	IP     netip.Addr
+	Scheme string
+	Host   Host
+}
+
+// ForwardedHeaders says which headers the trusted proxies describe the
+// client in. Only that kind is read, since whatever the proxies don't set
+// themselves reaches us exactly as the client sent it
+type ForwardedHeaders int
+
+const (
+	// HeaderXForwarded is X-Forwarded-For, with X-Forwarded-Proto and
+	// X-Forwarded-Host
+	HeaderXForwarded ForwardedHeaders = iota
+	// HeaderForwarded is the Forwarded header (RFC 7239)
+	HeaderForwarded
+)
+
+// hop is one proxy's account of the connection it received. ip is invalid
+// where the proxy didn't say or hid it, and proto and host are empty where
+// it didn't pass them on
+type hop struct {
+	ip    netip.Addr
+	proto string
+	host  string
+}
+
+// ResolveOrigin sets r.Origin. Without a trusted proxy in front it comes
+// from the connection itself. Otherwise the hops in the from headers are
+// walked from the nearest back, stopping at the first address that isn't
+// trusted, which is the client. Anything further left came from it and
+// could be made up
+func (r *Request) ResolveOrigin(trusted []netip.Prefix, from ForwardedHeaders) {
+	r.Origin = r.directOrigin()
+	if !trusts(trusted, r.Origin.IP) {
+		return
+	}
+
+	hops := r.forwardedHops(from)
+	for i := len(hops) - 1; i >= 0; i-- {
+		h := hops[i]
+		// this hop was added by a proxy we trust, so what it saw stands
+		if defaultPorts[h.proto] != "" {
+			r.Origin.Scheme = h.proto
+		}
+		if host, err := ParseHost(h.host); err == nil {
+			r.Origin.Host = host
+		}
+
+		// an unknown address ends the walk too, leaving no client rather
+		// than passing off the proxy as one
+		r.Origin.IP = h.ip
+		if !trusts(trusted, h.ip) {
+			return
+		}
+	}
+}
+
+// directOrigin is the origin as the connection has it
+func (r *Request) directOrigin() Origin {
+	o := Origin{Scheme: "http", Host: r.Host}
+	if r.Conn != nil && r.Conn.TLS != nil {
+		o.Scheme = "https"
+	}
+	if ap, err := netip.ParseAddrPort(r.RemoteAddr); err == nil {
+		o.IP = ap.Addr().Unmap()
+	}
+	return o
+}
+
+// trusts reports whether ip is in one of the trusted ranges
+func trusts(trusted []netip.Prefix, ip netip.Addr) bool {
+	if !ip.IsValid() {
+		return false
+	}
+	for _, prefix := range trusted {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedHops returns the hops the from headers list, furthest first
+func (r *Request) forwardedHops(from ForwardedHeaders) []hop {
+	if from == HeaderForwarded {
+		return parseForwarded(r.Headers.Get("forwarded"))
+	}
+
+	ips := splitList(r.Headers.Get("x-forwarded-for"))
+	hops := make([]hop, len(ips))
+	for i, ip := range ips {
+		hops[i].ip = parseNode(ip)
+	}
+
+	// each proxy may have added its own value, lining up with the
+	// addresses. Otherwise the one value is from the nearest proxy
+	protos := splitList(r.Headers.Get("x-forwarded-proto"))
+	hosts := splitList(r.Headers.Get("x-forwarded-host"))
+	for i := range hops {
+		if len(protos) == len(hops) {
+			hops[i].proto = strings.ToLower(protos[i])
+		}
+		if len(hosts) == len(hops) {
+			hops[i].host = hosts[i]
+		}
+	}
+	if last := len(hops) - 1; last >= 0 {
+		if len(protos) > 0 && len(protos) != len(hops) {
+			hops[last].proto = strings.ToLower(protos[len(protos)-1])
+		}
+		if len(hosts) > 0 && len(hosts) != len(hops) {
+			hops[last].host = hosts[len(hosts)-1]
+		}
+	}
+	return hops
+}
+
+// splitList splits a comma separated header value, dropping empty elements
+func splitList(v string) []string {
+	var list []string
+	for _, el := range strings.Split(v, ",") {
+		if el = strings.Trim(el, " \t"); el != "" {
+			list = append(list, el)
+		}
+	}
+	return list
+}
+
+// parseForwarded parses a Forwarded header value such as
+// `for=192.0.2.60;proto=http, for="[2001:db8:cafe::17]:4711"`. It works
+// back from the right, as the elements on the left may be the client's and
+// anything but well formed. The first that can't be parsed ends the list
+// as a hop with no address
+func parseForwarded(v string) []hop {
+	var hops []hop
+	for v != "" {
+		var element string
+		var ok bool
+		v, element, ok = cutLastElement(v)
+		if !ok {
+			hops = append(hops, hop{})
+			break
+		}
+		if strings.Trim(element, " \t") == "" {
+			continue
+		}
+
+		h, ok := parseElement(element)
+		hops = append(hops, h)
+		if !ok {
+			break
+		}
+	}
+
+	slices.Reverse(hops)
+	return hops
+}
+
+// cutLastElement splits off the last comma separated element of v, minding
+// quoted strings. It reports false when a quote is left open
+func cutLastElement(v string) (rest, element string, ok bool) {
+	quoted := false
+	for i := len(v) - 1; i >= 0; i-- {
+		switch {
+		case v[i] == '"' && quoted && escaped(v, i):
+		case v[i] == '"':
+			quoted = !quoted
+		case v[i] == ',' && !quoted:
+			return v[:i], v[i+1:], true
+		}
+	}
+	if quoted {
+		return "", "", false
+	}
+	return "", v, true
+}
+
+// escaped reports whether the byte at i follows an odd number of
+// backslashes
+func escaped(v string, i int) bool {
+	n := 0
+	for i--; i >= 0 && v[i] == '\\'; i-- {
+		n++
+	}
+	return n%2 == 1
+}
+
+// parseElement parses one element of a Forwarded header, a list of
+// name=value pairs. A bad element gives a hop with no address
+func parseElement(element string) (hop, bool) {
+	pairs, ok := splitQuoted(element, ';')
+	if !ok {
+		return hop{}, false
+	}
+
+	var h hop
+	for _, pair := range pairs {
+		name, value, found := strings.Cut(strings.Trim(pair, " \t"), "=")
+		if !found || name == "" {
+			return hop{}, false
+		}
+		value, ok := unquote(value)
+		if !ok {
+			return hop{}, false
+		}
+
+		switch strings.ToLower(name) {
+		case "for":
+			h.ip = parseNode(value)
+		case "proto":
+			h.proto = strings.ToLower(value)
+		case "host":
+			h.host = value
+		}
+	}
+	return h, true
+}
+
+// splitQuoted splits v on sep outside of quoted strings. It reports false
+// for an unterminated quote
+func splitQuoted(v string, sep byte) ([]string, bool) {
+	var parts []string
+	start, quoted := 0, false
+	for i := 0; i < len(v); i++ {
+		switch {
+		case quoted && v[i] == '\\':
+			i++
+		case v[i] == '"':
+			quoted = !quoted
+		case !quoted && v[i] == sep:
+			parts = append(parts, v[start:i])
+			start = i + 1
+		}
+	}
+	if quoted {
+		return nil, false
+	}
+	return append(parts, v[start:]), true
+}
+
+// unquote returns a token as it is and a quoted string without its quotes
+// and escapes
+func unquote(v string) (string, bool) {
+	if !strings.HasPrefix(v, `"`) {
+		return v, !strings.Contains(v, `"`)
+	}
+	if len(v) < 2 || !strings.HasSuffix(v, `"`) {
+		return "", false
+	}
+
+	var b strings.Builder
+	inner := v[1 : len(v)-1]
+	for i := 0; i < len(inner); i++ {
+		if inner[i] == '\\' && i+1 < len(inner) {
+			i++
+		}
+		b.WriteByte(inner[i])
+	}
+	return b.String(), true
+}
+
+// parseNode returns the address of a forwarded node, which may have a port
+// and, for IPv6, brackets. "unknown" and obfuscated identifiers give an
+// invalid address
+func parseNode(v string) netip.Addr {
+	if ip, err := netip.ParseAddr(v); err == nil {
+		return ip.Unmap()
+	}
+	if ap, err := netip.ParseAddrPort(v); err == nil {
+		return ap.Addr().Unmap()
+	}
+	if literal, ok := strings.CutPrefix(v, "["); ok {
+		// a port may be obfuscated too
+		if end := strings.IndexByte(literal, ']'); end != -1 {
+			if ip, err := netip.ParseAddr(literal[:end]); err == nil && ip.Is6() {
+				return ip
+			}
+		}
+	}
+	return netip.Addr{}
+}
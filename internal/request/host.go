@@ -0,0 +1,208 @@
+package request
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/yus-works/tcp-to-http/internal/framing"
+)
+
+// Host is the parsed value of the Host header
+type Host struct {
+	// Name is a hostname, an IPv4 address or an IPv6 address (without the
+	// brackets)
+	Name string
+	// Port is empty when the header didn't include one
+	Port string
+}
+
+func (h Host) String() string {
+	name := h.Name
+	if strings.Contains(name, ":") {
+		name = "[" + name + "]"
+	}
+
+	if h.Port == "" {
+		return name
+	}
+	return name + ":" + h.Port
+}
+
+var (
+	ErrMissingHost  = errors.New("Request is missing the Host header")
+	ErrMultipleHost = errors.New("Request has more than one Host header")
+	ErrInvalidHost  = errors.New("Invalid Host header value")
+	ErrHostMismatch = errors.New("Host header does not match the request target")
+)
+
+var defaultPorts = map[string]string{
+	"http":  "80",
+	"https": "443",
+}
+
+func isRegNameChar(c byte) bool {
+	return 'a' <= c && c <= 'z' ||
+		'A' <= c && c <= 'Z' ||
+		'0' <= c && c <= '9' ||
+		c == '-' || c == '.' || c == '_' || c == '~'
+}
+
+// ParseHost parses a uri-host with an optional port, as used by the Host
+// header and the authority of absolute-form targets (RFC 9110 7.2)
+func ParseHost(v string) (Host, error) {
+	var host Host
+
+	rest := v
+	if strings.HasPrefix(rest, "[") {
+		end := strings.IndexByte(rest, ']')
+		if end == -1 {
+			return Host{}, ErrInvalidHost
+		}
+
+		literal := rest[1:end]
+		if net.ParseIP(literal) == nil || !strings.Contains(literal, ":") {
+			return Host{}, ErrInvalidHost
+		}
+
+		host.Name = literal
+		rest = rest[end+1:]
+	} else {
+		end := strings.IndexByte(rest, ':')
+		if end == -1 {
+			end = len(rest)
+		}
+
+		name := rest[:end]
+		if name == "" {
+			return Host{}, ErrInvalidHost
+		}
+		for i := 0; i < len(name); i++ {
+			if !isRegNameChar(name[i]) {
+				return Host{}, ErrInvalidHost
+			}
+		}
+
+		host.Name = name
+		rest = rest[end:]
+	}
+
+	if rest == "" {
+		return host, nil
+	}
+
+	port, ok := strings.CutPrefix(rest, ":")
+	if !ok || !framing.IsDigits(port) {
+		return Host{}, ErrInvalidHost
+	}
+
+	n, err := strconv.Atoi(port)
+	if err != nil || n > 65535 {
+		return Host{}, ErrInvalidHost
+	}
+
+	host.Port = port
+	return host, nil
+}
+
+// parseAuthority parses an authority-form target, which always has a port
+func parseAuthority(target string) (Host, error) {
+	host, err := ParseHost(target)
+	if err != nil {
+		return Host{}, err
+	}
+	if host.Port == "" {
+		return Host{}, ErrInvalidHost
+	}
+	return host, nil
+}
+
+// Authority returns the host and port of a CONNECT request's target
+func (rl RequestLine) Authority() (Host, error) {
+	if rl.Method != "CONNECT" {
+		return Host{}, ErrInvalidHost
+	}
+	return parseAuthority(rl.RequestTarget)
+}
+
+// targetAuthority returns the scheme and authority of an absolute-form
+// request target, or ok=false for any other form
+func targetAuthority(target string) (scheme string, authority string, ok bool) {
+	scheme, rest, found := strings.Cut(target, "://")
+	if !found {
+		return "", "", false
+	}
+	scheme = strings.ToLower(scheme)
+	if _, known := defaultPorts[scheme]; !known {
+		return "", "", false
+	}
+
+	end := strings.IndexAny(rest, "/?#")
+	if end == -1 {
+		end = len(rest)
+	}
+	return scheme, rest[:end], true
+}
+
+// sameHost compares two hosts, treating a missing port as the scheme's
+// default port
+func sameHost(a, b Host, scheme string) bool {
+	portA, portB := a.Port, b.Port
+	if portA == "" {
+		portA = defaultPorts[scheme]
+	}
+	if portB == "" {
+		portB = defaultPorts[scheme]
+	}
+	return strings.EqualFold(a.Name, b.Name) && portA == portB
+}
+
+// parseHostHeader enforces exactly one valid Host header and, for
+// absolute-form and authority-form targets, that it agrees with the
+// target's authority
+func (r *Request) parseHostHeader() error {
+	vals := r.Headers.Values("host")
+	if len(vals) == 0 {
+		return ErrMissingHost
+	}
+
+	if len(vals) > 1 {
+		return ErrMultipleHost
+	}
+
+	host, err := ParseHost(vals[0])
+	if err != nil {
+		return err
+	}
+
+	if r.RequestLine.Method == "CONNECT" {
+		targetHost, err := r.RequestLine.Authority()
+		if err != nil {
+			return err
+		}
+
+		// the target always has a port, so one left off Host can't be
+		// filled in from a scheme
+		if !strings.EqualFold(host.Name, targetHost.Name) ||
+			(host.Port != "" && host.Port != targetHost.Port) {
+			return ErrHostMismatch
+		}
+	} else if scheme, authority, ok := targetAuthority(r.RequestLine.RequestTarget); ok {
+		if strings.Contains(authority, "@") {
+			return ErrInvalidHost
+		}
+
+		targetHost, err := ParseHost(authority)
+		if err != nil {
+			return err
+		}
+
+		if !sameHost(host, targetHost, scheme) {
+			return ErrHostMismatch
+		}
+	}
+
+	r.Host = host
+	return nil
+}
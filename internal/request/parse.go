@@ -12,6 +12,7 @@ var methods = map[string]struct{}{
 	"POST":    {},
 	"DELETE":  {},
 	"OPTIONS": {},
+	"CONNECT": {},
 }
 
 var versions = map[string]struct{}{
@@ -49,7 +50,12 @@ func parseRequestLine(data []byte) (*RequestLine, int, error) {
 	reqLine.Method = method
 
 	target := parts[1]
-	if !isValidTarget.Match(target) {
+	if method == "CONNECT" {
+		// CONNECT takes the authority-form and nothing else (RFC 9112 3.2.3)
+		if _, err := parseAuthority(string(target)); err != nil {
+			return nil, 0, fmt.Errorf("CONNECT TARGET must be host:port")
+		}
+	} else if !isValidTarget.Match(target) {
 		return nil, 0, fmt.Errorf("Request TARGET must follow [/].* (for now)")
 	}
 
@@ -1,10 +1,14 @@
 package request
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
-	"strconv"
+	"strings"
+	"time"
 
+	"github.com/yus-works/tcp-to-http/internal/framing"
 	"github.com/yus-works/tcp-to-http/internal/headers"
 )
 
@@ -12,7 +16,49 @@ type Request struct {
 	RequestLine RequestLine
 	state       parserState
 	Headers     *headers.Headers
-	Body        []byte
+	// Body is the body once it has been read. The server puts off reading
+	// it for requests with ExpectContinue set and when streaming bodies,
+	// and then has no more than what came in with the head until ReadBody
+	// is called. Handlers that may get such requests use ReadBody instead
+	Body []byte
+
+	// Host is the validated value of the Host header
+	Host Host
+
+	// Trailers holds the trailer fields sent after a chunked body
+	Trailers *headers.Headers
+
+	// RemoteAddr is the client's address as host:port, set by the server
+	RemoteAddr string
+
+	// Conn describes the connection the request arrived on, and Seq counts
+	// the requests on it from 1. Both are set by the server, see SetConn
+	Conn *ConnInfo
+	Seq  uint64
+	// StartTime is when the server started reading the request
+	StartTime time.Time
+
+	// Origin is the client and the scheme and host it used, looking past
+	// trusted proxies. It is set by the server, see ResolveOrigin
+	Origin Origin
+
+	// ExpectContinue is set when the client sent Expect: 100-continue and
+	// is waiting for the go-ahead before sending the body
+	ExpectContinue bool
+
+	contentLength  int
+	chunkRemaining int
+	// bodyRead counts the body bytes parsed, which may have been handed out
+	// of Body already, see Reader.BodyReader
+	bodyRead int
+	// maxBodySize is the largest body accepted, 0 for no limit
+	maxBodySize int
+
+	// readBody reads a body the server put off reading and openBody streams
+	// it instead, see DeferBody
+	readBody func() error
+	openBody func() (io.Reader, error)
+	bodyErr  error
 }
 
 type RequestLine struct {
@@ -21,6 +67,24 @@ type RequestLine struct {
 	Method        string
 }
 
+// Path returns the path of the request target without the query, for both
+// origin-form and absolute-form targets. It is not percent-decoded
+func (rl RequestLine) Path() string {
+	target := rl.RequestTarget
+	if _, authority, ok := targetAuthority(target); ok {
+		_, rest, _ := strings.Cut(target, "://")
+		target = strings.TrimPrefix(rest, authority)
+	}
+
+	if i := strings.IndexAny(target, "?#"); i != -1 {
+		target = target[:i]
+	}
+	if target == "" {
+		return "/"
+	}
+	return target
+}
+
 type parserState string
 
 const (
@@ -28,8 +92,98 @@ const (
 	StateDone    parserState = "done"
 	StateHeaders parserState = "headers"
 	StateBody    parserState = "body"
+
+	StateChunkSize    parserState = "chunk size"
+	StateChunkData    parserState = "chunk data"
+	StateChunkDataEnd parserState = "chunk data end"
+	StateTrailers     parserState = "trailers"
+)
+
+// Errors returned for requests whose body framing is ambiguous. Front-end
+// proxies and this server must agree on where a request ends, otherwise the
+// leftover bytes get interpreted as a second, smuggled request, so anything
+// that is not unambiguous is rejected (RFC 9112 6.1 - 6.3).
+var (
+	ErrContentLengthWithTransferEncoding = errors.New(
+		"Request has both Content-Length and Transfer-Encoding",
+	)
+	ErrConflictingContentLength    = framing.ErrConflictingContentLength
+	ErrInvalidContentLength        = framing.ErrInvalidContentLength
+	ErrUnsupportedTransferEncoding = errors.New("Unsupported Transfer-Encoding")
+	ErrInvalidChunk                = framing.ErrInvalidChunk
 )
 
+var (
+	// ErrBodyTooLarge is returned for a body over the Reader's MaxBodySize.
+	// A Content-Length over it is rejected before any of the body is read
+	ErrBodyTooLarge = errors.New("Request body too large")
+	// ErrUnsupportedExpectation is returned for an Expect header asking for
+	// anything but 100-continue (RFC 9110 10.1.1)
+	ErrUnsupportedExpectation = errors.New("Unsupported expectation")
+	// ErrBodyStreamed is returned by ReadBody once BodyReader has taken the
+	// body off the connection
+	ErrBodyStreamed = errors.New("Request body was streamed")
+)
+
+// isChunked reports whether the Transfer-Encoding value is exactly
+// "chunked". Other codings can't be decoded, and applying chunked more than
+// once or not as the final coding leaves the length undetermined
+func isChunked(v string) bool {
+	codings := strings.Split(v, ",")
+	if len(codings) != 1 {
+		return false
+	}
+	return strings.EqualFold(strings.Trim(codings[0], " \t"), "chunked")
+}
+
+// startBody picks the body state once all headers have been parsed
+func (r *Request) startBody() error {
+	hasTE := r.Headers.Has("transfer-encoding")
+	hasCL := r.Headers.Has("content-length")
+
+	if hasTE && hasCL {
+		return ErrContentLengthWithTransferEncoding
+	}
+
+	if hasTE {
+		if !isChunked(r.Headers.Get("transfer-encoding")) {
+			return ErrUnsupportedTransferEncoding
+		}
+		r.state = StateChunkSize
+		return nil
+	}
+
+	if hasCL {
+		ln, err := framing.ParseContentLength(r.Headers.Get("content-length"))
+		if err != nil {
+			return err
+		}
+		if r.maxBodySize > 0 && ln > r.maxBodySize {
+			return ErrBodyTooLarge
+		}
+		r.contentLength = ln
+		r.state = StateBody
+		return nil
+	}
+
+	r.state = StateDone
+	return nil
+}
+
+// parseExpect checks the Expect header, 100-continue being the only
+// expectation there is
+func (r *Request) parseExpect() error {
+	if !r.Headers.Has("expect") {
+		return nil
+	}
+
+	if !strings.EqualFold(strings.Trim(r.Headers.Get("expect"), " \t"), "100-continue") {
+		return ErrUnsupportedExpectation
+	}
+	r.ExpectContinue = true
+	return nil
+}
+
 func (r *Request) parse(data []byte) (int, error) {
 	consumed := 0
 	// TODO: is this loop doing anything
@@ -58,13 +212,23 @@ func (r *Request) parse(data []byte) (int, error) {
 			}
 
 			if done {
-				r.state = StateBody
-
 				// done means CRLF at start of buf
 				// so += 2 to skip those two bytes
 				consumed += 2
 				consumed += n
 
+				if err := r.parseHostHeader(); err != nil {
+					return consumed, err
+				}
+
+				if err := r.parseExpect(); err != nil {
+					return consumed, err
+				}
+
+				if err := r.startBody(); err != nil {
+					return consumed, err
+				}
+
 				continue
 			}
 
@@ -75,27 +239,85 @@ func (r *Request) parse(data []byte) (int, error) {
 			}
 
 		case StateBody:
-			clen := r.Headers.Get("content-length")
-			if clen == "" {
+			ln := r.contentLength
+
+			remaining := ln - r.bodyRead
+			available := len(data) - consumed
+			toRead := min(remaining, available)
+
+			r.Body = append(r.Body, data[consumed:consumed+toRead]...)
+			r.bodyRead += toRead
+			consumed += toRead
+
+			if r.bodyRead == ln {
 				r.state = StateDone
-				return consumed, nil
 			}
+			return consumed, nil
 
-			ln, err := strconv.Atoi(clen)
+		case StateChunkSize:
+			size, n, err := framing.ParseChunkSize(data[consumed:])
 			if err != nil {
 				return consumed, err
 			}
 
-			remaining := ln - len(r.Body)
+			if n == 0 {
+				return consumed, nil
+			}
+
+			consumed += n
+			r.chunkRemaining = size
+
+			if r.maxBodySize > 0 && r.bodyRead+size > r.maxBodySize {
+				return consumed, ErrBodyTooLarge
+			}
+
+			if size == 0 {
+				r.state = StateTrailers
+			} else {
+				r.state = StateChunkData
+			}
+
+		case StateChunkData:
 			available := len(data) - consumed
-			toRead := min(remaining, available)
+			toRead := min(r.chunkRemaining, available)
 
 			r.Body = append(r.Body, data[consumed:consumed+toRead]...)
+			r.bodyRead += toRead
 			consumed += toRead
+			r.chunkRemaining -= toRead
+
+			if r.chunkRemaining > 0 {
+				return consumed, nil
+			}
 
-			if len(r.Body) == ln {
+			r.state = StateChunkDataEnd
+
+		case StateChunkDataEnd:
+			if len(data)-consumed < len(CRLF) {
+				return consumed, nil
+			}
+
+			if !bytes.HasPrefix(data[consumed:], CRLF) {
+				return consumed, ErrInvalidChunk
+			}
+
+			consumed += len(CRLF)
+			r.state = StateChunkSize
+
+		case StateTrailers:
+			n, done, err := r.Trailers.Parse(data[consumed:])
+			if err != nil {
+				return consumed, err
+			}
+
+			consumed += n
+
+			if done {
+				consumed += len(CRLF)
 				r.state = StateDone
+				continue
 			}
+
 			return consumed, nil
 
 		case StateDone:
@@ -113,29 +335,178 @@ func (r *Request) done() bool {
 
 func newRequest() *Request {
 	return &Request{
-		state:   StateInit,
-		Headers: headers.NewHeaders(),
+		state:    StateInit,
+		Headers:  headers.NewHeaders(),
+		Trailers: headers.NewHeaders(),
+	}
+}
+
+// NewRequest builds a request whose head arrived some other way than as
+// HTTP/1.1 text, such as in an HTTP/2 HEADERS frame. Host, Expect and
+// Content-Length are checked as they would be for HTTP/1.1, the last
+// against maxBodySize. The body is left for the caller to fill in
+func NewRequest(line RequestLine, h *headers.Headers, maxBodySize int) (*Request, error) {
+	if _, ok := methods[line.Method]; !ok {
+		return nil, fmt.Errorf("Request METHOD not found in allowed set")
+	}
+	if line.Method == "CONNECT" {
+		if _, err := parseAuthority(line.RequestTarget); err != nil {
+			return nil, fmt.Errorf("CONNECT TARGET must be host:port")
+		}
+	} else if !isValidTarget.MatchString(line.RequestTarget) {
+		return nil, fmt.Errorf("Request TARGET must follow [/].* (for now)")
+	}
+
+	r := newRequest()
+	r.RequestLine = line
+	r.Headers = h
+	r.maxBodySize = maxBodySize
+
+	if err := r.parseHostHeader(); err != nil {
+		return nil, err
+	}
+	if err := r.parseExpect(); err != nil {
+		return nil, err
 	}
+	if err := r.startBody(); err != nil {
+		return nil, err
+	}
+
+	r.state = StateDone
+	return r, nil
+}
+
+// ContentLength returns the length given by the Content-Length header, or
+// -1 if there isn't one
+func (r *Request) ContentLength() int {
+	if !r.Headers.Has("content-length") {
+		return -1
+	}
+	return r.contentLength
 }
 
 func RequestFromReader(reader io.Reader) (*Request, error) {
-	request := newRequest()
+	request, _, err := ReadRequest(reader)
+	return request, err
+}
 
-	// TODO: add buffer resizing
-	buf := make([]byte, 1024)
+// ReadRequest is RequestFromReader for callers that keep using the
+// connection afterwards. It also returns the bytes that were read past the
+// end of the request, which belong to whatever the client sent next
+func ReadRequest(reader io.Reader) (*Request, []byte, error) {
+	rr := NewReader(reader)
 
+	request, err := rr.ReadHead()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := rr.ReadBody(); err != nil {
+		return nil, nil, err
+	}
+
+	return request, rr.Buffered(), nil
+}
+
+// Reader reads a request in two steps, so that reading the body can be put
+// off until it is wanted
+type Reader struct {
+	reader io.Reader
+
+	// MaxBodySize rejects bodies larger than this with ErrBodyTooLarge.
+	// Zero means no limit
+	MaxBodySize int
+
+	request *Request
+
+	// TODO: add buffer resizing
+	buf []byte
 	// this indexes the last byte in the buf that stores data
-	dataEnd := 0
-	for !request.done() {
+	dataEnd int
+}
+
+func NewReader(reader io.Reader) *Reader {
+	return &Reader{
+		reader: reader,
+		buf:    make([]byte, 1024),
+	}
+}
+
+// ReadHead reads the request line and headers. Any of the body that came
+// in with them is parsed too, but no more is read
+func (rr *Reader) ReadHead() (*Request, error) {
+	rr.request = newRequest()
+	rr.request.maxBodySize = rr.MaxBodySize
+
+	err := rr.readUntil(func() bool {
+		return rr.request.state != StateInit && rr.request.state != StateHeaders
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rr.request, nil
+}
+
+// ReadBody reads the rest of the request ReadHead started on
+func (rr *Reader) ReadBody() error {
+	return rr.readUntil(rr.request.done)
+}
+
+// BodyReader streams the rest of the body, without its chunked framing,
+// handing out what is parsed instead of collecting it in the request's Body
+func (rr *Reader) BodyReader() io.Reader {
+	return &bodyReader{rr: rr}
+}
+
+type bodyReader struct {
+	rr *Reader
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	r := b.rr.request
+	if len(r.Body) == 0 {
+		if r.done() {
+			return 0, io.EOF
+		}
+		err := b.rr.readUntil(func() bool { return len(r.Body) > 0 || r.done() })
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, r.Body)
+	r.Body = r.Body[n:]
+	return n, nil
+}
+
+// BodyDone reports whether the whole request has been read, which is true
+// straight after ReadHead for requests without a body
+func (rr *Reader) BodyDone() bool {
+	return rr.request.done()
+}
+
+// Buffered returns the bytes read past what has been parsed so far
+func (rr *Reader) Buffered() []byte {
+	if rr.dataEnd == 0 {
+		return nil
+	}
+	return bytes.Clone(rr.buf[:rr.dataEnd])
+}
+
+// readUntil keeps reading and parsing until stop reports true
+func (rr *Reader) readUntil(stop func() bool) error {
+	request := rr.request
+	buf := rr.buf
+
+	for !stop() {
 		// this just keeps reading into the buffer
-		readN, readErr := reader.Read(buf[dataEnd:])
+		readN, readErr := rr.reader.Read(buf[rr.dataEnd:])
 
 		if readN > 0 {
-			dataEnd += readN
+			rr.dataEnd += readN
 
-			parsedN, parseErr := request.parse(buf[:dataEnd])
+			parsedN, parseErr := request.parse(buf[:rr.dataEnd])
 			if parseErr != nil {
-				return nil, parseErr
+				return parseErr
 			}
 
 			// when it returns non zero, it means it parsed a valid line
@@ -147,45 +518,81 @@ func RequestFromReader(reader io.Reader) (*Request, error) {
 				// after the length the parser says it consumed and copy it
 				// to the start because that might be the start of another line
 
-				copy(buf, buf[parsedN:dataEnd])
-				dataEnd -= parsedN
+				copy(buf, buf[parsedN:rr.dataEnd])
+				rr.dataEnd -= parsedN
 			}
 		}
 
 		if readErr == io.EOF {
 			// try to parse any remaining data
-			if dataEnd > 0 {
-				_, parseErr := request.parse(buf[:dataEnd])
+			if rr.dataEnd > 0 {
+				parsedN, parseErr := request.parse(buf[:rr.dataEnd])
 				if parseErr != nil {
-					return nil, parseErr
+					return parseErr
 				}
+				copy(buf, buf[parsedN:rr.dataEnd])
+				rr.dataEnd -= parsedN
 			}
 
 			// check if body is done
 			if request.state == StateBody {
-				if cl := request.Headers.Get("content-length"); cl != "" {
-					ln, _ := strconv.Atoi(cl)
-					if len(request.Body) < ln {
-						return nil, fmt.Errorf("incomplete body: expected %d bytes, got %d", ln, len(request.Body))
-					}
+				ln := request.contentLength
+				if request.bodyRead < ln {
+					return fmt.Errorf("incomplete body: expected %d bytes, got %d", ln, request.bodyRead)
 				}
 				request.state = StateDone
 			}
 
-			if request.done() {
+			if stop() {
 				break
 			}
 
-			return nil, fmt.Errorf("unexpected EOF in state %s", request.state)
+			return fmt.Errorf("unexpected EOF in state %s", request.state)
 		}
 
 		if readErr != nil {
-			return nil, readErr
+			return readErr
 		}
 
 		// keep reading and trying to parse until parse() returns non zero or
 		// read errors
 	}
 
-	return request, nil
+	return nil
+}
+
+// DeferBody leaves the body on the connection until it is asked for: read
+// reads all of it the first time ReadBody is called, and open starts
+// streaming it for BodyReader. The server uses it to hold off on a body the
+// client won't send until told to continue, and to let handlers stream
+// bodies
+func (r *Request) DeferBody(read func() error, open func() (io.Reader, error)) {
+	r.readBody = read
+	r.openBody = open
+}
+
+// ReadBody returns the body, reading it first if the server put that off
+func (r *Request) ReadBody() ([]byte, error) {
+	if r.readBody != nil {
+		read := r.readBody
+		r.readBody, r.openBody = nil, nil
+		r.bodyErr = read()
+	}
+	return r.Body, r.bodyErr
+}
+
+// BodyReader returns a reader over the body. A body the server put off
+// reading is streamed from the connection as it is read rather than
+// collected in Body, and comes as the client sent it, in any
+// Content-Encoding. After that ReadBody fails with ErrBodyStreamed
+func (r *Request) BodyReader() (io.Reader, error) {
+	if r.openBody == nil {
+		body, err := r.ReadBody()
+		return bytes.NewReader(body), err
+	}
+
+	open := r.openBody
+	r.readBody, r.openBody = nil, nil
+	r.bodyErr = ErrBodyStreamed
+	return open()
 }
@@ -1,13 +1,22 @@
 package request
 
 import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/tls"
 	"fmt"
 	"io"
+	"net"
+	"net/netip"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/yus-works/tcp-to-http/internal/headers"
 )
 
 type chunkReader struct {
@@ -280,10 +289,8 @@ func TestRequestParseHeaders(t *testing.T) {
 		data:            "GET / HTTP/1.1\r\n\r\n",
 		numBytesPerRead: 3,
 	}
-	r, err = RequestFromReader(reader)
-	require.NoError(t, err)
-	require.NotNil(t, r)
-	assert.Equal(t, 0, len(*r.Headers))
+	_, err = RequestFromReader(reader)
+	require.ErrorIs(t, err, ErrMissingHost)
 
 	// Test: Malformed Header
 	reader = &chunkReader{
@@ -295,13 +302,14 @@ func TestRequestParseHeaders(t *testing.T) {
 
 	// Test: Duplicate Headers
 	reader = &chunkReader{
-		data:            "GET / HTTP/1.1\r\nSet-Cookie: session=abc\r\nSet-Cookie: user=123\r\nSet-Cookie: theme=dark\r\n\r\n",
+		data:            "GET / HTTP/1.1\r\nHost: localhost\r\nSet-Cookie: session=abc\r\nSet-Cookie: user=123\r\nSet-Cookie: theme=dark\r\n\r\n",
 		numBytesPerRead: 5,
 	}
 	r, err = RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
 	assert.Equal(t, "session=abc, user=123, theme=dark", r.Headers.Get("set-cookie"))
+	assert.Equal(t, []string{"session=abc", "user=123", "theme=dark"}, r.Headers.Values("set-cookie"))
 
 	// Test: Case Insensitive Headers
 	reader = &chunkReader{
@@ -335,7 +343,7 @@ func TestRequestParseHeaders(t *testing.T) {
 
 	// Test: Single character chunks with headers
 	reader = &chunkReader{
-		data:            "GET / HTTP/1.1\r\nX-Custom: value\r\n\r\n",
+		data:            "GET / HTTP/1.1\r\nHost: localhost\r\nX-Custom: value\r\n\r\n",
 		numBytesPerRead: 1,
 	}
 	r, err = RequestFromReader(reader)
@@ -346,7 +354,7 @@ func TestRequestParseHeaders(t *testing.T) {
 	// Test: Large header value
 	largeValue := strings.Repeat("a", 1000)
 	reader = &chunkReader{
-		data:            fmt.Sprintf("GET / HTTP/1.1\r\nX-Large: %s\r\n\r\n", largeValue),
+		data:            fmt.Sprintf("GET / HTTP/1.1\r\nHost: localhost\r\nX-Large: %s\r\n\r\n", largeValue),
 		numBytesPerRead: 10,
 	}
 	r, err = RequestFromReader(reader)
@@ -356,7 +364,7 @@ func TestRequestParseHeaders(t *testing.T) {
 
 	// Test: Invalid header characters
 	reader = &chunkReader{
-		data:            "GET / HTTP/1.1\r\nInvalid-©: value\r\n\r\n",
+		data:            "GET / HTTP/1.1\r\nHost: localhost\r\nInvalid-©: value\r\n\r\n",
 		numBytesPerRead: 3,
 	}
 	r, err = RequestFromReader(reader)
@@ -471,3 +479,884 @@ func TestBodyParse(t *testing.T) {
 	require.NotNil(t, r)
 	assert.Equal(t, []byte{0x00, 0x01, 0x02, 0x03}, r.Body)
 }
+
+func TestChunkedBodyParse(t *testing.T) {
+	// Test: Standard chunked body
+	reader := &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"6\r\nhello \r\n" +
+			"7\r\nworld!\n\r\n" +
+			"0\r\n" +
+			"\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Equal(t, "hello world!\n", string(r.Body))
+
+	// Test: Hex sizes, chunk extensions and trailers
+	reader = &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: Chunked\r\n" +
+			"\r\n" +
+			"1A;name=value\r\nabcdefghijklmnopqrstuvwxyz\r\n" +
+			"0\r\n" +
+			"X-Checksum: 42\r\n" +
+			"\r\n",
+		numBytesPerRead: 1,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Equal(t, "abcdefghijklmnopqrstuvwxyz", string(r.Body))
+	assert.Equal(t, "42", r.Trailers.Get("x-checksum"))
+
+	// Test: Missing CRLF after chunk data
+	reader = &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"3\r\nabcdef\r\n" +
+			"0\r\n" +
+			"\r\n",
+		numBytesPerRead: 4,
+	}
+	_, err = RequestFromReader(reader)
+	require.ErrorIs(t, err, ErrInvalidChunk)
+
+	// Test: Truncated chunked body
+	reader = &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"a\r\nabc",
+		numBytesPerRead: 4,
+	}
+	_, err = RequestFromReader(reader)
+	require.Error(t, err)
+}
+
+func TestRequestSmuggling(t *testing.T) {
+	// Test: CL.TE, both Content-Length and Transfer-Encoding
+	reader := &chunkReader{
+		data: "POST / HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Length: 13\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"0\r\n" +
+			"\r\n" +
+			"SMUGGLED",
+		numBytesPerRead: 3,
+	}
+	_, err := RequestFromReader(reader)
+	require.ErrorIs(t, err, ErrContentLengthWithTransferEncoding)
+
+	// Test: TE.CL, Transfer-Encoding sent first
+	reader = &chunkReader{
+		data: "POST / HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"Content-Length: 3\r\n" +
+			"\r\n" +
+			"8\r\n" +
+			"SMUGGLED\r\n" +
+			"0\r\n" +
+			"\r\n",
+		numBytesPerRead: 3,
+	}
+	_, err = RequestFromReader(reader)
+	require.ErrorIs(t, err, ErrContentLengthWithTransferEncoding)
+
+	// Test: Conflicting duplicate Content-Length
+	reader = &chunkReader{
+		data: "POST / HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Length: 8\r\n" +
+			"Content-Length: 7\r\n" +
+			"\r\n" +
+			"12345678",
+		numBytesPerRead: 5,
+	}
+	_, err = RequestFromReader(reader)
+	require.ErrorIs(t, err, ErrConflictingContentLength)
+
+	// Test: Conflicting Content-Length list in a single field
+	reader = &chunkReader{
+		data: "POST / HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Length: 10, 20\r\n" +
+			"\r\n",
+		numBytesPerRead: 5,
+	}
+	_, err = RequestFromReader(reader)
+	require.ErrorIs(t, err, ErrConflictingContentLength)
+
+	// Test: Identical duplicate Content-Length is accepted
+	reader = &chunkReader{
+		data: "POST / HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Length: 5\r\n" +
+			"Content-Length: 5\r\n" +
+			"\r\n" +
+			"12345",
+		numBytesPerRead: 5,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "12345", string(r.Body))
+
+	// Test: Negative Content-Length
+	reader = &chunkReader{
+		data: "POST / HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Length: -1\r\n" +
+			"\r\n",
+		numBytesPerRead: 3,
+	}
+	_, err = RequestFromReader(reader)
+	require.ErrorIs(t, err, ErrInvalidContentLength)
+
+	// Test: Non-digit Content-Length values that strconv.Atoi would accept
+	// or that other parsers read differently
+	for _, clen := range []string{"+5", "0x5", "5 5", "5a", "1_0", "99999999999999999999"} {
+		reader = &chunkReader{
+			data: "POST / HTTP/1.1\r\n" +
+				"Host: localhost:42069\r\n" +
+				"Content-Length: " + clen + "\r\n" +
+				"\r\n" +
+				"12345",
+			numBytesPerRead: 3,
+		}
+		_, err = RequestFromReader(reader)
+		require.ErrorIs(t, err, ErrInvalidContentLength, clen)
+	}
+
+	// Test: Unknown and obfuscated transfer codings
+	for _, te := range []string{"xchunked", "chunked, identity", "gzip, chunked", "chunked, chunked", "identity", "chunk"} {
+		reader = &chunkReader{
+			data: "POST / HTTP/1.1\r\n" +
+				"Host: localhost:42069\r\n" +
+				"Transfer-Encoding: " + te + "\r\n" +
+				"\r\n" +
+				"0\r\n" +
+				"\r\n",
+			numBytesPerRead: 3,
+		}
+		_, err = RequestFromReader(reader)
+		require.ErrorIs(t, err, ErrUnsupportedTransferEncoding, te)
+	}
+
+	// Test: Empty Transfer-Encoding
+	reader = &chunkReader{
+		data: "POST / HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding:\r\n" +
+			"\r\n",
+		numBytesPerRead: 3,
+	}
+	_, err = RequestFromReader(reader)
+	require.ErrorIs(t, err, ErrUnsupportedTransferEncoding)
+
+	// Test: Transfer-Encoding hidden with obs-fold
+	reader = &chunkReader{
+		data: "POST / HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: identity\r\n" +
+			" chunked\r\n" +
+			"\r\n",
+		numBytesPerRead: 3,
+	}
+	_, err = RequestFromReader(reader)
+	require.ErrorIs(t, err, headers.ErrObsFold)
+
+	// Test: Obs-fold with a horizontal tab
+	reader = &chunkReader{
+		data: "GET / HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"X-Folded: first\r\n" +
+			"\tsecond\r\n" +
+			"\r\n",
+		numBytesPerRead: 3,
+	}
+	_, err = RequestFromReader(reader)
+	require.ErrorIs(t, err, headers.ErrObsFold)
+
+	// Test: Whitespace between Transfer-Encoding and the colon
+	reader = &chunkReader{
+		data: "POST / HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Length: 4\r\n" +
+			"Transfer-Encoding : chunked\r\n" +
+			"\r\n" +
+			"0\r\n" +
+			"\r\n",
+		numBytesPerRead: 3,
+	}
+	_, err = RequestFromReader(reader)
+	require.ErrorIs(t, err, headers.ErrSpaceBeforeColon)
+
+	// Test: Tab between Content-Length and the colon
+	reader = &chunkReader{
+		data: "POST / HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Length\t: 4\r\n" +
+			"\r\n" +
+			"1234",
+		numBytesPerRead: 3,
+	}
+	_, err = RequestFromReader(reader)
+	require.ErrorIs(t, err, headers.ErrSpaceBeforeColon)
+
+	// Test: Invalid chunk size
+	for _, size := range []string{"-1", "+5", "0x5", "", "fffffffffffffffff1"} {
+		reader = &chunkReader{
+			data: "POST / HTTP/1.1\r\n" +
+				"Host: localhost:42069\r\n" +
+				"Transfer-Encoding: chunked\r\n" +
+				"\r\n" +
+				size + "\r\n" +
+				"abcde\r\n" +
+				"0\r\n" +
+				"\r\n",
+			numBytesPerRead: 3,
+		}
+		_, err = RequestFromReader(reader)
+		require.ErrorIs(t, err, ErrInvalidChunk, size)
+	}
+}
+
+func TestHostHeader(t *testing.T) {
+	// Test: Hostname with port
+	r, err := RequestFromReader(&chunkReader{
+		data:            "GET / HTTP/1.1\r\nHost: localhost:42069\r\n\r\n",
+		numBytesPerRead: 3,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, Host{Name: "localhost", Port: "42069"}, r.Host)
+	assert.Equal(t, "localhost:42069", r.Host.String())
+
+	// Test: Hostname without port
+	r, err = RequestFromReader(&chunkReader{
+		data:            "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n",
+		numBytesPerRead: 3,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, Host{Name: "example.com"}, r.Host)
+
+	// Test: IPv4 address
+	r, err = RequestFromReader(&chunkReader{
+		data:            "GET / HTTP/1.1\r\nHost: 127.0.0.1:8080\r\n\r\n",
+		numBytesPerRead: 3,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, Host{Name: "127.0.0.1", Port: "8080"}, r.Host)
+
+	// Test: IPv6 literal with port
+	r, err = RequestFromReader(&chunkReader{
+		data:            "GET / HTTP/1.1\r\nHost: [::1]:42069\r\n\r\n",
+		numBytesPerRead: 3,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, Host{Name: "::1", Port: "42069"}, r.Host)
+	assert.Equal(t, "[::1]:42069", r.Host.String())
+
+	// Test: IPv6 literal without port
+	r, err = RequestFromReader(&chunkReader{
+		data:            "GET / HTTP/1.1\r\nHost: [2001:db8::1]\r\n\r\n",
+		numBytesPerRead: 3,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, Host{Name: "2001:db8::1"}, r.Host)
+
+	// Test: Multiple Host headers
+	_, err = RequestFromReader(&chunkReader{
+		data:            "GET / HTTP/1.1\r\nHost: example.com\r\nHost: evil.com\r\n\r\n",
+		numBytesPerRead: 3,
+	})
+	require.ErrorIs(t, err, ErrMultipleHost)
+
+	// Test: Repeated identical Host headers
+	_, err = RequestFromReader(&chunkReader{
+		data:            "GET / HTTP/1.1\r\nHost: example.com\r\nHost: example.com\r\n\r\n",
+		numBytesPerRead: 3,
+	})
+	require.ErrorIs(t, err, ErrMultipleHost)
+
+	// Test: Invalid Host values
+	invalid := []string{
+		"",
+		"exa mple.com",
+		"example.com:",
+		"example.com:port",
+		"example.com:65536",
+		"example.com:-1",
+		"[::1",
+		"[127.0.0.1]",
+		"[not-an-ip]:80",
+		"::1",
+		"user@example.com",
+		"example.com/path",
+	}
+	for _, host := range invalid {
+		_, err = RequestFromReader(&chunkReader{
+			data:            "GET / HTTP/1.1\r\nHost: " + host + "\r\n\r\n",
+			numBytesPerRead: 3,
+		})
+		require.Error(t, err, host)
+	}
+
+	// Test: Absolute-form target matching Host
+	r, err = RequestFromReader(&chunkReader{
+		data:            "GET http://Example.com:80/path HTTP/1.1\r\nHost: example.com\r\n\r\n",
+		numBytesPerRead: 3,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, Host{Name: "example.com"}, r.Host)
+
+	// Test: Absolute-form target with a different Host
+	_, err = RequestFromReader(&chunkReader{
+		data:            "GET http://example.com/path HTTP/1.1\r\nHost: evil.com\r\n\r\n",
+		numBytesPerRead: 3,
+	})
+	require.ErrorIs(t, err, ErrHostMismatch)
+
+	// Test: Absolute-form target with a different port
+	_, err = RequestFromReader(&chunkReader{
+		data:            "GET http://example.com:8080/ HTTP/1.1\r\nHost: example.com\r\n\r\n",
+		numBytesPerRead: 3,
+	})
+	require.ErrorIs(t, err, ErrHostMismatch)
+
+	// Test: Absolute-form target with userinfo
+	_, err = RequestFromReader(&chunkReader{
+		data:            "GET http://user@example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n",
+		numBytesPerRead: 3,
+	})
+	require.ErrorIs(t, err, ErrInvalidHost)
+
+	// Test: Authority-form CONNECT target
+	r, err = RequestFromReader(&chunkReader{
+		data:            "CONNECT Example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n",
+		numBytesPerRead: 3,
+	})
+	require.NoError(t, err)
+	authority, err := r.RequestLine.Authority()
+	require.NoError(t, err)
+	assert.Equal(t, Host{Name: "Example.com", Port: "443"}, authority)
+
+	// Test: CONNECT to an IPv6 literal
+	r, err = RequestFromReader(&chunkReader{
+		data:            "CONNECT [::1]:8443 HTTP/1.1\r\nHost: [::1]:8443\r\n\r\n",
+		numBytesPerRead: 3,
+	})
+	require.NoError(t, err)
+	authority, err = r.RequestLine.Authority()
+	require.NoError(t, err)
+	assert.Equal(t, Host{Name: "::1", Port: "8443"}, authority)
+
+	// Test: CONNECT targets need a port and nothing else
+	for _, target := range []string{"example.com", "/path", "http://example.com:443/", "user@example.com:443"} {
+		_, err = RequestFromReader(&chunkReader{
+			data:            "CONNECT " + target + " HTTP/1.1\r\nHost: example.com:443\r\n\r\n",
+			numBytesPerRead: 3,
+		})
+		require.Error(t, err, target)
+	}
+
+	// Test: CONNECT with a different Host
+	_, err = RequestFromReader(&chunkReader{
+		data:            "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:8443\r\n\r\n",
+		numBytesPerRead: 3,
+	})
+	require.ErrorIs(t, err, ErrHostMismatch)
+
+	// Test: Authority is only for CONNECT
+	_, err = RequestLine{Method: "GET", RequestTarget: "example.com:443"}.Authority()
+	require.ErrorIs(t, err, ErrInvalidHost)
+}
+
+func gzipped(t *testing.T, data []byte) []byte {
+	buf := bytes.Buffer{}
+	gz := gzip.NewWriter(&buf)
+	_, err := gz.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+	return buf.Bytes()
+}
+
+func encodedRequest(t *testing.T, encoding string, body []byte) *Request {
+	r, err := RequestFromReader(&chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Encoding: " + encoding + "\r\n" +
+			fmt.Sprintf("Content-Length: %d\r\n", len(body)) +
+			"\r\n" +
+			string(body),
+		numBytesPerRead: 64,
+	})
+	require.NoError(t, err)
+	return r
+}
+
+func TestDecodeBody(t *testing.T) {
+	payload := []byte(strings.Repeat("metrics=1;", 100))
+
+	// Test: gzip body
+	r := encodedRequest(t, "gzip", gzipped(t, payload))
+	require.NoError(t, r.DecodeBody(1<<20))
+	assert.Equal(t, payload, r.Body)
+	assert.False(t, r.Headers.Has("content-encoding"))
+	assert.Equal(t, fmt.Sprint(len(payload)), r.Headers.Get("content-length"))
+
+	// Test: zlib wrapped deflate body
+	buf := bytes.Buffer{}
+	zw := zlib.NewWriter(&buf)
+	zw.Write(payload)
+	zw.Close()
+	r = encodedRequest(t, "deflate", buf.Bytes())
+	require.NoError(t, r.DecodeBody(1<<20))
+	assert.Equal(t, payload, r.Body)
+
+	// Test: raw deflate body
+	buf = bytes.Buffer{}
+	fw, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+	fw.Write(payload)
+	fw.Close()
+	r = encodedRequest(t, "deflate", buf.Bytes())
+	require.NoError(t, r.DecodeBody(1<<20))
+	assert.Equal(t, payload, r.Body)
+
+	// Test: stacked codings are undone in reverse
+	r = encodedRequest(t, "gzip, identity, X-Gzip", gzipped(t, gzipped(t, payload)))
+	require.NoError(t, r.DecodeBody(1<<20))
+	assert.Equal(t, payload, r.Body)
+
+	// Test: no Content-Encoding leaves the body alone
+	r, err := RequestFromReader(&chunkReader{
+		data:            "POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 3\r\n\r\nabc",
+		numBytesPerRead: 64,
+	})
+	require.NoError(t, err)
+	require.NoError(t, r.DecodeBody(1))
+	assert.Equal(t, "abc", string(r.Body))
+
+	// Test: a body the server put off reading is read first
+	encoded := gzipped(t, payload)
+	rr := NewReader(&chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Encoding: gzip\r\n" +
+			fmt.Sprintf("Content-Length: %d\r\n", len(encoded)) +
+			"Expect: 100-continue\r\n\r\n" +
+			string(encoded),
+		numBytesPerRead: 64,
+	})
+	r, err = rr.ReadHead()
+	require.NoError(t, err)
+	r.DeferBody(rr.ReadBody, nil)
+	require.NoError(t, r.DecodeBody(1<<20))
+	assert.Equal(t, payload, r.Body)
+
+	// Test: unsupported coding
+	r = encodedRequest(t, "br", []byte("whatever"))
+	require.ErrorIs(t, r.DecodeBody(1<<20), ErrUnsupportedContentEncoding)
+
+	// Test: zip bomb is cut off at the limit
+	bomb := gzipped(t, make([]byte, 10<<20))
+	r = encodedRequest(t, "gzip", bomb)
+	require.ErrorIs(t, r.DecodeBody(1<<20), ErrDecodedBodyTooLarge)
+
+	// Test: body exactly at the limit
+	r = encodedRequest(t, "gzip", gzipped(t, payload))
+	require.NoError(t, r.DecodeBody(int64(len(payload))))
+
+	// Test: corrupt gzip data
+	r = encodedRequest(t, "gzip", []byte("not gzip at all"))
+	err = r.DecodeBody(1 << 20)
+	require.Error(t, err)
+	assert.NotErrorIs(t, err, ErrUnsupportedContentEncoding)
+}
+
+func TestReadRequest(t *testing.T) {
+	// Test: Bytes past the end of the request are handed back
+	reader := &chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Length: 5\r\n" +
+			"\r\n" +
+			"hello" +
+			"next protocol",
+		numBytesPerRead: 7,
+	}
+	r, rest, err := ReadRequest(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(r.Body))
+	assert.NotEmpty(t, rest)
+
+	unread, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "next protocol", string(rest)+string(unread))
+
+	// Test: Nothing left over
+	r, rest, err = ReadRequest(&chunkReader{
+		data:            "GET / HTTP/1.1\r\nHost: localhost:42069\r\n\r\n",
+		numBytesPerRead: 3,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "GET", r.RequestLine.Method)
+	assert.Empty(t, rest)
+}
+
+func TestExpectContinue(t *testing.T) {
+	head := "POST /upload HTTP/1.1\r\n" +
+		"Host: localhost:42069\r\n" +
+		"Content-Length: 5\r\n"
+
+	// Test: 100-continue is surfaced
+	r, err := RequestFromReader(&chunkReader{
+		data:            head + "Expect: 100-Continue\r\n\r\nhello",
+		numBytesPerRead: 3,
+	})
+	require.NoError(t, err)
+	assert.True(t, r.ExpectContinue)
+
+	// Test: Anything else is unsupported
+	_, err = RequestFromReader(&chunkReader{
+		data:            head + "Expect: teapot\r\n\r\nhello",
+		numBytesPerRead: 3,
+	})
+	require.ErrorIs(t, err, ErrUnsupportedExpectation)
+
+	// Test: No Expect header
+	r, err = RequestFromReader(&chunkReader{data: head + "\r\nhello", numBytesPerRead: 3})
+	require.NoError(t, err)
+	assert.False(t, r.ExpectContinue)
+}
+
+func TestReader(t *testing.T) {
+	// Test: The head is read without waiting for the body
+	pr, pw := io.Pipe()
+	go io.WriteString(pw, "POST /upload HTTP/1.1\r\n"+
+		"Host: localhost:42069\r\n"+
+		"Content-Length: 5\r\n"+
+		"Expect: 100-continue\r\n\r\n")
+
+	rr := NewReader(pr)
+	r, err := rr.ReadHead()
+	require.NoError(t, err)
+	assert.True(t, r.ExpectContinue)
+	assert.False(t, rr.BodyDone())
+
+	// Test: A deferred body is read on the first ReadBody only
+	reads := 0
+	r.DeferBody(func() error {
+		reads++
+		go io.WriteString(pw, "hello")
+		return rr.ReadBody()
+	}, nil)
+	for range 2 {
+		body, err := r.ReadBody()
+		require.NoError(t, err)
+		assert.Equal(t, "hello", string(body))
+	}
+	assert.Equal(t, 1, reads)
+	assert.True(t, rr.BodyDone())
+
+	// Test: ReadBody without deferring returns Body
+	r, err = RequestFromReader(&chunkReader{
+		data:            "GET / HTTP/1.1\r\nHost: localhost:42069\r\n\r\n",
+		numBytesPerRead: 3,
+	})
+	require.NoError(t, err)
+	body, err := r.ReadBody()
+	require.NoError(t, err)
+	assert.Empty(t, body)
+
+	// Test: A Content-Length over the limit is rejected with the head
+	rr = NewReader(&chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Length: 11\r\n\r\n",
+		numBytesPerRead: 3,
+	})
+	rr.MaxBodySize = 10
+	_, err = rr.ReadHead()
+	require.ErrorIs(t, err, ErrBodyTooLarge)
+
+	// Test: So are chunked bodies that grow past it
+	rr = NewReader(&chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n\r\n" +
+			"6\r\nabcdef\r\n5\r\nghijk\r\n0\r\n\r\n",
+		numBytesPerRead: 3,
+	})
+	rr.MaxBodySize = 10
+	_, err = rr.ReadHead()
+	if err == nil {
+		err = rr.ReadBody()
+	}
+	require.ErrorIs(t, err, ErrBodyTooLarge)
+}
+
+func TestBodyReader(t *testing.T) {
+	// Test: A chunked body streams out decoded, including the part that
+	// came in with the head
+	rr := NewReader(&chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n\r\n" +
+			"5\r\nhello\r\n6\r\n world\r\n0\r\nX-Sum: 1\r\n\r\n",
+		numBytesPerRead: 7,
+	})
+	r, err := rr.ReadHead()
+	require.NoError(t, err)
+	r.DeferBody(rr.ReadBody, func() (io.Reader, error) {
+		return rr.BodyReader(), nil
+	})
+
+	body, err := r.BodyReader()
+	require.NoError(t, err)
+	data, err := io.ReadAll(body)
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", string(data))
+	assert.Empty(t, r.Body)
+	assert.Equal(t, "1", r.Trailers.Get("x-sum"))
+	assert.True(t, rr.BodyDone())
+
+	// Test: After which ReadBody has nothing to give
+	_, err = r.ReadBody()
+	require.ErrorIs(t, err, ErrBodyStreamed)
+
+	// Test: A body cut short
+	rr = NewReader(&chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Length: 11\r\n\r\nhello",
+		numBytesPerRead: 3,
+	})
+	_, err = rr.ReadHead()
+	require.NoError(t, err)
+	_, err = io.ReadAll(rr.BodyReader())
+	require.Error(t, err)
+
+	// Test: A body read in already is read from Body
+	r, err = RequestFromReader(&chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Length: 5\r\n\r\nhello",
+		numBytesPerRead: 3,
+	})
+	require.NoError(t, err)
+	body, err = r.BodyReader()
+	require.NoError(t, err)
+	data, err = io.ReadAll(body)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+}
+
+// tlsConn passes for a TLS connection
+type tlsConn struct {
+	net.Conn
+	state tls.ConnectionState
+}
+
+func (c tlsConn) ConnectionState() tls.ConnectionState { return c.state }
+
+func TestNewConnInfo(t *testing.T) {
+	client, conn := net.Pipe()
+	defer client.Close()
+	defer conn.Close()
+
+	// Test: Plain connections
+	info := NewConnInfo(7, conn)
+	assert.Equal(t, uint64(7), info.ID)
+	assert.Equal(t, conn.RemoteAddr(), info.RemoteAddr)
+	assert.Equal(t, conn.LocalAddr(), info.LocalAddr)
+	assert.Nil(t, info.TLS)
+
+	// Test: TLS state is only recorded once the handshake is done
+	info = NewConnInfo(8, tlsConn{Conn: conn})
+	assert.Nil(t, info.TLS)
+
+	state := tls.ConnectionState{HandshakeComplete: true, ServerName: "example.com"}
+	info = NewConnInfo(9, tlsConn{conn, state})
+	require.NotNil(t, info.TLS)
+	assert.Equal(t, "example.com", info.TLS.ServerName)
+
+	// Test: Requests take their remote address from it
+	r := &Request{}
+	start := time.Now()
+	r.SetConn(info, 3, start)
+	assert.Same(t, info, r.Conn)
+	assert.Equal(t, uint64(3), r.Seq)
+	assert.Equal(t, start, r.StartTime)
+	assert.Equal(t, conn.RemoteAddr().String(), r.RemoteAddr)
+}
+
+func TestResolveOrigin(t *testing.T) {
+	trusted := []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("2001:db8:cafe::/48"),
+	}
+
+	tests := []struct {
+		name   string
+		remote string
+		from   ForwardedHeaders
+		fields []string
+		// ip is empty where the client is unknown
+		ip     string
+		scheme string
+		host   string
+	}{
+		{
+			name:   "untrusted peer's headers are ignored",
+			remote: "198.51.100.9:1234",
+			fields: []string{"X-Forwarded-For", "203.0.113.1", "X-Forwarded-Proto", "https"},
+			ip:     "198.51.100.9", scheme: "http", host: "example.com",
+		},
+		{
+			name:   "trusted peer without headers",
+			remote: "10.0.0.1:1234",
+			ip:     "10.0.0.1", scheme: "http", host: "example.com",
+		},
+		{
+			name:   "X-Forwarded-For",
+			remote: "10.0.0.1:1234",
+			fields: []string{
+				"X-Forwarded-For", "203.0.113.1",
+				"X-Forwarded-Proto", "HTTPS",
+				"X-Forwarded-Host", "shop.example:8443",
+			},
+			ip: "203.0.113.1", scheme: "https", host: "shop.example:8443",
+		},
+		{
+			name:   "stops at the first untrusted hop",
+			remote: "10.0.0.1:1234",
+			fields: []string{
+				"X-Forwarded-For", "1.1.1.1, 203.0.113.1",
+				"X-Forwarded-For", "10.2.3.4",
+			},
+			ip: "203.0.113.1", scheme: "http", host: "example.com",
+		},
+		{
+			name:   "every hop trusted",
+			remote: "10.0.0.1:1234",
+			fields: []string{"X-Forwarded-For", "10.0.0.3, 10.0.0.2"},
+			ip:     "10.0.0.3", scheme: "http", host: "example.com",
+		},
+		{
+			name:   "protos line up with the hops",
+			remote: "10.0.0.1:1234",
+			fields: []string{
+				"X-Forwarded-For", "203.0.113.1, 10.0.0.2",
+				"X-Forwarded-Proto", "https, http",
+			},
+			ip: "203.0.113.1", scheme: "https", host: "example.com",
+		},
+		{
+			name:   "client's own Forwarded is ignored",
+			remote: "10.0.0.1:1234",
+			fields: []string{
+				"Forwarded", "for=8.8.8.8",
+				"X-Forwarded-For", "203.0.113.1",
+			},
+			ip: "203.0.113.1", scheme: "http", host: "example.com",
+		},
+		{
+			name:   "Forwarded",
+			remote: "10.0.0.1:1234",
+			from:   HeaderForwarded,
+			fields: []string{
+				"X-Forwarded-For", "192.0.2.1",
+				"Forwarded", `for=192.0.2.60;proto=https;host="shop.example", for="[2001:db8:cafe::17]:4711"`,
+			},
+			ip: "192.0.2.60", scheme: "https", host: "shop.example",
+		},
+		{
+			name:   "client's own X-Forwarded-For is ignored",
+			remote: "10.0.0.1:1234",
+			from:   HeaderForwarded,
+			fields: []string{
+				"X-Forwarded-For", "8.8.8.8",
+				"Forwarded", "for=203.0.113.1",
+			},
+			ip: "203.0.113.1", scheme: "http", host: "example.com",
+		},
+		{
+			name:   "Forwarded with an unknown client",
+			remote: "10.0.0.1:1234",
+			from:   HeaderForwarded,
+			fields: []string{"Forwarded", "for=unknown;proto=https, for=10.0.0.2"},
+			ip:     "", scheme: "https", host: "example.com",
+		},
+		{
+			name:   "malformed Forwarded from the client",
+			remote: "10.0.0.1:1234",
+			from:   HeaderForwarded,
+			fields: []string{"Forwarded", `for="192.0.2.60, for=203.0.113.1;proto=https`},
+			ip:     "203.0.113.1", scheme: "https", host: "example.com",
+		},
+		{
+			name:   "malformed Forwarded past trusted hops",
+			remote: "10.0.0.1:1234",
+			from:   HeaderForwarded,
+			fields: []string{"Forwarded", `for=192.0.2.60;x, for="[2001:db8:cafe::1]"`},
+			ip:     "", scheme: "http", host: "example.com",
+		},
+		{
+			name:   "quoted commas and escapes",
+			remote: "10.0.0.1:1234",
+			from:   HeaderForwarded,
+			fields: []string{"Forwarded", `for=192.0.2.60;host="a,\"b", for=10.0.0.2;host="x\\"`},
+			ip:     "192.0.2.60", scheme: "http", host: "example.com",
+		},
+		{
+			name:   "unknown X-Forwarded-For entry",
+			remote: "10.0.0.1:1234",
+			fields: []string{"X-Forwarded-For", "203.0.113.1, unknown"},
+			ip:     "", scheme: "http", host: "example.com",
+		},
+		{
+			name:   "bad scheme and host are ignored",
+			remote: "[::ffff:10.0.0.1]:1234",
+			fields: []string{
+				"X-Forwarded-For", "[2001:db8::1]:80",
+				"X-Forwarded-Proto", "gopher",
+				"X-Forwarded-Host", "bad host",
+			},
+			ip: "2001:db8::1", scheme: "http", host: "example.com",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &Request{
+				Headers:    headers.NewHeaders(),
+				Host:       Host{Name: "example.com"},
+				RemoteAddr: tt.remote,
+			}
+			for i := 0; i < len(tt.fields); i += 2 {
+				r.Headers.Add(tt.fields[i], tt.fields[i+1])
+			}
+
+			r.ResolveOrigin(trusted, tt.from)
+			if tt.ip == "" {
+				assert.False(t, r.Origin.IP.IsValid())
+			} else {
+				assert.Equal(t, netip.MustParseAddr(tt.ip), r.Origin.IP)
+			}
+			assert.Equal(t, tt.scheme, r.Origin.Scheme)
+			assert.Equal(t, tt.host, r.Origin.Host.String())
+		})
+	}
+}
@@ -0,0 +1,157 @@
+package response
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/yus-works/tcp-to-http/internal/headers"
+	"github.com/yus-works/tcp-to-http/internal/negotiate"
+	"github.com/yus-works/tcp-to-http/internal/request"
+)
+
+// Compression configures transparent response compression
+type Compression struct {
+	// MinSize is the smallest buffered body worth compressing. Streamed
+	// bodies are always compressed since their size isn't known up front
+	MinSize int
+	// Level is passed to compress/gzip and compress/zlib
+	Level int
+}
+
+func DefaultCompression() Compression {
+	return Compression{
+		MinSize: 1024,
+		Level:   gzip.DefaultCompression,
+	}
+}
+
+// encodings are the content codings the server can produce, most preferred
+// first. "deflate" in HTTP means the zlib format (RFC 9110 8.4.1.2)
+var encodings = []string{"gzip", "deflate", "identity"}
+
+// incompressibleTypes are media types whose contents are already compressed
+var incompressibleTypes = map[string]struct{}{
+	"application/gzip":             {},
+	"application/x-gzip":           {},
+	"application/zip":              {},
+	"application/zstd":             {},
+	"application/x-bzip2":          {},
+	"application/x-7z-compressed":  {},
+	"application/x-rar-compressed": {},
+	"application/octet-stream":     {},
+	"application/pdf":              {},
+	"font/woff":                    {},
+	"font/woff2":                   {},
+}
+
+func isCompressible(contentType string) bool {
+	mt, err := headers.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	if mt.Essence() == "image/svg+xml" {
+		return true
+	}
+
+	switch mt.Type {
+	case "image", "audio", "video":
+		return false
+	}
+
+	_, skip := incompressibleTypes[mt.Essence()]
+	return !skip
+}
+
+// EnableCompression compresses the response with whichever of gzip and
+// deflate req accepts
+func (w *Writer) EnableCompression(req *request.Request, c Compression) {
+	w.compression = &c
+	w.req = req
+}
+
+// negotiateEncoding decides how the body will be encoded when the response
+// is committed, returning "" for no encoding. size is -1 for streamed bodies
+func (w *Writer) negotiateEncoding(size int) string {
+	if w.compression == nil || w.req == nil {
+		return ""
+	}
+
+	if w.statusCode < 200 || w.statusCode == 204 || w.statusCode == 304 {
+		return ""
+	}
+
+	// the handler encoded the body itself
+	if w.header.Has("Content-Encoding") {
+		return ""
+	}
+
+	contentType := w.header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "text/plain"
+	}
+	if !isCompressible(contentType) {
+		return ""
+	}
+
+	// from here on the representation depends on Accept-Encoding, even if
+	// this particular body ends up too small to bother
+	AddVary(w.header, "Accept-Encoding")
+
+	if size != -1 && size < w.compression.MinSize {
+		return ""
+	}
+
+	enc, ok := negotiate.Encoding(w.req.Headers, encodings)
+	if !ok || enc == "identity" {
+		return ""
+	}
+	return enc
+}
+
+// setContentEncoding marks h as encoded with enc. A strong ETag no longer
+// describes the encoded bytes, so it is weakened
+func setContentEncoding(h *headers.Headers, enc string) {
+	h.Set("Content-Encoding", enc)
+
+	if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		h.Set("ETag", "W/"+etag)
+	}
+}
+
+// encoder is implemented by both gzip.Writer and zlib.Writer
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+}
+
+func newEncoder(enc string, w io.Writer, level int) (encoder, error) {
+	switch enc {
+	case "gzip":
+		return gzip.NewWriterLevel(w, level)
+	case "deflate":
+		return zlib.NewWriterLevel(w, level)
+	}
+	return nil, fmt.Errorf("Unsupported content coding %q", enc)
+}
+
+func encodeAll(enc string, body []byte, level int) ([]byte, error) {
+	buf := bytes.Buffer{}
+
+	encoder, err := newEncoder(enc, &buf, level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := encoder.Write(body); err != nil {
+		return nil, fmt.Errorf("Failed to encode body: %w", err)
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, fmt.Errorf("Failed to encode body: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,179 @@
+package response
+
+import (
+	"bytes"
+	"encoding/json"
+	htmltemplate "html/template"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/yus-works/tcp-to-http/internal/headers"
+	"github.com/yus-works/tcp-to-http/internal/negotiate"
+	"github.com/yus-works/tcp-to-http/internal/request"
+)
+
+// ErrorRenderer turns a HandlerError into a response body. req is nil when
+// the request itself couldn't be parsed
+type ErrorRenderer interface {
+	RenderError(req *request.Request, e *HandlerError) (contentType string, body []byte)
+}
+
+// ErrorRendererFunc adapts a function to ErrorRenderer
+type ErrorRendererFunc func(req *request.Request, e *HandlerError) (string, []byte)
+
+func (f ErrorRendererFunc) RenderError(req *request.Request, e *HandlerError) (string, []byte) {
+	return f(req, e)
+}
+
+// PlainTextErrors sends the error's Message as is
+var PlainTextErrors = ErrorRendererFunc(
+	func(req *request.Request, e *HandlerError) (string, []byte) {
+		return "text/plain", []byte(e.Message)
+	},
+)
+
+// Problem holds the RFC 9457 problem details of an error. It is also the
+// data passed to error templates
+type Problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+}
+
+func NewProblem(req *request.Request, e *HandlerError) Problem {
+	p := Problem{
+		Type:   e.Type,
+		Title:  e.StatusCode.String(),
+		Status: int(e.StatusCode),
+		Detail: e.Message,
+	}
+	if p.Type == "" {
+		p.Type = "about:blank"
+	}
+	if p.Title == "" {
+		p.Title = strconv.Itoa(p.Status)
+	}
+	if req != nil {
+		p.Instance = req.RequestLine.RequestTarget
+	}
+	return p
+}
+
+// Template is satisfied by both text/template and html/template templates
+type Template interface {
+	Execute(w io.Writer, data any) error
+}
+
+const (
+	MediaTypeText    = "text/plain"
+	MediaTypeHTML    = "text/html"
+	MediaTypeProblem = "application/problem+json"
+)
+
+var defaultHTMLErrorPage = htmltemplate.Must(htmltemplate.New("error").Parse(
+	`<!DOCTYPE html>
+<html>
+<head><title>{{.Status}} {{.Title}}</title></head>
+<body>
+<h1>{{.Status}} {{.Title}}</h1>
+{{if .Detail}}<p>{{.Detail}}</p>
+{{end}}</body>
+</html>
+`))
+
+type errorPageKey struct {
+	statusCode StatusCode
+	mediaType  string
+}
+
+// ErrorPages renders errors as plain text, an HTML page or problem+json,
+// whichever the request's Accept header prefers. Custom templates can be
+// registered per status code and media type
+type ErrorPages struct {
+	templates map[errorPageKey]Template
+}
+
+func NewErrorPages() *ErrorPages {
+	return &ErrorPages{
+		templates: map[errorPageKey]Template{},
+	}
+}
+
+// Register uses tmpl for errors with statusCode when mediaType is the
+// negotiated format. Templates are executed with a Problem
+func (p *ErrorPages) Register(statusCode StatusCode, mediaType string, tmpl Template) {
+	p.templates[errorPageKey{statusCode, mediaType}] = tmpl
+}
+
+// RenderError renders e in the format the request prefers. The format
+// depends on Accept, so that is added to the Vary in e.Header for caches
+func (p *ErrorPages) RenderError(req *request.Request, e *HandlerError) (string, []byte) {
+	mediaType := preferredErrorType(req)
+	problem := NewProblem(req, e)
+
+	if req != nil {
+		if e.Header == nil {
+			e.Header = headers.NewHeaders()
+		}
+		AddVary(e.Header, "Accept")
+	}
+
+	if tmpl, ok := p.templates[errorPageKey{e.StatusCode, mediaType}]; ok {
+		buf := bytes.Buffer{}
+		if err := tmpl.Execute(&buf, problem); err == nil {
+			return withCharset(mediaType), buf.Bytes()
+		}
+		// fall back to the built in page rather than sending half a template
+	}
+
+	switch mediaType {
+	case MediaTypeHTML:
+		buf := bytes.Buffer{}
+		defaultHTMLErrorPage.Execute(&buf, problem)
+		return withCharset(MediaTypeHTML), buf.Bytes()
+
+	case MediaTypeProblem:
+		body, _ := json.Marshal(problem)
+		return MediaTypeProblem, body
+
+	default:
+		return MediaTypeText, []byte(e.Message)
+	}
+}
+
+// withCharset labels the text formats templates render as UTF-8
+func withCharset(mediaType string) string {
+	if strings.HasPrefix(mediaType, "text/") {
+		return mediaType + "; charset=utf-8"
+	}
+	return mediaType
+}
+
+// errorOffers are the formats errors can be rendered in, in order of
+// preference. application/json clients get problem+json
+var errorOffers = []string{
+	MediaTypeText,
+	MediaTypeHTML,
+	MediaTypeProblem,
+	"application/json",
+}
+
+// preferredErrorType picks the error format the request's Accept header
+// prefers, defaulting to plain text when nothing is acceptable
+func preferredErrorType(req *request.Request) string {
+	if req == nil {
+		return MediaTypeText
+	}
+
+	mediaType, ok := negotiate.ContentType(req.Headers, errorOffers)
+	if !ok {
+		return MediaTypeText
+	}
+	if mediaType == "application/json" {
+		return MediaTypeProblem
+	}
+	return mediaType
+}
@@ -0,0 +1,68 @@
+package response
+
+import (
+	"strings"
+
+	"github.com/yus-works/tcp-to-http/internal/headers"
+	"github.com/yus-works/tcp-to-http/internal/negotiate"
+	"github.com/yus-works/tcp-to-http/internal/request"
+)
+
+// AddVary adds field to the Vary header unless it is already listed
+func AddVary(h *headers.Headers, field string) {
+	existing, _ := headers.ParseList(h.Get("Vary"))
+	for _, f := range existing {
+		if f == "*" || strings.EqualFold(f, field) {
+			return
+		}
+	}
+
+	h.Set("Vary", headers.FormatList(append(existing, field)))
+}
+
+// notAcceptable is the 406 for a failed negotiation. The error response
+// replaces what the handler set up, so it carries the Vary itself
+func notAcceptable(w *Writer) *HandlerError {
+	err := NewHandlerErr(StatusNotAcceptable)
+	err.Header = headers.NewHeaders()
+	err.Header.Set("Vary", w.Header().Get("Vary"))
+	return &err
+}
+
+// NegotiateContentType picks the offer the request's Accept header prefers
+// and marks the response as varying on Accept. It returns a 406 error when
+// none of the offers are acceptable
+func NegotiateContentType(
+	w *Writer, req *request.Request, offers ...string,
+) (string, *HandlerError) {
+	AddVary(w.Header(), "Accept")
+
+	if offer, ok := negotiate.ContentType(req.Headers, offers); ok {
+		return offer, nil
+	}
+	return "", notAcceptable(w)
+}
+
+// NegotiateEncoding is NegotiateContentType for Accept-Encoding
+func NegotiateEncoding(
+	w *Writer, req *request.Request, offers ...string,
+) (string, *HandlerError) {
+	AddVary(w.Header(), "Accept-Encoding")
+
+	if offer, ok := negotiate.Encoding(req.Headers, offers); ok {
+		return offer, nil
+	}
+	return "", notAcceptable(w)
+}
+
+// NegotiateLanguage is NegotiateContentType for Accept-Language
+func NegotiateLanguage(
+	w *Writer, req *request.Request, offers ...string,
+) (string, *HandlerError) {
+	AddVary(w.Header(), "Accept-Language")
+
+	if offer, ok := negotiate.Language(req.Headers, offers); ok {
+		return offer, nil
+	}
+	return "", notAcceptable(w)
+}
@@ -1,31 +1,70 @@
 package response
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"strings"
 
 	"github.com/yus-works/tcp-to-http/internal/headers"
 	"github.com/yus-works/tcp-to-http/internal/request"
 )
 
 type StatusCode int
+
 const (
-	StatusOK StatusCode = 200
-	StatusBadRequest StatusCode = 400
-	StatusInternalServerError StatusCode = 500
+	StatusContinue             StatusCode = 100
+	StatusSwitchingProtocols   StatusCode = 101
+	StatusOK                   StatusCode = 200
+	StatusCreated              StatusCode = 201
+	StatusNoContent            StatusCode = 204
+	StatusPartialContent       StatusCode = 206
+	StatusMovedPermanently     StatusCode = 301
+	StatusNotModified          StatusCode = 304
+	StatusBadRequest           StatusCode = 400
+	StatusForbidden            StatusCode = 403
+	StatusNotFound             StatusCode = 404
+	StatusMethodNotAllowed     StatusCode = 405
+	StatusNotAcceptable        StatusCode = 406
+	StatusContentTooLarge      StatusCode = 413
+	StatusUnsupportedMediaType StatusCode = 415
+	StatusRangeNotSatisfiable  StatusCode = 416
+	StatusExpectationFailed    StatusCode = 417
+	StatusUpgradeRequired      StatusCode = 426
+	StatusInternalServerError  StatusCode = 500
+	StatusBadGateway           StatusCode = 502
+	StatusGatewayTimeout       StatusCode = 504
 )
 
 var statusText = map[StatusCode]string{
-    StatusOK:                  "OK",
-    StatusBadRequest:          "Bad Request",
-    StatusInternalServerError: "Internal Server Error",
+	StatusContinue:             "Continue",
+	StatusSwitchingProtocols:   "Switching Protocols",
+	StatusOK:                   "OK",
+	StatusCreated:              "Created",
+	StatusNoContent:            "No Content",
+	StatusPartialContent:       "Partial Content",
+	StatusMovedPermanently:     "Moved Permanently",
+	StatusNotModified:          "Not Modified",
+	StatusBadRequest:           "Bad Request",
+	StatusForbidden:            "Forbidden",
+	StatusNotFound:             "Not Found",
+	StatusMethodNotAllowed:     "Method Not Allowed",
+	StatusNotAcceptable:        "Not Acceptable",
+	StatusContentTooLarge:      "Content Too Large",
+	StatusUnsupportedMediaType: "Unsupported Media Type",
+	StatusRangeNotSatisfiable:  "Range Not Satisfiable",
+	StatusExpectationFailed:    "Expectation Failed",
+	StatusUpgradeRequired:      "Upgrade Required",
+	StatusInternalServerError:  "Internal Server Error",
+	StatusBadGateway:           "Bad Gateway",
+	StatusGatewayTimeout:       "Gateway Timeout",
 }
 
 func (s StatusCode) String() string {
-    if text, ok := statusText[s]; ok {
-        return text
-    }
-    return ""
+	if text, ok := statusText[s]; ok {
+		return text
+	}
+	return ""
 }
 
 func WriteStatusLine(w io.Writer, statusCode StatusCode) error {
@@ -49,39 +88,144 @@ func GetDefaultHeaders(contentLen int) headers.Headers {
 	return *headers
 }
 
-func WriteHeaders(w io.Writer, headers headers.Headers) error  {
-	var msg string
-	for k, v := range headers {
-		msg += fmt.Sprintf("%s: %s\r\n", k, v)
+// WriteHeaders writes the fields in the order they were added, with names
+// cased exactly as they were set, followed by the blank line that ends the
+// header section. Nothing is written if any field is invalid
+func WriteHeaders(w io.Writer, headers headers.Headers) error {
+	if err := headers.Validate(); err != nil {
+		return fmt.Errorf("Failed to write headers: %w", err)
+	}
+
+	var msg strings.Builder
+	for k, v := range headers.All() {
+		msg.WriteString(k)
+		msg.WriteString(": ")
+		msg.WriteString(v)
+		msg.WriteString("\r\n")
 	}
+	msg.WriteString("\r\n") // finish headers
 
-	_, err := fmt.Fprintf(w, "%s\r\n", msg) // finish headers
+	_, err := io.WriteString(w, msg.String())
 	if err != nil {
 		return fmt.Errorf("Failed to write headers: %w", err)
 	}
 	return nil
 }
 
-type Handler func(w io.Writer, req *request.Request) *HandlerError
+// Handler writes its response to w. Returning a HandlerError discards
+// anything written to w and sends the error response instead
+type Handler func(w *Writer, req *request.Request) *HandlerError
 
 type HandlerError struct {
 	StatusCode StatusCode
-	Message    string
+	// Message is the body of plain text errors and the detail of others
+	Message string
+	// Type is an optional URI identifying the kind of problem (RFC 9457)
+	Type string
+	// Header holds optional extra fields for the error response, like Allow
+	// for a 405
+	Header *headers.Headers
 }
 
 func NewHandlerErr(statusCode StatusCode) HandlerError {
 	return HandlerError{
 		StatusCode: statusCode,
-		Message: statusCode.String(),
+		Message:    statusCode.String(),
+	}
+}
+
+// NewHandlerErrMsg is like NewHandlerErr but with a custom response body
+func NewHandlerErrMsg(statusCode StatusCode, msg string) HandlerError {
+	return HandlerError{
+		StatusCode: statusCode,
+		Message:    msg,
+	}
+}
+
+// RequestError turns a failure to read or decode a request into the
+// matching error response
+func RequestError(err error) *HandlerError {
+	var handlerErr HandlerError
+	switch {
+	case errors.Is(err, request.ErrUnsupportedExpectation):
+		handlerErr = NewHandlerErr(StatusExpectationFailed)
+	case errors.Is(err, request.ErrBodyTooLarge),
+		errors.Is(err, request.ErrDecodedBodyTooLarge):
+		handlerErr = NewHandlerErr(StatusContentTooLarge)
+	case errors.Is(err, request.ErrUnsupportedContentEncoding):
+		handlerErr = NewHandlerErr(StatusUnsupportedMediaType)
+		handlerErr.Header = headers.NewHeaders()
+		handlerErr.Header.Set("Accept-Encoding", "gzip, deflate")
+	default:
+		handlerErr = NewHandlerErr(StatusBadRequest)
+	}
+	return &handlerErr
+}
+
+// Write sends the error as a complete response with Message as the body
+func (e *HandlerError) Write(w io.Writer) error {
+	return e.Render(w, nil, PlainTextErrors)
+}
+
+// Render sends the error as a complete response with a body produced by r
+func (e *HandlerError) Render(
+	w io.Writer, req *request.Request, r ErrorRenderer,
+) error {
+	contentType, body := r.RenderError(req, e)
+
+	h := GetDefaultHeaders(len(body))
+	h.Set("Content-Type", contentType)
+
+	if e.Header != nil {
+		for k, v := range e.Header.All() {
+			if !isFramingHeader(k) && !strings.EqualFold(k, "Content-Type") {
+				h.Add(k, v)
+			}
+		}
+	}
+
+	if err := h.Validate(); err != nil {
+		return fmt.Errorf("Failed to write error: %w", err)
+	}
+
+	if err := WriteStatusLine(w, e.StatusCode); err != nil {
+		return err
+	}
+	if err := WriteHeaders(w, h); err != nil {
+		return err
 	}
+
+	_, err := w.Write(body)
+	if err != nil {
+		return fmt.Errorf("Failed to write error body: %w", err)
+	}
+	return nil
 }
 
-func (e *HandlerError) Write(w io.Writer) {
-	WriteStatusLine(w, e.StatusCode)
-	WriteHeaders(w, GetDefaultHeaders(0))
+// RenderTo sends the error through w instead of straight to a connection,
+// for protocols that frame responses themselves. Anything already written
+// to w is discarded
+func (e *HandlerError) RenderTo(
+	w *Writer, req *request.Request, r ErrorRenderer,
+) error {
+	contentType, body := r.RenderError(req, e)
+
+	w.Reset()
+	w.SetStatus(e.StatusCode)
+	if e.Header != nil {
+		for k, v := range e.Header.All() {
+			w.Header().Add(k, v)
+		}
+	}
+	w.Header().Set("Content-Type", contentType)
+
+	if _, err := w.Write(body); err != nil {
+		return fmt.Errorf("Failed to write error body: %w", err)
+	}
+	return w.Finish()
 }
 
-func WriteError(w io.Writer, statusCode StatusCode) {
-	WriteStatusLine(w, statusCode)
-	WriteHeaders(w, GetDefaultHeaders(0))
+func WriteError(w io.Writer, statusCode StatusCode) error {
+	err := NewHandlerErr(statusCode)
+	return err.Write(w)
 }
@@ -0,0 +1,446 @@
+package response
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"text/template"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yus-works/tcp-to-http/internal/headers"
+	"github.com/yus-works/tcp-to-http/internal/request"
+)
+
+func TestWriteHeaders(t *testing.T) {
+	// Test: Default headers are written in a fixed order
+	for range 10 {
+		buf := bytes.Buffer{}
+		err := WriteHeaders(&buf, GetDefaultHeaders(13))
+		require.NoError(t, err)
+		assert.Equal(t,
+			"Content-Length: 13\r\n"+
+				"Connection: close\r\n"+
+				"Content-Type: text/plain\r\n"+
+				"\r\n",
+			buf.String(),
+		)
+	}
+
+	// Test: Casing set by the handler is kept and repeated fields stay separate
+	h := headers.NewHeaders()
+	h.Add("x-lower", "a")
+	h.Add("Set-Cookie", "session=abc")
+	h.Add("ETag", `"v1"`)
+	h.Add("Set-Cookie", "theme=dark")
+	buf := bytes.Buffer{}
+	err := WriteHeaders(&buf, *h)
+	require.NoError(t, err)
+	assert.Equal(t,
+		"x-lower: a\r\n"+
+			"Set-Cookie: session=abc\r\n"+
+			"ETag: \"v1\"\r\n"+
+			"Set-Cookie: theme=dark\r\n"+
+			"\r\n",
+		buf.String(),
+	)
+
+	// Test: Parsed headers come out canonically cased
+	h = headers.NewHeaders()
+	_, _, err = h.Parse([]byte("content-TYPE: text/html\r\nx-request-id: 1\r\n\r\n"))
+	require.NoError(t, err)
+	buf = bytes.Buffer{}
+	err = WriteHeaders(&buf, *h)
+	require.NoError(t, err)
+	assert.Equal(t,
+		"Content-Type: text/html\r\n"+
+			"X-Request-Id: 1\r\n"+
+			"\r\n",
+		buf.String(),
+	)
+
+	// Test: No headers
+	buf = bytes.Buffer{}
+	err = WriteHeaders(&buf, *headers.NewHeaders())
+	require.NoError(t, err)
+	assert.Equal(t, "\r\n", buf.String())
+
+	// Test: Response splitting through a header value writes nothing
+	h = headers.NewHeaders()
+	h.Set("Content-Type", "text/plain")
+	h.Set("Location", "/search?q=x\r\nContent-Length: 0\r\n\r\nHTTP/1.1 200 OK")
+	buf = bytes.Buffer{}
+	err = WriteHeaders(&buf, *h)
+	require.ErrorIs(t, err, headers.ErrInvalidFieldValue)
+	assert.Equal(t, 0, buf.Len())
+
+	// Test: Invalid field name writes nothing
+	h = headers.NewHeaders()
+	h.Set("X-Injected: 1\r\nX-Other", "value")
+	buf = bytes.Buffer{}
+	err = WriteHeaders(&buf, *h)
+	require.ErrorIs(t, err, headers.ErrInvalidFieldName)
+	assert.Equal(t, 0, buf.Len())
+}
+
+func requestWithAccept(accept string) *request.Request {
+	req := &request.Request{Headers: headers.NewHeaders()}
+	req.RequestLine.RequestTarget = "/things/1"
+	if accept != "" {
+		req.Headers.Set("Accept", accept)
+	}
+	return req
+}
+
+func TestErrorPages(t *testing.T) {
+	pages := NewErrorPages()
+	notFound := NewHandlerErrMsg(StatusBadRequest, "no <such> thing")
+
+	// Test: No request falls back to plain text, with nothing to vary on
+	contentType, body := pages.RenderError(nil, &notFound)
+	assert.Equal(t, "text/plain", contentType)
+	assert.Equal(t, "no <such> thing", string(body))
+	assert.Nil(t, notFound.Header)
+
+	// Test: curl style wildcard gets plain text
+	contentType, body = pages.RenderError(requestWithAccept("*/*"), &notFound)
+	assert.Equal(t, "text/plain", contentType)
+	assert.Equal(t, "no <such> thing", string(body))
+
+	// Test: Browser Accept gets an escaped HTML page
+	contentType, body = pages.RenderError(
+		requestWithAccept("text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8"),
+		&notFound,
+	)
+	assert.Equal(t, "text/html; charset=utf-8", contentType)
+	assert.Contains(t, string(body), "<h1>400 Bad Request</h1>")
+	assert.Equal(t, "Accept", notFound.Header.Get("Vary"))
+	assert.Contains(t, string(body), "no &lt;such&gt; thing")
+
+	// Test: JSON clients get problem details
+	for _, accept := range []string{"application/problem+json", "application/json", "text/html;q=0.5, application/json"} {
+		contentType, body = pages.RenderError(requestWithAccept(accept), &notFound)
+		assert.Equal(t, "application/problem+json", contentType, accept)
+
+		var problem map[string]any
+		require.NoError(t, json.Unmarshal(body, &problem))
+		assert.Equal(t, map[string]any{
+			"type":     "about:blank",
+			"title":    "Bad Request",
+			"status":   float64(400),
+			"detail":   "no <such> thing",
+			"instance": "/things/1",
+		}, problem)
+	}
+
+	// Test: Problem type from the handler error
+	typed := NewHandlerErr(StatusBadRequest)
+	typed.Type = "https://example.com/probs/out-of-credit"
+	_, body = pages.RenderError(requestWithAccept("application/problem+json"), &typed)
+	assert.Contains(t, string(body), `"type":"https://example.com/probs/out-of-credit"`)
+
+	// Test: q=0 excludes a format
+	contentType, _ = pages.RenderError(requestWithAccept("text/html;q=0, */*;q=0.1"), &notFound)
+	assert.Equal(t, "text/plain", contentType)
+
+	// Test: Custom template per status code and media type
+	pages.Register(StatusBadRequest, MediaTypeText, template.Must(
+		template.New("400").Parse("oops {{.Status}}: {{.Detail}}\n"),
+	))
+	contentType, body = pages.RenderError(requestWithAccept("text/plain"), &notFound)
+	assert.Equal(t, "text/plain; charset=utf-8", contentType)
+	assert.Equal(t, "oops 400: no <such> thing\n", string(body))
+
+	// Test: Custom template doesn't apply to other statuses
+	internalErr := NewHandlerErr(StatusInternalServerError)
+	_, body = pages.RenderError(requestWithAccept("text/plain"), &internalErr)
+	assert.Equal(t, "Internal Server Error", string(body))
+}
+
+func TestNegotiate(t *testing.T) {
+	// Test: Negotiated type and Vary
+	w := NewWriter(nil)
+	ct, herr := NegotiateContentType(w, requestWithAccept("application/json"), "text/html", "application/json")
+	require.Nil(t, herr)
+	assert.Equal(t, "application/json", ct)
+	assert.Equal(t, "Accept", w.Header().Get("Vary"))
+
+	// Test: Vary lists each field once
+	req := requestWithAccept("text/html")
+	req.Headers.Set("Accept-Encoding", "gzip")
+	req.Headers.Set("Accept-Language", "en")
+	_, herr = NegotiateContentType(w, req, "text/html")
+	require.Nil(t, herr)
+	enc, herr := NegotiateEncoding(w, req, "gzip", "identity")
+	require.Nil(t, herr)
+	assert.Equal(t, "gzip", enc)
+	lang, herr := NegotiateLanguage(w, req, "en-US")
+	require.Nil(t, herr)
+	assert.Equal(t, "en-US", lang)
+	assert.Equal(t, "Accept, Accept-Encoding, Accept-Language", w.Header().Get("Vary"))
+
+	// Test: Vary: * is left alone
+	w = NewWriter(nil)
+	w.Header().Set("Vary", "*")
+	_, herr = NegotiateContentType(w, requestWithAccept("*/*"), "text/html")
+	require.Nil(t, herr)
+	assert.Equal(t, "*", w.Header().Get("Vary"))
+
+	// Test: Nothing acceptable is a 406
+	w = NewWriter(nil)
+	_, herr = NegotiateContentType(w, requestWithAccept("image/png"), "text/html", "application/json")
+	require.NotNil(t, herr)
+	assert.Equal(t, StatusNotAcceptable, herr.StatusCode)
+	assert.Equal(t, "Accept", herr.Header.Get("Vary"))
+}
+
+// splitResponse splits a raw response into its head and body, decoding a
+// chunked body
+func splitResponse(t *testing.T, raw string) (string, []byte) {
+	t.Helper()
+
+	head, body, ok := strings.Cut(raw, "\r\n\r\n")
+	require.True(t, ok, "no end of headers")
+	head += "\r\n"
+
+	if !strings.Contains(head, "Transfer-Encoding: chunked") {
+		return head, []byte(body)
+	}
+
+	decoded := bytes.Buffer{}
+	r := bufio.NewReader(strings.NewReader(body))
+	for {
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		size, err := strconv.ParseInt(strings.TrimSpace(line), 16, 64)
+		require.NoError(t, err)
+		if size == 0 {
+			break
+		}
+		_, err = io.CopyN(&decoded, r, size)
+		require.NoError(t, err)
+		crlf := make([]byte, 2)
+		_, err = io.ReadFull(r, crlf)
+		require.NoError(t, err)
+		require.Equal(t, "\r\n", string(crlf))
+	}
+	return head, decoded.Bytes()
+}
+
+func TestWriterStreaming(t *testing.T) {
+	// Test: Flush switches to chunked encoding
+	conn := bytes.Buffer{}
+	w := NewWriter(&conn)
+	fmt.Fprint(w, "first")
+	require.NoError(t, w.Flush())
+	assert.True(t, w.Committed())
+	fmt.Fprint(w, "second")
+	require.NoError(t, w.Finish())
+	assert.Equal(t,
+		"HTTP/1.1 200 OK\r\n"+
+			"Connection: close\r\n"+
+			"Content-Type: text/plain\r\n"+
+			"Transfer-Encoding: chunked\r\n"+
+			"\r\n"+
+			"5\r\nfirst\r\n"+
+			"6\r\nsecond\r\n"+
+			"0\r\n\r\n",
+		conn.String(),
+	)
+
+	// Test: Reset after Flush keeps the committed response
+	w.Reset()
+	assert.True(t, w.Committed())
+
+	// Test: Flush without a connection
+	w = NewWriter(nil)
+	require.ErrorIs(t, w.Flush(), ErrNoConnection)
+
+	// Test: A declared length is streamed without chunking
+	conn.Reset()
+	w = NewWriter(&conn)
+	w.SetContentLength(6)
+	require.NoError(t, w.Flush())
+	fmt.Fprint(w, "abc")
+	fmt.Fprint(w, "def")
+	_, err := fmt.Fprint(w, "g")
+	require.ErrorIs(t, err, ErrBodyTooLong)
+	require.NoError(t, w.Finish())
+	assert.Equal(t,
+		"HTTP/1.1 200 OK\r\n"+
+			"Content-Length: 6\r\n"+
+			"Connection: close\r\n"+
+			"Content-Type: text/plain\r\n"+
+			"\r\n"+
+			"abcdef",
+		conn.String(),
+	)
+
+	// Test: Stopping short of the declared length
+	w = NewWriter(&conn)
+	w.SetContentLength(6)
+	require.NoError(t, w.Flush())
+	require.ErrorIs(t, w.Finish(), ErrBodyTooShort)
+
+	// Test: 304 has neither a body nor Content-Length
+	conn.Reset()
+	w = NewWriter(&conn)
+	w.SetStatus(StatusNotModified)
+	fmt.Fprint(w, "ignored")
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 304 Not Modified\r\nConnection: close\r\n\r\n", conn.String())
+}
+
+func TestWriterCompression(t *testing.T) {
+	large := strings.Repeat("all good frfr\n", 200)
+
+	gzipReq := requestWithAccept("*/*")
+	gzipReq.Headers.Set("Accept-Encoding", "gzip, deflate")
+
+	// Test: Large buffered body is gzipped
+	conn := bytes.Buffer{}
+	w := NewWriter(&conn)
+	w.EnableCompression(gzipReq, DefaultCompression())
+	w.Header().Set("ETag", `"v1"`)
+	fmt.Fprint(w, large)
+	require.NoError(t, w.Finish())
+
+	head, body := splitResponse(t, conn.String())
+	assert.Contains(t, head, "Content-Encoding: gzip\r\n")
+	assert.Contains(t, head, "Vary: Accept-Encoding\r\n")
+	assert.Contains(t, head, `ETag: W/"v1"`)
+	assert.Contains(t, head, fmt.Sprintf("Content-Length: %d\r\n", len(body)))
+	assert.Less(t, len(body), len(large))
+
+	gz, err := gzip.NewReader(bytes.NewReader(body))
+	require.NoError(t, err)
+	decoded, err := io.ReadAll(gz)
+	require.NoError(t, err)
+	assert.Equal(t, large, string(decoded))
+
+	// Test: Deflate when gzip isn't accepted
+	deflateReq := requestWithAccept("*/*")
+	deflateReq.Headers.Set("Accept-Encoding", "gzip;q=0, deflate")
+	conn = bytes.Buffer{}
+	w = NewWriter(&conn)
+	w.EnableCompression(deflateReq, DefaultCompression())
+	fmt.Fprint(w, large)
+	require.NoError(t, w.Finish())
+
+	head, body = splitResponse(t, conn.String())
+	assert.Contains(t, head, "Content-Encoding: deflate\r\n")
+	zr, err := zlib.NewReader(bytes.NewReader(body))
+	require.NoError(t, err)
+	decoded, err = io.ReadAll(zr)
+	require.NoError(t, err)
+	assert.Equal(t, large, string(decoded))
+
+	// Test: Small body is left alone but still varies
+	conn = bytes.Buffer{}
+	w = NewWriter(&conn)
+	w.EnableCompression(gzipReq, DefaultCompression())
+	fmt.Fprint(w, "tiny")
+	require.NoError(t, w.Finish())
+
+	head, body = splitResponse(t, conn.String())
+	assert.NotContains(t, head, "Content-Encoding")
+	assert.Contains(t, head, "Vary: Accept-Encoding\r\n")
+	assert.Equal(t, "tiny", string(body))
+
+	// Test: Already compressed content types are skipped
+	conn = bytes.Buffer{}
+	w = NewWriter(&conn)
+	w.EnableCompression(gzipReq, DefaultCompression())
+	w.Header().Set("Content-Type", "image/png")
+	fmt.Fprint(w, large)
+	require.NoError(t, w.Finish())
+
+	head, body = splitResponse(t, conn.String())
+	assert.NotContains(t, head, "Content-Encoding")
+	assert.NotContains(t, head, "Vary")
+	assert.Equal(t, large, string(body))
+
+	// Test: Client without Accept-Encoding gets identity
+	conn = bytes.Buffer{}
+	w = NewWriter(&conn)
+	identityReq := requestWithAccept("*/*")
+	identityReq.Headers.Set("Accept-Encoding", "")
+	w.EnableCompression(identityReq, DefaultCompression())
+	fmt.Fprint(w, large)
+	require.NoError(t, w.Finish())
+
+	head, body = splitResponse(t, conn.String())
+	assert.NotContains(t, head, "Content-Encoding")
+	assert.Equal(t, large, string(body))
+
+	// Test: Streamed body is compressed as it is flushed
+	conn = bytes.Buffer{}
+	w = NewWriter(&conn)
+	w.EnableCompression(gzipReq, DefaultCompression())
+	fmt.Fprint(w, "event one\n")
+	require.NoError(t, w.Flush())
+	flushed := conn.Len()
+	fmt.Fprint(w, "event two\n")
+	require.NoError(t, w.Flush())
+	assert.Greater(t, conn.Len(), flushed, "second flush should reach the connection")
+	require.NoError(t, w.Finish())
+
+	head, body = splitResponse(t, conn.String())
+	assert.Contains(t, head, "Transfer-Encoding: chunked\r\n")
+	assert.Contains(t, head, "Content-Encoding: gzip\r\n")
+	assert.NotContains(t, head, "Content-Length")
+	gz, err = gzip.NewReader(bytes.NewReader(body))
+	require.NoError(t, err)
+	decoded, err = io.ReadAll(gz)
+	require.NoError(t, err)
+	assert.Equal(t, "event one\nevent two\n", string(decoded))
+}
+
+func TestWriterHijack(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	// Test: Not hijackable unless the server allows it
+	w := NewWriter(server)
+	_, _, err := w.Hijack()
+	require.ErrorIs(t, err, ErrNotHijackable)
+
+	// Test: Hijacking hands over the connection and buffered bytes, and
+	// the Writer is unusable afterwards
+	w.SetHijacker(func() (net.Conn, []byte, error) {
+		return server, []byte("early"), nil
+	})
+	fmt.Fprint(w, "dropped")
+	conn, buffered, err := w.Hijack()
+	require.NoError(t, err)
+	assert.Equal(t, server, conn)
+	assert.Equal(t, "early", string(buffered))
+	assert.True(t, w.Hijacked())
+
+	_, err = fmt.Fprint(w, "more")
+	require.ErrorIs(t, err, ErrHijacked)
+	require.ErrorIs(t, w.Flush(), ErrHijacked)
+	require.ErrorIs(t, w.Finish(), ErrHijacked)
+	_, _, err = w.Hijack()
+	require.ErrorIs(t, err, ErrHijacked)
+
+	// Test: Too late once the response is committed
+	var out bytes.Buffer
+	w = NewWriter(&out)
+	w.SetHijacker(func() (net.Conn, []byte, error) {
+		t.Error("hijacker should not be called")
+		return nil, nil, nil
+	})
+	require.NoError(t, w.Flush())
+	_, _, err = w.Hijack()
+	require.ErrorIs(t, err, ErrNotHijackable)
+}
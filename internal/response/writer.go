@@ -0,0 +1,412 @@
+package response
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/yus-works/tcp-to-http/internal/framing"
+	"github.com/yus-works/tcp-to-http/internal/headers"
+	"github.com/yus-works/tcp-to-http/internal/request"
+)
+
+// ErrNoConnection is returned by Flush on a Writer that isn't attached to a
+// connection
+var ErrNoConnection = errors.New("Writer has no connection to flush to")
+
+// ErrHijacked is returned by a Writer whose connection a handler has taken
+// over, and ErrNotHijackable by Hijack when the connection can't be
+var (
+	ErrHijacked      = errors.New("Connection has been hijacked")
+	ErrNotHijackable = errors.New("Connection can't be hijacked")
+)
+
+// Hijacker hands over the connection a Writer is attached to, with any bytes
+// already read from it that haven't been consumed
+type Hijacker func() (net.Conn, []byte, error)
+
+// Framer carries a response over something other than an HTTP/1.1
+// connection, such as an HTTP/2 stream. The Writer still decides the status,
+// headers and body; the Framer only decides how they go on the wire
+type Framer interface {
+	// WriteHead sends the status and headers. Connection-specific fields
+	// the protocol doesn't allow are the Framer's to drop
+	WriteHead(statusCode StatusCode, h headers.Headers) error
+	// Write sends body bytes
+	io.Writer
+	// Close ends the response
+	Close() error
+}
+
+// ErrBodyTooLong and ErrBodyTooShort are returned when the body written
+// doesn't match the length given to SetContentLength
+var (
+	ErrBodyTooLong  = errors.New("Body is longer than the declared Content-Length")
+	ErrBodyTooShort = errors.New("Body is shorter than the declared Content-Length")
+)
+
+// Writer collects a handler's response. Nothing reaches the connection until
+// the handler returns or calls Flush, so when a handler fails part way
+// through its output can be thrown away and replaced by a single error
+// response. Once flushed, the response is streamed with chunked encoding
+type Writer struct {
+	conn       io.Writer
+	statusCode StatusCode
+	header     *headers.Headers
+	body       bytes.Buffer
+
+	// set once the status line and headers have been written
+	committed bool
+	// where body bytes go once committed: the chunked writer, possibly
+	// behind an encoder
+	out     io.Writer
+	chunked *framing.ChunkedWriter
+	encoder encoder
+
+	// contentLength is the length declared with SetContentLength, or -1.
+	// A declared length is streamed as is instead of chunked
+	contentLength int64
+	written       int64
+
+	compression *Compression
+	req         *request.Request
+
+	hijacker Hijacker
+	hijacked bool
+
+	framer Framer
+}
+
+// NewWriter returns a Writer for conn. conn may be nil when the response is
+// only ever buffered, e.g. in tests
+func NewWriter(conn io.Writer) *Writer {
+	return &Writer{
+		conn:          conn,
+		statusCode:    StatusOK,
+		header:        headers.NewHeaders(),
+		contentLength: -1,
+	}
+}
+
+// NewFramedWriter returns a Writer that sends its response through f
+func NewFramedWriter(f Framer) *Writer {
+	w := NewWriter(nil)
+	w.framer = f
+	return w
+}
+
+// Header returns the response headers. Content-Length, Transfer-Encoding and
+// Connection are managed by the server and are overwritten. Changes made
+// after Flush have no effect
+func (w *Writer) Header() *headers.Headers {
+	return w.header
+}
+
+// SetStatus sets the status code, 200 if never called
+func (w *Writer) SetStatus(statusCode StatusCode) {
+	w.statusCode = statusCode
+}
+
+// SetContentLength declares the length of the body up front, so that after
+// Flush it is streamed with a Content-Length instead of chunked encoding.
+// This rules out compressing the response
+func (w *Writer) SetContentLength(n int64) {
+	w.contentLength = n
+}
+
+// SetHijacker lets handlers take over the connection with Hijack
+func (w *Writer) SetHijacker(h Hijacker) {
+	w.hijacker = h
+}
+
+// Hijack takes the connection away from the server, which will neither
+// write a response nor close it: both become the caller's job. The bytes
+// returned were read from the connection past the end of the request and
+// come before anything still to be read from it. Anything written to w so
+// far is discarded, and it fails once the response has been committed
+func (w *Writer) Hijack() (net.Conn, []byte, error) {
+	switch {
+	case w.hijacked:
+		return nil, nil, ErrHijacked
+	case w.hijacker == nil:
+		return nil, nil, ErrNotHijackable
+	case w.committed:
+		return nil, nil, fmt.Errorf("%w: response already committed", ErrNotHijackable)
+	}
+
+	conn, buffered, err := w.hijacker()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	w.hijacked = true
+	w.body.Reset()
+	return conn, buffered, nil
+}
+
+// Hijacked reports whether the connection has been taken over with Hijack
+func (w *Writer) Hijacked() bool {
+	return w.hijacked
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.hijacked {
+		return 0, ErrHijacked
+	}
+
+	if !w.committed {
+		return w.body.Write(p)
+	}
+
+	if w.contentLength != -1 {
+		if w.written+int64(len(p)) > w.contentLength {
+			return 0, ErrBodyTooLong
+		}
+		w.written += int64(len(p))
+	}
+	return w.out.Write(p)
+}
+
+// Committed reports whether the status line and headers have been sent,
+// after which the response can no longer be replaced
+func (w *Writer) Committed() bool {
+	return w.committed
+}
+
+// Reset discards the status, headers and body written so far. It has no
+// effect once the response is committed
+func (w *Writer) Reset() {
+	if w.committed {
+		return
+	}
+
+	w.statusCode = StatusOK
+	w.header = headers.NewHeaders()
+	w.body.Reset()
+	w.contentLength = -1
+}
+
+// Flush sends the status line, headers and everything written so far, and
+// switches the response to chunked encoding so later writes are streamed.
+// Calling it again pushes out anything held back by the encoder
+func (w *Writer) Flush() error {
+	if w.hijacked {
+		return ErrHijacked
+	}
+	if w.conn == nil && w.framer == nil {
+		return ErrNoConnection
+	}
+
+	if !w.committed {
+		if err := w.commitStreaming(); err != nil {
+			return err
+		}
+	}
+
+	if w.encoder != nil {
+		return w.encoder.Flush()
+	}
+	return nil
+}
+
+// isFramingHeader reports whether k describes how the message is delimited,
+// which only the server decides
+func isFramingHeader(k string) bool {
+	switch strings.ToLower(k) {
+	case "content-length", "connection", "transfer-encoding":
+		return true
+	}
+	return false
+}
+
+// bodyAllowed reports whether a response with statusCode can have a body
+func bodyAllowed(statusCode StatusCode) bool {
+	return statusCode >= 200 && statusCode != 204 && statusCode != 304
+}
+
+// responseHeaders merges the handler's headers with the default ones
+func (w *Writer) responseHeaders(contentLen int64) headers.Headers {
+	h := GetDefaultHeaders(int(contentLen))
+	if w.header.Has("Content-Type") || !bodyAllowed(w.statusCode) {
+		h.Del("Content-Type")
+	}
+	if !bodyAllowed(w.statusCode) {
+		h.Del("Content-Length")
+	}
+
+	for k, v := range w.header.All() {
+		if !isFramingHeader(k) {
+			h.Add(k, v)
+		}
+	}
+	return h
+}
+
+func (w *Writer) writeHead(h headers.Headers) error {
+	if err := h.Validate(); err != nil {
+		return fmt.Errorf("Failed to write response: %w", err)
+	}
+
+	if w.framer != nil {
+		return w.framer.WriteHead(w.statusCode, h)
+	}
+
+	if err := WriteStatusLine(w.conn, w.statusCode); err != nil {
+		return err
+	}
+	return WriteHeaders(w.conn, h)
+}
+
+// commitStreaming writes the head of a chunked response and moves the
+// buffered body into the stream
+func (w *Writer) commitStreaming() error {
+	if w.contentLength != -1 || !bodyAllowed(w.statusCode) {
+		return w.commitFixedLength()
+	}
+
+	enc := w.negotiateEncoding(-1)
+
+	h := w.responseHeaders(0)
+	h.Del("Content-Length")
+	if w.framer == nil {
+		h.Set("Transfer-Encoding", "chunked")
+	}
+	if enc != "" {
+		setContentEncoding(&h, enc)
+	}
+
+	if err := w.writeHead(h); err != nil {
+		return err
+	}
+
+	w.committed = true
+	if w.framer != nil {
+		// the framer delimits the body itself
+		w.out = w.framer
+	} else {
+		w.chunked = framing.NewChunkedWriter(w.conn)
+		w.out = w.chunked
+	}
+
+	if enc != "" {
+		encoder, err := newEncoder(enc, w.out, w.compression.Level)
+		if err != nil {
+			return err
+		}
+		w.encoder = encoder
+		w.out = encoder
+	}
+
+	_, err := w.out.Write(w.body.Bytes())
+	w.body.Reset()
+	return err
+}
+
+// commitFixedLength writes the head of a response whose length was declared
+// with SetContentLength, or that can't have a body at all
+func (w *Writer) commitFixedLength() error {
+	length := w.contentLength
+	if !bodyAllowed(w.statusCode) {
+		length = 0
+	}
+
+	h := w.responseHeaders(length)
+	if err := w.writeHead(h); err != nil {
+		return err
+	}
+
+	w.committed = true
+	w.contentLength = length
+	w.out = w.conn
+	if w.framer != nil {
+		w.out = w.framer
+	}
+
+	buffered := w.body.Bytes()
+	w.body.Reset()
+	if !bodyAllowed(w.statusCode) {
+		// whatever was written to a response without a body is dropped
+		return nil
+	}
+	_, err := w.Write(buffered)
+	return err
+}
+
+// Finish completes the response: a buffered response is written in full
+// with a Content-Length, a streamed one gets its final chunk. Invalid
+// headers on a buffered response are reported before anything is written
+func (w *Writer) Finish() error {
+	if w.hijacked {
+		return ErrHijacked
+	}
+
+	if w.committed && w.contentLength != -1 {
+		if w.written < w.contentLength {
+			return ErrBodyTooShort
+		}
+		if w.framer != nil {
+			return w.framer.Close()
+		}
+		return nil
+	}
+
+	if w.committed {
+		if w.encoder != nil {
+			if err := w.encoder.Close(); err != nil {
+				return fmt.Errorf("Failed to finish encoded body: %w", err)
+			}
+		}
+		if w.framer != nil {
+			return w.framer.Close()
+		}
+		return w.chunked.Close()
+	}
+
+	if w.conn == nil && w.framer == nil {
+		return ErrNoConnection
+	}
+
+	if w.contentLength != -1 || !bodyAllowed(w.statusCode) {
+		if err := w.commitFixedLength(); err != nil {
+			return err
+		}
+		return w.Finish()
+	}
+
+	body := w.body.Bytes()
+
+	enc := w.negotiateEncoding(len(body))
+	if enc != "" {
+		encoded, err := encodeAll(enc, body, w.compression.Level)
+		if err != nil {
+			return err
+		}
+		body = encoded
+	}
+
+	h := w.responseHeaders(int64(len(body)))
+	if enc != "" {
+		setContentEncoding(&h, enc)
+	}
+
+	if err := w.writeHead(h); err != nil {
+		return err
+	}
+	w.committed = true
+
+	if w.framer != nil {
+		if _, err := w.framer.Write(body); err != nil {
+			return fmt.Errorf("Failed to write body: %w", err)
+		}
+		return w.framer.Close()
+	}
+
+	_, err := w.conn.Write(body)
+	if err != nil {
+		return fmt.Errorf("Failed to write body: %w", err)
+	}
+	return nil
+}
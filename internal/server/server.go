@@ -2,13 +2,22 @@ package server
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"net/netip"
+	"sync"
 	"sync/atomic"
+	"time"
 
+	"github.com/yus-works/tcp-to-http/internal/headers"
+	"github.com/yus-works/tcp-to-http/internal/http2"
+	"github.com/yus-works/tcp-to-http/internal/proxyproto"
 	"github.com/yus-works/tcp-to-http/internal/request"
 	"github.com/yus-works/tcp-to-http/internal/response"
+	"github.com/yus-works/tcp-to-http/internal/websocket"
 )
 
 type Server struct {
@@ -16,29 +25,218 @@ type Server struct {
 
 	closed   atomic.Bool
 	listener net.Listener
-	handler response.Handler
+	handler  response.Handler
+
+	// conns are the connections being served, closed along with the server.
+	// Hijacked connections are dropped from it
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+	// connIDs numbers the connections accepted
+	connIDs atomic.Uint64
+
+	errorRenderer response.ErrorRenderer
+	compression   *response.Compression
+
+	// decodeRequests enables decoding Content-Encoding request bodies of up
+	// to maxDecodedSize bytes
+	decodeRequests bool
+	maxDecodedSize int64
+
+	// maxBodySize is the largest request body accepted, 0 for no limit
+	maxBodySize int
+	// streamBodies leaves request bodies on the connection until the
+	// handler asks for them
+	streamBodies bool
+
+	websocket websocket.Handler
+	// tunnel serves CONNECT requests, which are refused without one
+	tunnel response.Handler
+
+	// h2c serves HTTP/2 alongside HTTP/1.1 when set
+	h2c bool
+	h2  *http2.Server
+
+	// proxyProtocol reads PROXY protocol headers from the proxyTrusted
+	// ranges
+	proxyProtocol bool
+	proxyTrusted  []netip.Prefix
+
+	// trustedProxies may tell us who the client is in the forwardedFrom
+	// headers
+	trustedProxies []netip.Prefix
+	forwardedFrom  request.ForwardedHeaders
+}
+
+// Option configures optional server behaviour
+type Option func(*Server)
+
+// WithErrorRenderer sets how error response bodies are rendered. The default
+// picks plain text, HTML or problem+json from the request's Accept header
+func WithErrorRenderer(r response.ErrorRenderer) Option {
+	return func(s *Server) {
+		s.errorRenderer = r
+	}
+}
+
+// WithCompression compresses responses for clients that accept gzip or
+// deflate
+func WithCompression(c response.Compression) Option {
+	return func(s *Server) {
+		s.compression = &c
+	}
+}
+
+// WithRequestDecoding transparently decodes gzip and deflate request bodies
+// before they reach the handler. Bodies that decode to more than maxSize
+// bytes are rejected with 413, other codings with 415
+func WithRequestDecoding(maxSize int64) Option {
+	return func(s *Server) {
+		s.decodeRequests = true
+		s.maxDecodedSize = maxSize
+	}
+}
+
+// WithMaxBodySize rejects request bodies over n bytes with 413. Requests
+// that declare a larger Content-Length are turned away before their body is
+// read, and before the 100 Continue for clients waiting on one
+func WithMaxBodySize(n int) Option {
+	return func(s *Server) {
+		s.maxBodySize = n
+	}
+}
+
+// WithStreamingBodies leaves request bodies on the connection until the
+// handler asks for them, so it can stream them with req.BodyReader rather
+// than have the server read them in first. Handlers have to get the body
+// from req.ReadBody, as until then req.Body has no more than what came in
+// with the head
+func WithStreamingBodies() Option {
+	return func(s *Server) {
+		s.streamBodies = true
+	}
+}
+
+// WithWebSocket hands requests asking for a WebSocket upgrade to h once the
+// handshake is done. Other requests still go to the server's handler
+func WithWebSocket(h websocket.Handler) Option {
+	return func(s *Server) {
+		s.websocket = h
+	}
+}
+
+// WithTunnel hands CONNECT requests to h, typically a proxy.Tunnel's Serve.
+// Without it they are refused with 405, as not every handler is ready for a
+// request whose target is a host:port to connect to
+func WithTunnel(h response.Handler) Option {
+	return func(s *Server) {
+		s.tunnel = h
+	}
 }
 
-func Serve(port int, handler response.Handler) (*Server, error) {
+// WithH2C also serves HTTP/2 over cleartext TCP, both to clients that open
+// with the HTTP/2 preface and to ones that ask to switch with Upgrade: h2c.
+// HTTP/2 requests go to the same handler as HTTP/1.1 ones
+func WithH2C() Option {
+	return func(s *Server) {
+		s.h2c = true
+	}
+}
+
+// WithProxyProtocol reads the PROXY protocol header load balancers in the
+// trusted ranges send ahead of each connection, so requests carry the
+// client's address instead of the balancer's. Connections from trusted
+// ranges must send one, and anyone else sending one is dropped
+func WithProxyProtocol(trusted []netip.Prefix) Option {
+	return func(s *Server) {
+		s.proxyProtocol = true
+		s.proxyTrusted = trusted
+	}
+}
+
+// WithTrustedProxies believes the forwarding headers proxies in the
+// trusted ranges send, for the client address, scheme and host in
+// req.Origin. from has to be the kind the proxies write, as the other kind
+// is passed through from the client untouched. Without it Origin describes
+// the connection. proxyproto.ParseTrusted parses the ranges
+func WithTrustedProxies(trusted []netip.Prefix, from request.ForwardedHeaders) Option {
+	return func(s *Server) {
+		s.trustedProxies = trusted
+		s.forwardedFrom = from
+	}
+}
+
+func newServer(handler response.Handler, opts ...Option) *Server {
+	s := &Server{
+		handler:       handler,
+		errorRenderer: response.NewErrorPages(),
+		conns:         map[net.Conn]struct{}{},
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	if s.h2c {
+		s.h2 = http2.NewServer(s.serveStream)
+		s.h2.ErrorRenderer = s.errorRenderer
+		s.h2.MaxBodySize = s.maxBodySize
+	}
+
+	return s
+}
+
+func Serve(port int, handler response.Handler, opts ...Option) (*Server, error) {
 	ln, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", port))
 	if err != nil {
 		return nil, fmt.Errorf("Error starting server on %d: %w\n", port, err)
 	}
 
-	s := Server{
-		port:     port,
-		listener: ln,
-		handler: handler,
+	s := newServer(handler, opts...)
+	s.port = port
+	s.listener = ln
+	if s.proxyProtocol {
+		s.listener = proxyproto.NewListener(ln, s.proxyTrusted)
 	}
 
 	go s.listen()
 
-	return &s, nil
+	return s, nil
 }
 
+// Close stops accepting connections and closes the ones being served.
+// Connections handlers have hijacked are left alone
 func (s *Server) Close() error {
 	s.closed.Store(true)
-	return s.listener.Close()
+	err := s.listener.Close()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	clear(s.conns)
+
+	return err
+}
+
+// track adds conn to the connections being served. It reports false if the
+// server has been closed, in which case conn should be dropped
+func (s *Server) track(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed.Load() {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	return true
+}
+
+func (s *Server) untrack(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.conns, conn)
 }
 
 func (s *Server) listen() {
@@ -56,27 +254,212 @@ func (s *Server) listen() {
 	}
 }
 
+// writeContinue tells a client waiting on Expect: 100-continue to send the
+// body
+func writeContinue(conn net.Conn) error {
+	if err := response.WriteStatusLine(conn, response.StatusContinue); err != nil {
+		return err
+	}
+	return response.WriteHeaders(conn, *headers.NewHeaders())
+}
+
+// writeError sends e rendered for req, which is nil if it couldn't be parsed
+func (s *Server) writeError(conn net.Conn, req *request.Request, e *response.HandlerError) {
+	err := e.Render(conn, req, s.errorRenderer)
+	if err != nil {
+		log.Println("Failed to write error response: ", err)
+	}
+}
+
+// serveStream does for a request arriving over HTTP/2 what handle does for
+// an HTTP/1.1 one before its handler runs
+func (s *Server) serveStream(w *response.Writer, req *request.Request) *response.HandlerError {
+	req.ResolveOrigin(s.trustedProxies, s.forwardedFrom)
+	if s.compression != nil {
+		w.EnableCompression(req, *s.compression)
+	}
+	if s.decodeRequests {
+		if err := req.DecodeBody(s.maxDecodedSize); err != nil {
+			return response.RequestError(err)
+		}
+	}
+	// a tunnel takes over the connection, which a stream can't hand over
+	if req.RequestLine.Method == "CONNECT" {
+		return refuseConnect(w, req)
+	}
+	return s.handler(w, req)
+}
+
+// connectHandler is the handler for CONNECT requests
+func (s *Server) connectHandler() response.Handler {
+	if s.tunnel != nil {
+		return s.tunnel
+	}
+	return refuseConnect
+}
+
+// refuseConnect answers CONNECT on a server that doesn't tunnel
+func refuseConnect(w *response.Writer, req *request.Request) *response.HandlerError {
+	e := response.NewHandlerErr(response.StatusMethodNotAllowed)
+	e.Header = headers.NewHeaders()
+	e.Header.Set("Allow", "GET, PUT, POST, DELETE, OPTIONS")
+	return &e
+}
+
 func (s *Server) handle(conn net.Conn) {
-	defer conn.Close()
+	if !s.track(conn) {
+		conn.Close()
+		return
+	}
+
+	hijacked := false
+	defer func() {
+		if !hijacked {
+			s.untrack(conn)
+			conn.Close()
+		}
+	}()
+
+	// PROXY protocol and TLS connections are set up before anything else,
+	// so their addresses and TLS state are known
+	if hc, ok := conn.(interface{ Handshake() error }); ok {
+		if err := hc.Handshake(); err != nil {
+			log.Println("Dropping connection: ", err)
+			return
+		}
+	}
+	info := request.NewConnInfo(s.connIDs.Add(1), conn)
 
-	req, err := request.RequestFromReader(conn)
+	var reader io.Reader = conn
+	if s.h2 != nil {
+		// a failed read shows up again when reading the request
+		head, isH2, _ := http2.SniffPreface(conn)
+		if isH2 {
+			if err := s.h2.ServeConn(conn, head, info); err != nil {
+				log.Println("HTTP/2 connection failed: ", err)
+			}
+			return
+		}
+		reader = io.MultiReader(bytes.NewReader(head), conn)
+	}
+
+	rr := request.NewReader(reader)
+	rr.MaxBodySize = s.maxBodySize
+
+	start := time.Now()
+	req, err := rr.ReadHead()
 	if err != nil {
 		log.Println("Failed to parse/read request: ", err)
+		s.writeError(conn, nil, response.RequestError(err))
+		return
+	}
+	// connections carry a single request
+	req.SetConn(info, 1, start)
+	req.ResolveOrigin(s.trustedProxies, s.forwardedFrom)
+
+	w := response.NewWriter(conn)
+	if s.compression != nil {
+		w.EnableCompression(req, *s.compression)
+	}
+	w.SetHijacker(func() (net.Conn, []byte, error) {
+		s.untrack(conn)
+		hijacked = true
+		return conn, rr.Buffered(), nil
+	})
+
+	readBody := func() error {
+		if err := rr.ReadBody(); err != nil {
+			return err
+		}
+		if s.decodeRequests {
+			return req.DecodeBody(s.maxDecodedSize)
+		}
+		return nil
+	}
 
-		response.WriteError(conn, response.StatusBadRequest)
+	// a client waiting on Expect: 100-continue holds the body back until
+	// it is told to go ahead, which waits for the handler to ask for it. A
+	// handler that answers without reading it saves the upload
+	// (RFC 9110 10.1.1)
+	goAhead := func() error {
+		if req.ExpectContinue && !w.Committed() {
+			return writeContinue(conn)
+		}
+		return nil
+	}
+
+	if (req.ExpectContinue || s.streamBodies) && !rr.BodyDone() {
+		req.DeferBody(func() error {
+			if err := goAhead(); err != nil {
+				return err
+			}
+			return readBody()
+		}, func() (io.Reader, error) {
+			if err := goAhead(); err != nil {
+				return nil, err
+			}
+			return rr.BodyReader(), nil
+		})
+	} else if err := readBody(); err != nil {
+		log.Println("Failed to read request body: ", err)
+		s.writeError(conn, req, response.RequestError(err))
 		return
 	}
 
-	buf := bytes.Buffer{}
+	if s.h2 != nil && http2.IsUpgrade(req) {
+		// the request has to be read in full before switching, and is
+		// answered over HTTP/2
+		if _, err := req.ReadBody(); err != nil {
+			log.Println("Failed to read request body: ", err)
+			s.writeError(conn, req, response.RequestError(err))
+			return
+		}
+		if err := s.h2.ServeUpgrade(conn, rr.Buffered(), req); err != nil {
+			log.Println("HTTP/2 connection failed: ", err)
+		}
+		return
+	}
+
+	handler := s.handler
+	switch {
+	case req.RequestLine.Method == "CONNECT":
+		handler = s.connectHandler()
+	case s.websocket != nil && websocket.IsUpgrade(req):
+		handler = websocket.Handle(s.websocket)
+	}
+
+	handlerErr := handler(w, req)
+	if w.Hijacked() {
+		if handlerErr != nil {
+			log.Println("Handler failed after hijacking: ", handlerErr.Message)
+		}
+		return
+	}
 
-	handlerErr := s.handler(&buf, req)
 	if handlerErr != nil {
-		handlerErr.Write(conn)
+		if w.Committed() {
+			// the head is already out so there's no replacing it; closing
+			// without the last chunk tells the client the body is incomplete
+			log.Println("Handler failed after flushing: ", handlerErr.Message)
+			return
+		}
+
+		// whatever the handler wrote before failing is dropped so the
+		// client only ever sees the error response
+		w.Reset()
+
+		s.writeError(conn, req, handlerErr)
+		return
 	}
 
-	msg := buf.Bytes()
+	err = w.Finish()
+	if err != nil {
+		log.Println("Failed to write response: ", err)
 
-	response.WriteStatusLine(conn, response.StatusOK)
-	response.WriteHeaders(conn, response.GetDefaultHeaders(len(msg)))
-	conn.Write(msg)
+		if !w.Committed() && (errors.Is(err, headers.ErrInvalidFieldName) ||
+			errors.Is(err, headers.ErrInvalidFieldValue)) {
+			internalErr := response.NewHandlerErr(response.StatusInternalServerError)
+			s.writeError(conn, req, &internalErr)
+		}
+	}
 }
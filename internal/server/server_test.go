@@ -0,0 +1,834 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yus-works/tcp-to-http/internal/hpack"
+	"github.com/yus-works/tcp-to-http/internal/http2"
+	"github.com/yus-works/tcp-to-http/internal/proxy"
+	"github.com/yus-works/tcp-to-http/internal/proxyproto"
+	"github.com/yus-works/tcp-to-http/internal/request"
+	"github.com/yus-works/tcp-to-http/internal/response"
+	"github.com/yus-works/tcp-to-http/internal/websocket"
+)
+
+// roundTrip runs handle on one end of a net.Pipe, sends rawReq from the
+// other end and returns every byte the server wrote before closing
+func roundTrip(
+	t *testing.T, handler response.Handler, rawReq string, opts ...Option,
+) string {
+	t.Helper()
+
+	client, conn := net.Pipe()
+	defer client.Close()
+
+	s := newServer(handler, opts...)
+	go s.handle(conn)
+
+	go func() {
+		client.Write([]byte(rawReq))
+	}()
+
+	out, err := io.ReadAll(client)
+	require.NoError(t, err)
+	return string(out)
+}
+
+const getRoot = "GET / HTTP/1.1\r\nHost: localhost:42069\r\n\r\n"
+
+func TestHandle(t *testing.T) {
+	// Test: Successful handler
+	out := roundTrip(t, func(w *response.Writer, req *request.Request) *response.HandlerError {
+		fmt.Fprint(w, "all good frfr\n")
+		return nil
+	}, getRoot)
+	assert.Equal(t,
+		"HTTP/1.1 200 OK\r\n"+
+			"Content-Length: 14\r\n"+
+			"Connection: close\r\n"+
+			"Content-Type: text/plain\r\n"+
+			"\r\n"+
+			"all good frfr\n",
+		out,
+	)
+
+	// Test: Handler sets status and headers
+	out = roundTrip(t, func(w *response.Writer, req *request.Request) *response.HandlerError {
+		w.SetStatus(response.StatusBadRequest)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", "9999")
+		w.Header().Add("Set-Cookie", "a=1")
+		w.Header().Add("Set-Cookie", "b=2")
+		fmt.Fprint(w, "{}")
+		return nil
+	}, getRoot)
+	assert.Equal(t,
+		"HTTP/1.1 400 Bad Request\r\n"+
+			"Content-Length: 2\r\n"+
+			"Connection: close\r\n"+
+			"Content-Type: application/json\r\n"+
+			"Set-Cookie: a=1\r\n"+
+			"Set-Cookie: b=2\r\n"+
+			"\r\n"+
+			"{}",
+		out,
+	)
+
+	// Test: Unparseable request
+	out = roundTrip(t, func(w *response.Writer, req *request.Request) *response.HandlerError {
+		t.Error("handler should not be called")
+		return nil
+	}, "GET / HTTP/1.1\r\n\r\n")
+	assert.Equal(t,
+		"HTTP/1.1 400 Bad Request\r\n"+
+			"Content-Length: 11\r\n"+
+			"Connection: close\r\n"+
+			"Content-Type: text/plain\r\n"+
+			"\r\n"+
+			"Bad Request",
+		out,
+	)
+
+	// Test: Invalid handler headers become a 500
+	out = roundTrip(t, func(w *response.Writer, req *request.Request) *response.HandlerError {
+		w.Header().Set("Location", "/\r\nSet-Cookie: admin=1")
+		fmt.Fprint(w, "redirecting")
+		return nil
+	}, getRoot)
+	assert.Equal(t,
+		"HTTP/1.1 500 Internal Server Error\r\n"+
+			"Content-Length: 21\r\n"+
+			"Connection: close\r\n"+
+			"Content-Type: text/plain\r\n"+
+			"Vary: Accept\r\n"+
+			"\r\n"+
+			"Internal Server Error",
+		out,
+	)
+}
+
+func TestHandleHandlerError(t *testing.T) {
+	// Test: Handler error produces exactly one response
+	out := roundTrip(t, func(w *response.Writer, req *request.Request) *response.HandlerError {
+		err := response.NewHandlerErr(response.StatusInternalServerError)
+		return &err
+	}, getRoot)
+	assert.Equal(t,
+		"HTTP/1.1 500 Internal Server Error\r\n"+
+			"Content-Length: 21\r\n"+
+			"Connection: close\r\n"+
+			"Content-Type: text/plain\r\n"+
+			"Vary: Accept\r\n"+
+			"\r\n"+
+			"Internal Server Error",
+		out,
+	)
+
+	// Test: Partial output, status and headers are discarded
+	out = roundTrip(t, func(w *response.Writer, req *request.Request) *response.HandlerError {
+		w.SetStatus(response.StatusOK)
+		w.Header().Set("X-Partial", "yes")
+		fmt.Fprint(w, "half a resp")
+		err := response.NewHandlerErr(response.StatusBadRequest)
+		return &err
+	}, getRoot)
+	assert.Equal(t,
+		"HTTP/1.1 400 Bad Request\r\n"+
+			"Content-Length: 11\r\n"+
+			"Connection: close\r\n"+
+			"Content-Type: text/plain\r\n"+
+			"Vary: Accept\r\n"+
+			"\r\n"+
+			"Bad Request",
+		out,
+	)
+	assert.NotContains(t, out, "HTTP/1.1 200")
+	assert.NotContains(t, out, "half a resp")
+
+	// Test: Custom message becomes the body
+	out = roundTrip(t, func(w *response.Writer, req *request.Request) *response.HandlerError {
+		err := response.NewHandlerErrMsg(response.StatusBadRequest, "missing ?id parameter\n")
+		return &err
+	}, getRoot)
+	assert.Equal(t,
+		"HTTP/1.1 400 Bad Request\r\n"+
+			"Content-Length: 22\r\n"+
+			"Connection: close\r\n"+
+			"Content-Type: text/plain\r\n"+
+			"Vary: Accept\r\n"+
+			"\r\n"+
+			"missing ?id parameter\n",
+		out,
+	)
+}
+
+func TestHandleStreaming(t *testing.T) {
+	// Test: Handler error after Flush leaves the stream unterminated
+	out := roundTrip(t, func(w *response.Writer, req *request.Request) *response.HandlerError {
+		fmt.Fprint(w, "partial")
+		w.Flush()
+		err := response.NewHandlerErr(response.StatusInternalServerError)
+		return &err
+	}, getRoot)
+	assert.Equal(t,
+		"HTTP/1.1 200 OK\r\n"+
+			"Connection: close\r\n"+
+			"Content-Type: text/plain\r\n"+
+			"Transfer-Encoding: chunked\r\n"+
+			"\r\n"+
+			"7\r\npartial\r\n",
+		out,
+	)
+
+	// Test: Compression option
+	out = roundTrip(t, func(w *response.Writer, req *request.Request) *response.HandlerError {
+		fmt.Fprint(w, "hello")
+		return nil
+	},
+		"GET / HTTP/1.1\r\nHost: localhost\r\nAccept-Encoding: gzip\r\n\r\n",
+		WithCompression(response.Compression{MinSize: 0, Level: 1}),
+	)
+	assert.Contains(t, out, "Content-Encoding: gzip\r\n")
+	assert.Contains(t, out, "Vary: Accept-Encoding\r\n")
+}
+
+func TestHandleErrorRendering(t *testing.T) {
+	failing := func(w *response.Writer, req *request.Request) *response.HandlerError {
+		err := response.NewHandlerErrMsg(response.StatusBadRequest, "bad id")
+		return &err
+	}
+
+	// Test: Default renderer negotiates problem+json
+	out := roundTrip(t, failing,
+		"GET /items HTTP/1.1\r\nHost: localhost\r\nAccept: application/json\r\n\r\n",
+	)
+	body := `{"type":"about:blank","title":"Bad Request","status":400,"detail":"bad id","instance":"/items"}`
+	assert.Equal(t,
+		"HTTP/1.1 400 Bad Request\r\n"+
+			fmt.Sprintf("Content-Length: %d\r\n", len(body))+
+			"Connection: close\r\n"+
+			"Content-Type: application/problem+json\r\n"+
+			"Vary: Accept\r\n"+
+			"\r\n"+
+			body,
+		out,
+	)
+
+	// Test: Custom renderer
+	renderer := response.ErrorRendererFunc(
+		func(req *request.Request, e *response.HandlerError) (string, []byte) {
+			return "text/x-custom", []byte("custom " + e.Message)
+		},
+	)
+	out = roundTrip(t, failing, getRoot, WithErrorRenderer(renderer))
+	assert.Equal(t,
+		"HTTP/1.1 400 Bad Request\r\n"+
+			"Content-Length: 13\r\n"+
+			"Connection: close\r\n"+
+			"Content-Type: text/x-custom\r\n"+
+			"\r\n"+
+			"custom bad id",
+		out,
+	)
+}
+
+func TestHandleRequestDecoding(t *testing.T) {
+	echo := func(w *response.Writer, req *request.Request) *response.HandlerError {
+		w.Write(req.Body)
+		return nil
+	}
+
+	// Test: Unsupported coding is a 415 listing what is supported
+	out := roundTrip(t, echo,
+		"POST / HTTP/1.1\r\nHost: localhost\r\nContent-Encoding: br\r\nContent-Length: 3\r\n\r\nabc",
+		WithRequestDecoding(1024),
+	)
+	assert.Equal(t,
+		"HTTP/1.1 415 Unsupported Media Type\r\n"+
+			"Content-Length: 22\r\n"+
+			"Connection: close\r\n"+
+			"Content-Type: text/plain\r\n"+
+			"Accept-Encoding: gzip, deflate\r\n"+
+			"Vary: Accept\r\n"+
+			"\r\n"+
+			"Unsupported Media Type",
+		out,
+	)
+
+	// Test: Decoding is off by default
+	out = roundTrip(t, echo,
+		"POST / HTTP/1.1\r\nHost: localhost\r\nContent-Encoding: br\r\nContent-Length: 3\r\n\r\nabc",
+	)
+	assert.Contains(t, out, "HTTP/1.1 200 OK\r\n")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\nabc"))
+}
+
+func TestHandleNotAcceptable(t *testing.T) {
+	negotiating := func(w *response.Writer, req *request.Request) *response.HandlerError {
+		if _, herr := response.NegotiateEncoding(w, req, "identity"); herr != nil {
+			return herr
+		}
+		ct, herr := response.NegotiateContentType(w, req, "application/json")
+		if herr != nil {
+			return herr
+		}
+		w.Header().Set("Content-Type", ct)
+		fmt.Fprint(w, "{}")
+		return nil
+	}
+
+	// Test: The 406 replaces the handler's response but keeps its Vary, so
+	// caches don't hand it to clients asking for something else
+	out := roundTrip(t, negotiating,
+		"GET / HTTP/1.1\r\nHost: localhost\r\nAccept: image/png\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 406 Not Acceptable\r\n"))
+	assert.Contains(t, out, "Vary: Accept-Encoding, Accept\r\n")
+}
+
+func TestHandleConnect(t *testing.T) {
+	connect := "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n"
+	handler := func(w *response.Writer, req *request.Request) *response.HandlerError {
+		fmt.Fprint(w, "handler")
+		return nil
+	}
+
+	// Test: Without a tunnel CONNECT never reaches the handler
+	out := roundTrip(t, handler, connect)
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 405 Method Not Allowed\r\n"))
+	assert.Contains(t, out, "Allow: GET, PUT, POST, DELETE, OPTIONS\r\n")
+	assert.NotContains(t, out, "handler")
+
+	// Test: With one it goes there, and everything else to the handler
+	tunnel := WithTunnel(func(w *response.Writer, req *request.Request) *response.HandlerError {
+		fmt.Fprint(w, "tunnel")
+		return nil
+	})
+	out = roundTrip(t, handler, connect, tunnel)
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\ntunnel"))
+	out = roundTrip(t, handler, getRoot, tunnel)
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\nhandler"))
+}
+
+func TestHandleWebSocket(t *testing.T) {
+	notCalled := func(w *response.Writer, req *request.Request) *response.HandlerError {
+		t.Error("handler should not be called")
+		return nil
+	}
+	echo := WithWebSocket(func(conn *websocket.Conn, req *request.Request) {
+		for {
+			op, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			conn.WriteMessage(op, msg)
+		}
+	})
+
+	// Test: Handshake, then messages echoed until the client closes. Bytes
+	// the client sent early aren't lost
+	client, conn := net.Pipe()
+	defer client.Close()
+
+	go newServer(notCalled, echo).handle(conn)
+	go io.WriteString(client, "GET /chat HTTP/1.1\r\n"+
+		"Host: localhost\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n"+
+		"Sec-WebSocket-Version: 13\r\n\r\n"+
+		// a frame sent straight behind the handshake, masked with a zero key
+		"\x81\x82\x00\x00\x00\x00hi")
+
+	br := bufio.NewReader(client)
+	var head strings.Builder
+	for !strings.HasSuffix(head.String(), "\r\n\r\n") {
+		line, err := br.ReadString('\n')
+		require.NoError(t, err)
+		head.WriteString(line)
+	}
+	assert.Equal(t,
+		"HTTP/1.1 101 Switching Protocols\r\n"+
+			"Upgrade: websocket\r\n"+
+			"Connection: Upgrade\r\n"+
+			"Sec-WebSocket-Accept: s3pPLMBiTxaQ9kYGzzhZRbK+xOo=\r\n"+
+			"\r\n",
+		head.String(),
+	)
+
+	ws := websocket.NewConn(struct {
+		io.Reader
+		io.WriteCloser
+	}{br, client}, false)
+	_, msg, err := ws.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, "hi", string(msg))
+
+	go ws.WriteMessage(websocket.OpText, []byte("ping?"))
+	op, msg, err := ws.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, websocket.OpText, op)
+	assert.Equal(t, "ping?", string(msg))
+	require.NoError(t, ws.Close(websocket.CloseNormal, ""))
+
+	// Test: A bad handshake gets an error response
+	out := roundTrip(t, notCalled, "GET / HTTP/1.1\r\n"+
+		"Host: localhost\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n"+
+		"Sec-WebSocket-Version: 8\r\n\r\n", echo)
+	assert.Contains(t, out, "HTTP/1.1 426 Upgrade Required\r\n")
+	assert.Contains(t, out, "Sec-WebSocket-Version: 13\r\n")
+
+	// Test: Without the option upgrades are ordinary requests
+	out = roundTrip(t, func(w *response.Writer, req *request.Request) *response.HandlerError {
+		return nil
+	}, "GET / HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+	assert.Contains(t, out, "HTTP/1.1 200 OK\r\n")
+}
+
+func TestHandleHijack(t *testing.T) {
+	type hijack struct {
+		conn     net.Conn
+		buffered []byte
+	}
+	hijacked := make(chan hijack, 1)
+
+	s, err := Serve(0, func(w *response.Writer, req *request.Request) *response.HandlerError {
+		fmt.Fprint(w, "never sent")
+		conn, buffered, err := w.Hijack()
+		require.NoError(t, err)
+		hijacked <- hijack{conn, buffered}
+		return nil
+	})
+	require.NoError(t, err)
+	defer s.Close()
+	addr := s.listener.Addr().String()
+
+	// Test: The handler gets the connection and the bytes sent after the
+	// request, and the server forgets about it
+	client, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer client.Close()
+	io.WriteString(client, getRoot+"extra")
+
+	h := <-hijacked
+	defer h.conn.Close()
+	rest := make([]byte, 5-len(h.buffered))
+	_, err = io.ReadFull(h.conn, rest)
+	require.NoError(t, err)
+	assert.Equal(t, "extra", string(h.buffered)+string(rest))
+
+	s.mu.Lock()
+	assert.Empty(t, s.conns)
+	s.mu.Unlock()
+
+	// Test: Idle connections are closed with the server, hijacked ones
+	// aren't
+	idle, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer idle.Close()
+	require.Eventually(t, func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return len(s.conns) == 1
+	}, time.Second, time.Millisecond)
+
+	require.NoError(t, s.Close())
+
+	_, err = io.ReadAll(idle)
+	require.NoError(t, err)
+
+	go io.WriteString(h.conn, "still here")
+	got := make([]byte, len("still here"))
+	_, err = io.ReadFull(client, got)
+	require.NoError(t, err)
+	assert.Equal(t, "still here", string(got))
+}
+
+func TestHandleExpectContinue(t *testing.T) {
+	echo := func(w *response.Writer, req *request.Request) *response.HandlerError {
+		body, err := req.ReadBody()
+		if err != nil {
+			e := response.NewHandlerErr(response.StatusBadRequest)
+			return &e
+		}
+		w.Write(body)
+		return nil
+	}
+	upload := "POST /upload HTTP/1.1\r\n" +
+		"Host: localhost\r\n" +
+		"Content-Length: 5\r\n" +
+		"Expect: 100-continue\r\n\r\n"
+
+	// Test: 100 Continue goes out once the handler reads the body, and
+	// only then does the client send it
+	client, conn := net.Pipe()
+	defer client.Close()
+	go newServer(echo).handle(conn)
+	go io.WriteString(client, upload)
+
+	br := bufio.NewReader(client)
+	interim := make([]byte, len("HTTP/1.1 100 Continue\r\n\r\n"))
+	_, err := io.ReadFull(br, interim)
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 100 Continue\r\n\r\n", string(interim))
+
+	go io.WriteString(client, "hello")
+	out, err := io.ReadAll(br)
+	require.NoError(t, err)
+	assert.Contains(t, string(out), "HTTP/1.1 200 OK\r\n")
+	assert.True(t, strings.HasSuffix(string(out), "\r\n\r\nhello"))
+
+	// Test: A handler that never reads the body answers without a 100
+	out2 := roundTrip(t, func(w *response.Writer, req *request.Request) *response.HandlerError {
+		e := response.NewHandlerErr(response.StatusForbidden)
+		return &e
+	}, upload)
+	assert.True(t, strings.HasPrefix(out2, "HTTP/1.1 403 Forbidden\r\n"))
+
+	// Test: Unsupported expectations
+	out2 = roundTrip(t, echo, strings.Replace(upload, "100-continue", "teapot", 1))
+	assert.True(t, strings.HasPrefix(out2, "HTTP/1.1 417 Expectation Failed\r\n"))
+
+	// Test: Too large a body is turned away before the 100
+	out2 = roundTrip(t, echo, upload, WithMaxBodySize(4))
+	assert.True(t, strings.HasPrefix(out2, "HTTP/1.1 413 Content Too Large\r\n"))
+
+	// Test: Bodies without Expect are read up front as before
+	out2 = roundTrip(t, func(w *response.Writer, req *request.Request) *response.HandlerError {
+		w.Write(req.Body)
+		return nil
+	}, "POST /upload HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\n\r\nhello")
+	assert.True(t, strings.HasSuffix(out2, "\r\n\r\nhello"))
+	assert.NotContains(t, out2, "100 Continue")
+}
+
+// readH2Response reads frames from an HTTP/2 connection until stream 1
+// ends, returning its header fields and body
+func TestHandleStreamingBodies(t *testing.T) {
+	started := make(chan string, 1)
+	stream := func(w *response.Writer, req *request.Request) *response.HandlerError {
+		body, err := req.BodyReader()
+		if err != nil {
+			return response.RequestError(err)
+		}
+
+		first := make([]byte, 5)
+		io.ReadFull(body, first)
+		started <- string(first)
+
+		rest, err := io.ReadAll(body)
+		if err != nil {
+			return response.RequestError(err)
+		}
+		w.Write(rest)
+		return nil
+	}
+
+	client, conn := net.Pipe()
+	defer client.Close()
+	go newServer(stream, WithStreamingBodies()).handle(conn)
+	go io.WriteString(client, "POST /upload HTTP/1.1\r\n"+
+		"Host: localhost\r\n"+
+		"Content-Length: 11\r\n\r\n"+
+		"hello")
+
+	// Test: The handler runs before the whole body is in, and reads it as
+	// it arrives
+	select {
+	case first := <-started:
+		assert.Equal(t, "hello", first)
+	case <-time.After(time.Second):
+		t.Fatal("handler didn't get the start of the body")
+	}
+
+	go io.WriteString(client, " world")
+	out, err := io.ReadAll(client)
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(string(out), "\r\n\r\n world"))
+}
+
+func readH2Response(t *testing.T, r io.Reader) ([]hpack.HeaderField, string) {
+	t.Helper()
+
+	dec := hpack.NewDecoder(4096)
+	var fields []hpack.HeaderField
+	var body strings.Builder
+	for {
+		f, err := http2.ReadFrame(r, 1<<20)
+		require.NoError(t, err)
+		if f.StreamID != 1 {
+			continue
+		}
+
+		switch f.Type {
+		case http2.FrameHeaders:
+			fields, err = dec.Decode(f.Payload)
+			require.NoError(t, err)
+		case http2.FrameData:
+			body.Write(f.Payload)
+		}
+		if f.Flags.Has(http2.FlagEndStream) {
+			return fields, body.String()
+		}
+	}
+}
+
+func TestHandleH2C(t *testing.T) {
+	handler := func(w *response.Writer, req *request.Request) *response.HandlerError {
+		fmt.Fprintf(w, "%s %s over %s: %s", req.RequestLine.Method,
+			req.RequestLine.Path(), req.RequestLine.HttpVersion, req.Body)
+		return nil
+	}
+	s, err := Serve(0, handler, WithH2C())
+	require.NoError(t, err)
+	defer s.Close()
+	addr := s.listener.Addr().String()
+
+	clientStart := append([]byte(http2.ClientPreface),
+		http2.AppendFrame(nil, http2.FrameSettings, 0, 0, nil)...)
+	get := hpack.NewEncoder(4096).Encode([]hpack.HeaderField{
+		{Name: ":method", Value: "GET"},
+		{Name: ":scheme", Value: "http"},
+		{Name: ":path", Value: "/h2"},
+		{Name: ":authority", Value: "localhost"},
+	})
+
+	// Test: Prior knowledge
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	conn.Write(clientStart)
+	conn.Write(http2.AppendFrame(nil, http2.FrameHeaders,
+		http2.FlagEndHeaders|http2.FlagEndStream, 1, get))
+	fields, body := readH2Response(t, conn)
+	assert.Equal(t, hpack.HeaderField{Name: ":status", Value: "200"}, fields[0])
+	assert.Equal(t, "GET /h2 over 2: ", body)
+
+	// Test: Upgrade, the request being answered on stream 1
+	conn, err = net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	io.WriteString(conn, "POST /up HTTP/1.1\r\nHost: localhost\r\n"+
+		"Connection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\n"+
+		"HTTP2-Settings: AAMAAABkAAQAAP__\r\nContent-Length: 4\r\n\r\nbody")
+	br := bufio.NewReader(conn)
+	status, err := br.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 101 Switching Protocols\r\n", status)
+	for {
+		line, err := br.ReadString('\n')
+		require.NoError(t, err)
+		if line == "\r\n" {
+			break
+		}
+	}
+
+	conn.Write(clientStart)
+	_, body = readH2Response(t, br)
+	assert.Equal(t, "POST /up over 1.1: body", body)
+
+	// Test: HTTP/1.1 still works, and so do upgrades without settings
+	out := roundTrip(t, handler, "GET / HTTP/1.1\r\nHost: localhost\r\n"+
+		"Connection: Upgrade\r\nUpgrade: h2c\r\n\r\n", WithH2C())
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+	assert.True(t, strings.HasSuffix(out, "GET / over 1.1: "))
+
+	// Test: Without the option the preface is a bad request
+	out = roundTrip(t, handler, http2.ClientPreface)
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 400 Bad Request\r\n"))
+}
+
+func TestHandleH2CConnect(t *testing.T) {
+	tunnel := WithTunnel(func(w *response.Writer, req *request.Request) *response.HandlerError {
+		t.Error("tunnel should not be called")
+		return nil
+	})
+	s, err := Serve(0, nil, WithH2C(), tunnel)
+	require.NoError(t, err)
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Test: CONNECT on a stream is refused rather than handed to the tunnel
+	connect := hpack.NewEncoder(4096).Encode([]hpack.HeaderField{
+		{Name: ":method", Value: "CONNECT"},
+		{Name: ":authority", Value: "example.com:443"},
+	})
+	conn.Write(append([]byte(http2.ClientPreface),
+		http2.AppendFrame(nil, http2.FrameSettings, 0, 0, nil)...))
+	conn.Write(http2.AppendFrame(nil, http2.FrameHeaders,
+		http2.FlagEndHeaders|http2.FlagEndStream, 1, connect))
+	fields, _ := readH2Response(t, conn)
+	assert.Equal(t, hpack.HeaderField{Name: ":status", Value: "405"}, fields[0])
+	assert.Contains(t, fields, hpack.HeaderField{Name: "allow", Value: "GET, PUT, POST, DELETE, OPTIONS"})
+}
+
+func TestHandleProxyProtocol(t *testing.T) {
+	handler := func(w *response.Writer, req *request.Request) *response.HandlerError {
+		fmt.Fprint(w, req.RemoteAddr)
+		return nil
+	}
+	trusted, err := proxyproto.ParseTrusted("127.0.0.1")
+	require.NoError(t, err)
+	s, err := Serve(0, handler, WithProxyProtocol(trusted))
+	require.NoError(t, err)
+	defer s.Close()
+	addr := s.listener.Addr().String()
+
+	// Test: The handler sees the client's address from the header
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	io.WriteString(conn, "PROXY TCP4 203.0.113.7 192.0.2.10 4000 80\r\n"+getRoot)
+	out, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Contains(t, string(out), "HTTP/1.1 200 OK\r\n")
+	assert.True(t, strings.HasSuffix(string(out), "203.0.113.7:4000"))
+
+	// Test: A trusted peer without a header is dropped
+	conn, err = net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	io.WriteString(conn, getRoot)
+	out, err = io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Empty(t, out)
+}
+
+func TestHandleProxyProtocolTunnel(t *testing.T) {
+	// a destination that says its piece and half-closes, then waits for
+	// everything the client has to say
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	received := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.WriteString(conn, "hi")
+		conn.(*net.TCPConn).CloseWrite()
+		data, _ := io.ReadAll(conn)
+		received <- string(data)
+	}()
+	target := ln.Addr().String()
+
+	trusted, err := proxyproto.ParseTrusted("127.0.0.1")
+	require.NoError(t, err)
+	tunnel := WithTunnel(proxy.NewTunnel(target).Serve)
+	s, err := Serve(0, nil, WithProxyProtocol(trusted), tunnel)
+	require.NoError(t, err)
+	defer s.Close()
+
+	// Test: The destination's half-close only half-closes the PROXY
+	// connection, so the client can still send after it
+	conn, err := net.Dial("tcp", s.listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	io.WriteString(conn, "PROXY TCP4 203.0.113.7 192.0.2.10 4000 80\r\n"+
+		"CONNECT "+target+" HTTP/1.1\r\nHost: "+target+"\r\n\r\n")
+	out, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n\r\nhi", string(out))
+
+	io.WriteString(conn, "bye")
+	require.NoError(t, conn.(*net.TCPConn).CloseWrite())
+	select {
+	case data := <-received:
+		assert.Equal(t, "bye", data)
+	case <-time.After(time.Second):
+		t.Fatal("destination never saw the client finish")
+	}
+}
+
+func TestHandleConnInfo(t *testing.T) {
+	reqs := make(chan *request.Request, 2)
+	s, err := Serve(0, func(w *response.Writer, req *request.Request) *response.HandlerError {
+		reqs <- req
+		return nil
+	})
+	require.NoError(t, err)
+	defer s.Close()
+	addr := s.listener.Addr().String()
+
+	get := func() net.Conn {
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer conn.Close()
+		io.WriteString(conn, getRoot)
+		_, err = io.ReadAll(conn)
+		require.NoError(t, err)
+		return conn
+	}
+
+	// Test: Requests know their connection and when they started
+	before := time.Now()
+	conn := get()
+	req := <-reqs
+	require.NotNil(t, req.Conn)
+	assert.Equal(t, conn.LocalAddr().String(), req.Conn.RemoteAddr.String())
+	assert.Equal(t, conn.LocalAddr().String(), req.RemoteAddr)
+	assert.Equal(t, addr, req.Conn.LocalAddr.String())
+	assert.Nil(t, req.Conn.TLS)
+	assert.Equal(t, uint64(1), req.Seq)
+	assert.False(t, req.StartTime.Before(before))
+
+	// Test: Each connection gets its own ID
+	get()
+	next := <-reqs
+	assert.Greater(t, next.Conn.ID, req.Conn.ID)
+	assert.Equal(t, uint64(1), next.Seq)
+}
+
+func TestHandleTrustedProxies(t *testing.T) {
+	handler := func(w *response.Writer, req *request.Request) *response.HandlerError {
+		fmt.Fprintf(w, "%s %s://%s", req.Origin.IP, req.Origin.Scheme, req.Origin.Host)
+		return nil
+	}
+	forwarded := "GET / HTTP/1.1\r\n" +
+		"Host: localhost\r\n" +
+		"Forwarded: for=8.8.8.8\r\n" +
+		"X-Forwarded-For: 203.0.113.7\r\n" +
+		"X-Forwarded-Proto: https\r\n\r\n"
+
+	get := func(opts ...Option) string {
+		s, err := Serve(0, handler, opts...)
+		require.NoError(t, err)
+		defer s.Close()
+
+		conn, err := net.Dial("tcp", s.listener.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+		io.WriteString(conn, forwarded)
+		out, err := io.ReadAll(conn)
+		require.NoError(t, err)
+		return string(out)
+	}
+
+	// Test: The forwarding headers are believed from trusted proxies only,
+	// and only the kind they were said to send
+	trusted, err := proxyproto.ParseTrusted("127.0.0.0/8")
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(get(WithTrustedProxies(trusted, request.HeaderXForwarded)),
+		"\r\n\r\n203.0.113.7 https://localhost"))
+	assert.True(t, strings.HasSuffix(get(), "\r\n\r\n127.0.0.1 http://localhost"))
+}
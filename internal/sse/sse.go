@@ -0,0 +1,229 @@
+package sse
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yus-works/tcp-to-http/internal/request"
+	"github.com/yus-works/tcp-to-http/internal/response"
+)
+
+// ErrInvalidField is returned for an event name or ID that would break the
+// stream's framing
+var ErrInvalidField = errors.New("Invalid event field")
+
+// ErrStreamClosed is returned by sends after the stream has ended, either
+// because the client went away or Close was called
+var ErrStreamClosed = errors.New("Event stream closed")
+
+// Event is one message on an event stream. Data is always sent, so every
+// event is dispatched by the client, even when Data is empty
+type Event struct {
+	// Event names the event type, "message" on the client when empty
+	Event string
+	// ID sets the client's last event ID, sent back as Last-Event-ID when
+	// it reconnects
+	ID string
+	// Retry tells the client how long to wait before reconnecting, and is
+	// left out when zero
+	Retry time.Duration
+	// Data may span several lines, each sent as its own data field
+	Data string
+}
+
+// Handler produces events on s until it returns or s.Done is closed
+type Handler func(s *Stream, req *request.Request)
+
+// Stream writes events to a streamed text/event-stream response. It is safe
+// for concurrent use
+type Stream struct {
+	w *response.Writer
+
+	mu   sync.Mutex
+	err  error
+	done chan struct{}
+}
+
+// NewStream sets up w for an event stream and sends the response head
+func NewStream(w *response.Writer) (*Stream, error) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	s := &Stream{w: w, done: make(chan struct{})}
+	if err := w.Flush(); err != nil {
+		s.end(err)
+		return nil, err
+	}
+	return s, nil
+}
+
+// Handle returns a handler that opens an event stream and runs h on it,
+// sending a comment every heartbeat to keep proxies from timing the
+// connection out. Heartbeats also notice a client that disconnected while
+// h had nothing to send. A zero heartbeat disables them
+func Handle(h Handler, heartbeat time.Duration) response.Handler {
+	return func(w *response.Writer, req *request.Request) *response.HandlerError {
+		s, err := NewStream(w)
+		if err != nil {
+			e := response.NewHandlerErrMsg(response.StatusInternalServerError, err.Error())
+			return &e
+		}
+
+		if heartbeat > 0 {
+			stop := s.heartbeat(heartbeat)
+			defer stop()
+		}
+
+		h(s, req)
+		return nil
+	}
+}
+
+// LastEventID returns the ID of the last event a reconnecting client saw,
+// or "" on a first connection
+func LastEventID(req *request.Request) string {
+	return strings.TrimSpace(req.Headers.Get("Last-Event-ID"))
+}
+
+// Send writes e and flushes it to the client
+func (s *Stream) Send(e Event) error {
+	if strings.ContainsAny(e.Event, "\r\n") {
+		return ErrInvalidField
+	}
+	// a NUL in the ID makes clients ignore the field (HTML 9.2.6)
+	if strings.ContainsAny(e.ID, "\r\n\x00") {
+		return ErrInvalidField
+	}
+
+	var b strings.Builder
+	if e.Event != "" {
+		writeField(&b, "event", e.Event)
+	}
+	if e.ID != "" {
+		writeField(&b, "id", e.ID)
+	}
+	if e.Retry > 0 {
+		writeField(&b, "retry", strconv.FormatInt(e.Retry.Milliseconds(), 10))
+	}
+	for _, line := range splitLines(e.Data) {
+		writeField(&b, "data", line)
+	}
+	b.WriteByte('\n')
+
+	return s.write(b.String())
+}
+
+// Comment writes a comment, which clients ignore
+func (s *Stream) Comment(text string) error {
+	var b strings.Builder
+	for _, line := range splitLines(text) {
+		b.WriteString(":")
+		if line != "" {
+			b.WriteString(" ")
+			b.WriteString(line)
+		}
+		b.WriteByte('\n')
+	}
+	b.WriteByte('\n')
+
+	return s.write(b.String())
+}
+
+// Done is closed once the stream has ended. Producers should stop when it
+// is
+func (s *Stream) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns why the stream ended, nil while it is still open
+func (s *Stream) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// Close ends the stream. Nothing more is sent and Done is closed
+func (s *Stream) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.end(ErrStreamClosed)
+}
+
+func (s *Stream) write(msg string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err != nil {
+		return ErrStreamClosed
+	}
+
+	// a failed write means the client has gone away
+	if _, err := s.w.Write([]byte(msg)); err != nil {
+		s.end(err)
+		return err
+	}
+	if err := s.w.Flush(); err != nil {
+		s.end(err)
+		return err
+	}
+	return nil
+}
+
+// end records why the stream ended. Must be called with s.mu held, except
+// before the stream is handed out
+func (s *Stream) end(err error) {
+	if s.err == nil {
+		s.err = err
+		close(s.done)
+	}
+}
+
+// heartbeat sends an empty comment every interval until the stream ends or
+// the returned func is called
+func (s *Stream) heartbeat(interval time.Duration) func() {
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if s.Comment("") != nil {
+					return
+				}
+			case <-stop:
+				return
+			case <-s.done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-stopped
+	}
+}
+
+func writeField(b *strings.Builder, name, value string) {
+	b.WriteString(name)
+	b.WriteString(": ")
+	b.WriteString(value)
+	b.WriteByte('\n')
+}
+
+// splitLines splits s on any of the line endings the event stream format
+// accepts, so each line can be sent as its own field
+func splitLines(s string) []string {
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	s = strings.ReplaceAll(s, "\r", "\n")
+	return strings.Split(s, "\n")
+}
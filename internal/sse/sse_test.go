@@ -0,0 +1,156 @@
+package sse
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yus-works/tcp-to-http/internal/headers"
+	"github.com/yus-works/tcp-to-http/internal/request"
+	"github.com/yus-works/tcp-to-http/internal/response"
+)
+
+// syncBuffer is a bytes.Buffer that heartbeats can write to while a test
+// reads it
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestSend(t *testing.T) {
+	var out syncBuffer
+	w := response.NewWriter(&out)
+	s, err := NewStream(w)
+	require.NoError(t, err)
+
+	// Test: The head goes out straight away
+	assert.Contains(t, out.String(), "Content-Type: text/event-stream\r\n")
+	assert.Contains(t, out.String(), "Cache-Control: no-cache\r\n")
+
+	tests := []struct {
+		name  string
+		event Event
+		want  string
+	}{
+		{
+			name:  "data only",
+			event: Event{Data: "hello"},
+			want:  "data: hello\n\n",
+		},
+		{
+			name:  "all fields",
+			event: Event{Event: "update", ID: "42", Retry: 3 * time.Second, Data: "{}"},
+			want:  "event: update\nid: 42\nretry: 3000\ndata: {}\n\n",
+		},
+		{
+			name:  "multi-line data",
+			event: Event{Data: "one\ntwo\r\nthree\rfour"},
+			want:  "data: one\ndata: two\ndata: three\ndata: four\n\n",
+		},
+		{
+			name:  "empty data is still dispatched",
+			event: Event{ID: "7"},
+			want:  "id: 7\ndata: \n\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := len(out.String())
+			require.NoError(t, s.Send(tt.event))
+			assert.Contains(t, out.String()[before:], tt.want)
+		})
+	}
+
+	// Test: Comments
+	require.NoError(t, s.Comment("two\nlines"))
+	assert.Contains(t, out.String(), ": two\n: lines\n\n")
+
+	// Test: Fields that would break framing
+	assert.ErrorIs(t, s.Send(Event{ID: "1\n2"}), ErrInvalidField)
+	assert.ErrorIs(t, s.Send(Event{ID: "a\x00"}), ErrInvalidField)
+	assert.ErrorIs(t, s.Send(Event{Event: "a\rb"}), ErrInvalidField)
+
+	// Test: Nothing is sent after Close
+	s.Close()
+	<-s.Done()
+	assert.ErrorIs(t, s.Send(Event{Data: "late"}), ErrStreamClosed)
+	assert.ErrorIs(t, s.Err(), ErrStreamClosed)
+}
+
+func TestDisconnect(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+
+	go io.Copy(io.Discard, client)
+
+	s, err := NewStream(response.NewWriter(server))
+	require.NoError(t, err)
+	require.NoError(t, s.Send(Event{Data: "first"}))
+
+	// Test: A failed write ends the stream
+	client.Close()
+	require.Error(t, s.Send(Event{Data: "second"}))
+
+	select {
+	case <-s.Done():
+	case <-time.After(time.Second):
+		t.Fatal("Done wasn't closed")
+	}
+	require.Error(t, s.Err())
+}
+
+func TestHandle(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	req := &request.Request{Headers: headers.NewHeaders()}
+	req.Headers.Set("Last-Event-ID", " 41 ")
+
+	// Test: The handler sees the client's last event ID, and heartbeats
+	// notice the client leaving while the handler is idle
+	stopped := make(chan struct{})
+	handler := Handle(func(s *Stream, req *request.Request) {
+		defer close(stopped)
+		assert.Equal(t, "41", LastEventID(req))
+		s.Send(Event{ID: "42", Data: "resumed"})
+		<-s.Done()
+	}, 5*time.Millisecond)
+
+	go handler(response.NewWriter(server), req)
+
+	br := bufio.NewReader(client)
+	var got strings.Builder
+	for !strings.Contains(got.String(), ":\n\n") {
+		line, err := br.ReadString('\n')
+		require.NoError(t, err)
+		got.WriteString(line)
+	}
+	assert.Contains(t, got.String(), "id: 42\ndata: resumed\n\n")
+
+	client.Close()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("handler didn't stop after the client left")
+	}
+}
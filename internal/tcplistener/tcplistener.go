@@ -39,7 +39,7 @@ func Start() {
 		fmt.Printf("- Version: %s\n", rq.RequestLine.HttpVersion)
 
 		fmt.Printf("Headers:\n")
-		for k, v := range *rq.Headers {
+		for k, v := range rq.Headers.All() {
 			fmt.Printf("- %s: %s\n", k, v)
 		}
 		
@@ -0,0 +1,317 @@
+package websocket
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+// Close codes (RFC 6455 7.4.1)
+const (
+	CloseNormal             = 1000
+	CloseGoingAway          = 1001
+	CloseProtocolError      = 1002
+	CloseUnsupportedData    = 1003
+	CloseNoStatus           = 1005
+	CloseAbnormal           = 1006
+	CloseInvalidPayload     = 1007
+	ClosePolicyViolation    = 1008
+	CloseMessageTooBig      = 1009
+	CloseMandatoryExtension = 1010
+	CloseInternalError      = 1011
+)
+
+// DefaultMaxMessageSize is the MaxMessageSize of new connections
+const DefaultMaxMessageSize = 1 << 20
+
+// closeTimeout bounds how long Close waits for the peer's close frame
+const closeTimeout = 5 * time.Second
+
+var ErrClosed = errors.New("WebSocket connection closed")
+
+// CloseError is returned by ReadMessage once the peer has closed the
+// connection. Code is CloseNoStatus if the peer didn't send one
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	if e.Reason == "" {
+		return fmt.Sprintf("WebSocket closed with %d", e.Code)
+	}
+	return fmt.Sprintf("WebSocket closed with %d: %s", e.Code, e.Reason)
+}
+
+// Conn is a WebSocket connection. Reads must come from one goroutine at a
+// time; writes may come from any number
+type Conn struct {
+	rwc    io.ReadWriteCloser
+	br     *bufio.Reader
+	server bool
+
+	// MaxMessageSize caps the size of a reassembled message. Larger messages
+	// close the connection with CloseMessageTooBig
+	MaxMessageSize int64
+
+	// writeMu serialises frames so control frames sent while a reader is
+	// answering pings don't interleave with data frames
+	writeMu sync.Mutex
+	// closeSent is set once a close frame has gone out, after which only
+	// the peer's close frame is waited for
+	closeSent bool
+	// closed is set once the close handshake is over or the connection
+	// failed
+	closed bool
+	// reading is set while ReadMessage runs
+	reading atomic.Bool
+	// closeDone is closed once the peer's close frame has been read or the
+	// connection failed
+	closeDone chan struct{}
+	closeOnce sync.Once
+}
+
+// NewConn wraps a connection the handshake has completed on. server
+// selects which side of the masking rules applies (RFC 6455 5.1): servers
+// expect masked frames and send unmasked ones, clients the reverse
+func NewConn(rwc io.ReadWriteCloser, server bool) *Conn {
+	return &Conn{
+		rwc:            rwc,
+		br:             bufio.NewReader(rwc),
+		server:         server,
+		MaxMessageSize: DefaultMaxMessageSize,
+		closeDone:      make(chan struct{}),
+	}
+}
+
+// ReadMessage returns the next text or binary message, reassembling
+// fragments. Pings are answered and pongs dropped along the way. Once the
+// peer closes, the close is echoed and a *CloseError is returned. Protocol
+// violations close the connection with the matching code and are returned
+func (c *Conn) ReadMessage() (Opcode, []byte, error) {
+	c.reading.Store(true)
+	defer c.reading.Store(false)
+
+	var (
+		op  Opcode
+		msg []byte
+	)
+
+	for {
+		f, err := readFrame(c.br, c.server, c.MaxMessageSize-int64(len(msg)))
+		if err != nil {
+			return 0, nil, c.fail(err)
+		}
+
+		switch f.opcode {
+		case OpPing:
+			if err := c.writeControl(OpPong, f.payload); err != nil && !errors.Is(err, ErrClosed) {
+				return 0, nil, err
+			}
+			continue
+
+		case OpPong:
+			continue
+
+		case OpClose:
+			return 0, nil, c.handleClose(f.payload)
+
+		case OpText, OpBinary:
+			if op != 0 {
+				return 0, nil, c.fail(fmt.Errorf("%w: new message inside a fragmented one", ErrProtocol))
+			}
+			op = f.opcode
+
+		case OpContinuation:
+			if op == 0 {
+				return 0, nil, c.fail(fmt.Errorf("%w: continuation without a message", ErrProtocol))
+			}
+
+		default:
+			return 0, nil, c.fail(fmt.Errorf("%w: unknown opcode %d", ErrProtocol, f.opcode))
+		}
+
+		msg = append(msg, f.payload...)
+		if !f.fin {
+			continue
+		}
+
+		if op == OpText && !utf8.Valid(msg) {
+			return 0, nil, c.fail(errInvalidUTF8)
+		}
+		if msg == nil {
+			msg = []byte{}
+		}
+		return op, msg, nil
+	}
+}
+
+var errInvalidUTF8 = errors.New("WebSocket text message isn't valid UTF-8")
+
+// fail closes the connection after a read error, telling the peer why when
+// the error is its fault
+func (c *Conn) fail(err error) error {
+	code := 0
+	switch {
+	case errors.Is(err, ErrProtocol):
+		code = CloseProtocolError
+	case errors.Is(err, ErrMessageTooLarge):
+		code = CloseMessageTooBig
+	case errors.Is(err, errInvalidUTF8):
+		code = CloseInvalidPayload
+	}
+
+	if code != 0 {
+		c.writeControl(OpClose, closePayload(code, ""))
+	}
+	c.shutdown()
+	return err
+}
+
+// handleClose answers the peer's close frame, or finishes the handshake if
+// we started it
+func (c *Conn) handleClose(payload []byte) error {
+	closeErr := &CloseError{Code: CloseNoStatus}
+
+	switch {
+	case len(payload) == 1:
+		return c.fail(fmt.Errorf("%w: truncated close code", ErrProtocol))
+	case len(payload) >= 2:
+		closeErr.Code = int(binary.BigEndian.Uint16(payload))
+		closeErr.Reason = string(payload[2:])
+		if !validCloseCode(closeErr.Code) {
+			return c.fail(fmt.Errorf("%w: invalid close code %d", ErrProtocol, closeErr.Code))
+		}
+		if !utf8.ValidString(closeErr.Reason) {
+			return c.fail(errInvalidUTF8)
+		}
+	}
+
+	// echo the code back, as RFC 6455 5.5.1 suggests
+	echo := []byte{}
+	if closeErr.Code != CloseNoStatus {
+		echo = closePayload(closeErr.Code, "")
+	}
+	c.writeControl(OpClose, echo)
+
+	c.shutdown()
+	return closeErr
+}
+
+// validCloseCode reports whether code may appear in a close frame
+// (RFC 6455 7.4)
+func validCloseCode(code int) bool {
+	switch {
+	case code >= 3000 && code <= 4999:
+		return true
+	case code < 1000 || code > 1011:
+		return false
+	case code == 1004 || code == CloseNoStatus || code == CloseAbnormal:
+		return false
+	}
+	return true
+}
+
+func closePayload(code int, reason string) []byte {
+	b := binary.BigEndian.AppendUint16(nil, uint16(code))
+	return append(b, reason...)
+}
+
+// WriteMessage sends data as a single text or binary frame
+func (c *Conn) WriteMessage(op Opcode, data []byte) error {
+	if op != OpText && op != OpBinary {
+		return fmt.Errorf("%w: %d isn't a data opcode", ErrProtocol, op)
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.closeSent || c.closed {
+		return ErrClosed
+	}
+	return writeFrame(c.rwc, true, op, data, !c.server)
+}
+
+// Ping sends a ping with an optional payload of up to 125 bytes
+func (c *Conn) Ping(data []byte) error {
+	return c.writeControl(OpPing, data)
+}
+
+func (c *Conn) writeControl(op Opcode, payload []byte) error {
+	if len(payload) > maxControlPayload {
+		return fmt.Errorf("%w: control frame too long", ErrProtocol)
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.closeSent || c.closed {
+		return ErrClosed
+	}
+	if op == OpClose {
+		c.closeSent = true
+	}
+	return writeFrame(c.rwc, true, op, payload, !c.server)
+}
+
+// Close starts the close handshake with code and reason, then waits for
+// the peer's close frame before closing the connection. The peer's close
+// frame only arrives through ReadMessage, so Close reads and discards
+// messages itself unless another goroutine is already reading
+func (c *Conn) Close(code int, reason string) error {
+	if len(reason) > maxControlPayload-2 {
+		reason = reason[:maxControlPayload-2]
+	}
+
+	err := c.writeControl(OpClose, closePayload(code, reason))
+	if errors.Is(err, ErrClosed) {
+		return nil
+	}
+	if err != nil {
+		c.shutdown()
+		return err
+	}
+
+	if conn, ok := c.rwc.(net.Conn); ok {
+		conn.SetReadDeadline(time.Now().Add(closeTimeout))
+	}
+	if !c.reading.Load() {
+		go c.drain()
+	}
+
+	select {
+	case <-c.closeDone:
+	case <-time.After(closeTimeout):
+	}
+
+	c.shutdown()
+	return nil
+}
+
+// drain reads until the peer's close arrives, for callers that close
+// without a reader running
+func (c *Conn) drain() {
+	for {
+		if _, _, err := c.ReadMessage(); err != nil {
+			return
+		}
+	}
+}
+
+func (c *Conn) shutdown() {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if !c.closed {
+		c.closed = true
+		c.rwc.Close()
+	}
+	c.closeOnce.Do(func() { close(c.closeDone) })
+}
@@ -0,0 +1,171 @@
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Opcode identifies the type of a frame (RFC 6455 5.2)
+type Opcode byte
+
+const (
+	OpContinuation Opcode = 0x0
+	OpText         Opcode = 0x1
+	OpBinary       Opcode = 0x2
+	OpClose        Opcode = 0x8
+	OpPing         Opcode = 0x9
+	OpPong         Opcode = 0xA
+)
+
+func (op Opcode) isControl() bool {
+	return op&0x8 != 0
+}
+
+// maxControlPayload is the largest payload a control frame may carry
+const maxControlPayload = 125
+
+var (
+	ErrProtocol        = errors.New("WebSocket protocol error")
+	ErrMessageTooLarge = errors.New("WebSocket message too large")
+)
+
+type frame struct {
+	fin     bool
+	opcode  Opcode
+	payload []byte
+}
+
+// readFrame reads one frame, checking the header against RFC 6455 5.2.
+// Frames from clients must be masked and frames from servers must not be.
+// Payloads over maxPayload fail with ErrMessageTooLarge before they are
+// read into memory
+func readFrame(r *bufio.Reader, wantMasked bool, maxPayload int64) (frame, error) {
+	var f frame
+
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return f, err
+	}
+
+	f.fin = head[0]&0x80 != 0
+	f.opcode = Opcode(head[0] & 0x0f)
+	if head[0]&0x70 != 0 {
+		return f, fmt.Errorf("%w: reserved bits set without an extension", ErrProtocol)
+	}
+
+	masked := head[1]&0x80 != 0
+	if masked != wantMasked {
+		return f, fmt.Errorf("%w: wrong masking", ErrProtocol)
+	}
+
+	length := int64(head[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return f, unexpectedEOF(err)
+		}
+		length = int64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return f, unexpectedEOF(err)
+		}
+		n := binary.BigEndian.Uint64(ext[:])
+		if n > 1<<63-1 {
+			return f, fmt.Errorf("%w: payload length overflows", ErrProtocol)
+		}
+		length = int64(n)
+	}
+
+	if f.opcode.isControl() {
+		if !f.fin {
+			return f, fmt.Errorf("%w: fragmented control frame", ErrProtocol)
+		}
+		if length > maxControlPayload {
+			return f, fmt.Errorf("%w: control frame too long", ErrProtocol)
+		}
+	} else if length > maxPayload {
+		return f, ErrMessageTooLarge
+	}
+
+	var key [4]byte
+	if masked {
+		if _, err := io.ReadFull(r, key[:]); err != nil {
+			return f, unexpectedEOF(err)
+		}
+	}
+
+	f.payload = make([]byte, length)
+	if _, err := io.ReadFull(r, f.payload); err != nil {
+		return f, unexpectedEOF(err)
+	}
+	if masked {
+		maskBytes(key, f.payload)
+	}
+
+	return f, nil
+}
+
+// writeFrame writes a single frame, masking it with a fresh random key when
+// mask is set
+func writeFrame(w io.Writer, fin bool, op Opcode, payload []byte, mask bool) error {
+	buf := make([]byte, 0, 14+len(payload))
+
+	b0 := byte(op)
+	if fin {
+		b0 |= 0x80
+	}
+	buf = append(buf, b0)
+
+	var maskBit byte
+	if mask {
+		maskBit = 0x80
+	}
+
+	switch n := len(payload); {
+	case n <= 125:
+		buf = append(buf, maskBit|byte(n))
+	case n <= 0xffff:
+		buf = append(buf, maskBit|126)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(n))
+	default:
+		buf = append(buf, maskBit|127)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(n))
+	}
+
+	if mask {
+		var key [4]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			return err
+		}
+		buf = append(buf, key[:]...)
+		start := len(buf)
+		buf = append(buf, payload...)
+		maskBytes(key, buf[start:])
+	} else {
+		buf = append(buf, payload...)
+	}
+
+	_, err := w.Write(buf)
+	return err
+}
+
+// maskBytes applies the masking key to b in place. Masking and unmasking
+// are the same operation (RFC 6455 5.3)
+func maskBytes(key [4]byte, b []byte) {
+	for i := range b {
+		b[i] ^= key[i%4]
+	}
+}
+
+func unexpectedEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,142 @@
+package websocket
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"io"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/yus-works/tcp-to-http/internal/headers"
+	"github.com/yus-works/tcp-to-http/internal/request"
+	"github.com/yus-works/tcp-to-http/internal/response"
+)
+
+// acceptGUID is appended to the client's key when computing the accept key
+// (RFC 6455 1.3)
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Handler serves a WebSocket connection once the handshake is done. The
+// connection is closed when it returns
+type Handler func(conn *Conn, req *request.Request)
+
+// AcceptKey computes the Sec-WebSocket-Accept value for a Sec-WebSocket-Key
+func AcceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// IsUpgrade reports whether req asks to switch to the WebSocket protocol
+func IsUpgrade(req *request.Request) bool {
+	return headers.HasToken(req.Headers, "Upgrade", "websocket") &&
+		headers.HasToken(req.Headers, "Connection", "upgrade")
+}
+
+// checkHandshake validates an opening handshake (RFC 6455 4.2.1)
+func checkHandshake(req *request.Request) *response.HandlerError {
+	if req.RequestLine.Method != "GET" {
+		e := response.NewHandlerErrMsg(response.StatusMethodNotAllowed,
+			"WebSocket handshakes must use GET")
+		e.Header = headers.NewHeaders()
+		e.Header.Set("Allow", "GET")
+		return &e
+	}
+
+	if !IsUpgrade(req) {
+		e := response.NewHandlerErrMsg(response.StatusBadRequest,
+			"Missing WebSocket upgrade headers")
+		return &e
+	}
+
+	if strings.TrimSpace(req.Headers.Get("Sec-WebSocket-Version")) != "13" {
+		e := response.NewHandlerErrMsg(response.StatusUpgradeRequired,
+			"Unsupported WebSocket version")
+		e.Header = headers.NewHeaders()
+		e.Header.Set("Sec-WebSocket-Version", "13")
+		return &e
+	}
+
+	key, err := base64.StdEncoding.DecodeString(
+		strings.TrimSpace(req.Headers.Get("Sec-WebSocket-Key")),
+	)
+	if err != nil || len(key) != 16 {
+		e := response.NewHandlerErrMsg(response.StatusBadRequest,
+			"Invalid Sec-WebSocket-Key")
+		return &e
+	}
+
+	return nil
+}
+
+// Upgrade completes the server side of the opening handshake on rwc,
+// writing the 101 response and returning the WebSocket connection. If the
+// handshake is invalid nothing is written and the error response to send
+// is returned instead
+func Upgrade(rwc io.ReadWriteCloser, req *request.Request) (*Conn, *response.HandlerError) {
+	if e := checkHandshake(req); e != nil {
+		return nil, e
+	}
+
+	h := headers.NewHeaders()
+	h.Set("Upgrade", "websocket")
+	h.Set("Connection", "Upgrade")
+	h.Set("Sec-WebSocket-Accept",
+		AcceptKey(strings.TrimSpace(req.Headers.Get("Sec-WebSocket-Key"))))
+
+	err := response.WriteStatusLine(rwc, response.StatusSwitchingProtocols)
+	if err == nil {
+		err = response.WriteHeaders(rwc, *h)
+	}
+	if err != nil {
+		e := response.NewHandlerErrMsg(response.StatusInternalServerError, err.Error())
+		return nil, &e
+	}
+
+	return NewConn(rwc, true), nil
+}
+
+// Handle returns a handler that completes the handshake, takes over the
+// connection and runs h on it, closing normally if h left it open. Invalid
+// handshakes get an error response
+func Handle(h Handler) response.Handler {
+	return func(w *response.Writer, req *request.Request) *response.HandlerError {
+		if e := checkHandshake(req); e != nil {
+			return e
+		}
+
+		conn, buffered, err := w.Hijack()
+		if err != nil {
+			e := response.NewHandlerErrMsg(response.StatusInternalServerError, err.Error())
+			return &e
+		}
+
+		ws, handshakeErr := Upgrade(&bufferedConn{Conn: conn, r: bytes.NewReader(buffered)}, req)
+		if handshakeErr != nil {
+			conn.Close()
+			return handshakeErr
+		}
+
+		h(ws, req)
+
+		if err := ws.Close(CloseNormal, ""); err != nil {
+			log.Println("Failed to close WebSocket: ", err)
+		}
+		return nil
+	}
+}
+
+// bufferedConn is a connection with bytes read ahead of it put back in
+// front
+type bufferedConn struct {
+	net.Conn
+	r *bytes.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	if c.r.Len() > 0 {
+		return c.r.Read(p)
+	}
+	return c.Conn.Read(p)
+}
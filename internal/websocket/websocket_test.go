@@ -0,0 +1,270 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yus-works/tcp-to-http/internal/headers"
+	"github.com/yus-works/tcp-to-http/internal/request"
+	"github.com/yus-works/tcp-to-http/internal/response"
+)
+
+// pipe returns the server and client ends of a WebSocket over net.Pipe
+func pipe(t *testing.T) (*Conn, *Conn) {
+	t.Helper()
+
+	a, b := net.Pipe()
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	return NewConn(a, true), NewConn(b, false)
+}
+
+// rawPipe returns a server Conn and the raw client end, for sending frames
+// a well behaved client wouldn't
+func rawPipe(t *testing.T) (*Conn, net.Conn) {
+	t.Helper()
+
+	a, b := net.Pipe()
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	return NewConn(a, true), b
+}
+
+// readClose reads the next frame from the raw end, expecting a close, and
+// returns its code
+func readClose(t *testing.T, br *bufio.Reader) int {
+	t.Helper()
+
+	f, err := readFrame(br, false, 1<<20)
+	require.NoError(t, err)
+	require.Equal(t, OpClose, f.opcode)
+	require.GreaterOrEqual(t, len(f.payload), 2)
+	return int(binary.BigEndian.Uint16(f.payload))
+}
+
+func TestAcceptKey(t *testing.T) {
+	// the example from RFC 6455 1.3
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", AcceptKey("dGhlIHNhbXBsZSBub25jZQ=="))
+}
+
+func TestUpgrade(t *testing.T) {
+	newReq := func(method string, fields map[string]string) *request.Request {
+		req := &request.Request{Headers: headers.NewHeaders()}
+		req.RequestLine.Method = method
+		for k, v := range fields {
+			req.Headers.Set(k, v)
+		}
+		return req
+	}
+	valid := map[string]string{
+		"Upgrade":               "websocket",
+		"Connection":            "keep-alive, Upgrade",
+		"Sec-WebSocket-Version": "13",
+		"Sec-WebSocket-Key":     "dGhlIHNhbXBsZSBub25jZQ==",
+	}
+
+	// Test: Valid handshake
+	var out bytes.Buffer
+	rwc := struct {
+		*bytes.Buffer
+		nopCloser
+	}{Buffer: &out}
+	conn, herr := Upgrade(rwc, newReq("GET", valid))
+	require.Nil(t, herr)
+	require.NotNil(t, conn)
+	assert.Equal(t,
+		"HTTP/1.1 101 Switching Protocols\r\n"+
+			"Upgrade: websocket\r\n"+
+			"Connection: Upgrade\r\n"+
+			"Sec-WebSocket-Accept: s3pPLMBiTxaQ9kYGzzhZRbK+xOo=\r\n"+
+			"\r\n",
+		out.String(),
+	)
+
+	// Test: Invalid handshakes write nothing
+	tests := []struct {
+		name   string
+		method string
+		change map[string]string
+		status response.StatusCode
+		header [2]string
+	}{
+		{name: "not GET", method: "POST", status: response.StatusMethodNotAllowed, header: [2]string{"Allow", "GET"}},
+		{name: "old version", change: map[string]string{"Sec-WebSocket-Version": "8"},
+			status: response.StatusUpgradeRequired, header: [2]string{"Sec-WebSocket-Version", "13"}},
+		{name: "short key", change: map[string]string{"Sec-WebSocket-Key": "c2hvcnQ="}, status: response.StatusBadRequest},
+		{name: "no upgrade", change: map[string]string{"Connection": "keep-alive"}, status: response.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fields := map[string]string{}
+			for k, v := range valid {
+				fields[k] = v
+			}
+			for k, v := range tt.change {
+				fields[k] = v
+			}
+			method := tt.method
+			if method == "" {
+				method = "GET"
+			}
+
+			out.Reset()
+			conn, herr := Upgrade(rwc, newReq(method, fields))
+			assert.Nil(t, conn)
+			require.NotNil(t, herr)
+			assert.Equal(t, tt.status, herr.StatusCode)
+			if tt.header[0] != "" {
+				assert.Equal(t, tt.header[1], herr.Header.Get(tt.header[0]))
+			}
+			assert.Zero(t, out.Len())
+		})
+	}
+}
+
+type nopCloser struct{}
+
+func (nopCloser) Close() error { return nil }
+
+func TestMessages(t *testing.T) {
+	server, client := pipe(t)
+
+	// Test: Text and binary messages in both directions, including lengths
+	// that need the extended length fields
+	for _, size := range []int{0, 5, 125, 126, 70000} {
+		data := bytes.Repeat([]byte("a"), size)
+		go client.WriteMessage(OpBinary, data)
+
+		op, got, err := server.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, OpBinary, op)
+		assert.Equal(t, data, got)
+	}
+
+	go server.WriteMessage(OpText, []byte("héllo"))
+	op, got, err := client.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, OpText, op)
+	assert.Equal(t, "héllo", string(got))
+
+	// Test: Close handshake started by the server
+	closed := make(chan error, 1)
+	go func() {
+		_, _, err := client.ReadMessage()
+		closed <- err
+	}()
+	require.NoError(t, server.Close(CloseGoingAway, "bye"))
+
+	var closeErr *CloseError
+	require.ErrorAs(t, <-closed, &closeErr)
+	assert.Equal(t, CloseGoingAway, closeErr.Code)
+	assert.Equal(t, "bye", closeErr.Reason)
+
+	// Test: Nothing can be sent once closed
+	assert.ErrorIs(t, server.WriteMessage(OpText, []byte("late")), ErrClosed)
+}
+
+func TestFragmentsAndControlFrames(t *testing.T) {
+	server, raw := rawPipe(t)
+	br := bufio.NewReader(raw)
+
+	// Test: Fragments are reassembled around a ping, which is answered
+	go func() {
+		writeFrame(raw, false, OpText, []byte("hel"), true)
+		writeFrame(raw, true, OpPing, []byte("are you there"), true)
+		writeFrame(raw, false, OpContinuation, []byte("lo "), true)
+		writeFrame(raw, true, OpContinuation, []byte("world"), true)
+	}()
+
+	result := make(chan []byte, 1)
+	go func() {
+		_, msg, err := server.ReadMessage()
+		assert.NoError(t, err)
+		result <- msg
+	}()
+
+	pong, err := readFrame(br, false, 1<<20)
+	require.NoError(t, err)
+	assert.Equal(t, OpPong, pong.opcode)
+	assert.Equal(t, "are you there", string(pong.payload))
+	assert.Equal(t, "hello world", string(<-result))
+
+	// Test: The peer's close is echoed
+	go writeFrame(raw, true, OpClose, closePayload(CloseNormal, "done"), true)
+	go func() {
+		_, _, err := server.ReadMessage()
+		var closeErr *CloseError
+		assert.ErrorAs(t, err, &closeErr)
+		assert.Equal(t, "done", closeErr.Reason)
+	}()
+	assert.Equal(t, CloseNormal, readClose(t, br))
+}
+
+func TestProtocolErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		send func(raw net.Conn)
+		code int
+		err  error
+	}{
+		{
+			name: "unmasked client frame",
+			send: func(raw net.Conn) { writeFrame(raw, true, OpText, []byte("hi"), false) },
+			code: CloseProtocolError, err: ErrProtocol,
+		},
+		{
+			name: "reserved bits",
+			send: func(raw net.Conn) { raw.Write([]byte{0xC1, 0x80, 0, 0, 0, 0}) },
+			code: CloseProtocolError, err: ErrProtocol,
+		},
+		{
+			name: "fragmented ping",
+			send: func(raw net.Conn) { writeFrame(raw, false, OpPing, nil, true) },
+			code: CloseProtocolError, err: ErrProtocol,
+		},
+		{
+			name: "continuation without a message",
+			send: func(raw net.Conn) { writeFrame(raw, true, OpContinuation, []byte("x"), true) },
+			code: CloseProtocolError, err: ErrProtocol,
+		},
+		{
+			name: "invalid utf-8",
+			send: func(raw net.Conn) { writeFrame(raw, true, OpText, []byte{0xff, 0xfe}, true) },
+			code: CloseInvalidPayload, err: errInvalidUTF8,
+		},
+		{
+			name: "message too large",
+			send: func(raw net.Conn) {
+				writeFrame(raw, false, OpBinary, make([]byte, 60), true)
+				writeFrame(raw, true, OpContinuation, make([]byte, 60), true)
+			},
+			code: CloseMessageTooBig, err: ErrMessageTooLarge,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, raw := rawPipe(t)
+			server.MaxMessageSize = 100
+			go tt.send(raw)
+
+			errs := make(chan error, 1)
+			go func() {
+				_, _, err := server.ReadMessage()
+				errs <- err
+			}()
+
+			assert.Equal(t, tt.code, readClose(t, bufio.NewReader(raw)))
+			assert.ErrorIs(t, <-errs, tt.err)
+		})
+	}
+}